@@ -0,0 +1,220 @@
+package pkg
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AdaptiveConcurrencyConfig tunes the concurrency limits of the request queue from the responses of Bedrock.
+// Limits grow by about one request per round of successful requests and are cut by BackoffRatio
+// when Bedrock throttles or the first byte latency of streamed responses inflates beyond LatencyTolerance
+// times its baseline. The first byte of a non-streaming response comes after the whole generation, it is not used.
+type AdaptiveConcurrencyConfig struct {
+	Enable           bool    `json:"enable"`
+	MinLimit         int     `json:"min_limit,omitempty"`
+	MaxLimit         int     `json:"max_limit,omitempty"`
+	BackoffRatio     float64 `json:"backoff_ratio,omitempty"`
+	LatencyTolerance float64 `json:"latency_tolerance,omitempty"`
+}
+
+func LoadAdaptiveConcurrencyConfigWithEnv() *AdaptiveConcurrencyConfig {
+	config := &AdaptiveConcurrencyConfig{
+		Enable:           os.Getenv("ADAPTIVE_CONCURRENCY_ENABLE") == "true",
+		MinLimit:         1,
+		MaxLimit:         64,
+		BackoffRatio:     0.5,
+		LatencyTolerance: 2,
+	}
+	if value, ok := parsePositiveInt(os.Getenv("ADAPTIVE_CONCURRENCY_MIN_LIMIT")); ok {
+		config.MinLimit = value
+	}
+	if value, ok := parsePositiveInt(os.Getenv("ADAPTIVE_CONCURRENCY_MAX_LIMIT")); ok {
+		config.MaxLimit = value
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("ADAPTIVE_CONCURRENCY_BACKOFF"), 64); err == nil && value > 0 && value < 1 {
+		config.BackoffRatio = value
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("ADAPTIVE_CONCURRENCY_LATENCY_TOLERANCE"), 64); err == nil && value > 1 {
+		config.LatencyTolerance = value
+	}
+	return config
+}
+
+const (
+	// adaptiveBackoffCooldown keeps a burst of throttled responses from cutting the limit more than once
+	adaptiveBackoffCooldown = time.Second
+	// adaptiveWarmupSamples is the number of latency samples before latency inflation is considered
+	adaptiveWarmupSamples = 10
+)
+
+// AdaptiveLimitStats is the state of the limit of one model in one region, or of a provider
+type AdaptiveLimitStats struct {
+	Region     string  `json:"region,omitempty"`
+	Provider   string  `json:"provider,omitempty"`
+	Model      string  `json:"model"`
+	Limit      int     `json:"limit"`
+	BaselineMs float64 `json:"baseline_latency_ms"`
+	RecentMs   float64 `json:"recent_latency_ms"`
+	Throttles  int64   `json:"throttles"`
+	Backoffs   int64   `json:"backoffs"`
+}
+
+// adaptiveTarget is where a model was served, a Bedrock region or another provider
+type adaptiveTarget struct {
+	region   string
+	provider string
+	model    string
+}
+
+type adaptiveLimit struct {
+	limit float64
+	// baseline and recent are slow and fast moving averages of the first byte latency
+	baseline     float64
+	recent       float64
+	samples      int64
+	throttles    int64
+	backoffs     int64
+	lastDecrease time.Time
+}
+
+// AdaptiveConcurrency adjusts the concurrency limit of each model of the FairQueue with AIMD.
+// Limits are kept per region and model, the queue of a model follows the limit of the primary region,
+// so the throttling of a hedge region does not cut the capacity of the primary one.
+type AdaptiveConcurrency struct {
+	config *AdaptiveConcurrencyConfig
+	queue  *FairQueue
+	region string
+	mu     sync.Mutex
+	limits map[adaptiveTarget]*adaptiveLimit
+	now    func() time.Time
+}
+
+func NewAdaptiveConcurrency(config *AdaptiveConcurrencyConfig, queue *FairQueue, region string) *AdaptiveConcurrency {
+	return &AdaptiveConcurrency{config: config, queue: queue, region: region, limits: map[adaptiveTarget]*adaptiveLimit{}, now: time.Now}
+}
+
+// targetOf returns where a request was served, the region of a hedge or the primary region for Bedrock
+func (this *AdaptiveConcurrency) targetOf(model string, usage *RequestUsage) adaptiveTarget {
+	if !isBedrockProvider(usage.Provider) {
+		return adaptiveTarget{provider: usage.Provider, model: model}
+	}
+	region := usage.Region
+	if len(region) == 0 {
+		region = this.region
+	}
+	return adaptiveTarget{region: region, model: model}
+}
+
+func (this *AdaptiveConcurrency) clamp(limit float64) float64 {
+	return math.Max(float64(this.config.MinLimit), math.Min(float64(this.config.MaxLimit), limit))
+}
+
+// isThrottled reports whether Bedrock refused the request for capacity
+func isThrottled(usage *RequestUsage) bool {
+	switch usage.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, 529:
+		return true
+	}
+	return usage.ErrorType == "rate_limit_error" || usage.ErrorType == "overloaded_error"
+}
+
+// Observe applies one completed request of a target and returns its new limit
+func (this *AdaptiveConcurrency) Observe(target adaptiveTarget, usage *RequestUsage, inFlight int, initial int) int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	state, ok := this.limits[target]
+	if !ok {
+		state = &adaptiveLimit{limit: this.clamp(float64(initial))}
+		this.limits[target] = state
+	}
+	now := this.now()
+	decrease := func() {
+		if now.Sub(state.lastDecrease) < adaptiveBackoffCooldown {
+			return
+		}
+		state.limit = this.clamp(math.Floor(state.limit * this.config.BackoffRatio))
+		state.lastDecrease = now
+		state.backoffs++
+	}
+
+	if isThrottled(usage) {
+		state.throttles++
+		decrease()
+		return int(state.limit)
+	}
+	if usage.StatusCode >= 400 || len(usage.ErrorType) > 0 {
+		// other errors say nothing about the capacity
+		return int(state.limit)
+	}
+
+	if latency := float64(usage.FirstByteLatency); latency > 0 && usage.streamed {
+		if state.samples == 0 {
+			state.baseline, state.recent = latency, latency
+		} else {
+			state.recent = 0.3*latency + 0.7*state.recent
+			// the baseline only follows slowly, so an inflation shows against it
+			state.baseline = 0.02*latency + 0.98*state.baseline
+		}
+		state.samples++
+		if state.samples >= adaptiveWarmupSamples && state.recent > this.config.LatencyTolerance*state.baseline {
+			decrease()
+			return int(state.limit)
+		}
+	}
+	// only grow while the limit is actually used
+	if float64(inFlight)*2 >= state.limit {
+		state.limit = this.clamp(state.limit + 1/state.limit)
+	}
+	return int(state.limit)
+}
+
+// Listener is the UsageListener that feeds the outcome of each queued request back into its limit
+func (this *AdaptiveConcurrency) Listener(request *http.Request, usage *RequestUsage) {
+	model, ok := request.Context().Value(queueContextKey{}).(string)
+	// errors generated by the proxy, like the 529 of an open circuit breaker, say nothing about Bedrock capacity
+	if !ok || usage.Cached || usage.Local {
+		return
+	}
+	target := this.targetOf(model, usage)
+	limit, inFlight := this.queue.Limit(model)
+	updated := this.Observe(target, usage, inFlight, limit)
+	// a hedge region has its own limit, the queue follows the primary region
+	if target.region != this.region && len(target.provider) == 0 {
+		return
+	}
+	if updated != limit {
+		Log.Infof("concurrency limit of %s in %s%s: %d -> %d", model, target.region, target.provider, limit, updated)
+		this.queue.SetLimit(model, updated)
+	}
+}
+
+func (this *AdaptiveConcurrency) Stats() []*AdaptiveLimitStats {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var stats []*AdaptiveLimitStats
+	for target, state := range this.limits {
+		stats = append(stats, &AdaptiveLimitStats{
+			Region:     target.region,
+			Provider:   target.provider,
+			Model:      target.model,
+			Limit:      int(state.limit),
+			BaselineMs: math.Round(state.baseline),
+			RecentMs:   math.Round(state.recent),
+			Throttles:  state.throttles,
+			Backoffs:   state.backoffs,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Model != stats[j].Model {
+			return stats[i].Model < stats[j].Model
+		}
+		return stats[i].Region+stats[i].Provider < stats[j].Region+stats[j].Provider
+	})
+	return stats
+}
@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	queue := NewFairQueue(&FairQueueConfig{MaxConcurrency: 4, MaxQueueLength: 10, MaxWaitSeconds: 1})
+	adaptive := NewAdaptiveConcurrency(&AdaptiveConcurrencyConfig{
+		MinLimit:         1,
+		MaxLimit:         8,
+		BackoffRatio:     0.5,
+		LatencyTolerance: 2,
+	}, queue, "us-east-1")
+	now := time.Now()
+	adaptive.now = func() time.Time { return now }
+
+	completeModel := func(model string, usage *RequestUsage) int {
+		request := httptest.NewRequest("POST", "/v1/messages", nil)
+		request = request.WithContext(context.WithValue(request.Context(), queueContextKey{}, model))
+		adaptive.Listener(request, usage)
+		limit, _ := queue.Limit(model)
+		return limit
+	}
+	complete := func(usage *RequestUsage) int {
+		return completeModel("claude", usage)
+	}
+
+	// the limit grows while requests succeed and the queue is busy
+	var releases []func()
+	for i := 0; i < 4; i++ {
+		release, _, err := queue.Acquire(context.Background(), "claude", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, release)
+	}
+	for i := 0; i < 20; i++ {
+		complete(&RequestUsage{StatusCode: 200, FirstByteLatency: 500, streamed: true})
+	}
+	if limit, _ := queue.Limit("claude"); limit <= 4 || limit > 8 {
+		t.Fatalf("expected the limit to grow, got %d", limit)
+	}
+	grown, _ := queue.Limit("claude")
+
+	// a burst of throttling halves the limit once
+	if limit := complete(&RequestUsage{StatusCode: 429}); limit != grown/2 {
+		t.Errorf("expected the limit to halve from %d, got %d", grown, limit)
+	}
+	if limit := complete(&RequestUsage{StatusCode: 200, ErrorType: "rate_limit_error"}); limit != grown/2 {
+		t.Errorf("throttling within the cooldown should not cut again, got %d", limit)
+	}
+	now = now.Add(2 * time.Second)
+	if limit := complete(&RequestUsage{StatusCode: 200, ErrorType: "overloaded_error"}); limit != grown/4 {
+		t.Errorf("expected a stream overload to cut the limit again, got %d", limit)
+	}
+
+	// other errors do not change the limit
+	before, _ := queue.Limit("claude")
+	if limit := complete(&RequestUsage{StatusCode: 400}); limit != before {
+		t.Errorf("a client error should not change the limit, got %d", limit)
+	}
+	now = now.Add(2 * time.Second)
+	if limit := complete(&RequestUsage{StatusCode: 529, ErrorType: "overloaded_error", Local: true}); limit != before {
+		t.Errorf("the 529 of an open circuit breaker should not change the limit, got %d", limit)
+	}
+
+	now = now.Add(2 * time.Second)
+	if limit := complete(&RequestUsage{StatusCode: 503}); limit != 1 {
+		t.Errorf("the limit should never go below the minimum, got %d", limit)
+	}
+	for _, release := range releases {
+		release()
+	}
+
+	// latency inflation backs off before Bedrock throttles
+	for i := 0; i < adaptiveWarmupSamples; i++ {
+		completeModel("opus", &RequestUsage{StatusCode: 200, FirstByteLatency: 500, streamed: true})
+	}
+	before, _ = queue.Limit("opus")
+	// the first byte of a non-streaming response includes the whole generation
+	for i := 0; i < 5; i++ {
+		if limit := completeModel("opus", &RequestUsage{StatusCode: 200, FirstByteLatency: 30000}); limit < before {
+			t.Fatalf("a long non-streaming response should not cut the limit, got %d", limit)
+		}
+	}
+	limit := before
+	for i := 0; i < 5 && limit >= before; i++ {
+		limit = completeModel("opus", &RequestUsage{StatusCode: 200, FirstByteLatency: 3000, streamed: true})
+	}
+	if limit != before/2 {
+		t.Errorf("expected the latency inflation to halve the limit %d, got %d", before, limit)
+	}
+
+	// the throttling of a hedge region has its own limit
+	now = now.Add(2 * time.Second)
+	before, _ = queue.Limit("opus")
+	if limit := completeModel("opus", &RequestUsage{StatusCode: 429, Region: "us-west-2"}); limit != before {
+		t.Errorf("the throttling of a hedge region should not cut the primary limit, got %d", limit)
+	}
+
+	stats := adaptive.Stats()
+	if len(stats) != 3 || stats[0].Model != "claude" || stats[0].Region != "us-east-1" || stats[0].Throttles != 4 || stats[0].Backoffs != 3 {
+		t.Fatalf("unexpected stats %+v", stats[0])
+	}
+	if stats[1].Region != "us-east-1" || stats[1].Backoffs != 1 || stats[1].RecentMs <= stats[1].BaselineMs {
+		t.Errorf("unexpected stats %+v", stats[1])
+	}
+	if stats[2].Region != "us-west-2" || stats[2].Model != "opus" || stats[2].Throttles != 1 {
+		t.Errorf("unexpected stats %+v", stats[2])
+	}
+}
@@ -0,0 +1,286 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultAnthropicBaseURL = "https://api.anthropic.com"
+	defaultAnthropicVersion = "2023-06-01"
+	// vertexAnthropicVersion is the anthropic_version of the request bodies sent to Vertex AI
+	vertexAnthropicVersion = "vertex-2023-10-16"
+)
+
+// hopHeaders are not copied from the provider response
+var hopHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Keep-Alive":        true,
+	"Transfer-Encoding": true,
+	"Set-Cookie":        true,
+}
+
+// privateHeader tells whether a provider response header describes the upstream account, e.g. its rate limits
+// and request ids. These are not copied, so the per-key anthropic-ratelimit-* headers of the proxy are kept.
+func privateHeader(key string) bool {
+	key = http.CanonicalHeaderKey(key)
+	return strings.HasPrefix(key, "Anthropic-Ratelimit-") || key == "Request-Id" || key == "Retry-After"
+}
+
+// AnthropicProvider forwards Messages requests to the Anthropic API or to the Anthropic models on Vertex AI.
+// Requests go through the transformers of the Bedrock client and their usage through its usage listeners,
+// so quotas, rate limits and the usage ledger cover every provider.
+type AnthropicProvider struct {
+	config  *ProviderConfig
+	bedrock *BedrockClient
+	tokens  *googleTokenSource
+	client  *http.Client
+}
+
+func NewAnthropicProvider(config *ProviderConfig, bedrock *BedrockClient) (*AnthropicProvider, error) {
+	provider := &AnthropicProvider{config: config, bedrock: bedrock, client: http.DefaultClient}
+	switch config.Type {
+	case ProviderAnthropic:
+		if len(config.APIKey) == 0 {
+			return nil, fmt.Errorf("provider %s has no api key", config.Name)
+		}
+	case ProviderVertex:
+		if len(config.ProjectID) == 0 || len(config.Region) == 0 {
+			return nil, fmt.Errorf("provider %s needs a project id and a region", config.Name)
+		}
+		if len(config.AccessToken) == 0 {
+			tokens, err := newGoogleTokenSource(config.CredentialsFile)
+			if err != nil {
+				return nil, fmt.Errorf("provider %s: %v", config.Name, err)
+			}
+			provider.tokens = tokens
+		}
+	default:
+		return nil, fmt.Errorf("unknown provider type %q", config.Type)
+	}
+	return provider, nil
+}
+
+func (this *AnthropicProvider) Name() string {
+	if len(this.config.Name) > 0 {
+		return this.config.Name
+	}
+	return this.config.Type
+}
+
+func (this *AnthropicProvider) Serves(model string) bool {
+	_, ok := this.config.Models[model]
+	return ok
+}
+
+func (this *AnthropicProvider) Models() []string {
+	models := make([]string, 0, len(this.config.Models))
+	for model := range this.config.Models {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	return models
+}
+
+// buildRequest translates a decoded Messages body into the request of the provider
+func (this *AnthropicProvider) buildRequest(r *http.Request, body map[string]interface{}, model string, stream bool) (*http.Request, error) {
+	var endpoint string
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	if beta := r.Header.Get("anthropic-beta"); len(beta) > 0 {
+		header.Set("anthropic-beta", beta)
+	}
+
+	if this.config.Type == ProviderVertex {
+		baseURL := fmt.Sprintf("https://%s-aiplatform.googleapis.com", this.config.Region)
+		if this.config.Region == "global" {
+			baseURL = "https://aiplatform.googleapis.com"
+		}
+		if len(this.config.BaseURL) > 0 {
+			baseURL = this.config.BaseURL
+		}
+		method := "rawPredict"
+		if stream {
+			method = "streamRawPredict"
+		}
+		endpoint = fmt.Sprintf("%s/v1/projects/%s/locations/%s/publishers/anthropic/models/%s:%s", strings.TrimSuffix(baseURL, "/"),
+			url.PathEscape(this.config.ProjectID), url.PathEscape(this.config.Region), url.PathEscape(model), method)
+		// the model is in the url on Vertex AI
+		delete(body, "model")
+		body["anthropic_version"] = vertexAnthropicVersion
+
+		token := this.config.AccessToken
+		if this.tokens != nil {
+			var err error
+			if token, err = this.tokens.Token(); err != nil {
+				return nil, err
+			}
+		}
+		header.Set("Authorization", "Bearer "+token)
+	} else {
+		baseURL := this.config.BaseURL
+		if len(baseURL) == 0 {
+			baseURL = defaultAnthropicBaseURL
+		}
+		endpoint = strings.TrimSuffix(baseURL, "/") + "/v1/messages"
+		body["model"] = model
+		version := r.Header.Get("anthropic-version")
+		if len(version) == 0 {
+			version = this.config.Version
+		}
+		if len(version) == 0 {
+			version = defaultAnthropicVersion
+		}
+		header.Set("anthropic-version", version)
+		header.Set("x-api-key", this.config.APIKey)
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(r.Context(), "POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	request.Header = header
+	return request, nil
+}
+
+func (this *AnthropicProvider) HandleMessages(w http.ResponseWriter, r *http.Request) {
+	usage := NewRequestUsage()
+	state := GetRequestState(r)
+	if state != nil {
+		state.Usage = usage
+		state.Provider = this.Name()
+	}
+	recorder := &usageResponseWriter{ResponseWriter: w}
+	w = recorder
+	defer this.bedrock.reportUsage(r, usage, recorder)
+
+	body := this.bedrock.decodeMessages(w, r)
+	if body == nil {
+		return
+	}
+	requested, _ := body["model"].(string)
+	model, ok := this.config.Models[requested]
+	if !ok {
+		model = requested
+	}
+	stream, _ := body["stream"].(bool)
+	if state != nil {
+		state.Model = model
+	}
+	if err := this.bedrock.checkPrice(model, this.Name()); err != nil {
+		usage.Local = true
+		writeProxyError(w, err)
+		return
+	}
+
+	upstream, err := this.buildRequest(r, body, model, stream)
+	if err != nil {
+		Log.Error(err)
+		writeAPIError(w, http.StatusBadGateway, "api_error", err.Error())
+		return
+	}
+	resp, err := this.client.Do(upstream)
+	if err != nil {
+		Log.Error(err)
+		writeAPIError(w, http.StatusBadGateway, "api_error", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	usage.MarkFirstByte()
+
+	for k, v := range resp.Header {
+		if !hopHeaders[http.CanonicalHeaderKey(k)] && !privateHeader(k) {
+			w.Header()[k] = v
+		}
+	}
+	copyStateHeaders(w, r)
+	w.WriteHeader(resp.StatusCode)
+
+	if strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
+		if err := relayServerSentEvents(w, resp.Body, usage.ObserveStreamEvent); err != nil {
+			Log.Error(err)
+		}
+		return
+	}
+	captured := &cappedBuffer{limit: usageCaptureLimit}
+	if _, err := io.Copy(io.MultiWriter(w, captured), resp.Body); err != nil {
+		Log.Error(err)
+		return
+	}
+	if resp.StatusCode == http.StatusOK && !captured.overflow {
+		usage.MergeResponseBody(captured.Bytes())
+	}
+}
+
+// decodeMessages decodes a Messages request body and runs the transformers on it unless they already ran,
+// it writes the error response and returns nil when either fails
+func (this *BedrockClient) decodeMessages(w http.ResponseWriter, r *http.Request) map[string]interface{} {
+	body := make(map[string]interface{})
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		if !writeProxyError(w, err) {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		}
+		return nil
+	}
+	if _, err := this.transformMessages(r, body); err != nil {
+		if !writeProxyError(w, err) {
+			writeAPIError(w, http.StatusBadGateway, "api_error", err.Error())
+		}
+		return nil
+	}
+	return body
+}
+
+// relayServerSentEvents copies an SSE stream event by event, flushing after each event and passing
+// the event type and data to the observer
+func relayServerSentEvents(w http.ResponseWriter, body io.Reader, observer StreamEventObserver) error {
+	flusher, _ := w.(http.Flusher)
+	reader := bufio.NewReader(body)
+	eventType := ""
+	var data bytes.Buffer
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if _, writeErr := w.Write(line); writeErr != nil {
+				return writeErr
+			}
+			trimmed := bytes.TrimRight(line, "\r\n")
+			switch {
+			case len(trimmed) == 0:
+				if data.Len() > 0 && observer != nil {
+					observer(eventType, data.Bytes())
+				}
+				eventType = ""
+				data.Reset()
+				if flusher != nil {
+					flusher.Flush()
+				}
+			case bytes.HasPrefix(trimmed, []byte("event:")):
+				eventType = string(bytes.TrimSpace(trimmed[len("event:"):]))
+			case bytes.HasPrefix(trimmed, []byte("data:")):
+				data.Write(bytes.TrimSpace(trimmed[len("data:"):]))
+			}
+		}
+		if err == io.EOF {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -38,7 +38,17 @@ type BedrockConfig struct {
 	EnableComputerUse        bool              `json:"enable_computer_use"`
 	EnableOutputReason       bool              `json:"enable_output_reasoning"`
 	ReasonBudgetTokens       int               `json:"reason_budget_tokens"`
-	DEBUG                    bool              `json:"debug,omitempty"`
+	// Endpoint overrides the bedrock-runtime endpoint, e.g. a VPC interface endpoint
+	Endpoint string `json:"endpoint,omitempty"`
+	// StreamUpstream serves non-streaming requests over invoke-with-response-stream
+	StreamUpstream bool `json:"stream_upstream,omitempty"`
+	// KeepaliveSeconds is the interval of whitespace keepalives of StreamUpstream responses, 0 disables them
+	KeepaliveSeconds int `json:"keepalive_seconds,omitempty"`
+	// PingIntervalSeconds is the idle time before a "ping" event is sent on a stream, 0 disables pings
+	PingIntervalSeconds int `json:"ping_interval_seconds,omitempty"`
+	// StripInvocationMetrics removes amazon-bedrock-invocationMetrics from the events sent to clients
+	StripInvocationMetrics bool `json:"strip_invocation_metrics,omitempty"`
+	DEBUG                  bool `json:"debug,omitempty"`
 }
 
 type ThinkingConfig struct {
@@ -75,6 +85,9 @@ func LoadBedrockConfigWithEnv() *BedrockConfig {
 		EnableComputerUse:        os.Getenv("AWS_BEDROCK_ENABLE_COMPUTER_USE") == "true",
 		EnableOutputReason:       os.Getenv("AWS_BEDROCK_ENABLE_OUTPUT_REASON") == "true",
 		ReasonBudgetTokens:       1024,
+		Endpoint:                 os.Getenv("AWS_BEDROCK_ENDPOINT"),
+		StreamUpstream:           os.Getenv("AWS_BEDROCK_STREAM_UPSTREAM") == "true",
+		StripInvocationMetrics:   os.Getenv("AWS_BEDROCK_STRIP_INVOCATION_METRICS") == "true",
 		DEBUG:                    os.Getenv("AWS_BEDROCK_DEBUG") == "true",
 	}
 
@@ -85,12 +98,74 @@ func LoadBedrockConfigWithEnv() *BedrockConfig {
 		}
 	}
 
+	config.PingIntervalSeconds = 15
+	if ping := os.Getenv("AWS_BEDROCK_PING_INTERVAL_SECONDS"); len(ping) > 0 {
+		if seconds, err := strconv.Atoi(ping); err == nil {
+			config.PingIntervalSeconds = seconds
+		}
+	}
+
+	if keepalive := os.Getenv("AWS_BEDROCK_KEEPALIVE_SECONDS"); len(keepalive) > 0 {
+		if seconds, err := strconv.Atoi(keepalive); err == nil {
+			config.KeepaliveSeconds = seconds
+		}
+	}
+
 	return config
 }
 
 type BedrockClient struct {
-	config *BedrockConfig
-	client *bedrockRuntime.Client
+	config        *BedrockConfig
+	client        *bedrockRuntime.Client
+	transformers  []MessageTransformer
+	responseCache *ResponseCache
+	usageListener []UsageListener
+	priceTable    *PriceTable
+	breakers      *CircuitBreakers
+	hedger        *Hedger
+	experiments   *ExperimentRouter
+	images        *ImageProcessor
+}
+
+// SetExperimentRouter enables the weighted routing of model aliases to experiment arms
+func (this *BedrockClient) SetExperimentRouter(router *ExperimentRouter) {
+	this.experiments = router
+}
+
+// SetImageProcessor enables the image pipeline, it runs after the transformers and the experiment
+// assignment so the limits of the model serving the request apply
+func (this *BedrockClient) SetImageProcessor(processor *ImageProcessor) {
+	this.images = processor
+}
+
+// SetHedger enables hedging of non-streaming requests
+func (this *BedrockClient) SetHedger(hedger *Hedger) {
+	this.hedger = hedger
+}
+
+// SetCircuitBreakers enables the circuit breakers of the models
+func (this *BedrockClient) SetCircuitBreakers(breakers *CircuitBreakers) {
+	this.breakers = breakers
+}
+
+// SetPriceTable enables cost estimation of every request
+func (this *BedrockClient) SetPriceTable(table *PriceTable) {
+	this.priceTable = table
+}
+
+// SetResponseCache enables the exact-match response cache
+func (this *BedrockClient) SetResponseCache(cache *ResponseCache) {
+	this.responseCache = cache
+}
+
+// AddUsageListener registers a listener called with the usage of every completed request
+func (this *BedrockClient) AddUsageListener(listener UsageListener) {
+	this.usageListener = append(this.usageListener, listener)
+}
+
+// AddTransformer registers a transformer applied to every Messages request body in order
+func (this *BedrockClient) AddTransformer(transformer MessageTransformer) {
+	this.transformers = append(this.transformers, transformer)
 }
 
 type ModelInfo struct {
@@ -333,8 +408,9 @@ func NewBedrockClient(config *BedrockConfig) *BedrockClient {
 	}
 
 	return &BedrockClient{
-		config: config,
-		client: bedrockRuntime.NewFromConfig(cfg),
+		config:        config,
+		client:        bedrockRuntime.NewFromConfig(cfg),
+		usageListener: []UsageListener{logUsage},
 	}
 }
 
@@ -348,33 +424,109 @@ func (this *BedrockClient) GetModelMappings(source string) (string, error) {
 	return this.config.AnthropicDefaultModel, errors.New(fmt.Sprintf("model %s not found in model mappings", source))
 }
 
+// transformMessages runs the transformers on a decoded Messages body, replaces an experiment alias
+// by the model of the assigned arm and processes the images, it reports whether the body model is an experiment arm.
+// A request is transformed once, the providers skip the transformers after the provider was chosen.
+func (this *BedrockClient) transformMessages(request *http.Request, body map[string]interface{}) (bool, error) {
+	state := GetRequestState(request)
+	if state != nil && state.Transformed {
+		return len(state.Experiment) > 0, nil
+	}
+	for _, transformer := range this.transformers {
+		if err := transformer.TransformMessage(request, body); err != nil {
+			return false, err
+		}
+	}
+	if state != nil {
+		state.Transformed = true
+	}
+
+	experiment := false
+	if this.experiments != nil {
+		model, _ := body["model"].(string)
+		if arm := this.experiments.Assign(request, model, body); arm != nil {
+			if state != nil {
+				state.Experiment = model
+				state.Arm = arm.ArmName()
+			}
+			SetResponseHeader(request, ExperimentArmHeader, arm.ArmName())
+			body["model"] = arm.Model
+			experiment = true
+		}
+	}
+
+	if this.images != nil {
+		if err := this.images.TransformMessage(request, body); err != nil {
+			return false, err
+		}
+	}
+	return experiment, nil
+}
+
 func (this *BedrockClient) SignRequest(request *http.Request) (*http.Request, bool, error) {
 	contentType := request.Header.Get("Content-Type")
 	cloneReq := request
 	isStream := false
+	deterministic := false
 	Model := ""
 	var bodyBuff bytes.Buffer
-	reader := io.TeeReader(request.Body, &bodyBuff)
 
 	if strings.Contains(contentType, "json") {
-		decoder := json.NewDecoder(reader)
+		// read the (size limited) body once instead of buffering it beside the decoder
+		raw, err := io.ReadAll(request.Body)
+		if err != nil {
+			Log.Error(err)
+			return request, false, err
+		}
 		wrapper := make(map[string]interface{})
-		err := decoder.Decode(&wrapper)
+		err = json.Unmarshal(raw, &wrapper)
 		if err != nil {
 			Log.Error(err)
 			return request, false, err
 		}
+		experiment, err := this.transformMessages(request, wrapper)
+		if err != nil {
+			return request, false, err
+		}
+
 		if srcModel, ok := wrapper["model"]; ok {
 			if _model, ok := srcModel.(string); ok {
 				Model = _model
 			}
 		}
 
-		Model, err = this.GetModelMappings(Model)
-		if err != nil {
-			Log.Error(err)
-		} else {
+		if experiment {
+			// an arm is a name of the model mappings or a Bedrock model id
+			if mapped, ok := this.config.ModelMappings[Model]; ok {
+				Model = mapped
+			}
 			wrapper["model"] = Model
+		} else {
+			Model, err = this.GetModelMappings(Model)
+			if err != nil {
+				Log.Error(err)
+			} else {
+				wrapper["model"] = Model
+			}
+		}
+
+		if this.breakers != nil {
+			routed, probe, err := this.breakers.Route(Model)
+			if err != nil {
+				return request, false, err
+			}
+			if state := GetRequestState(request); state != nil {
+				state.BreakerModel = routed
+				state.BreakerProbe = probe
+			}
+			if routed != Model {
+				Log.Warningf("circuit breaker of %s is open, routing to %s", Model, routed)
+				SetResponseHeader(request, FallbackModelHeader, routed)
+				Model = routed
+			}
+		}
+		if err := this.checkPrice(Model, ProviderBedrock); err != nil {
+			return request, false, err
 		}
 
 		if srcStream, ok := wrapper["stream"]; ok {
@@ -383,6 +535,10 @@ func (this *BedrockClient) SignRequest(request *http.Request) (*http.Request, bo
 			}
 		}
 
+		if temperature, ok := wrapper["temperature"].(float64); ok && temperature == 0 {
+			deterministic = true
+		}
+
 		wrapper["anthropic_version"] = this.config.AnthropicDefaultVersion
 		delete(wrapper, "model")
 		delete(wrapper, "stream")
@@ -414,34 +570,96 @@ func (this *BedrockClient) SignRequest(request *http.Request) (*http.Request, bo
 			URL:    request.URL,
 			Proto:  request.Proto,
 			Header: request.Header.Clone(),
-			Body:   io.NopCloser(bytes.NewBuffer(bodyBuff.Bytes())),
+			Body:   io.NopCloser(bytes.NewReader(bodyBuff.Bytes())),
+		}
+	}
+
+	hash := sha256.Sum256(bodyBuff.Bytes())
+	payloadHash := hex.EncodeToString(hash[:])
+	if state := GetRequestState(request); state != nil {
+		state.Model = Model
+		state.PayloadHash = payloadHash
+		state.Deterministic = deterministic
+		state.Payload = bodyBuff.Bytes()
+	}
+
+	preSignReq, err := this.signInvoke(this.primaryTarget(), Model, contentType, cloneReq.Body, bodyBuff.Bytes(), isStream || this.config.StreamUpstream)
+	if err != nil {
+		return nil, false, err
+	}
+	return preSignReq, isStream, nil
+}
+
+// BedrockTarget is a region, and optionally another account, requests can be sent to
+type BedrockTarget struct {
+	Region    string `json:"region"`
+	AccessKey string `json:"access_key,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+	// Endpoint overrides the bedrock-runtime endpoint of the region
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// upstreamClient is the HTTP client of the calls to Bedrock, it logs the exchanges in debug mode
+func (this *BedrockClient) upstreamClient() *http.Client {
+	if this.config.DEBUG {
+		return &http.Client{
+			Transport: loggingRoundTripper{
+				wrapped: http.DefaultTransport,
+			},
 		}
 	}
+	return http.DefaultClient
+}
+
+func (this *BedrockClient) primaryTarget() *BedrockTarget {
+	return &BedrockTarget{
+		Region:    this.config.Region,
+		AccessKey: this.config.AccessKey,
+		SecretKey: this.config.SecretKey,
+		Endpoint:  this.config.Endpoint,
+	}
+}
 
+// signInvoke builds the signed invoke request of model on a target, payload is the body used for the signature
+func (this *BedrockClient) signInvoke(target *BedrockTarget, model string, contentType string, body io.Reader, payload []byte, stream bool) (*http.Request, error) {
+	operation := "invoke"
+	if stream {
+		operation = "invoke-with-response-stream"
+	}
+	return this.signRuntime(target, fmt.Sprintf(`/model/%s/%s`, url.QueryEscape(model), operation), contentType, body, payload)
+}
+
+// signRuntime builds a signed bedrock-runtime request of path on a target
+func (this *BedrockClient) signRuntime(target *BedrockTarget, path string, contentType string, body io.Reader, payload []byte) (*http.Request, error) {
+	accessKey, secretKey := target.AccessKey, target.SecretKey
+	if len(accessKey) == 0 {
+		accessKey, secretKey = this.config.AccessKey, this.config.SecretKey
+	}
 	cfg, err := awsConfig.LoadDefaultConfig(context.TODO(),
-		awsConfig.WithRegion(this.config.Region),
+		awsConfig.WithRegion(target.Region),
 		awsConfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-			this.config.AccessKey,
-			this.config.SecretKey,
+			accessKey,
+			secretKey,
 			"",
 		)),
 	)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 
-	bedrockRuntimeEndPoint := fmt.Sprintf(`https://bedrock-runtime.%s.amazonaws.com/model/%s/invoke`, this.config.Region, url.QueryEscape(Model))
-	if isStream {
-		bedrockRuntimeEndPoint = fmt.Sprintf(`https://bedrock-runtime.%s.amazonaws.com/model/%s/invoke-with-response-stream`, this.config.Region, url.QueryEscape(Model))
+	runtimeBaseURL := fmt.Sprintf(`https://bedrock-runtime.%s.amazonaws.com`, target.Region)
+	if len(target.Endpoint) > 0 {
+		runtimeBaseURL = strings.TrimSuffix(target.Endpoint, "/")
 	}
+	bedrockRuntimeEndPoint := runtimeBaseURL + path
 
-	preSignReq, err := http.NewRequest("POST", bedrockRuntimeEndPoint, cloneReq.Body)
+	preSignReq, err := http.NewRequest("POST", bedrockRuntimeEndPoint, body)
 	if err != nil {
 		Log.Error(err)
-		return nil, false, err
+		return nil, err
 	}
 	preSignReq.Header.Set("Content-Type", contentType)
-	preSignReq.ContentLength = int64(bodyBuff.Len())
+	preSignReq.ContentLength = int64(len(payload))
 
 	signer := v4.NewSigner()
 
@@ -449,23 +667,21 @@ func (this *BedrockClient) SignRequest(request *http.Request) (*http.Request, bo
 	credentialList, err := cfg.Credentials.Retrieve(context.TODO())
 	if err != nil {
 		Log.Error(err)
-		return nil, false, err
+		return nil, err
 	}
 
-	hash := sha256.Sum256(bodyBuff.Bytes())
-	payloadHash := hex.EncodeToString(hash[:])
+	hash := sha256.Sum256(payload)
 	// 签名请求
-	err = signer.SignHTTP(context.TODO(), credentialList, preSignReq, payloadHash, "bedrock", cfg.Region, time.Now(), func(options *v4.SignerOptions) {
+	err = signer.SignHTTP(context.TODO(), credentialList, preSignReq, hex.EncodeToString(hash[:]), "bedrock", cfg.Region, time.Now(), func(options *v4.SignerOptions) {
 		if this.config.DEBUG {
 			options.LogSigning = true
 		}
 	})
 	if err != nil {
 		Log.Error(err)
-		return nil, false, err
+		return nil, err
 	}
-
-	return preSignReq, isStream, nil
+	return preSignReq, nil
 }
 
 type RawAWSBedrockEvent struct {
@@ -493,26 +709,15 @@ func (this *RawAWSBedrockEvent) GetRawChunk() (string, string) {
 	return eventType.Type, string(jsonRaw)
 }
 func AsClaudeEvent(line string) string {
-	var rawEvent RawAWSBedrockEvent
-	decode := json.NewDecoder(strings.NewReader(line))
-	err := decode.Decode(&rawEvent)
+	eventType, raw, err := parseBedrockChunk([]byte(line))
 	if err != nil {
 		Log.Error(err)
 		return ""
 	}
-	eventType, raw := rawEvent.GetRawChunk()
-	return fmt.Sprintf("event: %s\ndata: %s\n", eventType, raw)
+	return formatSSEEvent(eventType, raw)
 }
 
-func (this *BedrockClient) handleBedrockStream(w http.ResponseWriter, res *http.Response) error {
-	// 設置 SSE 相關的 headers
-	for k, v := range res.Header {
-		w.Header()[k] = v
-	}
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
+func (this *BedrockClient) handleBedrockStream(w http.ResponseWriter, res *http.Response, observer StreamEventObserver) error {
 	StreamContentType := res.Header.Get("Content-Type")
 	BedrockContentType := res.Header.Get("X-Amzn-Bedrock-Content-Type")
 	isAWSEventstream := strings.Contains(StreamContentType, "amazon.eventstream")
@@ -526,15 +731,66 @@ func (this *BedrockClient) handleBedrockStream(w http.ResponseWriter, res *http.
 		}
 	}
 
+	// Bedrock 在請求失敗時返回普通的 JSON 錯誤
 	if !isAWSEventstream {
-		return nil
+		for k, v := range res.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(res.StatusCode)
+		_, err := io.Copy(w, res.Body)
+		return err
+	}
+
+	// 設置 SSE 相關的 headers
+	for k, v := range res.Header {
+		w.Header()[k] = v
 	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		return fmt.Errorf("streaming unsupported")
 	}
 
+	if !isJSONEncoded {
+		return nil
+	}
+
+	w.WriteHeader(res.StatusCode)
+	flusher.Flush()
+
+	// 長時間思考期間沒有事件時發送 ping，避免連線被中途的代理切斷
+	pinger := newSSEPinger(w, flusher, time.Duration(this.config.PingIntervalSeconds)*time.Second)
+	defer pinger.Stop()
+
+	return this.decodeBedrockStream(res.Body, func(eventType string, raw []byte) {
+		if observer != nil {
+			observer(eventType, raw)
+		}
+		if this.config.StripInvocationMetrics && eventType == "message_stop" {
+			raw = stripInvocationMetrics(raw)
+		}
+		SSEEvent := formatSSEEvent(eventType, raw)
+		if this.config.DEBUG {
+			Log.Infof("SSE: %s\n", SSEEvent)
+		}
+		// 寫入修改後的行並立即刷新
+		pinger.WriteEvent(SSEEvent)
+	})
+}
+
+func eventHeader(msg eventstream.Message, name string) string {
+	if value := msg.Headers.Get(name); value != nil {
+		return value.String()
+	}
+	return ""
+}
+
+// decodeBedrockStream decodes a Bedrock event stream and calls handler with every Anthropic event,
+// exceptions raised by Bedrock in the middle of the stream are turned into "error" events
+func (this *BedrockClient) decodeBedrockStream(body io.Reader, handler StreamEventObserver) error {
 	decoder := eventstream.NewDecoder()
 
 	// 创建缓冲读取器
@@ -542,44 +798,69 @@ func (this *BedrockClient) handleBedrockStream(w http.ResponseWriter, res *http.
 
 	for {
 		// 读取事件头部 (前面的12字节包含总长度等信息)
-		msg, err := decoder.Decode(res.Body, buf)
+		msg, err := decoder.Decode(body, buf)
 		if err != nil {
 			if err == io.EOF {
-				break
+				return nil
 			}
 			return fmt.Errorf("解码错误: %v\n", err)
 		}
 
-		//if this.config.DEBUG {
-		//	Log.Info("New Message")
-		//}
-
-		//for _, header := range msg.Headers {
-		//	Log.Infof("头部: %s = %v\n", header.Name, header.Value)
-		//}
-
 		if this.config.DEBUG {
 			Log.Infof("handleBedrockStreamRaw: %s\n", string(msg.Payload))
 		}
 
-		if isJSONEncoded {
-			// 查找事件类型和内容 (需要根据EventStream具体格式进一步解析)
-			// 简化示例: 假设数据是JSON格式
-			SSEEvent := AsClaudeEvent(string(msg.Payload))
-			if this.config.DEBUG {
-				Log.Infof("SSE: %s\n", SSEEvent)
-			}
-			// 寫入修改後的行並立即刷新
-			fmt.Fprintf(w, "%s\n", SSEEvent)
-			flusher.Flush()
+		if messageType := eventHeader(msg, ":message-type"); messageType == "exception" || messageType == "error" {
+			handler("error", bedrockExceptionEvent(eventHeader(msg, ":exception-type"), msg.Payload))
+			continue
+		}
+
+		// 查找事件类型和内容 (需要根据EventStream具体格式进一步解析)
+		eventType, raw, err := parseBedrockChunk(msg.Payload)
+		if err != nil {
+			Log.Error(err)
+			continue
 		}
+		handler(eventType, raw)
 	}
+}
 
-	return nil
+// reportUsage passes the usage of a completed request to the usage listeners
+func (this *BedrockClient) reportUsage(r *http.Request, usage *RequestUsage, recorder *usageResponseWriter) {
+	if state := GetRequestState(r); state != nil {
+		usage.Model = state.Model
+		usage.Provider = state.Provider
+		usage.Region = state.Region
+		usage.Experiment = state.Experiment
+		usage.Arm = state.Arm
+	}
+	usage.Finish(recorder.statusCode)
+	this.estimateCost(usage)
+	if state := GetRequestState(r); state != nil && this.breakers != nil && len(state.BreakerModel) > 0 {
+		this.breakers.Record(state.Target, state.BreakerModel, state.BreakerProbe, usage)
+	}
+	for _, listener := range this.usageListener {
+		listener(r, usage)
+	}
 }
 
 func (this *BedrockClient) HandleProxy(w http.ResponseWriter, r *http.Request) {
+	usage := NewRequestUsage()
+	if state := GetRequestState(r); state != nil {
+		state.Usage = usage
+	}
+	recorder := &usageResponseWriter{ResponseWriter: w}
+	w = recorder
+	defer this.reportUsage(r, usage, recorder)
+
 	cloneReq, isStream, err := this.SignRequest(r)
+	if err != nil {
+		// answered by the proxy, e.g. an open circuit breaker, Bedrock was not called
+		usage.Local = true
+	}
+	if err != nil && writeProxyError(w, err) {
+		return
+	}
 	if err != nil {
 		Log.Error(err)
 		w.Header().Set("Content-Type", "application/json")
@@ -587,6 +868,20 @@ func (this *BedrockClient) HandleProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	cacheKey := ""
+	if this.responseCache != nil {
+		cacheKey = this.responseCache.Key(r)
+		if len(cacheKey) > 0 && this.responseCache.Serve(w, r, cacheKey, isStream) {
+			usage.Cached = true
+			return
+		}
+	}
+
+	if !isStream && this.config.StreamUpstream {
+		this.handleAssembledStream(w, r, cloneReq, cacheKey)
+		return
+	}
+
 	if isStream {
 		var (
 			resp *http.Response
@@ -607,36 +902,97 @@ func (this *BedrockClient) HandleProxy(w http.ResponseWriter, r *http.Request) {
 		}
 		defer resp.Body.Close()
 
-		if err := this.handleBedrockStream(w, resp); err != nil {
+		state := GetRequestState(r)
+		shadowed := state != nil && state.Shadowed
+		var assembler *MessageAssembler
+		if (len(cacheKey) > 0 || shadowed) && resp.StatusCode == http.StatusOK {
+			assembler = NewMessageAssembler()
+		}
+		observer := func(eventType string, data []byte) {
+			usage.ObserveStreamEvent(eventType, data)
+			if assembler != nil {
+				if err := assembler.AddEvent(eventType, data); err != nil {
+					Log.Error(err)
+				}
+			}
+		}
+
+		copyStateHeaders(w, r)
+		// 串流完成後才知道用量，成本以 trailer 返回
+		if this.priceTable != nil {
+			w.Header().Add("Trailer", CostHeader)
+		}
+		err = this.handleBedrockStream(w, resp, observer)
+		this.setCostHeader(w.Header(), r, usage)
+		if err != nil {
 			Log.Error(err)
+			return
+		}
+		if assembler != nil && assembler.Error() == nil {
+			if len(cacheKey) > 0 {
+				this.responseCache.PutMessage(cacheKey, assembler.Message())
+			}
+			if shadowed {
+				state.Output, _ = json.Marshal(assembler.Message())
+			}
 		}
 		return
 	}
 
-	httpClient := http.DefaultClient
-	if this.config.DEBUG {
-		httpClient = &http.Client{
-			Transport: loggingRoundTripper{
-				wrapped: http.DefaultTransport,
-			},
+	var resp *http.Response
+	if this.hedger != nil {
+		// the hedge replays the translated payload, which is only kept in the request state
+		model, payload := "", []byte(nil)
+		if state := GetRequestState(r); state != nil {
+			model, payload = state.Model, state.Payload
 		}
+		var outcome *hedgeOutcome
+		resp, outcome, err = this.doHedged(r, cloneReq, this.upstreamClient(), model, payload, false, true)
+		recordHedge(r, outcome)
+	} else {
+		resp, err = this.upstreamClient().Do(cloneReq)
 	}
-
-	resp, err := httpClient.Do(cloneReq)
 	if err != nil {
 		Log.Error(err)
 		w.Header().Set("Content-Type", "application/json")
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
+	defer resp.Body.Close()
+	usage.MarkFirstByte()
+	usage.MergeResponseHeader(resp.Header)
 
 	// 寫入修改後的響應
 	for k, v := range resp.Header {
 		w.Header()[k] = v
 	}
+	copyStateHeaders(w, r)
+	if resp.StatusCode == http.StatusOK {
+		this.setCostHeader(w.Header(), r, usage)
+	}
 	w.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(w, resp.Body)
+
+	var target io.Writer = w
+	var captured *cappedBuffer
+	if resp.StatusCode == http.StatusOK {
+		captured = &cappedBuffer{limit: usageCaptureLimit}
+		if len(cacheKey) > 0 && this.responseCache.config.MaxEntry > captured.limit {
+			captured.limit = this.responseCache.config.MaxEntry
+		}
+		target = io.MultiWriter(w, captured)
+	}
+	_, err = io.Copy(target, resp.Body)
 	if err != nil {
 		Log.Error(err)
+		return
+	}
+	if captured != nil && !captured.overflow {
+		usage.MergeResponseBody(captured.Bytes())
+		if len(cacheKey) > 0 {
+			this.responseCache.Put(cacheKey, captured.Bytes())
+		}
+		if state := GetRequestState(r); state != nil && state.Shadowed {
+			state.Output = captured.Bytes()
+		}
 	}
 }
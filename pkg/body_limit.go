@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxBodySize matches the request size limit of the Anthropic Messages API
+const DefaultMaxBodySize int64 = 32 * 1024 * 1024
+
+// BodyLimitConfig bounds the request body accepted by the proxy.
+//
+// The limit of a request is resolved as: key limit (api key or email) > endpoint limit > MaxBodySize.
+// It bounds the body sent by the client, not the memory of a request: the proxy keeps a few copies
+// of the body while translating it (raw bytes, decoded JSON, re-encoded Bedrock payload), and the
+// transformers grow the decoded body. Inlined URL sources are bounded by URLSourceConfig.MaxBytes each,
+// inlined files by FilesConfig.MaxInlineSize per request, both growing by a third once base64 encoded,
+// and each image is decoded by the image pipeline only below ImageConfig.MaxPixels.
+type BodyLimitConfig struct {
+	MaxBodySize    int64            `json:"max_body_size"`
+	EndpointLimits map[string]int64 `json:"endpoint_limits,omitempty"`
+	KeyLimits      map[string]int64 `json:"key_limits,omitempty"`
+}
+
+// ParseByteSize parses sizes like "1048576", "512KB", "32MB" or "1GB"
+func ParseByteSize(raw string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(raw))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"GB", 1024 * 1024 * 1024},
+		{"MB", 1024 * 1024},
+		{"KB", 1024},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(str, unit.suffix) {
+			multiplier = unit.size
+			str = strings.TrimSpace(strings.TrimSuffix(str, unit.suffix))
+			break
+		}
+	}
+	size, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte size %q: %v", raw, err)
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("invalid byte size %q", raw)
+	}
+	return size * multiplier, nil
+}
+
+func parseByteSizeMappings(raw string) map[string]int64 {
+	limits := map[string]int64{}
+	for key, value := range ParseMappingsFromStr(raw) {
+		size, err := ParseByteSize(value)
+		if err != nil {
+			Log.Warningf("skip body limit for %s: %v", key, err)
+			continue
+		}
+		limits[key] = size
+	}
+	return limits
+}
+
+func LoadBodyLimitConfigWithEnv() *BodyLimitConfig {
+	config := &BodyLimitConfig{
+		MaxBodySize:    DefaultMaxBodySize,
+		EndpointLimits: parseByteSizeMappings(os.Getenv("HTTP_ENDPOINT_BODY_LIMITS")),
+		KeyLimits:      parseByteSizeMappings(os.Getenv("HTTP_KEY_BODY_LIMITS")),
+	}
+
+	if raw := os.Getenv("HTTP_MAX_BODY_SIZE"); len(raw) > 0 {
+		if size, err := ParseByteSize(raw); err == nil {
+			config.MaxBodySize = size
+		} else {
+			Log.Warning(err)
+		}
+	}
+
+	return config
+}
+
+// LimitFor resolves the body limit of a request path for the given identity, 0 means unlimited
+func (this *BodyLimitConfig) LimitFor(path string, identity *RequestIdentity) int64 {
+	if identity != nil {
+		if limit, ok := this.KeyLimits[identity.APIKey]; ok {
+			return limit
+		}
+		if limit, ok := this.KeyLimits[identity.Email]; ok && len(identity.Email) > 0 {
+			return limit
+		}
+	}
+	if limit, ok := this.EndpointLimits[path]; ok {
+		return limit
+	}
+	return this.MaxBodySize
+}
+
+// IsRequestTooLarge reports whether err was caused by a body exceeding its limit, and returns that limit
+func IsRequestTooLarge(err error) (int64, bool) {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		return maxBytesError.Limit, true
+	}
+	return 0, false
+}
+
+func requestTooLargeMessage(limit int64) string {
+	return fmt.Sprintf("Request exceeds the maximum allowed number of bytes (%d).", limit)
+}
+
+// BodyLimitMiddleware rejects oversized bodies with a 413 request_too_large error
+func (this *HTTPService) BodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		limits := this.conf.BodyLimitConfig
+		if limits == nil || request.Body == nil || request.Body == http.NoBody {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		limit := limits.LimitFor(request.URL.Path, GetRequestIdentity(request))
+		if limit <= 0 {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		if request.ContentLength > limit {
+			writeAPIError(writer, http.StatusRequestEntityTooLarge, "request_too_large", requestTooLargeMessage(limit))
+			return
+		}
+
+		request.Body = http.MaxBytesReader(writer, request.Body, limit)
+		next.ServeHTTP(writer, request)
+	})
+}
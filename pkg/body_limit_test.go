@@ -0,0 +1,111 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+		hasError bool
+	}{
+		{"1024", 1024, false},
+		{"512KB", 512 * 1024, false},
+		{"32mb", 32 * 1024 * 1024, false},
+		{" 1 GB ", 1024 * 1024 * 1024, false},
+		{"10B", 10, false},
+		{"abc", 0, true},
+		{"-1", 0, true},
+	}
+
+	for _, test := range tests {
+		result, err := ParseByteSize(test.input)
+		if (err != nil) != test.hasError {
+			t.Errorf("ParseByteSize(%q) error = %v", test.input, err)
+			continue
+		}
+		if result != test.expected {
+			t.Errorf("ParseByteSize(%q) = %d, want %d", test.input, result, test.expected)
+		}
+	}
+}
+
+func TestBodyLimitConfig_LimitFor(t *testing.T) {
+	config := &BodyLimitConfig{
+		MaxBodySize:    100,
+		EndpointLimits: map[string]int64{"/v1/messages": 50},
+		KeyLimits:      map[string]int64{"big-key": 1000, "user@example.com": 10},
+	}
+
+	if limit := config.LimitFor("/v1/models", nil); limit != 100 {
+		t.Errorf("expected default limit 100, got %d", limit)
+	}
+	if limit := config.LimitFor("/v1/messages", nil); limit != 50 {
+		t.Errorf("expected endpoint limit 50, got %d", limit)
+	}
+	if limit := config.LimitFor("/v1/messages", &RequestIdentity{APIKey: "big-key"}); limit != 1000 {
+		t.Errorf("expected key limit 1000, got %d", limit)
+	}
+	if limit := config.LimitFor("/v1/messages", &RequestIdentity{APIKey: "other", Email: "user@example.com"}); limit != 10 {
+		t.Errorf("expected email limit 10, got %d", limit)
+	}
+}
+
+func TestHTTPService_BodyLimitMiddleware(t *testing.T) {
+	service := &HTTPService{
+		conf: &Config{
+			BodyLimitConfig: &BodyLimitConfig{MaxBodySize: 16},
+		},
+		ApiStorage: NewMemoryStore(time.Hour),
+	}
+
+	handler := service.BodyLimitMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, err := io.ReadAll(request.Body)
+		if limit, ok := IsRequestTooLarge(err); ok {
+			writeAPIError(writer, http.StatusRequestEntityTooLarge, "request_too_large", requestTooLargeMessage(limit))
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+	}))
+
+	t.Run("WithinLimit", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/v1/messages", strings.NewReader("{}")))
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("ContentLengthTooLarge", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/v1/messages", strings.NewReader(strings.Repeat("a", 32))))
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("expected 413, got %d", w.Code)
+		}
+		var apiError APIStandardError
+		if err := json.Unmarshal(w.Body.Bytes(), &apiError); err != nil {
+			t.Fatal(err)
+		}
+		if apiError.Error == nil || apiError.Error.Type != "request_too_large" {
+			t.Errorf("expected request_too_large error, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("ChunkedTooLarge", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/v1/messages", io.MultiReader(bytes.NewReader(make([]byte, 32))))
+		request.ContentLength = -1
+		handler.ServeHTTP(w, request)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected 413, got %d", w.Code)
+		}
+	})
+}
@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
@@ -104,14 +105,9 @@ func (c *Cache) SaveAPIKey(email, apiKey string, expiry ...time.Duration) error
 		return fmt.Errorf("failed to marshal API key entry: %w", err)
 	}
 
-	err = c.db.Update(func(tx *nutsdb.Tx) error {
-		if tx.ExistBucket(nutsdb.DataStructureBTree, c.config.BucketName) {
-			return nil // Bucket already exists, no need to create it
-		}
-		return tx.NewBucket(nutsdb.DataStructureBTree, c.config.BucketName)
-	})
+	err = c.ensureBucket(c.config.BucketName)
 	if err != nil {
-		return fmt.Errorf("failed to create bucket: %w", err)
+		return err
 	}
 
 	err = c.db.Update(func(tx *nutsdb.Tx) error {
@@ -125,6 +121,61 @@ func (c *Cache) SaveAPIKey(email, apiKey string, expiry ...time.Duration) error
 	return nil
 }
 
+// ensureBucket creates the bucket when it does not exist yet
+func (c *Cache) ensureBucket(bucket string) error {
+	err := c.db.Update(func(tx *nutsdb.Tx) error {
+		if tx.ExistBucket(nutsdb.DataStructureBTree, bucket) {
+			return nil // Bucket already exists, no need to create it
+		}
+		return tx.NewBucket(nutsdb.DataStructureBTree, bucket)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create bucket: %w", err)
+	}
+	return nil
+}
+
+// isNotFound reports whether err means the bucket or key does not exist
+func isNotFound(err error) bool {
+	return errors.Is(err, nutsdb.ErrKeyNotFound) ||
+		errors.Is(err, nutsdb.ErrBucketNotExist) ||
+		errors.Is(err, nutsdb.ErrBucketNotFound)
+}
+
+// PutValue stores a raw value in the given bucket, a zero ttl never expires
+func (c *Cache) PutValue(bucket string, key []byte, value []byte, ttl time.Duration) error {
+	if err := c.ensureBucket(bucket); err != nil {
+		return err
+	}
+	err := c.db.Update(func(tx *nutsdb.Tx) error {
+		return tx.Put(bucket, key, value, uint32(ttl.Seconds()))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save value: %w", err)
+	}
+	return nil
+}
+
+// GetValue loads a raw value from the given bucket, returning nil without error when it does not exist
+func (c *Cache) GetValue(bucket string, key []byte) ([]byte, error) {
+	var value []byte
+	err := c.db.View(func(tx *nutsdb.Tx) error {
+		entry, err := tx.Get(bucket, key)
+		if err != nil {
+			return err
+		}
+		value = append([]byte{}, entry...)
+		return nil
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get value: %w", err)
+	}
+	return value, nil
+}
+
 func (c *Cache) GetDefaultExpiry() time.Duration {
 	return c.config.DefaultExpiry
 }
@@ -0,0 +1,274 @@
+package pkg
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FallbackModelHeader names the model a request was routed to while the breaker of its model was open
+const FallbackModelHeader = "X-Proxy-Fallback-Model"
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// CircuitBreakerConfig configures the breakers kept per (account, region, model)
+type CircuitBreakerConfig struct {
+	Enable bool `json:"enable"`
+	// FailureThreshold is the number of consecutive failures that opens a breaker
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+	// ProbeIntervalSeconds is how long a breaker stays open before a probe request is let through
+	ProbeIntervalSeconds int `json:"probe_interval_seconds,omitempty"`
+	// SuccessThreshold is the number of successful probes that closes a half open breaker
+	SuccessThreshold int `json:"success_threshold,omitempty"`
+	// Fallbacks maps a Bedrock model id to the model id used while its breaker is open
+	Fallbacks map[string]string `json:"fallbacks,omitempty"`
+}
+
+func LoadCircuitBreakerConfigWithEnv() *CircuitBreakerConfig {
+	config := &CircuitBreakerConfig{
+		Enable:               os.Getenv("CIRCUIT_BREAKER_ENABLE") == "true",
+		FailureThreshold:     5,
+		ProbeIntervalSeconds: 30,
+		SuccessThreshold:     1,
+		Fallbacks:            ParseMappingsFromStr(os.Getenv("CIRCUIT_BREAKER_FALLBACKS")),
+	}
+	if value, ok := parsePositiveInt(os.Getenv("CIRCUIT_BREAKER_FAILURE_THRESHOLD")); ok {
+		config.FailureThreshold = value
+	}
+	if value, ok := parsePositiveInt(os.Getenv("CIRCUIT_BREAKER_PROBE_INTERVAL_SECONDS")); ok {
+		config.ProbeIntervalSeconds = value
+	}
+	if value, ok := parsePositiveInt(os.Getenv("CIRCUIT_BREAKER_SUCCESS_THRESHOLD")); ok {
+		config.SuccessThreshold = value
+	}
+	return config
+}
+
+// BreakerStatus is the state of one breaker
+type BreakerStatus struct {
+	Account             string    `json:"account"`
+	Region              string    `json:"region"`
+	Model               string    `json:"model"`
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	OpenedAt            time.Time `json:"opened_at,omitempty"`
+	// NextProbeAt is when an open breaker lets a probe through
+	NextProbeAt time.Time `json:"next_probe_at,omitempty"`
+	Failures    int64     `json:"failures"`
+	Rejected    int64     `json:"rejected"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+type circuitBreaker struct {
+	status    BreakerStatus
+	successes int
+	probing   bool
+}
+
+// breakerKey is a model on a Bedrock target, the account is the masked access key
+type breakerKey struct {
+	account string
+	region  string
+	model   string
+}
+
+// CircuitBreakers fail requests fast while a model keeps failing, instead of letting each wait out its timeout
+type CircuitBreakers struct {
+	config *CircuitBreakerConfig
+	// account and region are those of the primary target
+	account string
+	region  string
+	mu      sync.Mutex
+	// breakers are keyed by target and model
+	breakers map[breakerKey]*circuitBreaker
+	now      func() time.Time
+}
+
+func NewCircuitBreakers(config *CircuitBreakerConfig, account string, region string) *CircuitBreakers {
+	if len(account) == 0 {
+		account = "default"
+	} else {
+		account = maskAPIKey(account)
+	}
+	return &CircuitBreakers{config: config, account: account, region: region, breakers: map[breakerKey]*circuitBreaker{}, now: time.Now}
+}
+
+// keyOf returns the key of a model on a target, a nil target is the primary one.
+// A target without access key uses the credentials, and so the account, of the primary target.
+func (this *CircuitBreakers) keyOf(target *BedrockTarget, model string) breakerKey {
+	key := breakerKey{account: this.account, region: this.region, model: model}
+	if target != nil {
+		key.region = target.Region
+		if len(target.AccessKey) > 0 {
+			key.account = maskAPIKey(target.AccessKey)
+		}
+	}
+	return key
+}
+
+func (this *CircuitBreakers) breakerOf(key breakerKey) *circuitBreaker {
+	breaker, ok := this.breakers[key]
+	if !ok {
+		breaker = &circuitBreaker{status: BreakerStatus{Account: key.account, Region: key.region, Model: key.model, State: BreakerClosed}}
+		this.breakers[key] = breaker
+	}
+	return breaker
+}
+
+// allow reports whether a request may be sent and whether it is the probe, an open breaker
+// lets one probe through after the probe interval, must be called with the lock held
+func (this *CircuitBreakers) allow(key breakerKey) (bool, bool) {
+	breaker := this.breakerOf(key)
+	switch breaker.status.State {
+	case BreakerOpen:
+		if this.now().Before(breaker.status.NextProbeAt) {
+			return false, false
+		}
+		breaker.status.State = BreakerHalfOpen
+		breaker.successes = 0
+		fallthrough
+	case BreakerHalfOpen:
+		if breaker.probing {
+			return false, false
+		}
+		breaker.probing = true
+		return true, true
+	}
+	return true, false
+}
+
+// Route returns the model a request for model should be sent to on the primary target, its fallback while
+// its breaker is open, or a 529 overloaded_error when neither is available. probe is true when the request
+// is the probe of a half open breaker, its outcome must be recorded with the same flag.
+func (this *CircuitBreakers) Route(model string) (routed string, probe bool, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	key := this.keyOf(nil, model)
+	if allowed, probe := this.allow(key); allowed {
+		return model, probe, nil
+	}
+	this.breakerOf(key).status.Rejected++
+	if fallback, ok := this.config.Fallbacks[model]; ok && len(fallback) > 0 && fallback != model {
+		if allowed, probe := this.allow(this.keyOf(nil, fallback)); allowed {
+			return fallback, probe, nil
+		}
+	}
+	return "", false, &ProxyError{
+		StatusCode: 529,
+		Type:       "overloaded_error",
+		Message:    "Model " + model + " is temporarily unavailable, please retry later",
+	}
+}
+
+// isBreakerFailure reports whether a response means the model or region is failing,
+// throttling and client errors do not count
+func isBreakerFailure(usage *RequestUsage) bool {
+	if usage.StatusCode >= 500 {
+		return true
+	}
+	return usage.ErrorType == "api_error" || usage.ErrorType == "overloaded_error"
+}
+
+// Record applies the outcome of a request that was routed to model, probe is the flag returned by Route.
+// target is the hedge target that served the request, nil for the primary one: the outcome of a hedge
+// is recorded against its target, and only ends the probe of the primary breaker.
+func (this *CircuitBreakers) Record(target *BedrockTarget, model string, probe bool, usage *RequestUsage) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	primary := this.keyOf(nil, model)
+	key := this.keyOf(target, model)
+	if probe {
+		// requests admitted before the breaker opened do not end the probe
+		this.breakerOf(primary).probing = false
+	}
+	if key != primary {
+		probe = false
+	}
+	breaker := this.breakerOf(key)
+	if usage.Cached || usage.StatusCode == 0 || (usage.StatusCode >= 400 && usage.StatusCode < 500) {
+		// nothing was learnt about the model
+		return
+	}
+
+	status := &breaker.status
+	if !isBreakerFailure(usage) {
+		status.ConsecutiveFailures = 0
+		if status.State == BreakerHalfOpen && probe {
+			breaker.successes++
+			if breaker.successes >= this.config.SuccessThreshold {
+				Log.Infof("circuit breaker of %s in %s closed", model, key.region)
+				status.State = BreakerClosed
+				status.OpenedAt = time.Time{}
+				status.NextProbeAt = time.Time{}
+			}
+		}
+		return
+	}
+
+	status.Failures++
+	status.ConsecutiveFailures++
+	status.LastError = usage.ErrorType
+	if len(status.LastError) == 0 {
+		status.LastError = http.StatusText(usage.StatusCode)
+	}
+	if status.State == BreakerHalfOpen || status.ConsecutiveFailures >= this.config.FailureThreshold {
+		if status.State != BreakerOpen {
+			Log.Warningf("circuit breaker of %s in %s opened after %d failures", model, key.region, status.ConsecutiveFailures)
+		}
+		now := this.now()
+		status.State = BreakerOpen
+		status.OpenedAt = now
+		status.NextProbeAt = now.Add(time.Duration(this.config.ProbeIntervalSeconds) * time.Second)
+	}
+}
+
+// Status returns the breakers sorted by model, region and account
+func (this *CircuitBreakers) Status() []*BreakerStatus {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	statuses := make([]*BreakerStatus, 0, len(this.breakers))
+	for _, breaker := range this.breakers {
+		status := breaker.status
+		statuses = append(statuses, &status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Model != statuses[j].Model {
+			return statuses[i].Model < statuses[j].Model
+		}
+		if statuses[i].Region != statuses[j].Region {
+			return statuses[i].Region < statuses[j].Region
+		}
+		return statuses[i].Account < statuses[j].Account
+	})
+	return statuses
+}
+
+// Reset closes the breakers of a model on every target, or every breaker when model is empty
+func (this *CircuitBreakers) Reset(model string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for key := range this.breakers {
+		if len(model) == 0 || key.model == model {
+			delete(this.breakers, key)
+		}
+	}
+}
+
+// HandleAdminBreakers reports the state of the circuit breakers
+func (this *HTTPService) HandleAdminBreakers(writer http.ResponseWriter, request *http.Request) {
+	this.ResponseJSON(map[string]interface{}{"breakers": this.bedrockClient.breakers.Status()}, writer)
+}
+
+// HandleAdminResetBreakers closes the breaker of the "model" query parameter, or all breakers
+func (this *HTTPService) HandleAdminResetBreakers(writer http.ResponseWriter, request *http.Request) {
+	model := strings.TrimSpace(request.URL.Query().Get("model"))
+	this.bedrockClient.breakers.Reset(model)
+	this.ResponseJSON(map[string]interface{}{"reset": true, "model": model}, writer)
+}
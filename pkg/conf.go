@@ -8,7 +8,29 @@ import (
 
 type Config struct {
 	HttpConfig
-	BedrockConfig *BedrockConfig `json:"bedrock_config,omitempty"`
+	BedrockConfig   *BedrockConfig             `json:"bedrock_config,omitempty"`
+	BodyLimitConfig *BodyLimitConfig           `json:"body_limit_config,omitempty"`
+	URLSourceConfig *URLSourceConfig           `json:"url_source_config,omitempty"`
+	FilesConfig     *FilesConfig               `json:"files_config,omitempty"`
+	ImageConfig     *ImageConfig               `json:"image_config,omitempty"`
+	ResponseCache   *ResponseCacheConfig       `json:"response_cache,omitempty"`
+	UsageLedger     *UsageLedgerConfig         `json:"usage_ledger,omitempty"`
+	Pricing         *PricingConfig             `json:"pricing,omitempty"`
+	Quota           *QuotaConfig               `json:"quota,omitempty"`
+	RateLimit       *RateLimitConfig           `json:"rate_limit,omitempty"`
+	SharedState     *SharedStateConfig         `json:"shared_state,omitempty"`
+	Queue           *FairQueueConfig           `json:"queue,omitempty"`
+	Concurrency     *AdaptiveConcurrencyConfig `json:"adaptive_concurrency,omitempty"`
+	CircuitBreaker  *CircuitBreakerConfig      `json:"circuit_breaker,omitempty"`
+	Hedge           *HedgeConfig               `json:"hedge,omitempty"`
+	Experiment      *ExperimentConfig          `json:"experiment,omitempty"`
+	Shadow          *ShadowConfig              `json:"shadow,omitempty"`
+	SmartRouting    *SmartRoutingConfig        `json:"smart_routing,omitempty"`
+	Providers       *ProvidersConfig           `json:"providers,omitempty"`
+	Converse        *ConverseConfig            `json:"converse,omitempty"`
+	Embeddings      *EmbeddingsConfig          `json:"embeddings,omitempty"`
+	Gemini          *GeminiConfig              `json:"gemini,omitempty"`
+	Ollama          *OllamaConfig              `json:"ollama,omitempty"`
 }
 
 func NewConfigFromLocal(filename string) (*Config, error) {
@@ -30,6 +52,72 @@ func (this *Config) MarginWithENV() {
 	if this.BedrockConfig == nil {
 		this.BedrockConfig = LoadBedrockConfigWithEnv()
 	}
+	if this.BodyLimitConfig == nil {
+		this.BodyLimitConfig = LoadBodyLimitConfigWithEnv()
+	}
+	if this.URLSourceConfig == nil {
+		this.URLSourceConfig = LoadURLSourceConfigWithEnv()
+	}
+	if this.FilesConfig == nil {
+		this.FilesConfig = LoadFilesConfigWithEnv()
+	}
+	if this.ImageConfig == nil {
+		this.ImageConfig = LoadImageConfigWithEnv()
+	}
+	if this.ResponseCache == nil {
+		this.ResponseCache = LoadResponseCacheConfigWithEnv()
+	}
+	if this.UsageLedger == nil {
+		this.UsageLedger = LoadUsageLedgerConfigWithEnv()
+	}
+	if this.Pricing == nil {
+		this.Pricing = LoadPricingConfigWithEnv()
+	}
+	if this.Quota == nil {
+		this.Quota = LoadQuotaConfigWithEnv()
+	}
+	if this.RateLimit == nil {
+		this.RateLimit = LoadRateLimitConfigWithEnv()
+	}
+	if this.SharedState == nil {
+		this.SharedState = LoadSharedStateConfigWithEnv()
+	}
+	if this.Queue == nil {
+		this.Queue = LoadFairQueueConfigWithEnv()
+	}
+	if this.Concurrency == nil {
+		this.Concurrency = LoadAdaptiveConcurrencyConfigWithEnv()
+	}
+	if this.CircuitBreaker == nil {
+		this.CircuitBreaker = LoadCircuitBreakerConfigWithEnv()
+	}
+	if this.Hedge == nil {
+		this.Hedge = LoadHedgeConfigWithEnv()
+	}
+	if this.Experiment == nil {
+		this.Experiment = LoadExperimentConfigWithEnv()
+	}
+	if this.Shadow == nil {
+		this.Shadow = LoadShadowConfigWithEnv()
+	}
+	if this.SmartRouting == nil {
+		this.SmartRouting = LoadSmartRoutingConfigWithEnv()
+	}
+	if this.Providers == nil {
+		this.Providers = LoadProvidersConfigWithEnv()
+	}
+	if this.Converse == nil {
+		this.Converse = LoadConverseConfigWithEnv()
+	}
+	if this.Embeddings == nil {
+		this.Embeddings = LoadEmbeddingsConfigWithEnv()
+	}
+	if this.Gemini == nil {
+		this.Gemini = LoadGeminiConfigWithEnv()
+	}
+	if this.Ollama == nil {
+		this.Ollama = LoadOllamaConfigWithEnv()
+	}
 }
 
 func (c *Config) load(filename string) error {
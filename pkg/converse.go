@@ -0,0 +1,746 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/protocol/eventstream"
+	"github.com/google/uuid"
+)
+
+// ConverseCapabilities are the Messages features a model family supports through the Bedrock Converse API
+type ConverseCapabilities struct {
+	System bool `json:"system"`
+	Tools  bool `json:"tools"`
+	// ToolChoice allows the "any" and "tool" tool choices, "auto" only needs Tools
+	ToolChoice bool `json:"tool_choice"`
+	Images     bool `json:"images"`
+	Documents  bool `json:"documents"`
+	Streaming  bool `json:"streaming"`
+	// StreamingTools allows tools in streaming calls, streams with tools are answered in one piece otherwise
+	StreamingTools bool `json:"streaming_tools"`
+	// Reasoning models think on their own, requests with thinking enabled are rejected by the other models
+	Reasoning bool `json:"reasoning"`
+}
+
+// converseCapabilityTable is keyed by a part of the Bedrock model id, the longest key found in the id wins
+var converseCapabilityTable = map[string]*ConverseCapabilities{
+	"amazon.nova":           {System: true, Tools: true, ToolChoice: true, Images: true, Documents: true, Streaming: true, StreamingTools: true},
+	"amazon.nova-micro":     {System: true, Tools: true, ToolChoice: true, Streaming: true, StreamingTools: true},
+	"amazon.titan-text":     {Streaming: true},
+	"meta.llama3":           {System: true, Streaming: true},
+	"meta.llama3-1":         {System: true, Tools: true, Streaming: true},
+	"meta.llama3-2-1b":      {System: true, Streaming: true},
+	"meta.llama3-2-3b":      {System: true, Streaming: true},
+	"meta.llama3-2-11b":     {System: true, Tools: true, Images: true, Streaming: true},
+	"meta.llama3-2-90b":     {System: true, Tools: true, Images: true, Streaming: true},
+	"meta.llama3-3":         {System: true, Tools: true, Streaming: true},
+	"meta.llama4":           {System: true, Tools: true, Images: true, Streaming: true},
+	"mistral.mistral-7b":    {Streaming: true},
+	"mistral.mixtral":       {Streaming: true},
+	"mistral.mistral-small": {System: true, Tools: true, Streaming: true},
+	"mistral.mistral-large": {System: true, Tools: true, Documents: true, Streaming: true},
+	"mistral.pixtral":       {System: true, Tools: true, Images: true, Streaming: true},
+	"cohere.command-text":   {Streaming: true},
+	"cohere.command-light":  {Streaming: true},
+	"cohere.command-r":      {System: true, Tools: true, Documents: true, Streaming: true},
+	"ai21.jamba":            {System: true, Tools: true, Streaming: true},
+	"deepseek.r1":           {System: true, Streaming: true, Reasoning: true},
+	"writer.palmyra":        {System: true, Tools: true, Streaming: true},
+}
+
+// defaultConverseCapabilities are assumed for the models missing from the table
+var defaultConverseCapabilities = &ConverseCapabilities{System: true, Streaming: true}
+
+// ConverseConfig serves non-Anthropic Bedrock models, e.g. Amazon Nova, Llama or Mistral, behind the Messages API
+type ConverseConfig struct {
+	Enable bool `json:"enable"`
+	// Models maps the model requested by clients to the Bedrock model id
+	Models map[string]string `json:"models"`
+	// Capabilities extend or override the capability table, keyed like it by a part of the model id
+	Capabilities map[string]*ConverseCapabilities `json:"capabilities,omitempty"`
+}
+
+func LoadConverseConfigWithEnv() *ConverseConfig {
+	return &ConverseConfig{
+		Enable: os.Getenv("CONVERSE_ENABLE") == "true",
+		Models: ParseMappingsFromStr(os.Getenv("CONVERSE_MODELS")),
+	}
+}
+
+// ConverseProvider translates Messages requests into Bedrock Converse calls and the results back into
+// Anthropic messages and events
+type ConverseProvider struct {
+	config  *ConverseConfig
+	bedrock *BedrockClient
+}
+
+func NewConverseProvider(config *ConverseConfig, bedrock *BedrockClient) *ConverseProvider {
+	return &ConverseProvider{config: config, bedrock: bedrock}
+}
+
+func (this *ConverseProvider) Name() string {
+	return ProviderConverse
+}
+
+func (this *ConverseProvider) Serves(model string) bool {
+	_, ok := this.config.Models[model]
+	return ok
+}
+
+func (this *ConverseProvider) Models() []string {
+	models := make([]string, 0, len(this.config.Models))
+	for model := range this.config.Models {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	return models
+}
+
+// Capabilities returns the capabilities of a Bedrock model id
+func (this *ConverseProvider) Capabilities(model string) *ConverseCapabilities {
+	match := func(table map[string]*ConverseCapabilities) (*ConverseCapabilities, int) {
+		var found *ConverseCapabilities
+		length := 0
+		for key, capabilities := range table {
+			if len(key) > length && strings.Contains(model, key) {
+				found, length = capabilities, len(key)
+			}
+		}
+		return found, length
+	}
+	capabilities, length := match(converseCapabilityTable)
+	if override, overrideLength := match(this.config.Capabilities); override != nil && overrideLength >= length {
+		capabilities = override
+	}
+	if capabilities == nil {
+		return defaultConverseCapabilities
+	}
+	return capabilities
+}
+
+var documentNameReplacer = regexp.MustCompile(`[^A-Za-z0-9\-\(\)\[\] ]+`)
+
+// documentFormats maps the media types of documents to the Converse document formats
+var documentFormats = map[string]string{
+	"application/pdf": "pdf",
+	"text/plain":      "txt",
+	"text/csv":        "csv",
+	"text/html":       "html",
+	"text/markdown":   "md",
+}
+
+// converseRequest translates the content of a Messages request for the Converse API of model
+type converseRequest struct {
+	model        string
+	capabilities *ConverseCapabilities
+	documents    int
+}
+
+func (this *converseRequest) unsupported(feature string) error {
+	return NewInvalidRequestError("%s does not support %s", this.model, feature)
+}
+
+func (this *converseRequest) image(block map[string]interface{}) (map[string]interface{}, error) {
+	if !this.capabilities.Images {
+		return nil, this.unsupported("images")
+	}
+	source, _ := block["source"].(map[string]interface{})
+	mediaType, _ := source["media_type"].(string)
+	if source["type"] != "base64" || !strings.HasPrefix(mediaType, "image/") {
+		return nil, NewInvalidRequestError("only base64 images can be sent to %s", this.model)
+	}
+	return map[string]interface{}{"image": map[string]interface{}{
+		"format": strings.TrimPrefix(mediaType, "image/"),
+		"source": map[string]interface{}{"bytes": source["data"]},
+	}}, nil
+}
+
+func (this *converseRequest) document(block map[string]interface{}) (map[string]interface{}, error) {
+	if !this.capabilities.Documents {
+		return nil, this.unsupported("documents")
+	}
+	source, _ := block["source"].(map[string]interface{})
+	mediaType, _ := source["media_type"].(string)
+	format, ok := documentFormats[mediaType]
+	data, _ := source["data"].(string)
+	switch {
+	case !ok:
+		return nil, NewInvalidRequestError("documents of type %q cannot be sent to %s", mediaType, this.model)
+	case source["type"] == "text":
+		data = base64.StdEncoding.EncodeToString([]byte(data))
+	case source["type"] != "base64":
+		return nil, NewInvalidRequestError("only base64 and text documents can be sent to %s", this.model)
+	}
+
+	// document names must be unique and may only hold letters, digits, spaces, hyphens, parentheses and brackets
+	this.documents++
+	title, _ := block["title"].(string)
+	name := strings.TrimSpace(documentNameReplacer.ReplaceAllString(title, " "))
+	if len(name) == 0 {
+		name = "document"
+	}
+	return map[string]interface{}{"document": map[string]interface{}{
+		"format": format,
+		"name":   fmt.Sprintf("%s-%d", name, this.documents),
+		"source": map[string]interface{}{"bytes": data},
+	}}, nil
+}
+
+func (this *converseRequest) toolResult(block map[string]interface{}) (map[string]interface{}, error) {
+	content := make([]interface{}, 0)
+	switch value := block["content"].(type) {
+	case string:
+		content = append(content, map[string]interface{}{"text": value})
+	case []interface{}:
+		for _, item := range value {
+			part, _ := item.(map[string]interface{})
+			switch part["type"] {
+			case "text":
+				content = append(content, map[string]interface{}{"text": part["text"]})
+			case "image":
+				image, err := this.image(part)
+				if err != nil {
+					return nil, err
+				}
+				content = append(content, image)
+			case "document":
+				document, err := this.document(part)
+				if err != nil {
+					return nil, err
+				}
+				content = append(content, document)
+			default:
+				return nil, NewInvalidRequestError("tool results with %v content cannot be sent to %s", part["type"], this.model)
+			}
+		}
+	}
+	if len(content) == 0 {
+		content = append(content, map[string]interface{}{"text": ""})
+	}
+	result := map[string]interface{}{"toolUseId": block["tool_use_id"], "content": content}
+	if isError, _ := block["is_error"].(bool); isError {
+		result["status"] = "error"
+	}
+	return map[string]interface{}{"toolResult": result}, nil
+}
+
+// content translates the content of a message, the thinking of earlier turns is left out
+func (this *converseRequest) content(content interface{}) ([]interface{}, error) {
+	if text, ok := content.(string); ok {
+		return []interface{}{map[string]interface{}{"text": text}}, nil
+	}
+	blocks := make([]interface{}, 0)
+	for _, item := range toSlice(content) {
+		block, _ := item.(map[string]interface{})
+		var translated map[string]interface{}
+		var err error
+		switch block["type"] {
+		case "text":
+			translated = map[string]interface{}{"text": block["text"]}
+		case "image":
+			translated, err = this.image(block)
+		case "document":
+			translated, err = this.document(block)
+		case "tool_use":
+			if !this.capabilities.Tools {
+				return nil, this.unsupported("tools")
+			}
+			translated = map[string]interface{}{"toolUse": map[string]interface{}{
+				"toolUseId": block["id"],
+				"name":      block["name"],
+				"input":     block["input"],
+			}}
+		case "tool_result":
+			if !this.capabilities.Tools {
+				return nil, this.unsupported("tools")
+			}
+			translated, err = this.toolResult(block)
+		case "thinking", "redacted_thinking":
+			continue
+		default:
+			return nil, NewInvalidRequestError("%v blocks cannot be sent to %s", block["type"], this.model)
+		}
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, translated)
+	}
+	return blocks, nil
+}
+
+func (this *converseRequest) toolConfig(body map[string]interface{}) (map[string]interface{}, error) {
+	tools := toSlice(body["tools"])
+	if len(tools) == 0 {
+		return nil, nil
+	}
+	if !this.capabilities.Tools {
+		return nil, this.unsupported("tools")
+	}
+	specs := make([]interface{}, 0, len(tools))
+	for _, item := range tools {
+		tool, _ := item.(map[string]interface{})
+		if toolType, _ := tool["type"].(string); len(toolType) > 0 && toolType != "custom" {
+			return nil, this.unsupported(fmt.Sprintf("the %s tool", toolType))
+		}
+		spec := map[string]interface{}{
+			"name":        tool["name"],
+			"inputSchema": map[string]interface{}{"json": tool["input_schema"]},
+		}
+		if description, ok := tool["description"].(string); ok && len(description) > 0 {
+			spec["description"] = description
+		}
+		specs = append(specs, map[string]interface{}{"toolSpec": spec})
+	}
+	config := map[string]interface{}{"tools": specs}
+
+	choice, _ := body["tool_choice"].(map[string]interface{})
+	switch choice["type"] {
+	case "any":
+		if !this.capabilities.ToolChoice {
+			return nil, this.unsupported("the any tool choice")
+		}
+		config["toolChoice"] = map[string]interface{}{"any": map[string]interface{}{}}
+	case "tool":
+		if !this.capabilities.ToolChoice {
+			return nil, this.unsupported("the tool tool choice")
+		}
+		config["toolChoice"] = map[string]interface{}{"tool": map[string]interface{}{"name": choice["name"]}}
+	case "auto":
+		if this.capabilities.ToolChoice {
+			config["toolChoice"] = map[string]interface{}{"auto": map[string]interface{}{}}
+		}
+	}
+	// "none" has no Converse counterpart, the tools stay declared since earlier turns may use them
+	return config, nil
+}
+
+// translateConverseRequest translates a decoded Messages request body into the body of a Converse call.
+// Features the model does not support are invalid request errors.
+func translateConverseRequest(model string, capabilities *ConverseCapabilities, body map[string]interface{}) (map[string]interface{}, error) {
+	request := &converseRequest{model: model, capabilities: capabilities}
+	converse := make(map[string]interface{})
+
+	if system := strings.TrimSpace(textOf(body["system"])); len(system) > 0 {
+		if !capabilities.System {
+			return nil, request.unsupported("system prompts")
+		}
+		converse["system"] = []interface{}{map[string]interface{}{"text": system}}
+	}
+	if thinking, ok := body["thinking"].(map[string]interface{}); ok && thinking["type"] == "enabled" && !capabilities.Reasoning {
+		return nil, request.unsupported("extended thinking")
+	}
+
+	messages := make([]interface{}, 0)
+	for _, item := range toSlice(body["messages"]) {
+		message, _ := item.(map[string]interface{})
+		content, err := request.content(message["content"])
+		if err != nil {
+			return nil, err
+		}
+		// Converse rejects empty messages, e.g. an assistant turn that only held thinking
+		if len(content) == 0 {
+			continue
+		}
+		messages = append(messages, map[string]interface{}{"role": message["role"], "content": content})
+	}
+	converse["messages"] = messages
+
+	// top_k and metadata have no Converse counterpart
+	inference := make(map[string]interface{})
+	for from, to := range map[string]string{
+		"max_tokens":     "maxTokens",
+		"temperature":    "temperature",
+		"top_p":          "topP",
+		"stop_sequences": "stopSequences",
+	} {
+		if value, ok := body[from]; ok && value != nil {
+			inference[to] = value
+		}
+	}
+	if len(inference) > 0 {
+		converse["inferenceConfig"] = inference
+	}
+
+	toolConfig, err := request.toolConfig(body)
+	if err != nil {
+		return nil, err
+	}
+	if toolConfig != nil {
+		converse["toolConfig"] = toolConfig
+	}
+	return converse, nil
+}
+
+// converseStopReason maps a Converse stop reason to the Anthropic one
+func converseStopReason(reason string) string {
+	switch reason {
+	case "end_turn", "tool_use", "max_tokens", "stop_sequence":
+		return reason
+	case "guardrail_intervened", "content_filtered":
+		return "refusal"
+	}
+	return "end_turn"
+}
+
+// converseUsage maps a Converse usage object to an Anthropic one
+func converseUsage(usage map[string]interface{}) map[string]interface{} {
+	anthropic := map[string]interface{}{"input_tokens": 0, "output_tokens": 0}
+	for from, to := range map[string]string{
+		"inputTokens":           "input_tokens",
+		"outputTokens":          "output_tokens",
+		"cacheReadInputTokens":  "cache_read_input_tokens",
+		"cacheWriteInputTokens": "cache_creation_input_tokens",
+	} {
+		if value, ok := usage[from]; ok {
+			anthropic[to] = value
+		}
+	}
+	return anthropic
+}
+
+func newMessageID() string {
+	return "msg_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// translateConverseResponse translates the body of a Converse response into an Anthropic message
+func translateConverseResponse(model string, response map[string]interface{}) map[string]interface{} {
+	output, _ := response["output"].(map[string]interface{})
+	message, _ := output["message"].(map[string]interface{})
+	content := make([]interface{}, 0)
+	for _, item := range toSlice(message["content"]) {
+		block, _ := item.(map[string]interface{})
+		if text, ok := block["text"].(string); ok {
+			content = append(content, map[string]interface{}{"type": "text", "text": text})
+		}
+		if toolUse, ok := block["toolUse"].(map[string]interface{}); ok {
+			content = append(content, map[string]interface{}{
+				"type":  "tool_use",
+				"id":    toolUse["toolUseId"],
+				"name":  toolUse["name"],
+				"input": toolUse["input"],
+			})
+		}
+		if reasoning, ok := block["reasoningContent"].(map[string]interface{}); ok {
+			if text, ok := reasoning["reasoningText"].(map[string]interface{}); ok {
+				signature, _ := text["signature"].(string)
+				content = append(content, map[string]interface{}{"type": "thinking", "thinking": text["text"], "signature": signature})
+			}
+			if redacted, ok := reasoning["redactedContent"]; ok {
+				content = append(content, map[string]interface{}{"type": "redacted_thinking", "data": redacted})
+			}
+		}
+	}
+	stopReason, _ := response["stopReason"].(string)
+	usage, _ := response["usage"].(map[string]interface{})
+	return map[string]interface{}{
+		"id":            newMessageID(),
+		"type":          "message",
+		"role":          "assistant",
+		"model":         model,
+		"content":       content,
+		"stop_reason":   converseStopReason(stopReason),
+		"stop_sequence": nil,
+		"usage":         converseUsage(usage),
+	}
+}
+
+// converseStreamBlock is a content block of a translated stream
+type converseStreamBlock struct {
+	index int
+	kind  string
+	open  bool
+}
+
+// converseStreamTranslator translates the events of a ConverseStream call into Anthropic stream events.
+// Converse starts text and reasoning blocks with their first delta, they are started lazily.
+type converseStreamTranslator struct {
+	model      string
+	emit       StreamEventObserver
+	blocks     map[int]*converseStreamBlock
+	order      []*converseStreamBlock
+	started    bool
+	finished   bool
+	stopReason string
+}
+
+func newConverseStreamTranslator(model string, emit StreamEventObserver) *converseStreamTranslator {
+	return &converseStreamTranslator{model: model, emit: emit, blocks: make(map[int]*converseStreamBlock)}
+}
+
+func (this *converseStreamTranslator) write(eventType string, payload map[string]interface{}) {
+	payload["type"] = eventType
+	data, err := json.Marshal(payload)
+	if err != nil {
+		Log.Error(err)
+		return
+	}
+	this.emit(eventType, data)
+}
+
+func (this *converseStreamTranslator) start() {
+	if this.started {
+		return
+	}
+	this.started = true
+	this.write("message_start", map[string]interface{}{"message": map[string]interface{}{
+		"id":            newMessageID(),
+		"type":          "message",
+		"role":          "assistant",
+		"model":         this.model,
+		"content":       []interface{}{},
+		"stop_reason":   nil,
+		"stop_sequence": nil,
+		"usage":         map[string]interface{}{"input_tokens": 0, "output_tokens": 0},
+	}})
+}
+
+// block returns the block of a Converse index, starting it as contentBlock when it is new
+func (this *converseStreamTranslator) block(index int, kind string, contentBlock map[string]interface{}) *converseStreamBlock {
+	if block, ok := this.blocks[index]; ok {
+		return block
+	}
+	this.start()
+	block := &converseStreamBlock{index: len(this.order), kind: kind, open: true}
+	this.blocks[index] = block
+	this.order = append(this.order, block)
+	this.write("content_block_start", map[string]interface{}{"index": block.index, "content_block": contentBlock})
+	return block
+}
+
+func (this *converseStreamTranslator) stop(block *converseStreamBlock) {
+	if block.open {
+		block.open = false
+		this.write("content_block_stop", map[string]interface{}{"index": block.index})
+	}
+}
+
+func (this *converseStreamTranslator) delta(block *converseStreamBlock, delta map[string]interface{}) {
+	this.write("content_block_delta", map[string]interface{}{"index": block.index, "delta": delta})
+}
+
+// Add translates one Converse stream event
+func (this *converseStreamTranslator) Add(eventType string, payload []byte) {
+	event := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &event); err != nil {
+		Log.Error(err)
+		return
+	}
+	index := 0
+	if value, ok := jsonInt(event["contentBlockIndex"]); ok {
+		index = int(value)
+	}
+
+	switch eventType {
+	case "messageStart":
+		this.start()
+	case "contentBlockStart":
+		start, _ := event["start"].(map[string]interface{})
+		if toolUse, ok := start["toolUse"].(map[string]interface{}); ok {
+			this.block(index, "tool_use", map[string]interface{}{
+				"type": "tool_use", "id": toolUse["toolUseId"], "name": toolUse["name"], "input": map[string]interface{}{},
+			})
+		}
+	case "contentBlockDelta":
+		delta, _ := event["delta"].(map[string]interface{})
+		if text, ok := delta["text"].(string); ok {
+			block := this.block(index, "text", map[string]interface{}{"type": "text", "text": ""})
+			this.delta(block, map[string]interface{}{"type": "text_delta", "text": text})
+		}
+		if toolUse, ok := delta["toolUse"].(map[string]interface{}); ok {
+			block := this.block(index, "tool_use", map[string]interface{}{"type": "tool_use", "id": "", "name": "", "input": map[string]interface{}{}})
+			input, _ := toolUse["input"].(string)
+			this.delta(block, map[string]interface{}{"type": "input_json_delta", "partial_json": input})
+		}
+		if reasoning, ok := delta["reasoningContent"].(map[string]interface{}); ok {
+			block := this.block(index, "thinking", map[string]interface{}{"type": "thinking", "thinking": "", "signature": ""})
+			if text, ok := reasoning["text"].(string); ok {
+				this.delta(block, map[string]interface{}{"type": "thinking_delta", "thinking": text})
+			}
+			if signature, ok := reasoning["signature"].(string); ok {
+				this.delta(block, map[string]interface{}{"type": "signature_delta", "signature": signature})
+			}
+		}
+	case "contentBlockStop":
+		if block, ok := this.blocks[index]; ok {
+			this.stop(block)
+		}
+	case "messageStop":
+		reason, _ := event["stopReason"].(string)
+		this.stopReason = converseStopReason(reason)
+	case "metadata":
+		usage, _ := event["usage"].(map[string]interface{})
+		this.finish(converseUsage(usage))
+	}
+}
+
+func (this *converseStreamTranslator) finish(usage map[string]interface{}) {
+	if this.finished {
+		return
+	}
+	this.start()
+	this.finished = true
+	for _, block := range this.order {
+		this.stop(block)
+	}
+	if len(this.stopReason) == 0 {
+		this.stopReason = "end_turn"
+	}
+	delta := map[string]interface{}{
+		"delta": map[string]interface{}{"stop_reason": this.stopReason, "stop_sequence": nil},
+	}
+	if usage != nil {
+		delta["usage"] = usage
+	}
+	this.write("message_delta", delta)
+	this.write("message_stop", map[string]interface{}{})
+}
+
+// Finish ends a stream that stopped before its metadata event
+func (this *converseStreamTranslator) Finish() {
+	if this.started && !this.finished {
+		this.finish(nil)
+	}
+}
+
+func (this *ConverseProvider) HandleMessages(w http.ResponseWriter, r *http.Request) {
+	usage := NewRequestUsage()
+	state := GetRequestState(r)
+	if state != nil {
+		state.Usage = usage
+		state.Provider = ProviderConverse
+	}
+	recorder := &usageResponseWriter{ResponseWriter: w}
+	w = recorder
+	defer this.bedrock.reportUsage(r, usage, recorder)
+
+	body := this.bedrock.decodeMessages(w, r)
+	if body == nil {
+		return
+	}
+	requested, _ := body["model"].(string)
+	model, ok := this.config.Models[requested]
+	if !ok {
+		model = requested
+	}
+	if state != nil {
+		state.Model = model
+	}
+	capabilities := this.Capabilities(model)
+	converse, err := translateConverseRequest(model, capabilities, body)
+	if err != nil {
+		writeProxyError(w, err)
+		return
+	}
+
+	stream, _ := body["stream"].(bool)
+	// the stream is replayed from a complete message when the model cannot stream it
+	streamUpstream := stream && capabilities.Streaming && (capabilities.StreamingTools || converse["toolConfig"] == nil)
+	operation := "converse"
+	if streamUpstream {
+		operation = "converse-stream"
+	}
+	payload, err := json.Marshal(converse)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "api_error", err.Error())
+		return
+	}
+	request, err := this.bedrock.signRuntime(this.bedrock.primaryTarget(), fmt.Sprintf("/model/%s/%s", url.QueryEscape(model), operation),
+		"application/json", bytes.NewReader(payload), payload)
+	if err != nil {
+		Log.Error(err)
+		writeAPIError(w, http.StatusBadGateway, "api_error", err.Error())
+		return
+	}
+	resp, err := http.DefaultClient.Do(request.WithContext(r.Context()))
+	if err != nil {
+		Log.Error(err)
+		writeAPIError(w, http.StatusBadGateway, "api_error", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	usage.MarkFirstByte()
+
+	copyStateHeaders(w, r)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, usageCaptureLimit))
+		writeBedrockError(w, resp.StatusCode, resp.Header, body)
+		return
+	}
+	if streamUpstream {
+		if err := this.relayStream(w, resp.Body, model, usage); err != nil {
+			Log.Error(err)
+		}
+		return
+	}
+
+	response := make(map[string]interface{})
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		Log.Error(err)
+		writeAPIError(w, http.StatusBadGateway, "api_error", err.Error())
+		return
+	}
+	message := translateConverseResponse(model, response)
+	usage.MergeAnthropicUsage(message["usage"].(map[string]interface{}))
+	if stream {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		if err := WriteMessageAsSSE(w, message); err != nil {
+			Log.Error(err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(message); err != nil {
+		Log.Error(err)
+	}
+}
+
+// relayStream translates a ConverseStream event stream into a Messages SSE stream
+func (this *ConverseProvider) relayStream(w http.ResponseWriter, body io.Reader, model string, usage *RequestUsage) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming unsupported")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	pinger := newSSEPinger(w, flusher, time.Duration(this.bedrock.config.PingIntervalSeconds)*time.Second)
+	defer pinger.Stop()
+	emit := func(eventType string, data []byte) {
+		usage.ObserveStreamEvent(eventType, data)
+		pinger.WriteEvent(formatSSEEvent(eventType, data))
+	}
+	translator := newConverseStreamTranslator(model, emit)
+
+	decoder := eventstream.NewDecoder()
+	buf := make([]byte, 256*1024)
+	for {
+		msg, err := decoder.Decode(body, buf)
+		if err == io.EOF {
+			translator.Finish()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if messageType := eventHeader(msg, ":message-type"); messageType == "exception" || messageType == "error" {
+			emit("error", bedrockExceptionEvent(eventHeader(msg, ":exception-type"), msg.Payload))
+			return nil
+		}
+		translator.Add(eventHeader(msg, ":event-type"), msg.Payload)
+	}
+}
@@ -0,0 +1,237 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws/protocol/eventstream"
+)
+
+func decodeTestBody(t *testing.T, raw string) map[string]interface{} {
+	body := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(raw), &body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestTranslateConverseRequest(t *testing.T) {
+	provider := NewConverseProvider(&ConverseConfig{}, nil)
+	model := "us.amazon.nova-pro-v1:0"
+	body := decodeTestBody(t, `{
+		"model": "nova-pro", "max_tokens": 512, "temperature": 0.5, "stop_sequences": ["END"],
+		"system": [{"type": "text", "text": "be brief"}],
+		"tools": [{"name": "get_weather", "description": "weather", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "tool", "name": "get_weather"},
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "text", "text": "weather?"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "aGk="}},
+				{"type": "document", "title": "notes.txt", "source": {"type": "text", "media_type": "text/plain", "data": "hi"}}
+			]},
+			{"role": "assistant", "content": [
+				{"type": "thinking", "thinking": "hmm", "signature": "sig"},
+				{"type": "tool_use", "id": "tool_1", "name": "get_weather", "input": {"city": "Taipei"}}
+			]},
+			{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "tool_1", "content": "sunny", "is_error": true}]}
+		]}`)
+
+	converse, err := translateConverseRequest(model, provider.Capabilities(model), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := decodeTestBody(t, `{
+		"system": [{"text": "be brief"}],
+		"inferenceConfig": {"maxTokens": 512, "temperature": 0.5, "stopSequences": ["END"]},
+		"toolConfig": {
+			"tools": [{"toolSpec": {"name": "get_weather", "description": "weather", "inputSchema": {"json": {"type": "object"}}}}],
+			"toolChoice": {"tool": {"name": "get_weather"}}
+		},
+		"messages": [
+			{"role": "user", "content": [
+				{"text": "weather?"},
+				{"image": {"format": "png", "source": {"bytes": "aGk="}}},
+				{"document": {"format": "txt", "name": "notes txt-1", "source": {"bytes": "aGk="}}}
+			]},
+			{"role": "assistant", "content": [{"toolUse": {"toolUseId": "tool_1", "name": "get_weather", "input": {"city": "Taipei"}}}]},
+			{"role": "user", "content": [{"toolResult": {"toolUseId": "tool_1", "content": [{"text": "sunny"}], "status": "error"}}]}
+		]}`)
+	got, _ := json.Marshal(converse)
+	want, _ := json.Marshal(expected)
+	if !bytes.Equal(got, want) {
+		t.Errorf("unexpected translation\n got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestTranslateConverseRequest_Capabilities(t *testing.T) {
+	provider := NewConverseProvider(&ConverseConfig{
+		Capabilities: map[string]*ConverseCapabilities{"mistral.mistral-7b": {System: true, Streaming: true}},
+	}, nil)
+	cases := []struct {
+		model string
+		body  string
+		err   string
+	}{
+		{"mistral.mixtral-8x7b-instruct-v0:1", `{"system": "be brief", "messages": []}`, "system prompts"},
+		{"mistral.mistral-7b-instruct-v0:2", `{"system": "be brief", "messages": []}`, ""},
+		{"meta.llama3-8b-instruct-v1:0", `{"tools": [{"name": "a", "input_schema": {}}], "messages": []}`, "tools"},
+		{"meta.llama3-1-70b-instruct-v1:0", `{"tools": [{"name": "a", "input_schema": {}}], "tool_choice": {"type": "any"}, "messages": []}`, "any tool choice"},
+		{"amazon.nova-micro-v1:0", `{"messages": [{"role": "user", "content": [{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": ""}}]}]}`, "images"},
+		{"amazon.nova-lite-v1:0", `{"thinking": {"type": "enabled", "budget_tokens": 1024}, "messages": []}`, "extended thinking"},
+		{"us.deepseek.r1-v1:0", `{"thinking": {"type": "enabled", "budget_tokens": 1024}, "messages": []}`, ""},
+		{"amazon.nova-pro-v1:0", `{"tools": [{"type": "web_search_20250305", "name": "web_search"}], "messages": []}`, "web_search_20250305"},
+	}
+	for _, c := range cases {
+		_, err := translateConverseRequest(c.model, provider.Capabilities(c.model), decodeTestBody(t, c.body))
+		if len(c.err) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", c.model, err)
+			}
+			continue
+		}
+		proxyError, ok := err.(*ProxyError)
+		if !ok || proxyError.StatusCode != http.StatusBadRequest || !strings.Contains(proxyError.Message, c.err) {
+			t.Errorf("%s: expected an invalid request error about %s, got %v", c.model, c.err, err)
+		}
+	}
+}
+
+func TestTranslateConverseResponse(t *testing.T) {
+	message := translateConverseResponse("amazon.nova-pro-v1:0", decodeTestBody(t, `{
+		"output": {"message": {"role": "assistant", "content": [
+			{"reasoningContent": {"reasoningText": {"text": "think", "signature": "sig"}}},
+			{"text": "let me check"},
+			{"toolUse": {"toolUseId": "tool_1", "name": "get_weather", "input": {"city": "Taipei"}}}
+		]}},
+		"stopReason": "tool_use",
+		"usage": {"inputTokens": 12, "outputTokens": 34, "totalTokens": 46}
+	}`))
+	content := message["content"].([]interface{})
+	if len(content) != 3 || content[0].(map[string]interface{})["type"] != "thinking" ||
+		content[1].(map[string]interface{})["text"] != "let me check" || content[2].(map[string]interface{})["id"] != "tool_1" {
+		t.Errorf("unexpected content %v", content)
+	}
+	usage := message["usage"].(map[string]interface{})
+	if message["stop_reason"] != "tool_use" || usage["input_tokens"] != float64(12) || usage["output_tokens"] != float64(34) {
+		t.Errorf("unexpected message %v", message)
+	}
+	if converseStopReason("guardrail_intervened") != "refusal" {
+		t.Errorf("guardrail interventions should be refusals")
+	}
+}
+
+// writeConverseEvent writes one ConverseStream event
+func writeConverseEvent(t *testing.T, w http.ResponseWriter, eventType string, payload string) {
+	msg := eventstream.Message{Payload: []byte(payload)}
+	msg.Headers.Set(":event-type", eventstream.StringValue(eventType))
+	msg.Headers.Set(":content-type", eventstream.StringValue("application/json"))
+	msg.Headers.Set(":message-type", eventstream.StringValue("event"))
+	if err := eventstream.NewEncoder().Encode(w, msg); err != nil {
+		t.Error(err)
+	}
+}
+
+func newConverseTestRequest(body string) *http.Request {
+	request := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	return request.WithContext(WithRequestState(request.Context(), NewRequestState()))
+}
+
+func TestConverseProvider_HandleMessages(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/converse-stream"):
+			w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+			writeConverseEvent(t, w, "messageStart", `{"role":"assistant"}`)
+			writeConverseEvent(t, w, "contentBlockDelta", `{"contentBlockIndex":0,"delta":{"text":"Hel"}}`)
+			writeConverseEvent(t, w, "contentBlockDelta", `{"contentBlockIndex":0,"delta":{"text":"lo"}}`)
+			writeConverseEvent(t, w, "contentBlockStop", `{"contentBlockIndex":0}`)
+			writeConverseEvent(t, w, "contentBlockStart", `{"contentBlockIndex":1,"start":{"toolUse":{"toolUseId":"tool_1","name":"get_weather"}}}`)
+			writeConverseEvent(t, w, "contentBlockDelta", `{"contentBlockIndex":1,"delta":{"toolUse":{"input":"{\"city\":"}}}`)
+			writeConverseEvent(t, w, "contentBlockDelta", `{"contentBlockIndex":1,"delta":{"toolUse":{"input":"\"Taipei\"}"}}}`)
+			writeConverseEvent(t, w, "contentBlockStop", `{"contentBlockIndex":1}`)
+			writeConverseEvent(t, w, "messageStop", `{"stopReason":"tool_use"}`)
+			writeConverseEvent(t, w, "metadata", `{"usage":{"inputTokens":10,"outputTokens":5},"metrics":{"latencyMs":100}}`)
+		case strings.Contains(r.URL.Path, "unknown"):
+			w.Header().Set("X-Amzn-ErrorType", "ValidationException:http://internal.amazon.com/coral/com.amazon.bedrock/")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message":"The provided model identifier is invalid."}`))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"output":{"message":{"role":"assistant","content":[{"text":"Hello"}]}},"stopReason":"end_turn","usage":{"inputTokens":10,"outputTokens":5}}`))
+		}
+	}))
+	defer server.Close()
+
+	provider := NewConverseProvider(&ConverseConfig{Models: map[string]string{
+		"nova-pro": "amazon.nova-pro-v1:0",
+		"llama":    "meta.llama3-1-70b-instruct-v1:0",
+		"unknown":  "unknown.model-v1",
+	}}, newTestBedrockClient(server.URL))
+	var recorded *RequestUsage
+	provider.bedrock.AddUsageListener(func(request *http.Request, usage *RequestUsage) {
+		recorded = usage
+	})
+
+	w := httptest.NewRecorder()
+	provider.HandleMessages(w, newConverseTestRequest(`{"model":"nova-pro","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`))
+	message := decodeTestBody(t, w.Body.String())
+	if w.Code != http.StatusOK || message["model"] != "amazon.nova-pro-v1:0" || message["content"].([]interface{})[0].(map[string]interface{})["text"] != "Hello" {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+	if paths[0] != "/model/amazon.nova-pro-v1%3A0/converse" || recorded.Provider != ProviderConverse || recorded.InputTokens != 10 || recorded.OutputTokens != 5 {
+		t.Errorf("unexpected call %s or usage %+v", paths[0], recorded)
+	}
+
+	tools := `,"tools":[{"name":"get_weather","input_schema":{"type":"object"}}]`
+	w = httptest.NewRecorder()
+	provider.HandleMessages(w, newConverseTestRequest(`{"model":"nova-pro","stream":true,"max_tokens":100,"messages":[{"role":"user","content":"hi"}]`+tools+`}`))
+	types, payloads := readSSE(t, w.Body.String())
+	expected := []string{"message_start", "content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop", "message_delta", "message_stop"}
+	if strings.Join(types, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected events %v", types)
+	}
+	assembler := NewMessageAssembler()
+	for i := range types {
+		if err := assembler.AddEvent(types[i], payloads[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assembled := assembler.Message()
+	content := assembled["content"].([]interface{})
+	input, _ := content[1].(map[string]interface{})["input"].(map[string]interface{})
+	if content[0].(map[string]interface{})["text"] != "Hello" || input["city"] != "Taipei" || assembled["stop_reason"] != "tool_use" {
+		t.Errorf("unexpected assembled message %v", assembled)
+	}
+	if recorded.InputTokens != 10 || recorded.OutputTokens != 5 {
+		t.Errorf("unexpected stream usage %+v", recorded)
+	}
+
+	// llama cannot stream tool use, the stream is replayed from a complete message
+	w = httptest.NewRecorder()
+	provider.HandleMessages(w, newConverseTestRequest(`{"model":"llama","stream":true,"max_tokens":100,"messages":[{"role":"user","content":"hi"}]`+tools+`}`))
+	types, _ = readSSE(t, w.Body.String())
+	if !strings.HasSuffix(paths[len(paths)-1], "/converse") || len(types) == 0 || types[len(types)-1] != "message_stop" {
+		t.Errorf("expected a replayed stream of a converse call, got %s %v", paths[len(paths)-1], types)
+	}
+
+	w = httptest.NewRecorder()
+	provider.HandleMessages(w, newConverseTestRequest(`{"model":"unknown","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"invalid_request_error"`) || !strings.Contains(w.Body.String(), "model identifier") {
+		t.Errorf("expected the Bedrock error in the Anthropic shape, got %d %s", w.Code, w.Body.String())
+	}
+
+	calls := len(paths)
+	w = httptest.NewRecorder()
+	provider.HandleMessages(w, newConverseTestRequest(`{"model":"llama","max_tokens":100,"messages":[{"role":"user","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":""}}]}]}`))
+	if w.Code != http.StatusBadRequest || len(paths) != calls {
+		t.Errorf("unsupported features should be rejected before calling Bedrock, got %d", w.Code)
+	}
+}
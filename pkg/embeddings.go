@@ -0,0 +1,467 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// cohereMaxTexts is the most texts Cohere Embed accepts in one call
+const cohereMaxTexts = 96
+
+// EmbeddingsConfig serves the OpenAI compatible /v1/embeddings endpoint with the Bedrock embedding models
+type EmbeddingsConfig struct {
+	Enable bool `json:"enable"`
+	// Models maps the model requested by clients to a Titan Text Embeddings or Cohere Embed model id
+	Models map[string]string `json:"models"`
+	// DefaultModel serves the requests that name no model
+	DefaultModel string `json:"default_model,omitempty"`
+	// MaxInputs bounds the inputs of one request
+	MaxInputs int `json:"max_inputs,omitempty"`
+	// Concurrency bounds the parallel calls of a batch, Titan embeds one input per call
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+func LoadEmbeddingsConfigWithEnv() *EmbeddingsConfig {
+	config := &EmbeddingsConfig{
+		Enable:       os.Getenv("EMBEDDINGS_ENABLE") == "true",
+		Models:       ParseMappingsFromStr(os.Getenv("EMBEDDINGS_MODELS")),
+		DefaultModel: os.Getenv("EMBEDDINGS_DEFAULT_MODEL"),
+		MaxInputs:    256,
+		Concurrency:  8,
+	}
+	if value, ok := parsePositiveInt(os.Getenv("EMBEDDINGS_MAX_INPUTS")); ok {
+		config.MaxInputs = value
+	}
+	if value, ok := parsePositiveInt(os.Getenv("EMBEDDINGS_CONCURRENCY")); ok {
+		config.Concurrency = value
+	}
+	return config
+}
+
+// EmbeddingsRequest is an OpenAI embeddings request, Normalize and InputType extend it for Titan and Cohere
+type EmbeddingsRequest struct {
+	Model string `json:"model"`
+	// Input is a string or an array of strings
+	Input          interface{} `json:"input"`
+	Dimensions     int         `json:"dimensions,omitempty"`
+	EncodingFormat string      `json:"encoding_format,omitempty"`
+	// Normalize scales the embeddings to unit length, the default like the OpenAI embeddings
+	Normalize *bool `json:"normalize,omitempty"`
+	// InputType is the Cohere input type, "search_document" by default
+	InputType string `json:"input_type,omitempty"`
+	User      string `json:"user,omitempty"`
+}
+
+// inputs returns the texts of the request
+func (this *EmbeddingsRequest) inputs() ([]string, error) {
+	switch input := this.Input.(type) {
+	case string:
+		return []string{input}, nil
+	case []interface{}:
+		texts := make([]string, 0, len(input))
+		for _, item := range input {
+			text, ok := item.(string)
+			if !ok {
+				return nil, NewInvalidRequestError("input must be a string or an array of strings, token arrays are not supported")
+			}
+			texts = append(texts, text)
+		}
+		if len(texts) > 0 {
+			return texts, nil
+		}
+	}
+	return nil, NewInvalidRequestError("input must be a non-empty string or array of strings")
+}
+
+// embeddingFamily is the request format of a Bedrock embedding model
+type embeddingFamily struct {
+	// batch is the most inputs of one call
+	batch int
+	// dimensions are the output sizes the model can produce, empty when it has a single size
+	dimensions []int
+	// normalizes tells the model normalizes on request, the proxy normalizes the others
+	normalizes bool
+	body       func(texts []string, request *EmbeddingsRequest) map[string]interface{}
+	parse      func(body []byte) ([][]float64, int64, error)
+}
+
+var titanV2Embeddings = &embeddingFamily{
+	batch:      1,
+	dimensions: []int{256, 512, 1024},
+	normalizes: true,
+	body: func(texts []string, request *EmbeddingsRequest) map[string]interface{} {
+		body := map[string]interface{}{"inputText": texts[0], "normalize": request.Normalize == nil || *request.Normalize}
+		if request.Dimensions > 0 {
+			body["dimensions"] = request.Dimensions
+		}
+		return body
+	},
+	parse: parseTitanEmbedding,
+}
+
+var titanV1Embeddings = &embeddingFamily{
+	batch: 1,
+	body: func(texts []string, request *EmbeddingsRequest) map[string]interface{} {
+		return map[string]interface{}{"inputText": texts[0]}
+	},
+	parse: parseTitanEmbedding,
+}
+
+var cohereV3Embeddings = &embeddingFamily{
+	batch: cohereMaxTexts,
+	body:  cohereEmbeddingBody,
+	parse: parseCohereEmbeddings,
+}
+
+var cohereV4Embeddings = &embeddingFamily{
+	batch:      cohereMaxTexts,
+	dimensions: []int{256, 512, 1024, 1536},
+	body: func(texts []string, request *EmbeddingsRequest) map[string]interface{} {
+		body := cohereEmbeddingBody(texts, request)
+		body["embedding_types"] = []string{"float"}
+		if request.Dimensions > 0 {
+			body["output_dimension"] = request.Dimensions
+		}
+		return body
+	},
+	parse: parseCohereEmbeddings,
+}
+
+func cohereEmbeddingBody(texts []string, request *EmbeddingsRequest) map[string]interface{} {
+	inputType := request.InputType
+	if len(inputType) == 0 {
+		inputType = "search_document"
+	}
+	return map[string]interface{}{"texts": texts, "input_type": inputType, "truncate": "END"}
+}
+
+func parseTitanEmbedding(body []byte) ([][]float64, int64, error) {
+	var response struct {
+		Embedding  []float64 `json:"embedding"`
+		TokenCount int64     `json:"inputTextTokenCount"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, 0, err
+	}
+	return [][]float64{response.Embedding}, response.TokenCount, nil
+}
+
+// parseCohereEmbeddings reads the embeddings as a plain array, or by type when embedding types were requested.
+// Cohere reports its token count in the response headers only.
+func parseCohereEmbeddings(body []byte) ([][]float64, int64, error) {
+	var response struct {
+		Embeddings json.RawMessage `json:"embeddings"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, 0, err
+	}
+	var embeddings [][]float64
+	if err := json.Unmarshal(response.Embeddings, &embeddings); err == nil {
+		return embeddings, 0, nil
+	}
+	var typed struct {
+		Float [][]float64 `json:"float"`
+	}
+	if err := json.Unmarshal(response.Embeddings, &typed); err != nil {
+		return nil, 0, err
+	}
+	return typed.Float, 0, nil
+}
+
+// embeddingFamilyOf returns the request format of a Bedrock model id
+func embeddingFamilyOf(model string) *embeddingFamily {
+	switch {
+	case strings.Contains(model, "amazon.titan-embed-text-v2"):
+		return titanV2Embeddings
+	case strings.Contains(model, "amazon.titan-embed-text-v1"), strings.Contains(model, "amazon.titan-embed-g1-text"):
+		return titanV1Embeddings
+	case strings.Contains(model, "cohere.embed-v4"):
+		return cohereV4Embeddings
+	case strings.Contains(model, "cohere.embed-"):
+		return cohereV3Embeddings
+	}
+	return nil
+}
+
+// normalizeEmbedding scales an embedding to unit length
+func normalizeEmbedding(embedding []float64) {
+	var sum float64
+	for _, value := range embedding {
+		sum += value * value
+	}
+	if sum == 0 {
+		return
+	}
+	norm := math.Sqrt(sum)
+	for i := range embedding {
+		embedding[i] /= norm
+	}
+}
+
+// encodeEmbedding returns the embedding as floats, or as the base64 of its little endian float32 values
+func encodeEmbedding(embedding []float64, format string) interface{} {
+	if format != "base64" {
+		return embedding
+	}
+	buf := make([]byte, 4*len(embedding))
+	for i, value := range embedding {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(float32(value)))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// Embeddings serves embedding requests through the signing path of the Bedrock client
+type Embeddings struct {
+	config  *EmbeddingsConfig
+	bedrock *BedrockClient
+}
+
+func NewEmbeddings(config *EmbeddingsConfig, bedrock *BedrockClient) *Embeddings {
+	return &Embeddings{config: config, bedrock: bedrock}
+}
+
+// embeddingBatch is the result of one call
+type embeddingBatch struct {
+	embeddings [][]float64
+	tokens     int64
+	resp       *http.Response
+	body       []byte
+	err        error
+	hedge      *hedgeOutcome
+}
+
+// invoke embeds one batch of texts
+func (this *Embeddings) invoke(r *http.Request, model string, family *embeddingFamily, texts []string, request *EmbeddingsRequest) *embeddingBatch {
+	batch := &embeddingBatch{}
+	payload, err := json.Marshal(family.body(texts, request))
+	if err != nil {
+		batch.err = err
+		return batch
+	}
+	upstream, err := this.bedrock.signInvoke(this.bedrock.primaryTarget(), model, "application/json", bytes.NewReader(payload), payload, false)
+	if err != nil {
+		batch.err = err
+		return batch
+	}
+	// batches are sent like Messages requests, hedged when enabled, but their latency does not tune the hedge delay
+	var resp *http.Response
+	if this.bedrock.hedger != nil {
+		resp, batch.hedge, err = this.bedrock.doHedged(r, upstream, this.bedrock.upstreamClient(), model, payload, false, false)
+	} else {
+		resp, err = this.bedrock.upstreamClient().Do(upstream.WithContext(r.Context()))
+	}
+	if err != nil {
+		batch.err = err
+		return batch
+	}
+	defer resp.Body.Close()
+	batch.resp = resp
+	if batch.body, batch.err = io.ReadAll(resp.Body); batch.err != nil || resp.StatusCode != http.StatusOK {
+		return batch
+	}
+	if batch.embeddings, batch.tokens, batch.err = family.parse(batch.body); batch.err != nil {
+		return batch
+	}
+	if len(batch.embeddings) != len(texts) {
+		batch.err = fmt.Errorf("%s returned %d embeddings for %d inputs", model, len(batch.embeddings), len(texts))
+	}
+	if batch.tokens == 0 {
+		batch.tokens, _ = strconv.ParseInt(resp.Header.Get("X-Amzn-Bedrock-Input-Token-Count"), 10, 64)
+	}
+	return batch
+}
+
+// resolveModel returns the Bedrock model of a requested name, the default model for an empty one
+func (this *Embeddings) resolveModel(name string) string {
+	if len(name) == 0 {
+		name = this.config.DefaultModel
+	}
+	if mapped, ok := this.config.Models[name]; ok {
+		return mapped
+	}
+	return name
+}
+
+func (this *Embeddings) HandleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	usage := NewRequestUsage()
+	state := GetRequestState(r)
+	if state != nil {
+		state.Usage = usage
+		state.Provider = ProviderBedrock
+	}
+	recorder := &usageResponseWriter{ResponseWriter: w}
+	w = recorder
+	defer this.bedrock.reportUsage(r, usage, recorder)
+
+	request := &EmbeddingsRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		if !writeProxyError(w, err) {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		}
+		return
+	}
+	texts, err := request.inputs()
+	if err == nil && len(texts) > this.config.MaxInputs {
+		err = NewInvalidRequestError("at most %d inputs are allowed in one request, got %d", this.config.MaxInputs, len(texts))
+	}
+	if err != nil {
+		writeProxyError(w, err)
+		return
+	}
+	if len(request.Model) == 0 {
+		request.Model = this.config.DefaultModel
+	}
+	model := this.resolveModel(request.Model)
+	if embeddingFamilyOf(model) == nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("%q is not an embedding model", request.Model))
+		return
+	}
+	if this.bedrock.breakers != nil {
+		routed, probe, err := this.bedrock.breakers.Route(model)
+		if err != nil {
+			usage.Local = true
+			writeProxyError(w, err)
+			return
+		}
+		if state != nil {
+			state.BreakerModel = routed
+			state.BreakerProbe = probe
+		}
+		if routed != model {
+			Log.Warningf("circuit breaker of %s is open, routing to %s", model, routed)
+			SetResponseHeader(r, FallbackModelHeader, routed)
+			model = routed
+		}
+	}
+	if state != nil {
+		state.Model = model
+	}
+	// the fallback of an open breaker is validated like the requested model
+	family := embeddingFamilyOf(model)
+	if family == nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("%q is not an embedding model", model))
+		return
+	}
+	if request.Dimensions > 0 {
+		supported := false
+		for _, dimensions := range family.dimensions {
+			supported = supported || dimensions == request.Dimensions
+		}
+		if !supported {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error",
+				fmt.Sprintf("%s does not support %d dimensions, supported: %v", model, request.Dimensions, family.dimensions))
+			return
+		}
+	}
+
+	// the goroutines write their own slot, the slice must not grow once they started
+	batches := make([]*embeddingBatch, (len(texts)+family.batch-1)/family.batch)
+	// the first failed batch cancels the others, its error is the response
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	batchRequest := r.WithContext(ctx)
+	failed := -1
+	var failOnce sync.Once
+	var wait sync.WaitGroup
+	slots := make(chan struct{}, this.config.Concurrency)
+	for index := range batches {
+		start := index * family.batch
+		end := start + family.batch
+		if end > len(texts) {
+			end = len(texts)
+		}
+		wait.Add(1)
+		go func(index int, texts []string) {
+			defer wait.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			batch := &embeddingBatch{err: ctx.Err()}
+			if batch.err == nil {
+				batch = this.invoke(batchRequest, model, family, texts, request)
+			}
+			batches[index] = batch
+			if batch.err != nil || batch.resp.StatusCode != http.StatusOK {
+				failOnce.Do(func() {
+					failed = index
+					cancel()
+				})
+			}
+		}(index, texts[start:end])
+	}
+	wait.Wait()
+	usage.MarkFirstByte()
+	for _, batch := range batches {
+		recordHedge(r, batch.hedge)
+	}
+
+	// the batches that succeeded were billed by Bedrock even when the request fails
+	for _, batch := range batches {
+		usage.InputTokens += batch.tokens
+	}
+
+	copyStateHeaders(w, r)
+	if failed >= 0 {
+		batch := batches[failed]
+		if batch.err != nil {
+			Log.Error(batch.err)
+			writeAPIError(w, http.StatusBadGateway, "api_error", batch.err.Error())
+		} else {
+			writeBedrockError(w, batch.resp.StatusCode, batch.resp.Header, batch.body)
+		}
+		return
+	}
+	data := make([]interface{}, 0, len(texts))
+	for _, batch := range batches {
+		for _, embedding := range batch.embeddings {
+			if (request.Normalize == nil || *request.Normalize) && !family.normalizes {
+				normalizeEmbedding(embedding)
+			}
+			data = append(data, map[string]interface{}{
+				"object":    "embedding",
+				"index":     len(data),
+				"embedding": encodeEmbedding(embedding, request.EncodingFormat),
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "list",
+		"data":   data,
+		"model":  request.Model,
+		"usage": map[string]interface{}{
+			"prompt_tokens": usage.InputTokens,
+			"total_tokens":  usage.InputTokens,
+		},
+	}); err != nil {
+		Log.Error(err)
+	}
+}
+
+// HandleEmbeddings serves the OpenAI compatible embeddings endpoint
+func (this *HTTPService) HandleEmbeddings(writer http.ResponseWriter, request *http.Request) {
+	request = request.WithContext(WithRequestState(request.Context(), NewRequestState()))
+	// requests for other models are refused by the handler without waiting
+	if name, err := requestModel(request); err == nil {
+		if model := this.Embeddings.resolveModel(name); embeddingFamilyOf(model) != nil {
+			var release func()
+			var ok bool
+			if request, release, ok = this.queueRequest(writer, request, model); !ok {
+				return
+			}
+			defer release()
+		}
+	}
+	this.Embeddings.HandleEmbeddings(writer, request)
+}
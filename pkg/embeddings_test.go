@@ -0,0 +1,299 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newEmbeddingsTestRequest(body string) *http.Request {
+	request := httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	return request.WithContext(WithRequestState(request.Context(), NewRequestState()))
+}
+
+func TestEmbeddings_HandleEmbeddings(t *testing.T) {
+	var mu sync.Mutex
+	calls := make(map[string][]map[string]interface{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make(map[string]interface{})
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		calls[r.URL.EscapedPath()] = append(calls[r.URL.EscapedPath()], body)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "titan") {
+			fmt.Fprintf(w, `{"embedding":[%d,0],"inputTextTokenCount":3}`, len(body["inputText"].(string)))
+			return
+		}
+		texts := body["texts"].([]interface{})
+		embeddings := make([][]float64, len(texts))
+		for i := range texts {
+			embeddings[i] = []float64{3, 4}
+		}
+		data, _ := json.Marshal(map[string]interface{}{"embeddings": embeddings})
+		w.Header().Set("X-Amzn-Bedrock-Input-Token-Count", fmt.Sprint(len(texts)))
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	var recorded *RequestUsage
+	client.AddUsageListener(func(request *http.Request, usage *RequestUsage) {
+		recorded = usage
+	})
+	embeddings := NewEmbeddings(&EmbeddingsConfig{
+		Models: map[string]string{
+			"titan":  "amazon.titan-embed-text-v2:0",
+			"cohere": "cohere.embed-english-v3",
+		},
+		DefaultModel: "titan",
+		MaxInputs:    200,
+		Concurrency:  2,
+	}, client)
+
+	w := httptest.NewRecorder()
+	embeddings.HandleEmbeddings(w, newEmbeddingsTestRequest(`{"input":["a","bb","ccc"],"dimensions":256}`))
+	var response struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Model string `json:"model"`
+		Usage struct {
+			PromptTokens int `json:"prompt_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+	if response.Model != "titan" || len(response.Data) != 3 || response.Usage.PromptTokens != 9 {
+		t.Fatalf("unexpected response %s", w.Body.String())
+	}
+	for i, item := range response.Data {
+		if item.Index != i || item.Embedding[0] != float64(i+1) {
+			t.Errorf("embeddings out of order: %s", w.Body.String())
+		}
+	}
+	titanCalls := calls["/model/amazon.titan-embed-text-v2%3A0/invoke"]
+	if len(titanCalls) != 3 || titanCalls[0]["dimensions"] != float64(256) || titanCalls[0]["normalize"] != true {
+		t.Errorf("unexpected titan calls %v", titanCalls)
+	}
+	if recorded.Model != "amazon.titan-embed-text-v2:0" || recorded.InputTokens != 9 || recorded.StatusCode != http.StatusOK {
+		t.Errorf("unexpected usage %+v", recorded)
+	}
+
+	// cohere takes 96 texts per call and is normalized by the proxy
+	inputs := make([]string, 100)
+	for i := range inputs {
+		inputs[i] = "text"
+	}
+	input, _ := json.Marshal(inputs)
+	w = httptest.NewRecorder()
+	embeddings.HandleEmbeddings(w, newEmbeddingsTestRequest(`{"model":"cohere","encoding_format":"base64","input":`+string(input)+`}`))
+	var encoded struct {
+		Data []struct {
+			Embedding string `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &encoded); err != nil || len(encoded.Data) != 100 {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+	raw, _ := base64.StdEncoding.DecodeString(encoded.Data[99].Embedding)
+	if len(raw) != 8 || math.Float32frombits(binary.LittleEndian.Uint32(raw)) != 0.6 || math.Float32frombits(binary.LittleEndian.Uint32(raw[4:])) != 0.8 {
+		t.Errorf("expected a normalized base64 embedding, got %v", raw)
+	}
+	cohereCalls := calls["/model/cohere.embed-english-v3/invoke"]
+	if len(cohereCalls) != 2 || cohereCalls[0]["input_type"] != "search_document" || recorded.InputTokens != 100 {
+		t.Errorf("expected two batches, got %d calls and usage %+v", len(cohereCalls), recorded)
+	}
+
+	for body, message := range map[string]string{
+		`{"model":"cohere","input":"a","dimensions":256}`: "does not support 256 dimensions",
+		`{"model":"claude","input":"a"}`:                  "not an embedding model",
+		`{"input":[1,2,3]}`:                               "token arrays",
+		`{"input":[]}`:                                    "non-empty",
+	} {
+		w = httptest.NewRecorder()
+		embeddings.HandleEmbeddings(w, newEmbeddingsTestRequest(body))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), message) {
+			t.Errorf("%s: expected an invalid request error about %q, got %d %s", body, message, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRequestAPIKey(t *testing.T) {
+	request := httptest.NewRequest("POST", "/v1/embeddings", nil)
+	request.Header.Set("Authorization", "Bearer sk-openai")
+	if key := requestAPIKey(request); key != "sk-openai" {
+		t.Errorf("expected the bearer token, got %q", key)
+	}
+	request.Header.Set("x-api-key", "sk-anthropic")
+	if key := requestAPIKey(request); key != "sk-anthropic" {
+		t.Errorf("expected x-api-key to win, got %q", key)
+	}
+}
+
+func TestEmbeddings_ConcurrentBatches(t *testing.T) {
+	var failing int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"message":"internal failure"}`))
+			return
+		}
+		body := make(map[string]interface{})
+		json.NewDecoder(r.Body).Decode(&body)
+		var index int
+		fmt.Sscan(body["inputText"].(string), &index)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"embedding":[%d,0],"inputTextTokenCount":1}`, index)
+	}))
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	client.SetCircuitBreakers(NewCircuitBreakers(&CircuitBreakerConfig{FailureThreshold: 1, ProbeIntervalSeconds: 60, SuccessThreshold: 1}, "", "us-east-1"))
+	var recorded *RequestUsage
+	client.AddUsageListener(func(request *http.Request, usage *RequestUsage) {
+		recorded = usage
+	})
+	embeddings := NewEmbeddings(&EmbeddingsConfig{
+		Models:       map[string]string{"titan": "amazon.titan-embed-text-v2:0"},
+		DefaultModel: "titan",
+		MaxInputs:    200,
+		Concurrency:  8,
+	}, client)
+
+	// one call per input, run with -race to check the batches are collected safely
+	inputs := make([]string, 200)
+	for i := range inputs {
+		inputs[i] = fmt.Sprint(i + 1)
+	}
+	input, _ := json.Marshal(inputs)
+	for round := 0; round < 5; round++ {
+		w := httptest.NewRecorder()
+		embeddings.HandleEmbeddings(w, newEmbeddingsTestRequest(`{"input":`+string(input)+`,"normalize":false}`))
+		var response struct {
+			Data []struct {
+				Index     int       `json:"index"`
+				Embedding []float64 `json:"embedding"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || len(response.Data) != len(inputs) {
+			t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+		}
+		for i, item := range response.Data {
+			if item.Index != i || item.Embedding[0] != float64(i+1) {
+				t.Fatalf("embedding %d out of order: %v", i, item.Embedding)
+			}
+		}
+	}
+
+	// embeddings share the circuit breakers of the models, an open breaker fails fast
+	atomic.StoreInt32(&failing, 1)
+	embeddings.HandleEmbeddings(httptest.NewRecorder(), newEmbeddingsTestRequest(`{"input":"a"}`))
+	w := httptest.NewRecorder()
+	embeddings.HandleEmbeddings(w, newEmbeddingsTestRequest(`{"input":"a"}`))
+	if w.Code != 529 || !recorded.Local {
+		t.Errorf("expected the open breaker to answer 529, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestEmbeddings_FailedBatch(t *testing.T) {
+	var cancelled int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make(map[string]interface{})
+		json.NewDecoder(r.Body).Decode(&body)
+		switch body["inputText"] {
+		case "fail":
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message":"malformed input"}`))
+		case "slow":
+			select {
+			case <-r.Context().Done():
+				atomic.AddInt32(&cancelled, 1)
+			case <-time.After(5 * time.Second):
+			}
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"embedding":[1,0],"inputTextTokenCount":3000}`))
+		}
+	}))
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	client.SetPriceTable(NewPriceTable(LoadPricingConfigWithEnv()))
+	var recorded *RequestUsage
+	client.AddUsageListener(func(request *http.Request, usage *RequestUsage) {
+		recorded = usage
+	})
+	embeddings := NewEmbeddings(&EmbeddingsConfig{
+		Models:       map[string]string{"titan": "amazon.titan-embed-text-v2:0"},
+		DefaultModel: "titan",
+		MaxInputs:    10,
+		Concurrency:  4,
+	}, client)
+
+	w := httptest.NewRecorder()
+	embeddings.HandleEmbeddings(w, newEmbeddingsTestRequest(`{"input":["a","b","fail","slow"]}`))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected the error of the failed batch, got %d %s", w.Code, w.Body.String())
+	}
+	// the batches that succeeded before the failure are billed, the one still in flight is cancelled
+	if recorded == nil || recorded.InputTokens != 6000 || recorded.Cost != 0.00012 {
+		t.Errorf("expected the tokens and cost of the successful batches, got %+v", recorded)
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&cancelled) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&cancelled) != 1 {
+		t.Errorf("the remaining batch should be cancelled")
+	}
+}
+
+func TestEmbeddings_Hedged(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer primary.Close()
+	hedge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"embedding":[1,0],"inputTextTokenCount":1}`))
+	}))
+	defer hedge.Close()
+
+	client := newTestBedrockClient(primary.URL)
+	client.SetHedger(NewHedger(&HedgeConfig{
+		Targets:            []*BedrockTarget{{Region: "us-west-2", Endpoint: hedge.URL}},
+		Percentile:         0.95,
+		MinDelayMillis:     20,
+		DefaultDelayMillis: 20,
+		Keys:               []string{"*"},
+	}))
+	embeddings := NewEmbeddings(&EmbeddingsConfig{
+		Models:       map[string]string{"titan": "amazon.titan-embed-text-v2:0"},
+		DefaultModel: "titan",
+		MaxInputs:    10,
+		Concurrency:  2,
+	}, client)
+
+	w := httptest.NewRecorder()
+	embeddings.HandleEmbeddings(w, newEmbeddingsTestRequest(`{"input":["a","b","c"]}`))
+	if w.Code != http.StatusOK || w.Header().Get(HedgeHeader) != "us-west-2" {
+		t.Fatalf("expected the batches to be hedged, got %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+}
@@ -0,0 +1,110 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ProxyError is an error that should reach the client as an Anthropic style error body
+type ProxyError struct {
+	StatusCode int
+	Type       string
+	Message    string
+}
+
+func (this *ProxyError) Error() string {
+	return this.Message
+}
+
+func NewInvalidRequestError(format string, args ...interface{}) *ProxyError {
+	return &ProxyError{
+		StatusCode: http.StatusBadRequest,
+		Type:       "invalid_request_error",
+		Message:    fmt.Sprintf(format, args...),
+	}
+}
+
+// writeProxyError writes err to the client when it is a ProxyError or an oversized body, and reports whether it did
+func writeProxyError(writer http.ResponseWriter, err error) bool {
+	if limit, ok := IsRequestTooLarge(err); ok {
+		writeAPIError(writer, http.StatusRequestEntityTooLarge, "request_too_large", requestTooLargeMessage(limit))
+		return true
+	}
+	var proxyError *ProxyError
+	if errors.As(err, &proxyError) {
+		writeAPIError(writer, proxyError.StatusCode, proxyError.Type, proxyError.Message)
+		return true
+	}
+	return false
+}
+
+// anthropicErrorStatus returns the HTTP status code the Anthropic API uses for an error type
+func anthropicErrorStatus(errType string) int {
+	switch errType {
+	case "invalid_request_error":
+		return http.StatusBadRequest
+	case "authentication_error":
+		return http.StatusUnauthorized
+	case "permission_error":
+		return http.StatusForbidden
+	case "not_found_error":
+		return http.StatusNotFound
+	case "request_too_large":
+		return http.StatusRequestEntityTooLarge
+	case "rate_limit_error":
+		return http.StatusTooManyRequests
+	case "overloaded_error":
+		return 529
+	}
+	return http.StatusInternalServerError
+}
+
+// bedrockExceptionErrorType maps a Bedrock exception name to an Anthropic error type
+func bedrockExceptionErrorType(exceptionType string) string {
+	switch strings.ToLower(strings.TrimSuffix(exceptionType, "Exception")) {
+	case "throttling":
+		return "rate_limit_error"
+	case "serviceunavailable", "modelnotready":
+		return "overloaded_error"
+	case "validation":
+		return "invalid_request_error"
+	case "accessdenied":
+		return "permission_error"
+	case "resourcenotfound":
+		return "not_found_error"
+	}
+	return "api_error"
+}
+
+// bedrockExceptionEvent converts an exception raised in a Bedrock stream into an Anthropic "error" event
+func bedrockExceptionEvent(exceptionType string, payload []byte) []byte {
+	var exception struct {
+		Message      string `json:"message"`
+		MessageUpper string `json:"Message"`
+	}
+	_ = json.Unmarshal(payload, &exception)
+	message := exception.Message
+	if len(message) == 0 {
+		message = exception.MessageUpper
+	}
+	if len(message) == 0 {
+		message = exceptionType
+	}
+
+	event, _ := json.Marshal(&APIStandardError{Type: "error", Error: &APIError{
+		Type:    bedrockExceptionErrorType(exceptionType),
+		Message: message,
+	}})
+	return event
+}
+
+// writeBedrockError writes the error response of a failed Bedrock call in the Anthropic shape
+func writeBedrockError(writer http.ResponseWriter, status int, header http.Header, body []byte) {
+	exceptionType := strings.SplitN(header.Get("X-Amzn-ErrorType"), ":", 2)[0]
+	var exception APIStandardError
+	_ = json.Unmarshal(bedrockExceptionEvent(exceptionType, body), &exception)
+	writeAPIError(writer, status, exception.Error.Type, exception.Error.Message)
+}
@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ExperimentArmHeader names the arm of the experiment that served a request
+const ExperimentArmHeader = "X-Proxy-Experiment-Arm"
+
+const (
+	StickyByUserID = "user_id"
+	StickyByAPIKey = "api_key"
+)
+
+// ExperimentArm is one Bedrock target of a model alias and its share of the traffic
+type ExperimentArm struct {
+	// Name identifies the arm in the usage log, the model when empty
+	Name string `json:"name,omitempty"`
+	// Model is a model name of the model mappings or a Bedrock model id
+	Model  string `json:"model"`
+	Weight int    `json:"weight"`
+}
+
+// ExperimentConfig splits the requests for model aliases between weighted arms
+type ExperimentConfig struct {
+	Enable bool `json:"enable"`
+	// Experiments maps a model alias requested by clients to its arms
+	Experiments map[string][]*ExperimentArm `json:"experiments,omitempty"`
+	// StickyBy is "user_id" to assign by metadata.user_id, falling back to the API key, or "api_key"
+	StickyBy string `json:"sticky_by,omitempty"`
+}
+
+// parseExperimentArms parses arms like "claude-sonnet@90|claude-next@10", an arm without weight has weight 1
+func parseExperimentArms(raw string) []*ExperimentArm {
+	arms := make([]*ExperimentArm, 0)
+	for _, item := range filterNonEmpty(strings.Split(raw, "|")) {
+		arm := &ExperimentArm{Model: strings.TrimSpace(item), Weight: 1}
+		if index := strings.LastIndex(arm.Model, "@"); index > 0 {
+			weight, err := strconv.Atoi(arm.Model[index+1:])
+			if err != nil || weight < 0 {
+				Log.Errorf("invalid weight of experiment arm %q", item)
+				continue
+			}
+			arm.Model, arm.Weight = strings.TrimSpace(arm.Model[:index]), weight
+		}
+		arms = append(arms, arm)
+	}
+	return arms
+}
+
+func LoadExperimentConfigWithEnv() *ExperimentConfig {
+	config := &ExperimentConfig{
+		Enable:      os.Getenv("EXPERIMENT_ENABLE") == "true",
+		Experiments: map[string][]*ExperimentArm{},
+		StickyBy:    StickyByUserID,
+	}
+	for alias, raw := range ParseMappingsFromStr(os.Getenv("EXPERIMENT_ROUTES")) {
+		config.Experiments[alias] = parseExperimentArms(raw)
+	}
+	if stickyBy := os.Getenv("EXPERIMENT_STICKY_BY"); stickyBy == StickyByAPIKey {
+		config.StickyBy = stickyBy
+	}
+	return config
+}
+
+// ExperimentRouter assigns the requests for a model alias to one of its arms
+type ExperimentRouter struct {
+	config *ExperimentConfig
+}
+
+func NewExperimentRouter(config *ExperimentConfig) *ExperimentRouter {
+	return &ExperimentRouter{config: config}
+}
+
+// stickyKey returns what a request is assigned by, empty when the request is anonymous
+func (this *ExperimentRouter) stickyKey(request *http.Request, body map[string]interface{}) string {
+	if this.config.StickyBy != StickyByAPIKey {
+		if metadata, ok := body["metadata"].(map[string]interface{}); ok {
+			if userID, ok := metadata["user_id"].(string); ok && len(userID) > 0 {
+				return "user:" + userID
+			}
+		}
+	}
+	if identity := GetRequestIdentity(request); identity != nil && len(identity.APIKey) > 0 {
+		return "key:" + identity.APIKey
+	}
+	return ""
+}
+
+// Assign returns the arm serving a request for model, or nil when model is not an experiment alias.
+// The same sticky key always gets the same arm as long as the weights are unchanged.
+func (this *ExperimentRouter) Assign(request *http.Request, model string, body map[string]interface{}) *ExperimentArm {
+	arms := this.config.Experiments[model]
+	total := 0
+	for _, arm := range arms {
+		total += arm.Weight
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	var bucket int
+	if key := this.stickyKey(request, body); len(key) > 0 {
+		hash := fnv.New64a()
+		hash.Write([]byte(model + "|" + key))
+		bucket = int(hash.Sum64() % uint64(total))
+	} else {
+		bucket = rand.Intn(total)
+	}
+	for _, arm := range arms {
+		if bucket < arm.Weight {
+			return arm
+		}
+		bucket -= arm.Weight
+	}
+	return arms[len(arms)-1]
+}
+
+// ArmName is the name of the arm in the usage log
+func (this *ExperimentArm) ArmName() string {
+	if len(this.Name) > 0 {
+		return this.Name
+	}
+	return this.Model
+}
+
+// HandleAdminExperiments lists the experiments and the arms of each alias
+func (this *HTTPService) HandleAdminExperiments(writer http.ResponseWriter, request *http.Request) {
+	aliases := make([]string, 0, len(this.bedrockClient.experiments.config.Experiments))
+	for alias := range this.bedrockClient.experiments.config.Experiments {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	experiments := make([]map[string]interface{}, 0, len(aliases))
+	for _, alias := range aliases {
+		experiments = append(experiments, map[string]interface{}{
+			"alias": alias,
+			"arms":  this.bedrockClient.experiments.config.Experiments[alias],
+		})
+	}
+	this.ResponseJSON(map[string]interface{}{"sticky_by": this.bedrockClient.experiments.config.StickyBy, "experiments": experiments}, writer)
+}
@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseExperimentArms(t *testing.T) {
+	arms := parseExperimentArms("claude-sonnet@90| anthropic.claude-next-v1:0@10 |claude-haiku|bad@x")
+	if len(arms) != 3 {
+		t.Fatalf("expected 3 arms, got %d", len(arms))
+	}
+	if arms[0].Model != "claude-sonnet" || arms[0].Weight != 90 || arms[1].Model != "anthropic.claude-next-v1:0" || arms[1].Weight != 10 || arms[2].Weight != 1 {
+		t.Errorf("unexpected arms %+v %+v %+v", arms[0], arms[1], arms[2])
+	}
+}
+
+func TestExperimentRouter_Assign(t *testing.T) {
+	router := NewExperimentRouter(&ExperimentConfig{
+		Experiments: map[string][]*ExperimentArm{
+			"claude": {{Name: "control", Model: "claude-sonnet", Weight: 80}, {Name: "candidate", Model: "claude-next", Weight: 20}},
+		},
+		StickyBy: StickyByUserID,
+	})
+	request := httptest.NewRequest("POST", "/v1/messages", nil)
+	request = request.WithContext(WithRequestIdentity(request.Context(), &RequestIdentity{APIKey: "sk-shared"}))
+
+	if arm := router.Assign(request, "claude-haiku", map[string]interface{}{}); arm != nil {
+		t.Errorf("models that are not an alias should not be assigned, got %+v", arm)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 2000; i++ {
+		body := map[string]interface{}{"metadata": map[string]interface{}{"user_id": fmt.Sprintf("user-%d", i)}}
+		first := router.Assign(request, "claude", body)
+		if again := router.Assign(request, "claude", body); again != first {
+			t.Fatalf("the assignment of user-%d is not sticky", i)
+		}
+		counts[first.ArmName()]++
+	}
+	if counts["candidate"] < 300 || counts["candidate"] > 500 {
+		t.Errorf("expected about 20%% of the users on the candidate, got %v", counts)
+	}
+
+	// without metadata.user_id, or when sticky by API key, every request of a key gets the same arm
+	router.config.StickyBy = StickyByAPIKey
+	byKey := router.Assign(request, "claude", map[string]interface{}{})
+	for i := 0; i < 20; i++ {
+		body := map[string]interface{}{"metadata": map[string]interface{}{"user_id": fmt.Sprintf("user-%d", i)}}
+		if arm := router.Assign(request, "claude", body); arm != byKey {
+			t.Fatalf("expected the arm of the API key, got %s and %s", arm.ArmName(), byKey.ArmName())
+		}
+	}
+}
+
+func TestBedrockClient_ExperimentArm(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant","content":[],"usage":{"input_tokens":1,"output_tokens":1}}`))
+	}))
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	client.config.ModelMappings = map[string]string{"claude-sonnet": "anthropic.claude-sonnet"}
+	client.SetExperimentRouter(NewExperimentRouter(&ExperimentConfig{
+		Experiments: map[string][]*ExperimentArm{
+			"claude-test": {{Model: "claude-sonnet", Weight: 0}, {Name: "next", Model: "anthropic.claude-next-v1:0", Weight: 1}},
+		},
+	}))
+	var usages []*RequestUsage
+	client.AddUsageListener(func(request *http.Request, usage *RequestUsage) {
+		usages = append(usages, usage)
+	})
+
+	request := httptest.NewRequest("POST", "/v1/messages", bytes.NewBufferString(`{"model":"claude-test","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`))
+	request.Header.Set("Content-Type", "application/json")
+	request = request.WithContext(WithRequestState(request.Context(), NewRequestState()))
+	w := httptest.NewRecorder()
+	client.HandleProxy(w, request)
+
+	if w.Code != http.StatusOK || w.Header().Get(ExperimentArmHeader) != "next" {
+		t.Fatalf("expected the next arm to serve the request, got %d %v", w.Code, w.Header())
+	}
+	if len(paths) != 1 || !strings.Contains(paths[0], "anthropic.claude-next-v1:0") {
+		t.Errorf("expected the Bedrock model id of the arm, got %v", paths)
+	}
+	if len(usages) != 1 || usages[0].Experiment != "claude-test" || usages[0].Arm != "next" || usages[0].Model != "anthropic.claude-next-v1:0" {
+		t.Errorf("expected the arm in the usage, got %+v", usages)
+	}
+}
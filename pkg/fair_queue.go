@@ -0,0 +1,375 @@
+package pkg
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	QueuePriorityLow    = 0
+	QueuePriorityNormal = 1
+	QueuePriorityHigh   = 2
+)
+
+// FairQueueConfig bounds the requests in flight per model. Requests over the limit wait in a
+// queue served by priority class first, then weighted fairly between users.
+type FairQueueConfig struct {
+	Enable bool `json:"enable"`
+	// MaxConcurrency is the default number of requests in flight per model
+	MaxConcurrency   int            `json:"max_concurrency,omitempty"`
+	ModelConcurrency map[string]int `json:"model_concurrency,omitempty"`
+	// MaxQueueLength is the number of requests that may wait per model
+	MaxQueueLength int `json:"max_queue_length,omitempty"`
+	MaxWaitSeconds int `json:"max_wait_seconds,omitempty"`
+	// KeyWeights and KeyPriorities are keyed by API key or email, the default weight is 1
+	KeyWeights    map[string]int `json:"key_weights,omitempty"`
+	KeyPriorities map[string]int `json:"key_priorities,omitempty"`
+}
+
+// parseQueuePriority accepts the class names or a number, higher is served first
+func parseQueuePriority(raw string) (int, bool) {
+	switch strings.ToLower(raw) {
+	case "low":
+		return QueuePriorityLow, true
+	case "normal":
+		return QueuePriorityNormal, true
+	case "high":
+		return QueuePriorityHigh, true
+	}
+	priority, err := strconv.Atoi(raw)
+	return priority, err == nil
+}
+
+func parseIntMappings(raw string, parse func(string) (int, bool)) map[string]int {
+	values := map[string]int{}
+	for key, item := range ParseMappingsFromStr(raw) {
+		value, ok := parse(item)
+		if !ok {
+			Log.Errorf("invalid value %q of %s", item, key)
+			continue
+		}
+		values[key] = value
+	}
+	return values
+}
+
+func parsePositiveInt(raw string) (int, bool) {
+	value, err := strconv.Atoi(raw)
+	return value, err == nil && value > 0
+}
+
+func LoadFairQueueConfigWithEnv() *FairQueueConfig {
+	config := &FairQueueConfig{
+		Enable:           os.Getenv("QUEUE_ENABLE") == "true",
+		MaxConcurrency:   16,
+		ModelConcurrency: parseIntMappings(os.Getenv("QUEUE_MODEL_CONCURRENCY"), parsePositiveInt),
+		MaxQueueLength:   100,
+		MaxWaitSeconds:   30,
+		KeyWeights:       parseIntMappings(os.Getenv("QUEUE_KEY_WEIGHTS"), parsePositiveInt),
+		KeyPriorities:    parseIntMappings(os.Getenv("QUEUE_KEY_PRIORITIES"), parseQueuePriority),
+	}
+	if value, ok := parsePositiveInt(os.Getenv("QUEUE_MAX_CONCURRENCY")); ok {
+		config.MaxConcurrency = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("QUEUE_MAX_LENGTH")); err == nil && value >= 0 {
+		config.MaxQueueLength = value
+	}
+	if value, ok := parsePositiveInt(os.Getenv("QUEUE_MAX_WAIT_SECONDS")); ok {
+		config.MaxWaitSeconds = value
+	}
+	return config
+}
+
+var (
+	errQueueFull = &ProxyError{
+		StatusCode: 529,
+		Type:       "overloaded_error",
+		Message:    "Too many requests are waiting for this model, please retry later",
+	}
+	errQueueTimeout = &ProxyError{
+		StatusCode: 529,
+		Type:       "overloaded_error",
+		Message:    "The request waited too long for capacity of this model, please retry later",
+	}
+)
+
+// queueContextKey holds the model whose queue admitted a request
+type queueContextKey struct{}
+
+type queueWaiter struct {
+	flow     string
+	priority int
+	// finish is the virtual finish tag of start-time fair queuing
+	finish  float64
+	ready   chan struct{}
+	granted bool
+}
+
+// QueueStats is the state of the queue of one model
+type QueueStats struct {
+	Limit         int     `json:"limit"`
+	InFlight      int     `json:"in_flight"`
+	Queued        int     `json:"queued"`
+	Admitted      int64   `json:"admitted"`
+	Rejected      int64   `json:"rejected"`
+	TimedOut      int64   `json:"timed_out"`
+	AverageWaitMs float64 `json:"average_wait_ms"`
+	MaxWaitMs     int64   `json:"max_wait_ms"`
+	// QueuedByUser counts the waiting requests of each user
+	QueuedByUser map[string]int `json:"queued_by_user,omitempty"`
+
+	totalWait time.Duration
+	waited    int64
+}
+
+type modelQueue struct {
+	limit    int
+	inFlight int
+	waiters  []*queueWaiter
+	// flows holds the last finish tag of users with waiting requests
+	flows   map[string]float64
+	virtual float64
+	stats   QueueStats
+}
+
+// FairQueue admits requests per model up to its concurrency limit and queues the rest
+type FairQueue struct {
+	config *FairQueueConfig
+	mu     sync.Mutex
+	queues map[string]*modelQueue
+}
+
+func NewFairQueue(config *FairQueueConfig) *FairQueue {
+	return &FairQueue{config: config, queues: map[string]*modelQueue{}}
+}
+
+func (this *FairQueue) queueOf(model string) *modelQueue {
+	queue, ok := this.queues[model]
+	if !ok {
+		limit := this.config.MaxConcurrency
+		if value, ok := this.config.ModelConcurrency[model]; ok {
+			limit = value
+		}
+		queue = &modelQueue{limit: limit, flows: map[string]float64{}}
+		this.queues[model] = queue
+	}
+	return queue
+}
+
+// classOf returns the weight and priority of an identity
+func (this *FairQueue) classOf(identity *RequestIdentity) (int, int) {
+	weight, priority := 1, QueuePriorityNormal
+	if identity == nil {
+		return weight, priority
+	}
+	for _, key := range []string{identity.Email, identity.APIKey} {
+		if value, ok := this.config.KeyWeights[key]; ok && len(key) > 0 {
+			weight = value
+			break
+		}
+	}
+	for _, key := range []string{identity.Email, identity.APIKey} {
+		if value, ok := this.config.KeyPriorities[key]; ok && len(key) > 0 {
+			priority = value
+			break
+		}
+	}
+	return weight, priority
+}
+
+// dispatch grants waiting requests while there is capacity, must be called with the lock held
+func (this *modelQueue) dispatch() {
+	for this.inFlight < this.limit && len(this.waiters) > 0 {
+		best := 0
+		for i, waiter := range this.waiters[1:] {
+			current := this.waiters[best]
+			if waiter.priority > current.priority || (waiter.priority == current.priority && waiter.finish < current.finish) {
+				best = i + 1
+			}
+		}
+		waiter := this.waiters[best]
+		this.remove(best)
+		this.virtual = math.Max(this.virtual, waiter.finish)
+		this.inFlight++
+		waiter.granted = true
+		close(waiter.ready)
+	}
+}
+
+func (this *modelQueue) remove(index int) {
+	waiter := this.waiters[index]
+	this.waiters = append(this.waiters[:index], this.waiters[index+1:]...)
+	this.stats.QueuedByUser[waiter.flow]--
+	if this.stats.QueuedByUser[waiter.flow] <= 0 {
+		delete(this.stats.QueuedByUser, waiter.flow)
+		delete(this.flows, waiter.flow)
+	}
+}
+
+// Limit returns the concurrency limit and the requests in flight of a model
+func (this *FairQueue) Limit(model string) (int, int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	queue := this.queueOf(model)
+	return queue.limit, queue.inFlight
+}
+
+// SetLimit changes the concurrency limit of a model and admits waiting requests when it grew
+func (this *FairQueue) SetLimit(model string, limit int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	queue := this.queueOf(model)
+	queue.limit = limit
+	queue.dispatch()
+}
+
+// Acquire waits for a slot of the model, the returned release must be called when the request is done
+func (this *FairQueue) Acquire(ctx context.Context, model string, identity *RequestIdentity) (func(), time.Duration, error) {
+	this.mu.Lock()
+	queue := this.queueOf(model)
+	release := func() {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		queue.inFlight--
+		queue.dispatch()
+	}
+
+	if queue.inFlight < queue.limit && len(queue.waiters) == 0 {
+		queue.inFlight++
+		queue.stats.Admitted++
+		this.mu.Unlock()
+		return release, 0, nil
+	}
+	if len(queue.waiters) >= this.config.MaxQueueLength {
+		queue.stats.Rejected++
+		this.mu.Unlock()
+		return nil, 0, errQueueFull
+	}
+
+	weight, priority := this.classOf(identity)
+	flow := usageUser(identity)
+	start, ok := queue.flows[flow]
+	if !ok || start < queue.virtual {
+		start = queue.virtual
+	}
+	waiter := &queueWaiter{flow: flow, priority: priority, finish: start + 1/float64(weight), ready: make(chan struct{})}
+	queue.flows[flow] = waiter.finish
+	queue.waiters = append(queue.waiters, waiter)
+	if queue.stats.QueuedByUser == nil {
+		queue.stats.QueuedByUser = map[string]int{}
+	}
+	queue.stats.QueuedByUser[flow]++
+	this.mu.Unlock()
+
+	started := time.Now()
+	timer := time.NewTimer(time.Duration(this.config.MaxWaitSeconds) * time.Second)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-waiter.ready:
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	waited := time.Since(started)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if !waiter.granted {
+		for i, item := range queue.waiters {
+			if item == waiter {
+				queue.remove(i)
+				break
+			}
+		}
+		if err == errQueueTimeout {
+			queue.stats.TimedOut++
+		}
+		return nil, waited, err
+	}
+	// a slot granted while timing out is still taken
+	queue.stats.Admitted++
+	queue.stats.totalWait += waited
+	queue.stats.waited++
+	if ms := waited.Milliseconds(); ms > queue.stats.MaxWaitMs {
+		queue.stats.MaxWaitMs = ms
+	}
+	return release, waited, nil
+}
+
+// Stats returns a snapshot of the queues by model
+func (this *FairQueue) Stats() map[string]*QueueStats {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	stats := map[string]*QueueStats{}
+	for model, queue := range this.queues {
+		snapshot := queue.stats
+		snapshot.Limit = queue.limit
+		snapshot.InFlight = queue.inFlight
+		snapshot.Queued = len(queue.waiters)
+		if snapshot.waited > 0 {
+			snapshot.AverageWaitMs = float64(snapshot.totalWait.Milliseconds()) / float64(snapshot.waited)
+		}
+		snapshot.QueuedByUser = map[string]int{}
+		for user, count := range queue.stats.QueuedByUser {
+			snapshot.QueuedByUser[user] = count
+		}
+		stats[model] = &snapshot
+	}
+	return stats
+}
+
+// queueRequest holds a request in the queue of model until a slot is free. It returns the request
+// carrying the queue model and the release function, or false when the request was answered.
+func (this *HTTPService) queueRequest(writer http.ResponseWriter, request *http.Request, model string) (*http.Request, func(), bool) {
+	if this.Queue == nil {
+		return request, func() {}, true
+	}
+	release, waited, err := this.Queue.Acquire(request.Context(), model, GetRequestIdentity(request))
+	if err != nil {
+		if request.Context().Err() == nil {
+			Log.Warningf("queue of %s rejected a request after %v: %v", model, waited, err)
+			writer.Header().Set("retry-after", strconv.Itoa(int(math.Max(1, waited.Seconds()))))
+			writeProxyError(writer, err)
+		}
+		return nil, nil, false
+	}
+	if waited > 0 {
+		Log.Debugf("request for %s waited %v in the queue", model, waited)
+	}
+	return request.WithContext(context.WithValue(request.Context(), queueContextKey{}, model)), release, true
+}
+
+// queueModel is the queue of a transformed Messages request, so aliases share the queue of the model they
+// resolve to and the number of queues stays bounded: Bedrock names are mapped to their model id, names without
+// mapping fold into the default model Bedrock serves them with, other providers only serve configured names.
+func (this *HTTPService) queueModel(request *http.Request, provider MessagesProvider, model string) string {
+	if provider != MessagesProvider(this.bedrockClient) {
+		return model
+	}
+	if mapped, ok := this.bedrockClient.config.ModelMappings[model]; ok {
+		return mapped
+	}
+	// an experiment arm may be a Bedrock model id
+	if state := GetRequestState(request); state != nil && len(state.Experiment) > 0 {
+		return model
+	}
+	return this.bedrockClient.config.AnthropicDefaultModel
+}
+
+// HandleAdminQueues reports the depth, concurrency and wait times of the queue of each model,
+// and the state of the adaptive limits when they are enabled
+func (this *HTTPService) HandleAdminQueues(writer http.ResponseWriter, request *http.Request) {
+	response := map[string]interface{}{"queues": this.Queue.Stats()}
+	if this.Concurrency != nil {
+		response["adaptive_limits"] = this.Concurrency.Stats()
+	}
+	this.ResponseJSON(response, writer)
+}
@@ -0,0 +1,150 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func waitQueued(t *testing.T, queue *FairQueue, model string, queued int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if stats, ok := queue.Stats()[model]; ok && stats.Queued == queued {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d queued requests, got %+v", queued, queue.Stats()[model])
+}
+
+func TestFairQueue(t *testing.T) {
+	queue := NewFairQueue(&FairQueueConfig{
+		MaxConcurrency: 1,
+		MaxQueueLength: 5,
+		MaxWaitSeconds: 10,
+		KeyPriorities:  map[string]int{"carol@example.com": QueuePriorityHigh},
+	})
+	alice := &RequestIdentity{APIKey: "alice", Email: "alice@example.com"}
+	bob := &RequestIdentity{APIKey: "bob", Email: "bob@example.com"}
+	carol := &RequestIdentity{APIKey: "carol", Email: "carol@example.com"}
+
+	hold, waited, err := queue.Acquire(context.Background(), "claude", alice)
+	if err != nil || waited != 0 {
+		t.Fatalf("the first request should be admitted at once, got %v %v", waited, err)
+	}
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	enqueue := func(name string, identity *RequestIdentity) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, _, err := queue.Acquire(context.Background(), "claude", identity)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			release()
+		}()
+	}
+	// alice floods the queue before bob and carol arrive
+	for i, name := range []string{"alice1", "alice2", "alice3"} {
+		enqueue(name, alice)
+		waitQueued(t, queue, "claude", i+1)
+	}
+	enqueue("bob", bob)
+	waitQueued(t, queue, "claude", 4)
+	enqueue("carol", carol)
+	waitQueued(t, queue, "claude", 5)
+
+	if _, _, err := queue.Acquire(context.Background(), "claude", bob); err != errQueueFull {
+		t.Errorf("expected the full queue to refuse, got %v", err)
+	}
+	if stats := queue.Stats()["claude"]; stats.QueuedByUser["alice@example.com"] != 3 || stats.InFlight != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	hold()
+	wg.Wait()
+	expected := []string{"carol", "alice1", "bob", "alice2", "alice3"}
+	for i := range expected {
+		if i >= len(order) || order[i] != expected[i] {
+			t.Fatalf("expected the order %v, got %v", expected, order)
+		}
+	}
+	stats := queue.Stats()["claude"]
+	if stats.Admitted != 6 || stats.Rejected != 1 || stats.InFlight != 0 || stats.Queued != 0 || stats.MaxWaitMs < 0 {
+		t.Errorf("unexpected final stats %+v", stats)
+	}
+
+	t.Run("Cancel", func(t *testing.T) {
+		queue.SetLimit("claude", 0)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			_, _, err := queue.Acquire(ctx, "claude", alice)
+			done <- err
+		}()
+		waitQueued(t, queue, "claude", 1)
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Errorf("expected the cancelled request to leave the queue, got %v", err)
+		}
+		if stats := queue.Stats()["claude"]; stats.Queued != 0 || len(stats.QueuedByUser) != 0 {
+			t.Errorf("unexpected stats after cancel %+v", stats)
+		}
+	})
+}
+
+func TestHTTPService_QueueRequest(t *testing.T) {
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"type":"message","content":[],"usage":{"input_tokens":1,"output_tokens":1}}`))
+	}))
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	client.config.ModelMappings = map[string]string{"claude-test": "anthropic.claude-test"}
+	service := &HTTPService{
+		bedrockClient: client,
+		Queue:         NewFairQueue(&FairQueueConfig{MaxConcurrency: 1, MaxQueueLength: 0, MaxWaitSeconds: 1}),
+	}
+	send := func(model string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "/v1/messages", bytes.NewBufferString(`{"model":"`+model+`","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`))
+		request.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		service.HandleMessageComplete(w, request)
+		return w
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- send("claude-test") }()
+	<-started
+	// a name without mapping is served by the default model and waits in its queue
+	if w := send("unknown-model"); w.Code != 529 || w.Header().Get("retry-after") == "" {
+		t.Errorf("expected 529 overloaded_error while the model is saturated, got %d %s", w.Code, w.Body.String())
+	}
+	close(finish)
+	if w := <-done; w.Code != http.StatusOK {
+		t.Errorf("expected the admitted request to complete, got %d %s", w.Code, w.Body.String())
+	}
+	stats := service.Queue.Stats()
+	if len(stats) != 1 || stats["anthropic.claude-test"] == nil {
+		t.Fatalf("expected a single queue for the Bedrock model, got %v", stats)
+	}
+	if queue := stats["anthropic.claude-test"]; queue.InFlight != 0 || queue.Rejected != 1 || queue.Admitted != 1 {
+		t.Errorf("unexpected stats %+v", queue)
+	}
+}
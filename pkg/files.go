@@ -0,0 +1,493 @@
+package pkg
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// ErrFileNotFound is returned by a FileStore when the file does not exist for the owner
+var ErrFileNotFound = errors.New("file not found")
+
+// errFilesNoOwner rejects requests without an API key, their files could not be isolated from other callers
+var errFilesNoOwner = &ProxyError{
+	StatusCode: http.StatusForbidden,
+	Type:       "permission_error",
+	Message:    "The Files API requires an API key",
+}
+
+// FilesConfig holds configuration of the local Files API
+type FilesConfig struct {
+	Enable      bool   `json:"enable"`
+	Dir         string `json:"dir"`
+	MaxFileSize int64  `json:"max_file_size"`
+	// MaxInlineSize bounds the bytes of stored files inlined into one message request
+	MaxInlineSize int64 `json:"max_inline_size"`
+}
+
+func LoadFilesConfigWithEnv() *FilesConfig {
+	config := &FilesConfig{
+		Enable:        os.Getenv("FILES_ENABLE") == "true",
+		Dir:           "./data/files",
+		MaxFileSize:   500 * 1024 * 1024,
+		MaxInlineSize: DefaultMaxBodySize,
+	}
+
+	if dir := os.Getenv("FILES_DIR"); len(dir) > 0 {
+		config.Dir = dir
+	}
+	if raw := os.Getenv("FILES_MAX_SIZE"); len(raw) > 0 {
+		if size, err := ParseByteSize(raw); err == nil {
+			config.MaxFileSize = size
+		}
+	}
+	if raw := os.Getenv("FILES_MAX_INLINE_SIZE"); len(raw) > 0 {
+		if size, err := ParseByteSize(raw); err == nil {
+			config.MaxInlineSize = size
+		}
+	}
+
+	return config
+}
+
+// FileMetadata is the file object of the Anthropic Files API
+type FileMetadata struct {
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	Filename     string `json:"filename"`
+	MimeType     string `json:"mime_type"`
+	SizeBytes    int64  `json:"size_bytes"`
+	CreatedAt    string `json:"created_at"`
+	Downloadable bool   `json:"downloadable"`
+}
+
+type ListFilesResponse struct {
+	Data    []*FileMetadata `json:"data"`
+	FirstID string          `json:"first_id,omitempty"`
+	LastID  string          `json:"last_id,omitempty"`
+	HasMore bool            `json:"has_more"`
+}
+
+type DeletedFileResponse struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// FileStore defines the interface of the blob storage behind the Files API, files are isolated per owner
+type FileStore interface {
+	Save(owner string, meta *FileMetadata, content io.Reader) error
+	List(owner string) ([]*FileMetadata, error)
+	Get(owner string, id string) (*FileMetadata, error)
+	Open(owner string, id string) (io.ReadCloser, error)
+	Delete(owner string, id string) error
+}
+
+// LocalFileStore implements FileStore on the local disk, as <dir>/<sha256(owner)>/<id>.{json,bin}
+type LocalFileStore struct {
+	dir string
+}
+
+func NewLocalFileStore(dir string) (*LocalFileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create files directory: %w", err)
+	}
+	return &LocalFileStore{dir: dir}, nil
+}
+
+func (this *LocalFileStore) ownerDir(owner string) string {
+	hash := sha256.Sum256([]byte(owner))
+	return filepath.Join(this.dir, hex.EncodeToString(hash[:]))
+}
+
+func (this *LocalFileStore) paths(owner string, id string) (string, string, error) {
+	if len(id) == 0 || strings.ContainsAny(id, `/\.`) {
+		return "", "", ErrFileNotFound
+	}
+	dir := this.ownerDir(owner)
+	return filepath.Join(dir, id+".json"), filepath.Join(dir, id+".bin"), nil
+}
+
+// Save writes content to disk and fills in the size of meta
+func (this *LocalFileStore) Save(owner string, meta *FileMetadata, content io.Reader) error {
+	metaPath, blobPath, err := this.paths(owner, meta.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(blobPath), meta.ID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	meta.SizeBytes = size
+
+	metaBin, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), blobPath); err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath, metaBin, 0644)
+}
+
+func (this *LocalFileStore) List(owner string) ([]*FileMetadata, error) {
+	entries, err := os.ReadDir(this.ownerDir(owner))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []*FileMetadata{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*FileMetadata, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		meta, err := this.Get(owner, strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			Log.Warningf("skip broken file metadata %s: %v", entry.Name(), err)
+			continue
+		}
+		files = append(files, meta)
+	}
+
+	// newest first, like the Anthropic Files API
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].CreatedAt == files[j].CreatedAt {
+			return files[i].ID > files[j].ID
+		}
+		return files[i].CreatedAt > files[j].CreatedAt
+	})
+	return files, nil
+}
+
+func (this *LocalFileStore) Get(owner string, id string) (*FileMetadata, error) {
+	metaPath, _, err := this.paths(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	metaBin, err := os.ReadFile(metaPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var meta FileMetadata
+	if err := json.Unmarshal(metaBin, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (this *LocalFileStore) Open(owner string, id string) (io.ReadCloser, error) {
+	_, blobPath, err := this.paths(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(blobPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrFileNotFound
+	}
+	return file, err
+}
+
+func (this *LocalFileStore) Delete(owner string, id string) error {
+	metaPath, blobPath, err := this.paths(owner, id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(metaPath); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrFileNotFound
+		}
+		return err
+	}
+	if err := os.Remove(blobPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// ReadFileContent loads a stored file as an asset that can be inlined into a message,
+// files larger than maxBytes are rejected before they are read
+func ReadFileContent(store FileStore, owner string, id string, maxBytes int64) (*FetchedAsset, error) {
+	meta, err := store.Get(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	if meta.SizeBytes > maxBytes {
+		return nil, errInlineTooLarge(maxBytes)
+	}
+	reader, err := store.Open(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, errInlineTooLarge(maxBytes)
+	}
+	return &FetchedAsset{URL: id, MediaType: meta.MimeType, Data: data}, nil
+}
+
+func errInlineTooLarge(limit int64) *ProxyError {
+	return &ProxyError{
+		StatusCode: http.StatusRequestEntityTooLarge,
+		Type:       "request_too_large",
+		Message:    fmt.Sprintf("Files referenced by the request exceed the maximum allowed number of bytes (%d).", limit),
+	}
+}
+
+// fileOwner returns the owner of the files of a request, requests without an API key have none
+func fileOwner(request *http.Request) (string, error) {
+	if owner := GetRequestIdentity(request).Owner(); len(owner) > 0 {
+		return owner, nil
+	}
+	return "", errFilesNoOwner
+}
+
+// FileSourceResolver replaces `{"source": {"type": "file"}}` blocks with the stored file content
+type FileSourceResolver struct {
+	store         FileStore
+	maxInlineSize int64
+}
+
+func NewFileSourceResolver(store FileStore, maxInlineSize int64) *FileSourceResolver {
+	return &FileSourceResolver{store: store, maxInlineSize: maxInlineSize}
+}
+
+func (this *FileSourceResolver) TransformMessage(request *http.Request, body map[string]interface{}) error {
+	// the budget is shared by all blocks, a file referenced twice is inlined twice
+	remaining := this.maxInlineSize
+	return WalkContentBlocks(body, func(block map[string]interface{}) error {
+		source, ok := getBlockSource(block)
+		if !ok || source["type"] != "file" {
+			return nil
+		}
+		owner, err := fileOwner(request)
+		if err != nil {
+			return err
+		}
+		fileID, _ := source["file_id"].(string)
+		asset, err := ReadFileContent(this.store, owner, fileID, remaining)
+		if errors.Is(err, ErrFileNotFound) {
+			return NewInvalidRequestError("File not found: %s", fileID)
+		}
+		if err != nil {
+			return err
+		}
+		remaining -= int64(len(asset.Data))
+		newSource, err := asset.AsSource(block["type"].(string))
+		if err != nil {
+			return NewInvalidRequestError("Unable to use file %s: %v", fileID, err)
+		}
+		block["source"] = newSource
+		return nil
+	})
+}
+
+func (this *HTTPService) responseFileError(err error, writer http.ResponseWriter) {
+	if errors.Is(err, ErrFileNotFound) {
+		writeAPIError(writer, http.StatusNotFound, "not_found_error", err.Error())
+		return
+	}
+	if writeProxyError(writer, err) {
+		return
+	}
+	Log.Error(err)
+	writeAPIError(writer, http.StatusInternalServerError, "api_error", err.Error())
+}
+
+// HandleUploadFile stores the "file" field of a multipart upload
+func (this *HTTPService) HandleUploadFile(writer http.ResponseWriter, request *http.Request) {
+	owner, err := fileOwner(request)
+	if err != nil {
+		this.responseFileError(err, writer)
+		return
+	}
+	reader, err := request.MultipartReader()
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, "invalid_request_error", "expected a multipart/form-data body")
+		return
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			writeAPIError(writer, http.StatusBadRequest, "invalid_request_error", "missing file field")
+			return
+		}
+		if err != nil {
+			this.responseFileError(err, writer)
+			return
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+
+		limit := this.conf.FilesConfig.MaxFileSize
+		content := bufio.NewReader(io.LimitReader(part, limit+1))
+		head, _ := content.Peek(512)
+
+		meta := &FileMetadata{
+			ID:           "file_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+			Type:         "file",
+			Filename:     part.FileName(),
+			MimeType:     sniffMediaType(part.Header.Get("Content-Type"), head),
+			CreatedAt:    time.Now().UTC().Format(time.RFC3339),
+			Downloadable: true,
+		}
+		if err := this.FileStorage.Save(owner, meta, content); err != nil {
+			this.responseFileError(err, writer)
+			return
+		}
+		if meta.SizeBytes > limit {
+			_ = this.FileStorage.Delete(owner, meta.ID)
+			writeAPIError(writer, http.StatusRequestEntityTooLarge, "request_too_large", requestTooLargeMessage(limit))
+			return
+		}
+
+		this.ResponseJSON(meta, writer)
+		return
+	}
+}
+
+// HandleListFiles lists the files of the caller, supporting limit, before_id and after_id
+func (this *HTTPService) HandleListFiles(writer http.ResponseWriter, request *http.Request) {
+	owner, err := fileOwner(request)
+	if err != nil {
+		this.responseFileError(err, writer)
+		return
+	}
+	files, err := this.FileStorage.List(owner)
+	if err != nil {
+		this.responseFileError(err, writer)
+		return
+	}
+
+	query := request.URL.Query()
+	limit := 20
+	if raw := query.Get("limit"); len(raw) > 0 {
+		if value, err := strconv.Atoi(raw); err == nil && value > 0 && value <= 1000 {
+			limit = value
+		}
+	}
+
+	start, end := 0, len(files)
+	for i, file := range files {
+		if file.ID == query.Get("after_id") {
+			start = i + 1
+		}
+		if file.ID == query.Get("before_id") {
+			end = i
+		}
+	}
+	if start > end {
+		start = end
+	}
+
+	page := files[start:end]
+	hasMore := false
+	if len(page) > limit {
+		if len(query.Get("before_id")) > 0 {
+			page = page[len(page)-limit:]
+		} else {
+			page = page[:limit]
+		}
+		hasMore = true
+	}
+
+	response := ListFilesResponse{Data: page, HasMore: hasMore}
+	if len(page) > 0 {
+		response.FirstID = page[0].ID
+		response.LastID = page[len(page)-1].ID
+	}
+	this.ResponseJSON(response, writer)
+}
+
+func (this *HTTPService) HandleGetFile(writer http.ResponseWriter, request *http.Request) {
+	owner, err := fileOwner(request)
+	if err != nil {
+		this.responseFileError(err, writer)
+		return
+	}
+	meta, err := this.FileStorage.Get(owner, mux.Vars(request)["file_id"])
+	if err != nil {
+		this.responseFileError(err, writer)
+		return
+	}
+	this.ResponseJSON(meta, writer)
+}
+
+func (this *HTTPService) HandleDownloadFile(writer http.ResponseWriter, request *http.Request) {
+	owner, err := fileOwner(request)
+	if err != nil {
+		this.responseFileError(err, writer)
+		return
+	}
+	fileID := mux.Vars(request)["file_id"]
+	meta, err := this.FileStorage.Get(owner, fileID)
+	if err != nil {
+		this.responseFileError(err, writer)
+		return
+	}
+	reader, err := this.FileStorage.Open(owner, fileID)
+	if err != nil {
+		this.responseFileError(err, writer)
+		return
+	}
+	defer reader.Close()
+
+	writer.Header().Set("Content-Type", meta.MimeType)
+	writer.Header().Set("Content-Length", strconv.FormatInt(meta.SizeBytes, 10))
+	writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", meta.Filename))
+	if _, err := io.Copy(writer, reader); err != nil {
+		Log.Error(err)
+	}
+}
+
+func (this *HTTPService) HandleDeleteFile(writer http.ResponseWriter, request *http.Request) {
+	owner, err := fileOwner(request)
+	if err != nil {
+		this.responseFileError(err, writer)
+		return
+	}
+	fileID := mux.Vars(request)["file_id"]
+	if err := this.FileStorage.Delete(owner, fileID); err != nil {
+		this.responseFileError(err, writer)
+		return
+	}
+	this.ResponseJSON(DeletedFileResponse{ID: fileID, Type: "file_deleted"}, writer)
+}
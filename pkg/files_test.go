@@ -0,0 +1,150 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func newFilesTestService(t *testing.T) *HTTPService {
+	store, err := NewLocalFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &HTTPService{
+		conf:        &Config{FilesConfig: &FilesConfig{Enable: true, MaxFileSize: 1024}},
+		FileStorage: store,
+	}
+}
+
+func uploadTestFile(t *testing.T, service *HTTPService, identity *RequestIdentity, filename string, content []byte) (*httptest.ResponseRecorder, *FileMetadata) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	form.Close()
+
+	request := httptest.NewRequest("POST", "/v1/files", &body)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	request = request.WithContext(WithRequestIdentity(request.Context(), identity))
+	w := httptest.NewRecorder()
+	service.HandleUploadFile(w, request)
+
+	var meta FileMetadata
+	_ = json.Unmarshal(w.Body.Bytes(), &meta)
+	return w, &meta
+}
+
+func TestHTTPService_Files(t *testing.T) {
+	service := newFilesTestService(t)
+	alice := &RequestIdentity{APIKey: "key-a", Email: "alice@example.com"}
+	bob := &RequestIdentity{APIKey: "key-b", Email: "bob@example.com"}
+
+	w, meta := uploadTestFile(t, service, alice, "notes.txt", []byte("hello world"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body.String())
+	}
+	if meta.SizeBytes != 11 || meta.MimeType != "text/plain" || meta.Filename != "notes.txt" {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+
+	withVars := func(method string, identity *RequestIdentity, fileID string) *http.Request {
+		request := httptest.NewRequest(method, "/v1/files/"+fileID, nil)
+		request = request.WithContext(WithRequestIdentity(request.Context(), identity))
+		return mux.SetURLVars(request, map[string]string{"file_id": fileID})
+	}
+
+	t.Run("List", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		service.HandleListFiles(w, withVars("GET", alice, ""))
+		var list ListFilesResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Data) != 1 || list.Data[0].ID != meta.ID {
+			t.Errorf("unexpected list: %s", w.Body.String())
+		}
+
+		w = httptest.NewRecorder()
+		service.HandleListFiles(w, withVars("GET", bob, ""))
+		list = ListFilesResponse{}
+		_ = json.Unmarshal(w.Body.Bytes(), &list)
+		if len(list.Data) != 0 {
+			t.Errorf("files should be isolated per owner, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("GetOtherOwner", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		service.HandleGetFile(w, withVars("GET", bob, meta.ID))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("ResolveFileSource", func(t *testing.T) {
+		body := map[string]interface{}{
+			"messages": []interface{}{
+				map[string]interface{}{
+					"role": "user",
+					"content": []interface{}{
+						map[string]interface{}{
+							"type":   "document",
+							"source": map[string]interface{}{"type": "file", "file_id": meta.ID},
+						},
+					},
+				},
+			},
+		}
+		resolver := NewFileSourceResolver(service.FileStorage, 1024)
+		if err := resolver.TransformMessage(withVars("POST", bob, ""), body); err == nil {
+			t.Errorf("expected file of another owner to be rejected")
+		}
+		if err := NewFileSourceResolver(service.FileStorage, 5).TransformMessage(withVars("POST", alice, ""), body); err == nil || err.(*ProxyError).StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected the inline limit to be enforced, got %v", err)
+		}
+		if err := resolver.TransformMessage(withVars("POST", alice, ""), body); err != nil {
+			t.Fatal(err)
+		}
+		content := body["messages"].([]interface{})[0].(map[string]interface{})["content"].([]interface{})
+		source := content[0].(map[string]interface{})["source"].(map[string]interface{})
+		if source["type"] != "text" || source["data"] != "hello world" {
+			t.Errorf("unexpected source: %v", source)
+		}
+	})
+
+	t.Run("Anonymous", func(t *testing.T) {
+		w, _ := uploadTestFile(t, service, nil, "notes.txt", []byte("hello world"))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected uploads without an API key to be rejected, got %d", w.Code)
+		}
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		w, _ := uploadTestFile(t, service, alice, "big.bin", bytes.Repeat([]byte("a"), 2048))
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected 413, got %d", w.Code)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		service.HandleDeleteFile(w, withVars("DELETE", alice, meta.ID))
+		if w.Code != http.StatusOK {
+			t.Fatalf("delete failed: %d %s", w.Code, w.Body.String())
+		}
+		w = httptest.NewRecorder()
+		service.HandleGetFile(w, withVars("GET", alice, meta.ID))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected 404 after delete, got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,527 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// GeminiConfig serves the generateContent API of Google Generative Language on the Messages providers
+type GeminiConfig struct {
+	Enable bool `json:"enable"`
+	// DefaultMaxTokens is the max_tokens of the requests without generationConfig.maxOutputTokens
+	DefaultMaxTokens int `json:"default_max_tokens,omitempty"`
+}
+
+func LoadGeminiConfigWithEnv() *GeminiConfig {
+	config := &GeminiConfig{
+		Enable:           os.Getenv("GEMINI_ENABLE") == "true",
+		DefaultMaxTokens: 8192,
+	}
+	if value, ok := parsePositiveInt(os.Getenv("GEMINI_DEFAULT_MAX_TOKENS")); ok {
+		config.DefaultMaxTokens = value
+	}
+	return config
+}
+
+// geminiStatus returns the Google RPC status name of an HTTP status code
+func geminiStatus(statusCode int) string {
+	switch statusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case http.StatusServiceUnavailable, 529:
+		return "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	}
+	return "INTERNAL"
+}
+
+func geminiError(statusCode int, message string) map[string]interface{} {
+	return map[string]interface{}{"error": map[string]interface{}{
+		"code":    statusCode,
+		"message": message,
+		"status":  geminiStatus(statusCode),
+	}}
+}
+
+// writeGeminiError writes an error in the shape of the Google APIs, 529 is sent as 503
+func writeGeminiError(w http.ResponseWriter, statusCode int, message string) {
+	if statusCode == 529 {
+		statusCode = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(geminiError(statusCode, message))
+}
+
+// geminiSchema lowercases the OpenAPI type names of a Gemini schema, e.g. "OBJECT", for JSON Schema
+func geminiSchema(schema interface{}) interface{} {
+	switch value := schema.(type) {
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			if typeName, ok := v.(string); ok && k == "type" {
+				converted[k] = strings.ToLower(typeName)
+				continue
+			}
+			converted[k] = geminiSchema(v)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(value))
+		for i, v := range value {
+			converted[i] = geminiSchema(v)
+		}
+		return converted
+	}
+	return schema
+}
+
+// geminiRequest translates a generateContent request into a Messages request
+type geminiRequest struct {
+	// calls holds the ids of the function calls not answered yet, by function name
+	calls    map[string][]string
+	sequence int
+}
+
+// media translates inline data into an image or document block
+func (this *geminiRequest) media(mimeType string, source map[string]interface{}) (map[string]interface{}, error) {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return map[string]interface{}{"type": "image", "source": source}, nil
+	case mimeType == "application/pdf", mimeType == "text/plain":
+		return map[string]interface{}{"type": "document", "source": source}, nil
+	}
+	return nil, NewInvalidRequestError("inline data of type %q is not supported", mimeType)
+}
+
+func (this *geminiRequest) part(part map[string]interface{}) (map[string]interface{}, error) {
+	if text, ok := part["text"].(string); ok {
+		// the thoughts of earlier turns are not sent back
+		if thought, _ := part["thought"].(bool); thought {
+			return nil, nil
+		}
+		return map[string]interface{}{"type": "text", "text": text}, nil
+	}
+	if data, ok := part["inlineData"].(map[string]interface{}); ok {
+		mimeType, _ := data["mimeType"].(string)
+		return this.media(mimeType, map[string]interface{}{"type": "base64", "media_type": mimeType, "data": data["data"]})
+	}
+	if data, ok := part["fileData"].(map[string]interface{}); ok {
+		mimeType, _ := data["mimeType"].(string)
+		uri, _ := data["fileUri"].(string)
+		if !strings.HasPrefix(uri, "http://") && !strings.HasPrefix(uri, "https://") {
+			return nil, NewInvalidRequestError("file data must be an http or https url, got %q", uri)
+		}
+		return this.media(mimeType, map[string]interface{}{"type": "url", "url": uri})
+	}
+	if call, ok := part["functionCall"].(map[string]interface{}); ok {
+		name, _ := call["name"].(string)
+		id, _ := call["id"].(string)
+		if len(id) == 0 {
+			this.sequence++
+			id = fmt.Sprintf("toolu_gemini_%d", this.sequence)
+		}
+		this.calls[name] = append(this.calls[name], id)
+		input := call["args"]
+		if input == nil {
+			input = map[string]interface{}{}
+		}
+		return map[string]interface{}{"type": "tool_use", "id": id, "name": name, "input": input}, nil
+	}
+	if response, ok := part["functionResponse"].(map[string]interface{}); ok {
+		name, _ := response["name"].(string)
+		id, _ := response["id"].(string)
+		// responses without an id answer the oldest call of the function
+		if pending := this.calls[name]; len(id) == 0 && len(pending) > 0 {
+			id, this.calls[name] = pending[0], pending[1:]
+		}
+		if len(id) == 0 {
+			return nil, NewInvalidRequestError("the response of function %s answers no function call", name)
+		}
+		content, err := json.Marshal(response["response"])
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "tool_result", "tool_use_id": id, "content": string(content)}, nil
+	}
+	return nil, NewInvalidRequestError("unsupported part %v", part)
+}
+
+// translateGeminiRequest translates a decoded generateContent request body into a Messages request body for model
+func translateGeminiRequest(model string, body map[string]interface{}, defaultMaxTokens int) (map[string]interface{}, error) {
+	request := &geminiRequest{calls: make(map[string][]string)}
+	messages := make([]interface{}, 0)
+	for _, item := range toSlice(body["contents"]) {
+		content, _ := item.(map[string]interface{})
+		role := "user"
+		if content["role"] == "model" {
+			role = "assistant"
+		}
+		blocks := make([]interface{}, 0)
+		for _, part := range toSlice(content["parts"]) {
+			partMap, _ := part.(map[string]interface{})
+			block, err := request.part(partMap)
+			if err != nil {
+				return nil, err
+			}
+			if block != nil {
+				blocks = append(blocks, block)
+			}
+		}
+		messages = appendMessage(messages, role, blocks)
+	}
+
+	translated := map[string]interface{}{"model": model, "messages": messages, "max_tokens": defaultMaxTokens}
+	if instruction, ok := body["systemInstruction"].(map[string]interface{}); ok {
+		var parts []string
+		for _, part := range toSlice(instruction["parts"]) {
+			partMap, _ := part.(map[string]interface{})
+			if text, ok := partMap["text"].(string); ok {
+				parts = append(parts, text)
+			}
+		}
+		if len(parts) > 0 {
+			translated["system"] = strings.Join(parts, "\n")
+		}
+	}
+
+	config, _ := body["generationConfig"].(map[string]interface{})
+	for from, to := range map[string]string{
+		"maxOutputTokens": "max_tokens",
+		"temperature":     "temperature",
+		"topP":            "top_p",
+		"topK":            "top_k",
+		"stopSequences":   "stop_sequences",
+	} {
+		if value, ok := config[from]; ok && value != nil {
+			translated[to] = value
+		}
+	}
+	if count, ok := jsonInt(config["candidateCount"]); ok && count > 1 {
+		return nil, NewInvalidRequestError("only one candidate is supported")
+	}
+	if thinking, ok := config["thinkingConfig"].(map[string]interface{}); ok {
+		if budget, ok := jsonInt(thinking["thinkingBudget"]); ok && budget > 0 {
+			translated["thinking"] = map[string]interface{}{"type": "enabled", "budget_tokens": budget}
+		}
+	}
+
+	tools := make([]interface{}, 0)
+	for _, item := range toSlice(body["tools"]) {
+		tool, _ := item.(map[string]interface{})
+		declarations, ok := tool["functionDeclarations"].([]interface{})
+		if !ok {
+			return nil, NewInvalidRequestError("only function declarations are supported as tools")
+		}
+		for _, declaration := range declarations {
+			function, _ := declaration.(map[string]interface{})
+			schema := function["parametersJsonSchema"]
+			if schema == nil {
+				schema = geminiSchema(function["parameters"])
+			}
+			if schema == nil {
+				schema = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+			}
+			definition := map[string]interface{}{"name": function["name"], "input_schema": schema}
+			if description, ok := function["description"].(string); ok && len(description) > 0 {
+				definition["description"] = description
+			}
+			tools = append(tools, definition)
+		}
+	}
+	if len(tools) > 0 {
+		translated["tools"] = tools
+		toolConfig, _ := body["toolConfig"].(map[string]interface{})
+		calling, _ := toolConfig["functionCallingConfig"].(map[string]interface{})
+		allowed := toSlice(calling["allowedFunctionNames"])
+		switch calling["mode"] {
+		case "ANY":
+			if len(allowed) == 1 {
+				translated["tool_choice"] = map[string]interface{}{"type": "tool", "name": allowed[0]}
+			} else {
+				translated["tool_choice"] = map[string]interface{}{"type": "any"}
+			}
+		case "NONE":
+			translated["tool_choice"] = map[string]interface{}{"type": "none"}
+		}
+	}
+	return translated, nil
+}
+
+// geminiFinishReason maps an Anthropic stop reason to a Gemini finish reason
+func geminiFinishReason(stopReason interface{}) string {
+	switch stopReason {
+	case "max_tokens":
+		return "MAX_TOKENS"
+	case "refusal":
+		return "SAFETY"
+	}
+	return "STOP"
+}
+
+// geminiUsage returns the usageMetadata of an Anthropic usage object
+func geminiUsage(usage map[string]interface{}) map[string]interface{} {
+	input, _ := jsonInt(usage["input_tokens"])
+	cacheRead, _ := jsonInt(usage["cache_read_input_tokens"])
+	cacheWrite, _ := jsonInt(usage["cache_creation_input_tokens"])
+	output, _ := jsonInt(usage["output_tokens"])
+	prompt := input + cacheRead + cacheWrite
+	metadata := map[string]interface{}{
+		"promptTokenCount":     prompt,
+		"candidatesTokenCount": output,
+		"totalTokenCount":      prompt + output,
+	}
+	if cacheRead > 0 {
+		metadata["cachedContentTokenCount"] = cacheRead
+	}
+	return metadata
+}
+
+func geminiResponse(model string, parts []interface{}, finishReason string, usage map[string]interface{}) map[string]interface{} {
+	candidate := map[string]interface{}{"content": map[string]interface{}{"role": "model", "parts": parts}, "index": 0}
+	if len(finishReason) > 0 {
+		candidate["finishReason"] = finishReason
+	}
+	response := map[string]interface{}{"candidates": []interface{}{candidate}, "modelVersion": model}
+	if usage != nil {
+		response["usageMetadata"] = usage
+	}
+	return response
+}
+
+// translateGeminiResponse translates an Anthropic message into a generateContent response
+func translateGeminiResponse(model string, message map[string]interface{}) map[string]interface{} {
+	parts := make([]interface{}, 0)
+	for _, item := range toSlice(message["content"]) {
+		block, _ := item.(map[string]interface{})
+		switch block["type"] {
+		case "text":
+			parts = append(parts, map[string]interface{}{"text": block["text"]})
+		case "thinking":
+			parts = append(parts, map[string]interface{}{"text": block["thinking"], "thought": true})
+		case "tool_use":
+			parts = append(parts, map[string]interface{}{"functionCall": map[string]interface{}{
+				"id": block["id"], "name": block["name"], "args": block["input"],
+			}})
+		}
+	}
+	usage, _ := message["usage"].(map[string]interface{})
+	return geminiResponse(model, parts, geminiFinishReason(message["stop_reason"]), geminiUsage(usage))
+}
+
+// geminiStreamTranslator translates the events of a Messages stream into generateContent response chunks.
+// Text and thoughts are sent as they arrive, function calls once their arguments are complete.
+type geminiStreamTranslator struct {
+	model      string
+	write      func(chunk map[string]interface{})
+	blocks     map[int]*streamBlock
+	usage      map[string]interface{}
+	stopReason interface{}
+}
+
+func newGeminiStreamTranslator(model string, write func(chunk map[string]interface{})) *geminiStreamTranslator {
+	return &geminiStreamTranslator{model: model, write: write, blocks: make(map[int]*streamBlock), usage: make(map[string]interface{})}
+}
+
+func (this *geminiStreamTranslator) Observe(eventType string, data []byte) {
+	event := make(map[string]interface{})
+	if err := json.Unmarshal(data, &event); err != nil {
+		Log.Error(err)
+		return
+	}
+	index := 0
+	if value, ok := jsonInt(event["index"]); ok {
+		index = int(value)
+	}
+	parts := func(part map[string]interface{}) {
+		this.write(geminiResponse(this.model, []interface{}{part}, "", nil))
+	}
+
+	switch eventType {
+	case "message_start":
+		message, _ := event["message"].(map[string]interface{})
+		usage, _ := message["usage"].(map[string]interface{})
+		for k, v := range usage {
+			this.usage[k] = v
+		}
+	case "content_block_start":
+		contentBlock, _ := event["content_block"].(map[string]interface{})
+		block := &streamBlock{}
+		block.kind, _ = contentBlock["type"].(string)
+		block.id, _ = contentBlock["id"].(string)
+		block.name, _ = contentBlock["name"].(string)
+		this.blocks[index] = block
+	case "content_block_delta":
+		delta, _ := event["delta"].(map[string]interface{})
+		switch delta["type"] {
+		case "text_delta":
+			parts(map[string]interface{}{"text": delta["text"]})
+		case "thinking_delta":
+			parts(map[string]interface{}{"text": delta["thinking"], "thought": true})
+		case "input_json_delta":
+			if block, ok := this.blocks[index]; ok {
+				partial, _ := delta["partial_json"].(string)
+				block.input.WriteString(partial)
+			}
+		}
+	case "content_block_stop":
+		block, ok := this.blocks[index]
+		if !ok || block.kind != "tool_use" {
+			return
+		}
+		args := make(map[string]interface{})
+		if block.input.Len() > 0 {
+			if err := json.Unmarshal([]byte(block.input.String()), &args); err != nil {
+				Log.Error(err)
+			}
+		}
+		parts(map[string]interface{}{"functionCall": map[string]interface{}{"id": block.id, "name": block.name, "args": args}})
+	case "message_delta":
+		delta, _ := event["delta"].(map[string]interface{})
+		this.stopReason = delta["stop_reason"]
+		usage, _ := event["usage"].(map[string]interface{})
+		for k, v := range usage {
+			this.usage[k] = v
+		}
+	case "message_stop":
+		this.write(geminiResponse(this.model, []interface{}{map[string]interface{}{"text": ""}},
+			geminiFinishReason(this.stopReason), geminiUsage(this.usage)))
+	case "error":
+		var apiError APIStandardError
+		_ = json.Unmarshal(data, &apiError)
+		message := string(data)
+		status := http.StatusInternalServerError
+		if apiError.Error != nil {
+			message = apiError.Error.Message
+			status = anthropicErrorStatus(apiError.Error.Type)
+		}
+		this.write(geminiError(status, message))
+	}
+}
+
+// HandleGeminiModels lists the models in the shape of the Generative Language API
+func (this *HTTPService) HandleGeminiModels(writer http.ResponseWriter, request *http.Request) {
+	names := this.modelNames()
+	models := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		models = append(models, map[string]interface{}{
+			"name":                       "models/" + name,
+			"displayName":                name,
+			"supportedGenerationMethods": []string{"generateContent", "streamGenerateContent"},
+		})
+	}
+	this.ResponseJSON(map[string]interface{}{"models": models}, writer)
+}
+
+// HandleGeminiGenerateContent serves generateContent and streamGenerateContent on the Messages providers
+func (this *HTTPService) HandleGeminiGenerateContent(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	model := vars["model"]
+	stream := vars["method"] == "streamGenerateContent"
+	if !stream && vars["method"] != "generateContent" {
+		writeGeminiError(writer, http.StatusNotFound, fmt.Sprintf("unknown method %q", vars["method"]))
+		return
+	}
+
+	body := make(map[string]interface{})
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		statusCode := http.StatusBadRequest
+		if _, ok := IsRequestTooLarge(err); ok {
+			statusCode = http.StatusRequestEntityTooLarge
+		}
+		writeGeminiError(writer, statusCode, err.Error())
+		return
+	}
+	translated, err := translateGeminiRequest(model, body, this.conf.Gemini.DefaultMaxTokens)
+	if err != nil {
+		writeGeminiError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	translated["stream"] = stream
+
+	if !stream {
+		recorder := newMessagesRecorder(nil)
+		this.serveTranslatedMessages(request, translated, recorder)
+		recorder.CopyHeader(writer.Header())
+		if recorder.statusCode != http.StatusOK {
+			statusCode, _, message := recorder.Error()
+			writeGeminiError(writer, statusCode, message)
+			return
+		}
+		message, err := recorder.Message()
+		if err != nil {
+			writeGeminiError(writer, http.StatusBadGateway, err.Error())
+			return
+		}
+		this.ResponseJSON(translateGeminiResponse(model, message), writer)
+		return
+	}
+
+	// alt=sse sends the chunks as server-sent events, the default is a streamed JSON array
+	sse := request.URL.Query().Get("alt") == "sse"
+	flusher, _ := writer.(http.Flusher)
+	var recorder *messagesRecorder
+	started := false
+	start := func() {
+		started = true
+		recorder.CopyHeader(writer.Header())
+		if sse {
+			writer.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			writer.Header().Set("Content-Type", "application/json")
+			writer.Write([]byte("["))
+		}
+	}
+	chunks := 0
+	translator := newGeminiStreamTranslator(model, func(chunk map[string]interface{}) {
+		if !started {
+			start()
+		}
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			Log.Error(err)
+			return
+		}
+		if sse {
+			fmt.Fprintf(writer, "data: %s\r\n\r\n", data)
+		} else {
+			if chunks > 0 {
+				writer.Write([]byte(",\r\n"))
+			}
+			writer.Write(data)
+		}
+		chunks++
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	recorder = newMessagesRecorder(translator.Observe)
+	this.serveTranslatedMessages(request, translated, recorder)
+
+	if !started {
+		if recorder.statusCode != http.StatusOK {
+			recorder.CopyHeader(writer.Header())
+			statusCode, _, message := recorder.Error()
+			writeGeminiError(writer, statusCode, message)
+			return
+		}
+		start()
+	}
+	if !sse {
+		writer.Write([]byte("]"))
+	}
+}
@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTranslateGeminiRequest(t *testing.T) {
+	translated, err := translateGeminiRequest("claude-test", decodeTestBody(t, `{
+		"systemInstruction": {"parts": [{"text": "be brief"}]},
+		"contents": [
+			{"role": "user", "parts": [{"text": "weather?"}, {"inlineData": {"mimeType": "image/png", "data": "aGk="}}]},
+			{"role": "model", "parts": [{"text": "hmm", "thought": true}, {"functionCall": {"name": "get_weather", "args": {"city": "Taipei"}}}]},
+			{"role": "user", "parts": [{"functionResponse": {"name": "get_weather", "response": {"sky": "sunny"}}}]},
+			{"role": "user", "parts": [{"text": "thanks"}]}
+		],
+		"tools": [{"functionDeclarations": [{"name": "get_weather", "description": "weather",
+			"parameters": {"type": "OBJECT", "properties": {"city": {"type": "STRING"}}}}]}],
+		"toolConfig": {"functionCallingConfig": {"mode": "ANY", "allowedFunctionNames": ["get_weather"]}},
+		"generationConfig": {"maxOutputTokens": 256, "temperature": 0.2, "stopSequences": ["END"], "thinkingConfig": {"thinkingBudget": 1024}}
+	}`), 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := decodeTestBody(t, `{
+		"model": "claude-test", "max_tokens": 256, "temperature": 0.2, "stop_sequences": ["END"], "system": "be brief",
+		"thinking": {"type": "enabled", "budget_tokens": 1024},
+		"tools": [{"name": "get_weather", "description": "weather", "input_schema": {"type": "object", "properties": {"city": {"type": "string"}}}}],
+		"tool_choice": {"type": "tool", "name": "get_weather"},
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "text", "text": "weather?"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "aGk="}}
+			]},
+			{"role": "assistant", "content": [{"type": "tool_use", "id": "toolu_gemini_1", "name": "get_weather", "input": {"city": "Taipei"}}]},
+			{"role": "user", "content": [
+				{"type": "tool_result", "tool_use_id": "toolu_gemini_1", "content": "{\"sky\":\"sunny\"}"},
+				{"type": "text", "text": "thanks"}
+			]}
+		]}`)
+	got, _ := json.Marshal(translated)
+	want, _ := json.Marshal(expected)
+	if string(got) != string(want) {
+		t.Errorf("unexpected translation\n got: %s\nwant: %s", got, want)
+	}
+
+	for body, message := range map[string]string{
+		`{"contents": [], "tools": [{"googleSearch": {}}]}`:                      "function declarations",
+		`{"contents": [], "generationConfig": {"candidateCount": 2}}`:            "one candidate",
+		`{"contents": [{"parts": [{"functionResponse": {"name": "missing"}}]}]}`: "answers no function call",
+	} {
+		if _, err := translateGeminiRequest("claude-test", decodeTestBody(t, body), 8192); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: expected an error about %q, got %v", body, message, err)
+		}
+	}
+
+	// system instruction parts that are not objects are skipped rather than panicking
+	translated, err = translateGeminiRequest("claude-test", decodeTestBody(t, `{"contents": [], "systemInstruction": {"parts": ["hi", {"text": "be brief"}]}}`), 8192)
+	if err != nil || translated["system"] != "be brief" {
+		t.Errorf("unexpected system prompt %v: %v", translated["system"], err)
+	}
+}
+
+func newGeminiTestService(endpoint string) *HTTPService {
+	client := newTestBedrockClient(endpoint)
+	return &HTTPService{conf: &Config{Gemini: &GeminiConfig{Enable: true, DefaultMaxTokens: 1024}}, bedrockClient: client}
+}
+
+func newGeminiTestRequest(model string, method string, query string) *http.Request {
+	request := httptest.NewRequest("POST", "/v1beta/models/"+model+":"+method+query,
+		strings.NewReader(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`))
+	request.Header.Set("Content-Type", "application/json")
+	return mux.SetURLVars(request, map[string]string{"model": model, "method": method})
+}
+
+func TestHTTPService_HandleGeminiGenerateContent(t *testing.T) {
+	server := newFakeBedrock(t, testStreamEvents, 0)
+	defer server.Close()
+	service := newGeminiTestService(server.URL)
+
+	// the fake only streams, the non-streaming call fails
+	w := httptest.NewRecorder()
+	service.HandleGeminiGenerateContent(w, newGeminiTestRequest("claude-test", "generateContent", ""))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"INVALID_ARGUMENT"`) || !strings.Contains(w.Body.String(), "expected a streaming call") {
+		t.Errorf("expected the error in the Google shape, got %d %s", w.Code, w.Body.String())
+	}
+
+	service.bedrockClient.config.StreamUpstream = true
+	w = httptest.NewRecorder()
+	service.HandleGeminiGenerateContent(w, newGeminiTestRequest("claude-test", "generateContent", ""))
+	response := decodeTestBody(t, w.Body.String())
+	candidate := response["candidates"].([]interface{})[0].(map[string]interface{})
+	parts := candidate["content"].(map[string]interface{})["parts"].([]interface{})
+	usage := response["usageMetadata"].(map[string]interface{})
+	if len(parts) != 2 || parts[0].(map[string]interface{})["text"] != "Hello world" || candidate["finishReason"] != "STOP" ||
+		usage["promptTokenCount"] != float64(10) || usage["candidatesTokenCount"] != float64(25) {
+		t.Errorf("unexpected response %s", w.Body.String())
+	}
+	call := parts[1].(map[string]interface{})["functionCall"].(map[string]interface{})
+	if call["name"] != "get_weather" || call["args"].(map[string]interface{})["city"] != "Hong Kong" {
+		t.Errorf("unexpected function call %v", call)
+	}
+
+	// the default stream is a JSON array of responses
+	w = httptest.NewRecorder()
+	service.HandleGeminiGenerateContent(w, newGeminiTestRequest("claude-test", "streamGenerateContent", ""))
+	var chunks []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &chunks); err != nil {
+		t.Fatalf("expected a JSON array, got %s", w.Body.String())
+	}
+	if len(chunks) != 4 {
+		t.Fatalf("expected two text chunks, a function call and the final chunk, got %s", w.Body.String())
+	}
+	last := chunks[3]["candidates"].([]interface{})[0].(map[string]interface{})
+	if last["finishReason"] != "STOP" || chunks[3]["usageMetadata"].(map[string]interface{})["totalTokenCount"] != float64(35) {
+		t.Errorf("unexpected final chunk %v", chunks[3])
+	}
+
+	w = httptest.NewRecorder()
+	service.HandleGeminiGenerateContent(w, newGeminiTestRequest("claude-test", "streamGenerateContent", "?alt=sse"))
+	if w.Header().Get("Content-Type") != "text/event-stream" || strings.Count(w.Body.String(), "data: ") != 4 {
+		t.Errorf("expected four server-sent events, got %s", w.Body.String())
+	}
+}
+
+func TestRequestAPIKey_Gemini(t *testing.T) {
+	request := httptest.NewRequest("POST", "/v1beta/models/claude:generateContent?key=sk-query", nil)
+	if key := geminiAPIKey(request); key != "sk-query" {
+		t.Errorf("expected the key parameter, got %q", key)
+	}
+	request.Header.Set("x-goog-api-key", "sk-header")
+	if key := geminiAPIKey(request); key != "sk-header" {
+		t.Errorf("expected the x-goog-api-key header, got %q", key)
+	}
+	// the other routes only read x-api-key and the bearer token, so their keys stay out of URLs
+	if key := requestAPIKey(request); len(key) > 0 {
+		t.Errorf("expected the Gemini key to be ignored outside /v1beta, got %q", key)
+	}
+}
@@ -0,0 +1,150 @@
+package pkg
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	googleTokenURL   = "https://oauth2.googleapis.com/token"
+	googleCloudScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// googleServiceAccount is the part of a service account key file used to request access tokens
+type googleServiceAccount struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// googleTokenSource exchanges a signed service account assertion (RFC 7523) for OAuth access tokens and caches them
+type googleTokenSource struct {
+	account *googleServiceAccount
+	key     *rsa.PrivateKey
+	client  *http.Client
+	mu      sync.Mutex
+	token   string
+	expiry  time.Time
+	now     func() time.Time
+}
+
+// newGoogleTokenSource loads a service account key, GOOGLE_APPLICATION_CREDENTIALS is used when path is empty
+func newGoogleTokenSource(path string) (*googleTokenSource, error) {
+	if len(path) == 0 {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if len(path) == 0 {
+		return nil, errors.New("no service account credentials file")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	account := &googleServiceAccount{}
+	if err := json.Unmarshal(data, account); err != nil {
+		return nil, err
+	}
+	if account.Type != "service_account" {
+		return nil, fmt.Errorf("unsupported credentials type %q, a service account key is required", account.Type)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("invalid service account private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the service account private key is not an RSA key")
+	}
+	if len(account.TokenURI) == 0 {
+		account.TokenURI = googleTokenURL
+	}
+	return &googleTokenSource{account: account, key: key, client: http.DefaultClient, now: time.Now}, nil
+}
+
+// assertion builds the signed JWT of the token request
+func (this *googleTokenSource) assertion(now time.Time) (string, error) {
+	encode := func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return base64.RawURLEncoding.EncodeToString(data), err
+	}
+	header, err := encode(map[string]string{"alg": "RS256", "typ": "JWT", "kid": this.account.PrivateKeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := encode(map[string]interface{}{
+		"iss":   this.account.ClientEmail,
+		"scope": googleCloudScope,
+		"aud":   this.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + claims
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, this.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Token returns a cached access token, requesting a new one a minute before it expires
+func (this *googleTokenSource) Token() (string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	now := this.now()
+	if len(this.token) > 0 && now.Add(time.Minute).Before(this.expiry) {
+		return this.token, nil
+	}
+
+	assertion, err := this.assertion(now)
+	if err != nil {
+		return "", err
+	}
+	resp, err := this.client.PostForm(this.account.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK || len(token.AccessToken) == 0 {
+		return "", fmt.Errorf("google token request failed with %d: %s %s", resp.StatusCode, token.Error, token.Description)
+	}
+	this.token = token.AccessToken
+	this.expiry = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	return this.token, nil
+}
@@ -0,0 +1,297 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HedgeHeader tells which attempt of a hedged request served the response, "primary" or the region of the hedge
+const HedgeHeader = "X-Proxy-Hedge"
+
+const (
+	// hedgeSampleSize is the number of recent first byte latencies the hedge delay is computed from
+	hedgeSampleSize = 200
+	// hedgeMinSamples is the number of samples before the percentile replaces the default delay
+	hedgeMinSamples = 20
+)
+
+// HedgeConfig enables a second attempt of slow non-streaming requests on another region or account
+type HedgeConfig struct {
+	Enable  bool             `json:"enable"`
+	Targets []*BedrockTarget `json:"targets,omitempty"`
+	// Percentile of the recent first byte latencies after which the hedge is sent
+	Percentile         float64 `json:"percentile,omitempty"`
+	MinDelayMillis     int     `json:"min_delay_millis,omitempty"`
+	DefaultDelayMillis int     `json:"default_delay_millis,omitempty"`
+	// Keys are the API keys or emails that opted in, "*" opts in every key
+	Keys []string `json:"keys,omitempty"`
+	// MaxDailyExtraCost caps the cost of hedged requests per UTC day, 0 means no cap
+	MaxDailyExtraCost float64 `json:"max_daily_extra_cost_usd,omitempty"`
+}
+
+func LoadHedgeConfigWithEnv() *HedgeConfig {
+	config := &HedgeConfig{
+		Enable:             os.Getenv("HEDGE_ENABLE") == "true",
+		Percentile:         0.95,
+		MinDelayMillis:     500,
+		DefaultDelayMillis: 3000,
+		Keys:               filterNonEmpty(strings.Split(os.Getenv("HEDGE_KEYS"), ",")),
+		MaxDailyExtraCost:  10,
+	}
+	for _, region := range filterNonEmpty(strings.Split(os.Getenv("HEDGE_REGIONS"), ",")) {
+		config.Targets = append(config.Targets, &BedrockTarget{Region: region})
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("HEDGE_PERCENTILE"), 64); err == nil && value > 0 {
+		if value > 1 {
+			value /= 100
+		}
+		config.Percentile = math.Min(value, 1)
+	}
+	if value, ok := parsePositiveInt(os.Getenv("HEDGE_MIN_DELAY_MS")); ok {
+		config.MinDelayMillis = value
+	}
+	if value, ok := parsePositiveInt(os.Getenv("HEDGE_DEFAULT_DELAY_MS")); ok {
+		config.DefaultDelayMillis = value
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("HEDGE_MAX_DAILY_COST_USD"), 64); err == nil && value >= 0 {
+		config.MaxDailyExtraCost = value
+	}
+	return config
+}
+
+// Hedger decides when and where non-streaming requests are hedged
+type Hedger struct {
+	config   *HedgeConfig
+	mu       sync.Mutex
+	samples  []time.Duration
+	next     int
+	target   int
+	spendDay string
+	spend    float64
+	now      func() time.Time
+}
+
+func NewHedger(config *HedgeConfig) *Hedger {
+	return &Hedger{config: config, now: time.Now}
+}
+
+// Observe records the first byte latency of a primary attempt
+func (this *Hedger) Observe(latency time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if len(this.samples) < hedgeSampleSize {
+		this.samples = append(this.samples, latency)
+		return
+	}
+	this.samples[this.next] = latency
+	this.next = (this.next + 1) % hedgeSampleSize
+}
+
+// Delay is how long the primary attempt may take to return its first byte before a hedge is sent
+func (this *Hedger) Delay() time.Duration {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	minDelay := time.Duration(this.config.MinDelayMillis) * time.Millisecond
+	if len(this.samples) < hedgeMinSamples {
+		return time.Duration(math.Max(float64(minDelay), float64(time.Duration(this.config.DefaultDelayMillis)*time.Millisecond)))
+	}
+	sorted := append([]time.Duration{}, this.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	index := int(math.Ceil(this.config.Percentile*float64(len(sorted)))) - 1
+	if index < 0 {
+		index = 0
+	}
+	if sorted[index] < minDelay {
+		return minDelay
+	}
+	return sorted[index]
+}
+
+// Admit reports whether the key of a request opted in and the daily budget is not spent, and picks the target
+func (this *Hedger) Admit(request *http.Request) (*BedrockTarget, bool) {
+	if len(this.config.Targets) == 0 {
+		return nil, false
+	}
+	identity := GetRequestIdentity(request)
+	optedIn := false
+	for _, key := range this.config.Keys {
+		if key == "*" || (identity != nil && (key == identity.APIKey || (len(identity.Email) > 0 && key == identity.Email))) {
+			optedIn = true
+			break
+		}
+	}
+	if !optedIn {
+		return nil, false
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if day := this.now().UTC().Format("2006-01-02"); day != this.spendDay {
+		this.spendDay, this.spend = day, 0
+	}
+	if this.config.MaxDailyExtraCost > 0 && this.spend >= this.config.MaxDailyExtraCost {
+		return nil, false
+	}
+	target := this.config.Targets[this.target%len(this.config.Targets)]
+	this.target++
+	return target, true
+}
+
+// Listener is the UsageListener that charges hedged requests to the daily budget. Either attempt may be
+// billed in full, so the cost of the served response is the upper bound of the extra cost.
+func (this *Hedger) Listener(request *http.Request, usage *RequestUsage) {
+	state := GetRequestState(request)
+	if state == nil || !state.Hedged {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if day := this.now().UTC().Format("2006-01-02"); day != this.spendDay {
+		this.spendDay, this.spend = day, 0
+	}
+	this.spend += usage.Cost
+}
+
+// cancelOnClose cancels the context of a response when its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (this cancelOnClose) Close() error {
+	err := this.ReadCloser.Close()
+	this.cancel()
+	return err
+}
+
+type hedgeAttempt struct {
+	index    int
+	response *http.Response
+	err      error
+	target   *BedrockTarget
+	cancel   context.CancelFunc
+}
+
+// hedgeOutcome tells whether a request was hedged and which target served it, nil for the primary region
+type hedgeOutcome struct {
+	hedged bool
+	target *BedrockTarget
+}
+
+// recordHedge sets the hedge state and header of a request, it must not run concurrently for one request
+func recordHedge(r *http.Request, outcome *hedgeOutcome) {
+	if outcome == nil || !outcome.hedged {
+		return
+	}
+	winner := "primary"
+	if state := GetRequestState(r); state != nil {
+		state.Hedged = true
+		if outcome.target != nil {
+			state.Region = outcome.target.Region
+			state.Target = outcome.target
+		}
+	}
+	if outcome.target != nil {
+		winner = outcome.target.Region
+	}
+	SetResponseHeader(r, HedgeHeader, winner)
+}
+
+// doHedged sends the primary request and, when it has not returned its first byte within the hedge delay,
+// the same model and payload to another target. The first usable response wins and the other attempt is cancelled.
+// stream signs the hedge for invoke-with-response-stream, like the primary of an assembled stream.
+// observe feeds the latency of the primary into the hedge delay, which is only done for Messages requests.
+// It does not touch the request state, so the batches of one request may be hedged concurrently.
+func (this *BedrockClient) doHedged(r *http.Request, primary *http.Request, client *http.Client, model string, payload []byte, stream bool, observe bool) (*http.Response, *hedgeOutcome, error) {
+	results := make(chan *hedgeAttempt, 2)
+	var cancels []context.CancelFunc
+	send := func(request *http.Request, target *BedrockTarget) {
+		ctx, cancel := context.WithCancel(r.Context())
+		attempt := &hedgeAttempt{index: len(cancels), target: target, cancel: cancel}
+		cancels = append(cancels, cancel)
+		go func() {
+			attempt.response, attempt.err = client.Do(request.WithContext(ctx))
+			results <- attempt
+		}()
+	}
+
+	started := time.Now()
+	send(primary, nil)
+	pending := 1
+	timer := time.NewTimer(this.hedger.Delay())
+	defer timer.Stop()
+	hedged := false
+
+	for {
+		select {
+		case <-timer.C:
+			if len(payload) == 0 {
+				continue
+			}
+			target, ok := this.hedger.Admit(r)
+			if !ok {
+				continue
+			}
+			request, err := this.signInvoke(target, model, primary.Header.Get("Content-Type"), bytes.NewReader(payload), payload, stream)
+			if err != nil {
+				Log.Errorf("failed to sign the hedge to %s: %v", target.Region, err)
+				continue
+			}
+			Log.Debugf("hedging %s to %s after %v", model, target.Region, time.Since(started))
+			hedged = true
+			pending++
+			send(request, target)
+
+		case attempt := <-results:
+			pending--
+			usable := attempt.err == nil && attempt.response.StatusCode < http.StatusInternalServerError
+			if usable && observe {
+				// when the hedge wins, the primary has not answered yet and the time so far is a lower bound of its
+				// latency. Sampling it keeps slow primaries in the percentile, which would otherwise drift down.
+				this.hedger.Observe(time.Since(started))
+			}
+			if !usable && pending > 0 {
+				// wait for the other attempt
+				if attempt.response != nil {
+					attempt.response.Body.Close()
+				}
+				attempt.cancel()
+				continue
+			}
+
+			// cancel the attempt still in flight, if any, and release its response
+			for index, cancel := range cancels {
+				if index != attempt.index {
+					cancel()
+				}
+			}
+			if pending > 0 {
+				go func(pending int) {
+					for i := 0; i < pending; i++ {
+						loser := <-results
+						loser.cancel()
+						if loser.response != nil {
+							loser.response.Body.Close()
+						}
+					}
+				}(pending)
+			}
+			outcome := &hedgeOutcome{hedged: hedged, target: attempt.target}
+			if attempt.err != nil {
+				attempt.cancel()
+				return nil, outcome, attempt.err
+			}
+			attempt.response.Body = cancelOnClose{ReadCloser: attempt.response.Body, cancel: attempt.cancel}
+			return attempt.response, outcome, nil
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package pkg
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testHedgeMessage = `{"id":"msg_1","type":"message","role":"assistant","content":[],"usage":{"input_tokens":1,"output_tokens":1}}`
+
+func TestHedger(t *testing.T) {
+	hedger := NewHedger(&HedgeConfig{
+		Targets:            []*BedrockTarget{{Region: "us-west-2"}, {Region: "eu-west-1"}},
+		Percentile:         0.9,
+		MinDelayMillis:     100,
+		DefaultDelayMillis: 2000,
+		Keys:               []string{"sk-hedge"},
+		MaxDailyExtraCost:  1,
+	})
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	hedger.now = func() time.Time { return now }
+
+	if delay := hedger.Delay(); delay != 2*time.Second {
+		t.Errorf("expected the default delay before enough samples, got %v", delay)
+	}
+	for i := 1; i <= 100; i++ {
+		hedger.Observe(time.Duration(i) * 10 * time.Millisecond)
+	}
+	if delay := hedger.Delay(); delay != 900*time.Millisecond {
+		t.Errorf("expected the p90 latency, got %v", delay)
+	}
+
+	request := httptest.NewRequest("POST", "/v1/messages", nil)
+	if _, ok := hedger.Admit(request.WithContext(WithRequestIdentity(request.Context(), &RequestIdentity{APIKey: "sk-other"}))); ok {
+		t.Errorf("keys that did not opt in should not be hedged")
+	}
+	request = request.WithContext(WithRequestIdentity(request.Context(), &RequestIdentity{APIKey: "sk-hedge"}))
+	first, ok := hedger.Admit(request)
+	second, _ := hedger.Admit(request)
+	if !ok || first.Region != "us-west-2" || second.Region != "eu-west-1" {
+		t.Errorf("expected the targets in turn, got %v %v", first, second)
+	}
+
+	state := NewRequestState()
+	state.Hedged = true
+	hedger.Listener(request.WithContext(WithRequestState(request.Context(), state)), &RequestUsage{Cost: 1.5})
+	if _, ok := hedger.Admit(request); ok {
+		t.Errorf("the daily budget is spent")
+	}
+	now = now.Add(24 * time.Hour)
+	if _, ok := hedger.Admit(request); !ok {
+		t.Errorf("the budget should reset the next day")
+	}
+}
+
+func TestBedrockClient_HandleProxyHedged(t *testing.T) {
+	release := make(chan struct{})
+	var primaryCancelled int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server only notices the client went away once the body is read
+		io.ReadAll(r.Body)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			atomic.AddInt32(&primaryCancelled, 1)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testHedgeMessage))
+	}))
+	defer primary.Close()
+	defer close(release)
+
+	var hedgeCalls int32
+	hedge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hedgeCalls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testHedgeMessage))
+	}))
+	defer hedge.Close()
+
+	client := newTestBedrockClient(primary.URL)
+	hedger := NewHedger(&HedgeConfig{
+		Targets:            []*BedrockTarget{{Region: "us-west-2", Endpoint: hedge.URL}},
+		Percentile:         0.95,
+		MinDelayMillis:     50,
+		DefaultDelayMillis: 50,
+		Keys:               []string{"sk-hedge"},
+	})
+	client.SetHedger(hedger)
+
+	send := func(apiKey string) *httptest.ResponseRecorder {
+		request := newTestMessageRequest(false)
+		request = request.WithContext(WithRequestIdentity(request.Context(), &RequestIdentity{APIKey: apiKey}))
+		w := httptest.NewRecorder()
+		client.HandleProxy(w, request)
+		return w
+	}
+
+	w := send("sk-hedge")
+	if w.Code != http.StatusOK || w.Header().Get(HedgeHeader) != "us-west-2" {
+		t.Fatalf("expected the hedge to win, got %d %v", w.Code, w.Header())
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&primaryCancelled) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&primaryCancelled) != 1 {
+		t.Errorf("the primary attempt should be cancelled")
+	}
+	// the primary that lost is sampled with the time it took the hedge to win
+	if len(hedger.samples) != 1 || hedger.samples[0] < 50*time.Millisecond {
+		t.Errorf("expected the lower bound of the primary latency, got %v", hedger.samples)
+	}
+
+	// keys that did not opt in wait for the primary
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		release <- struct{}{}
+	}()
+	w = send("sk-other")
+	if w.Code != http.StatusOK || len(w.Header().Get(HedgeHeader)) > 0 || atomic.LoadInt32(&hedgeCalls) != 1 {
+		t.Errorf("expected the primary to serve the request, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestBedrockClient_HandleAssembledStreamHedged(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer primary.Close()
+	hedge := newFakeBedrock(t, testStreamEvents, 0)
+	defer hedge.Close()
+
+	client := newTestBedrockClient(primary.URL)
+	client.config.StreamUpstream = true
+	client.SetHedger(NewHedger(&HedgeConfig{
+		Targets:            []*BedrockTarget{{Region: "us-west-2", Endpoint: hedge.URL}},
+		Percentile:         0.95,
+		MinDelayMillis:     50,
+		DefaultDelayMillis: 50,
+		Keys:               []string{"*"},
+	}))
+
+	w := httptest.NewRecorder()
+	client.HandleProxy(w, newTestMessageRequest(false))
+	// the hedge is sent to invoke-with-response-stream too, the fake answers 400 otherwise
+	if w.Code != http.StatusOK || w.Header().Get(HedgeHeader) != "us-west-2" {
+		t.Fatalf("expected the hedge to serve the assembled message, got %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+	var message map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &message); err != nil || message["stop_reason"] != "tool_use" {
+		t.Errorf("unexpected message: %s", w.Body.String())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,8 +22,17 @@ type HttpConfig struct {
 type HTTPService struct {
 	conf          *Config
 	bedrockClient *BedrockClient
+	providers     []MessagesProvider
 	zohoAuth      *ZohoOAuth
 	ApiStorage    APIKeyStore
+	FileStorage   FileStore
+	UsageLedger   *UsageLedger
+	Quotas        *QuotaManager
+	RateLimiter   *RateLimiter
+	Queue         *FairQueue
+	Concurrency   *AdaptiveConcurrency
+	Shadow        *Shadow
+	Embeddings    *Embeddings
 	apiKeysMutex  sync.RWMutex
 }
 
@@ -64,6 +74,16 @@ func (this *HTTPService) HandleListModels(writer http.ResponseWriter, request *h
 			Type:        "model",
 		})
 	}
+	for _, provider := range this.providers {
+		for _, model := range provider.Models() {
+			response.Data = append(response.Data, APIModelInfo{
+				CreatedAt:   "2025-02-19T00:00:00Z",
+				DisplayName: model + " (" + provider.Name() + ")",
+				ID:          model,
+				Type:        "model",
+			})
+		}
+	}
 
 	this.ResponseJSON(response, writer)
 }
@@ -86,6 +106,9 @@ type ExistApiKey struct {
 
 func NewHttpService(conf *Config) *HTTPService {
 	bedrock := NewBedrockClient(conf.BedrockConfig)
+	if conf.URLSourceConfig != nil {
+		bedrock.AddTransformer(NewURLSourceResolver(conf.URLSourceConfig))
+	}
 	zohoConfig := LoadZohoConfigFromEnv()
 	var cache APIKeyStore
 	cache, err := NewCache()
@@ -94,11 +117,169 @@ func NewHttpService(conf *Config) *HTTPService {
 		cache = NewMemoryStore(24 * time.Hour) // Fallback to in-memory store if cache creation fails
 	}
 
+	var fileStore FileStore
+	if conf.FilesConfig != nil && conf.FilesConfig.Enable {
+		localStore, err := NewLocalFileStore(conf.FilesConfig.Dir)
+		if err != nil {
+			Log.Errorf("Failed to create file store: %v", err)
+		} else {
+			fileStore = localStore
+			bedrock.AddTransformer(NewFileSourceResolver(fileStore, conf.FilesConfig.MaxInlineSize))
+			// uploads are bounded by the file size limit instead of the default body limit
+			if limits := conf.BodyLimitConfig; limits != nil {
+				if limits.EndpointLimits == nil {
+					limits.EndpointLimits = map[string]int64{}
+				}
+				if _, ok := limits.EndpointLimits["/v1/files"]; !ok {
+					limits.EndpointLimits["/v1/files"] = conf.FilesConfig.MaxFileSize + 1024*1024
+				}
+			}
+		}
+	}
+
+	if conf.ResponseCache != nil && conf.ResponseCache.Enable {
+		if store, ok := cache.(*Cache); ok {
+			bedrock.SetResponseCache(NewResponseCache(conf.ResponseCache, store))
+		} else {
+			Log.Warning("response cache requires the NutsDB cache, disabled")
+		}
+	}
+
+	if conf.CircuitBreaker != nil && conf.CircuitBreaker.Enable {
+		bedrock.SetCircuitBreakers(NewCircuitBreakers(conf.CircuitBreaker, conf.BedrockConfig.AccessKey, conf.BedrockConfig.Region))
+	}
+
+	if conf.Experiment != nil && conf.Experiment.Enable {
+		bedrock.SetExperimentRouter(NewExperimentRouter(conf.Experiment))
+	}
+
+	if conf.Hedge != nil && conf.Hedge.Enable {
+		hedger := NewHedger(conf.Hedge)
+		bedrock.SetHedger(hedger)
+		bedrock.AddUsageListener(hedger.Listener)
+	}
+
+	if conf.Pricing != nil && conf.Pricing.Enable {
+		bedrock.SetPriceTable(NewPriceTable(conf.Pricing))
+	}
+
+	var usageLedger *UsageLedger
+	if conf.UsageLedger != nil && conf.UsageLedger.Enable {
+		if store, ok := cache.(*Cache); ok {
+			usageLedger = NewUsageLedger(NewNutsUsageStore(store, conf.UsageLedger))
+			bedrock.AddUsageListener(usageLedger.Listener)
+		} else {
+			Log.Warning("usage ledger requires the NutsDB cache, disabled")
+		}
+	}
+
+	// replicas share API keys, quotas and rate limits through redis, otherwise they are kept locally
+	apiStorage := cache
+	var quotaStore QuotaStore
+	if store, ok := cache.(*Cache); ok {
+		quotaStore = store
+	}
+	var rateLimitStore RateLimitStore = NewLocalRateLimitStore()
+	if conf.SharedState != nil && len(conf.SharedState.RedisURL) > 0 {
+		store, err := NewRedisStore(conf.SharedState)
+		if err != nil {
+			Log.Errorf("Failed to connect the shared state, using local state: %v", err)
+		} else {
+			apiStorage = &fallbackAPIKeyStore{primary: store, local: cache}
+			quotaStore = store
+			rateLimitStore = &fallbackRateLimitStore{primary: store, local: rateLimitStore}
+		}
+	}
+
+	var quotas *QuotaManager
+	if conf.Quota != nil && conf.Quota.Enable {
+		if quotaStore != nil {
+			quotas = NewQuotaManager(conf.Quota, quotaStore)
+			bedrock.AddUsageListener(quotas.Listener)
+		} else {
+			Log.Warning("quotas require the NutsDB cache or the shared state, disabled")
+		}
+	}
+
+	var rateLimiter *RateLimiter
+	if conf.RateLimit != nil && conf.RateLimit.Enable {
+		rateLimiter = NewRateLimiter(conf.RateLimit, rateLimitStore)
+		bedrock.AddUsageListener(rateLimiter.Listener)
+	}
+
+	var queue *FairQueue
+	if conf.Queue != nil && conf.Queue.Enable {
+		queue = NewFairQueue(conf.Queue)
+	}
+	var concurrency *AdaptiveConcurrency
+	if conf.Concurrency != nil && conf.Concurrency.Enable {
+		if queue != nil {
+			concurrency = NewAdaptiveConcurrency(conf.Concurrency, queue, conf.BedrockConfig.Region)
+			bedrock.AddUsageListener(concurrency.Listener)
+		} else {
+			Log.Warning("adaptive concurrency requires the request queue, disabled")
+		}
+	}
+
+	// images are processed after all transformers (url and file sources inlined, smart routing)
+	// and the experiment assignment, with the limits of the model serving the request
+	if conf.ImageConfig != nil {
+		bedrock.SetImageProcessor(NewImageProcessor(conf.ImageConfig, conf.BedrockConfig.ModelMappings))
+	}
+
+	if conf.SmartRouting != nil && conf.SmartRouting.Enable {
+		if router, err := NewSmartRouter(conf.SmartRouting); err != nil {
+			Log.Errorf("smart routing disabled: %v", err)
+		} else {
+			bedrock.AddTransformer(router)
+		}
+	}
+
+	var providers []MessagesProvider
+	if conf.Providers != nil {
+		for _, providerConfig := range conf.Providers.Providers {
+			provider, err := NewAnthropicProvider(providerConfig, bedrock)
+			if err != nil {
+				Log.Errorf("provider disabled: %v", err)
+				continue
+			}
+			providers = append(providers, provider)
+		}
+	}
+	if conf.Converse != nil && conf.Converse.Enable && len(conf.Converse.Models) > 0 {
+		providers = append(providers, NewConverseProvider(conf.Converse, bedrock))
+	}
+
+	var embeddings *Embeddings
+	if conf.Embeddings != nil && conf.Embeddings.Enable {
+		embeddings = NewEmbeddings(conf.Embeddings, bedrock)
+	}
+
+	var shadow *Shadow
+	if conf.Shadow != nil && conf.Shadow.Enable {
+		if store, ok := cache.(*Cache); ok && len(conf.Shadow.Model) > 0 {
+			shadow = NewShadow(conf.Shadow, bedrock, store)
+			bedrock.AddTransformer(shadow)
+			bedrock.AddUsageListener(shadow.Listener)
+		} else {
+			Log.Warning("shadow traffic requires the NutsDB cache and a candidate model, disabled")
+		}
+	}
+
 	return &HTTPService{
 		conf:          conf,
 		bedrockClient: bedrock,
+		providers:     providers,
 		zohoAuth:      NewZohoOAuth(zohoConfig),
-		ApiStorage:    cache,
+		ApiStorage:    apiStorage,
+		FileStorage:   fileStore,
+		UsageLedger:   usageLedger,
+		Quotas:        quotas,
+		RateLimiter:   rateLimiter,
+		Queue:         queue,
+		Concurrency:   concurrency,
+		Shadow:        shadow,
+		Embeddings:    embeddings,
 	}
 }
 
@@ -223,6 +404,18 @@ func (this *HTTPService) ResponseError(err error, writer http.ResponseWriter) {
 	http.Error(writer, string(json_str), 200)
 }
 
+// writeAPIError writes an Anthropic style error body with the given status code
+func writeAPIError(writer http.ResponseWriter, status int, errType string, message string) {
+	server_error := &APIStandardError{Type: "error", Error: &APIError{
+		Type:    errType,
+		Message: message,
+	}}
+	json_str, _ := json.Marshal(server_error)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(json_str)
+}
+
 func (this *HTTPService) ResponseJSON(source interface{}, writer http.ResponseWriter) {
 	encoder := json.NewEncoder(writer)
 	encoder.SetEscapeHTML(false)
@@ -244,11 +437,44 @@ func (this *HTTPService) HandleMessageComplete(writer http.ResponseWriter, reque
 		return
 	}
 
-	this.bedrockClient.HandleProxy(writer, request)
+	request = request.WithContext(WithRequestState(request.Context(), NewRequestState()))
+	this.serveMessages(writer, request)
+}
+
+// requestAPIKey returns the API key of the x-api-key header or the bearer token OpenAI style clients send
+func requestAPIKey(request *http.Request) string {
+	if apiKey := request.Header.Get("x-api-key"); len(apiKey) > 0 {
+		return apiKey
+	}
+	if token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// geminiAPIKey also accepts the x-goog-api-key header and the key query parameter of Gemini clients.
+// It is only used by the /v1beta routes, so the keys of the other routes never appear in URLs and access logs.
+func geminiAPIKey(request *http.Request) string {
+	if apiKey := requestAPIKey(request); len(apiKey) > 0 {
+		return apiKey
+	}
+	if apiKey := request.Header.Get("x-goog-api-key"); len(apiKey) > 0 {
+		return apiKey
+	}
+	return request.URL.Query().Get("key")
 }
 
 // APIKeyMiddleware 验证 API Key 的中间件
 func (this *HTTPService) APIKeyMiddleware(next http.Handler) http.Handler {
+	return this.apiKeyMiddleware(next, requestAPIKey)
+}
+
+// GeminiAPIKeyMiddleware 验证 Gemini 客戶端的 API Key，另接受 x-goog-api-key 及 key 參數
+func (this *HTTPService) GeminiAPIKeyMiddleware(next http.Handler) http.Handler {
+	return this.apiKeyMiddleware(next, geminiAPIKey)
+}
+
+func (this *HTTPService) apiKeyMiddleware(next http.Handler, keyOf func(*http.Request) string) http.Handler {
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		Log.Debug("APIKeyMiddleware")
 		APIKey := this.conf.APIKey
@@ -257,7 +483,7 @@ func (this *HTTPService) APIKeyMiddleware(next http.Handler) http.Handler {
 			next.ServeHTTP(writer, request)
 			return
 		}
-		apiKey := request.Header.Get("x-api-key")
+		apiKey := keyOf(request)
 		Log.Debugf("API key in header: %s", apiKey)
 		if apiKey == "" {
 			this.ResponseError(fmt.Errorf("invalid api key"), writer)
@@ -276,7 +502,19 @@ func (this *HTTPService) APIKeyMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		next.ServeHTTP(writer, request)
+		identity := &RequestIdentity{APIKey: apiKey, IsMaster: apiKey == APIKey}
+		if !identity.IsMaster {
+			if email, err := this.ApiStorage.GetAPIKey(apiKey); err == nil {
+				identity.Email = email
+			}
+		}
+
+		// 在簽名請求之前檢查配額
+		if !this.enforceQuota(writer, request, identity) {
+			return
+		}
+
+		next.ServeHTTP(writer, request.WithContext(WithRequestIdentity(request.Context(), identity)))
 	})
 }
 
@@ -349,9 +587,73 @@ func (this *HTTPService) Start() {
 	// 需要 API Key 的路由
 	apiRouter := rHandler.PathPrefix("/v1").Subrouter()
 	apiRouter.Use(this.APIKeyMiddleware)
+	apiRouter.Use(this.BodyLimitMiddleware)
+	apiRouter.Use(this.RateLimitMiddleware)
 
 	apiRouter.HandleFunc("/messages", this.HandleMessageComplete)
 	apiRouter.HandleFunc("/models", this.HandleListModels).Methods("GET")
+	if this.Embeddings != nil {
+		apiRouter.HandleFunc("/embeddings", this.HandleEmbeddings).Methods("POST")
+	}
+
+	if this.FileStorage != nil {
+		apiRouter.HandleFunc("/files", this.HandleUploadFile).Methods("POST")
+		apiRouter.HandleFunc("/files", this.HandleListFiles).Methods("GET")
+		apiRouter.HandleFunc("/files/{file_id}", this.HandleGetFile).Methods("GET")
+		apiRouter.HandleFunc("/files/{file_id}", this.HandleDeleteFile).Methods("DELETE")
+		apiRouter.HandleFunc("/files/{file_id}/content", this.HandleDownloadFile).Methods("GET")
+	}
+
+	if this.UsageLedger != nil {
+		apiRouter.HandleFunc("/usage", this.HandleUsage).Methods("GET")
+	}
+
+	// Gemini 相容路由，API Key 可放在 x-goog-api-key 或 key 參數
+	if this.conf.Gemini != nil && this.conf.Gemini.Enable {
+		geminiRouter := rHandler.PathPrefix("/v1beta").Subrouter()
+		geminiRouter.Use(this.GeminiAPIKeyMiddleware)
+		geminiRouter.Use(this.BodyLimitMiddleware)
+		geminiRouter.Use(this.RateLimitMiddleware)
+		geminiRouter.HandleFunc("/models", this.HandleGeminiModels).Methods("GET")
+		geminiRouter.HandleFunc("/models/{model}:{method}", this.HandleGeminiGenerateContent).Methods("POST")
+	}
+
+	// Ollama 相容路由，讓 Ollama 客戶端只需改 base URL
+	if this.conf.Ollama != nil && this.conf.Ollama.Enable {
+		ollamaRouter := rHandler.PathPrefix("/api").Subrouter()
+		ollamaRouter.Use(this.APIKeyMiddleware)
+		ollamaRouter.Use(this.BodyLimitMiddleware)
+		ollamaRouter.Use(this.RateLimitMiddleware)
+		ollamaRouter.HandleFunc("/tags", this.HandleOllamaTags).Methods("GET")
+		ollamaRouter.HandleFunc("/version", this.HandleOllamaVersion).Methods("GET")
+		ollamaRouter.HandleFunc("/chat", this.HandleOllamaChat).Methods("POST")
+		ollamaRouter.HandleFunc("/generate", this.HandleOllamaGenerate).Methods("POST")
+	}
+
+	// 只限主 API Key 的管理路由
+	adminRouter := apiRouter.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(this.AdminMiddleware)
+	if this.UsageLedger != nil {
+		adminRouter.HandleFunc("/usage", this.HandleAdminUsage).Methods("GET")
+	}
+	if this.Quotas != nil {
+		adminRouter.HandleFunc("/quotas", this.HandleAdminQuotas).Methods("GET")
+		adminRouter.HandleFunc("/quotas", this.HandleAdminSetQuota).Methods("PUT")
+		adminRouter.HandleFunc("/quotas", this.HandleAdminDeleteQuota).Methods("DELETE")
+	}
+	if this.Queue != nil {
+		adminRouter.HandleFunc("/queues", this.HandleAdminQueues).Methods("GET")
+	}
+	if this.bedrockClient.breakers != nil {
+		adminRouter.HandleFunc("/breakers", this.HandleAdminBreakers).Methods("GET")
+		adminRouter.HandleFunc("/breakers", this.HandleAdminResetBreakers).Methods("DELETE")
+	}
+	if this.Shadow != nil {
+		adminRouter.HandleFunc("/shadow", this.HandleAdminShadow).Methods("GET")
+	}
+	if this.bedrockClient.experiments != nil {
+		adminRouter.HandleFunc("/experiments", this.HandleAdminExperiments).Methods("GET")
+	}
 
 	rHandler.HandleFunc("/", this.RedirectLanding)
 	rHandler.PathPrefix("/").Handler(http.StripPrefix("/",
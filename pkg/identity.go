@@ -0,0 +1,39 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+)
+
+type identityContextKey struct{}
+
+// RequestIdentity describes who is calling the proxy, resolved by APIKeyMiddleware
+type RequestIdentity struct {
+	APIKey string `json:"api_key"`
+	Email  string `json:"email,omitempty"`
+	// IsMaster is true when the request used the global API_KEY
+	IsMaster bool `json:"is_master,omitempty"`
+}
+
+// Owner returns the stable owner id of the identity, the email for user keys and the api key otherwise
+func (this *RequestIdentity) Owner() string {
+	if this == nil {
+		return ""
+	}
+	if len(this.Email) > 0 {
+		return this.Email
+	}
+	return this.APIKey
+}
+
+func WithRequestIdentity(ctx context.Context, identity *RequestIdentity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+// GetRequestIdentity returns the identity attached to the request, or nil when the request is anonymous
+func GetRequestIdentity(request *http.Request) *RequestIdentity {
+	if identity, ok := request.Context().Value(identityContextKey{}).(*RequestIdentity); ok {
+		return identity
+	}
+	return nil
+}
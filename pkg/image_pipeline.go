@@ -0,0 +1,356 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// ImageConfig controls the downscaling and re-encoding of base64 image blocks
+type ImageConfig struct {
+	Enable bool `json:"enable"`
+	// MaxEdge is the longest edge in pixels an image is downscaled to, 0 disables downscaling
+	MaxEdge       int            `json:"max_edge"`
+	ModelMaxEdges map[string]int `json:"model_max_edges,omitempty"`
+	// Format is the output format, "jpeg" or "png", empty keeps the source format when possible
+	Format  string `json:"format,omitempty"`
+	Quality int    `json:"quality"`
+	// MaxPixels rejects images whose declared dimensions would need more memory to decode
+	MaxPixels int `json:"max_pixels"`
+}
+
+func LoadImageConfigWithEnv() *ImageConfig {
+	config := &ImageConfig{
+		Enable:        os.Getenv("IMAGE_PIPELINE_ENABLE") == "true",
+		MaxEdge:       1568,
+		ModelMaxEdges: map[string]int{},
+		Format:        strings.ToLower(os.Getenv("IMAGE_FORMAT")),
+		Quality:       85,
+		MaxPixels:     25 * 1000 * 1000,
+	}
+
+	if raw := os.Getenv("IMAGE_MAX_EDGE"); len(raw) > 0 {
+		if edge, err := strconv.Atoi(raw); err == nil {
+			config.MaxEdge = edge
+		}
+	}
+	for model, raw := range ParseMappingsFromStr(os.Getenv("IMAGE_MODEL_MAX_EDGES")) {
+		if edge, err := strconv.Atoi(raw); err == nil {
+			config.ModelMaxEdges[model] = edge
+		}
+	}
+	if raw := os.Getenv("IMAGE_QUALITY"); len(raw) > 0 {
+		if quality, err := strconv.Atoi(raw); err == nil {
+			config.Quality = quality
+		}
+	}
+	if value, ok := parsePositiveInt(os.Getenv("IMAGE_MAX_PIXELS")); ok {
+		config.MaxPixels = value
+	}
+
+	return config
+}
+
+// ImageProcessor is a MessageTransformer that downsizes, re-encodes and strips metadata of base64 images.
+// It runs once the model serving the request is known, see BedrockClient.SetImageProcessor.
+type ImageProcessor struct {
+	config   *ImageConfig
+	mappings map[string]string
+}
+
+// NewImageProcessor returns a processor looking up the per-model limits by the request model,
+// then by the Bedrock model it is mapped to by mappings
+func NewImageProcessor(config *ImageConfig, mappings map[string]string) *ImageProcessor {
+	return &ImageProcessor{config: config, mappings: mappings}
+}
+
+// ProcessedImage is the result of ProcessImage
+type ProcessedImage struct {
+	MediaType string
+	Data      []byte
+	Resized   bool
+}
+
+func (this *ImageProcessor) maxEdgeFor(model string) int {
+	if edge, ok := this.config.ModelMaxEdges[model]; ok {
+		return edge
+	}
+	if mapped, ok := this.mappings[model]; ok {
+		if edge, ok := this.config.ModelMaxEdges[mapped]; ok {
+			return edge
+		}
+	}
+	return this.config.MaxEdge
+}
+
+// hasEXIF reports whether a JPEG carries an EXIF segment
+func hasEXIF(data []byte) bool {
+	if len(data) > 64*1024 {
+		data = data[:64*1024]
+	}
+	return bytes.Contains(data, []byte("Exif\x00\x00"))
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, 1 when it has none
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	offset := 2
+	for offset+4 <= len(data) && data[offset] == 0xFF {
+		marker := data[offset+1]
+		// the metadata segments precede the start of scan
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		size := int(binary.BigEndian.Uint16(data[offset+2:]))
+		end := offset + 2 + size
+		if size < 2 || end > len(data) {
+			break
+		}
+		if marker == 0xE1 {
+			if orientation, ok := exifOrientation(data[offset+4 : end]); ok {
+				return orientation
+			}
+		}
+		offset = end
+	}
+	return 1
+}
+
+// exifOrientation reads the Orientation tag of the first IFD of an APP1 Exif segment
+func exifOrientation(segment []byte) (int, bool) {
+	if len(segment) < 14 || string(segment[:6]) != "Exif\x00\x00" {
+		return 0, false
+	}
+	tiff := segment[6:]
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, false
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, false
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			return orientation, orientation >= 1 && orientation <= 8
+		}
+	}
+	return 0, false
+}
+
+// orientImage rotates or flips img as told by an EXIF orientation, since the tag is lost on re-encoding
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = width-1-x, y
+			case 3:
+				dx, dy = width-1-x, height-1-y
+			case 4:
+				dx, dy = x, height-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = height-1-y, x
+			case 7:
+				dx, dy = height-1-y, width-1-x
+			case 8:
+				dx, dy = y, width-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// ImageTooLargeError is returned by ProcessImage for images declaring more pixels than allowed,
+// they are rejected before decoding since a few compressed bytes may declare gigabytes of pixels
+type ImageTooLargeError struct {
+	Width  int
+	Height int
+	Limit  int
+}
+
+func (this *ImageTooLargeError) Error() string {
+	return fmt.Sprintf("image of %dx%d pixels exceeds the limit of %d pixels", this.Width, this.Height, this.Limit)
+}
+
+// ProcessImage returns the re-encoded image, or nil when the original should be kept
+func (this *ImageProcessor) ProcessImage(data []byte, maxEdge int) (*ProcessedImage, error) {
+	header, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if limit := this.config.MaxPixels; limit > 0 && int64(header.Width)*int64(header.Height) > int64(limit) {
+		return nil, &ImageTooLargeError{Width: header.Width, Height: header.Height, Limit: limit}
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	resized := maxEdge > 0 && (width > maxEdge || height > maxEdge)
+	withEXIF := format == "jpeg" && hasEXIF(data)
+
+	targetFormat := this.config.Format
+	if len(targetFormat) == 0 {
+		targetFormat = format
+		if format != "jpeg" && format != "png" {
+			targetFormat = "png"
+		}
+	}
+
+	if !resized && !withEXIF && targetFormat == format {
+		return nil, nil
+	}
+	// keep animations when only the format would change
+	if format == "gif" && !resized && len(this.config.Format) == 0 {
+		return nil, nil
+	}
+
+	if resized {
+		scale := float64(maxEdge) / float64(width)
+		if height > width {
+			scale = float64(maxEdge) / float64(height)
+		}
+		newWidth := int(float64(width)*scale + 0.5)
+		newHeight := int(float64(height)*scale + 0.5)
+		if newWidth < 1 {
+			newWidth = 1
+		}
+		if newHeight < 1 {
+			newHeight = 1
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+		xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, xdraw.Src, nil)
+		img = dst
+	}
+	// the longest edge does not depend on the orientation, rotate the downscaled image
+	if withEXIF {
+		img = orientImage(img, jpegOrientation(data))
+	}
+
+	var buf bytes.Buffer
+	result := &ProcessedImage{Resized: resized}
+	switch targetFormat {
+	case "jpeg":
+		// JPEG has no alpha channel, flatten on white
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		err = jpeg.Encode(&buf, flat, &jpeg.Options{Quality: this.config.Quality})
+		result.MediaType = "image/jpeg"
+	default:
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		err = encoder.Encode(&buf, img)
+		result.MediaType = "image/png"
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// re-encoding without a reason other than the format must pay off
+	if !resized && !withEXIF && buf.Len() >= len(data) {
+		return nil, nil
+	}
+
+	result.Data = buf.Bytes()
+	return result, nil
+}
+
+func (this *ImageProcessor) TransformMessage(request *http.Request, body map[string]interface{}) error {
+	if !this.config.Enable {
+		return nil
+	}
+
+	model, _ := body["model"].(string)
+	maxEdge := this.maxEdgeFor(model)
+	processed := 0
+	saved := 0
+
+	err := WalkContentBlocks(body, func(block map[string]interface{}) error {
+		if block["type"] != "image" {
+			return nil
+		}
+		source, ok := getBlockSource(block)
+		if !ok || source["type"] != "base64" {
+			return nil
+		}
+		encoded, _ := source["data"].(string)
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil
+		}
+
+		result, err := this.ProcessImage(data, maxEdge)
+		var tooLarge *ImageTooLargeError
+		if errors.As(err, &tooLarge) {
+			return NewInvalidRequestError("%v", tooLarge)
+		}
+		if err != nil {
+			Log.Warningf("skip image processing: %v", err)
+			return nil
+		}
+		if result == nil {
+			return nil
+		}
+
+		source["data"] = base64.StdEncoding.EncodeToString(result.Data)
+		source["media_type"] = result.MediaType
+		processed++
+		saved += len(data) - len(result.Data)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if processed > 0 {
+		SetResponseHeader(request, "X-Proxy-Images-Processed", strconv.Itoa(processed))
+		SetResponseHeader(request, "X-Proxy-Image-Bytes-Saved", strconv.Itoa(saved))
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: uint8(x + y), A: 255})
+		}
+	}
+	return img
+}
+
+func TestImageProcessor_ProcessImage(t *testing.T) {
+	processor := NewImageProcessor(&ImageConfig{Enable: true, MaxEdge: 100, Quality: 80}, nil)
+
+	var pngBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, newTestImage(400, 200)); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Downscale", func(t *testing.T) {
+		result, err := processor.ProcessImage(pngBuf.Bytes(), 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result == nil || !result.Resized || result.MediaType != "image/png" {
+			t.Fatalf("expected a resized png, got %+v", result)
+		}
+		img, _, err := image.Decode(bytes.NewReader(result.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds().Dx() != 100 || img.Bounds().Dy() != 50 {
+			t.Errorf("unexpected size %v", img.Bounds())
+		}
+	})
+
+	t.Run("KeepSmall", func(t *testing.T) {
+		var small bytes.Buffer
+		png.Encode(&small, newTestImage(10, 10))
+		result, err := processor.ProcessImage(small.Bytes(), 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != nil {
+			t.Errorf("small image should be kept, got %+v", result)
+		}
+	})
+
+	t.Run("StripEXIF", func(t *testing.T) {
+		var jpegBuf bytes.Buffer
+		jpeg.Encode(&jpegBuf, newTestImage(10, 10), nil)
+		raw := jpegBuf.Bytes()
+		// insert an APP1 EXIF segment after the SOI marker
+		exif := append([]byte{0xFF, 0xE1, 0x00, 0x0A}, []byte("Exif\x00\x00abcd")...)
+		withEXIF := append(append(append([]byte{}, raw[:2]...), exif...), raw[2:]...)
+
+		result, err := processor.ProcessImage(withEXIF, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result == nil || hasEXIF(result.Data) {
+			t.Errorf("expected EXIF to be stripped")
+		}
+	})
+
+	t.Run("Orientation", func(t *testing.T) {
+		// left half red and right half blue, stored sideways with orientation 6 (rotate 90 clockwise)
+		img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+		for x := 0; x < 40; x++ {
+			for y := 0; y < 20; y++ {
+				if x < 20 {
+					img.Set(x, y, color.RGBA{R: 255, A: 255})
+				} else {
+					img.Set(x, y, color.RGBA{B: 255, A: 255})
+				}
+			}
+		}
+		var jpegBuf bytes.Buffer
+		jpeg.Encode(&jpegBuf, img, &jpeg.Options{Quality: 100})
+		raw := jpegBuf.Bytes()
+		// big endian TIFF header, one IFD entry: Orientation (0x0112), SHORT, count 1, value 6
+		tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+		segment := append([]byte("Exif\x00\x00"), tiff...)
+		exif := append([]byte{0xFF, 0xE1, 0x00, byte(len(segment) + 2)}, segment...)
+		withEXIF := append(append(append([]byte{}, raw[:2]...), exif...), raw[2:]...)
+		if orientation := jpegOrientation(withEXIF); orientation != 6 {
+			t.Fatalf("expected orientation 6, got %d", orientation)
+		}
+
+		result, err := processor.ProcessImage(withEXIF, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result == nil {
+			t.Fatal("expected the image to be re-encoded")
+		}
+		oriented, _, err := image.Decode(bytes.NewReader(result.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if oriented.Bounds().Dx() != 20 || oriented.Bounds().Dy() != 40 {
+			t.Fatalf("expected a 20x40 upright image, got %v", oriented.Bounds())
+		}
+		top, _, _, _ := oriented.At(10, 5).RGBA()
+		_, _, bottom, _ := oriented.At(10, 35).RGBA()
+		if top < 0xc000 || bottom < 0xc000 {
+			t.Errorf("expected red on top and blue at the bottom, got %v and %v", oriented.At(10, 5), oriented.At(10, 35))
+		}
+	})
+}
+
+func TestImageProcessor_TransformMessage(t *testing.T) {
+	processor := NewImageProcessor(&ImageConfig{
+		Enable:        true,
+		MaxEdge:       1000,
+		ModelMaxEdges: map[string]int{"small-model": 50},
+		Format:        "jpeg",
+		Quality:       80,
+	}, nil)
+
+	var pngBuf bytes.Buffer
+	png.Encode(&pngBuf, newTestImage(200, 200))
+	source := map[string]interface{}{
+		"type":       "base64",
+		"media_type": "image/png",
+		"data":       base64.StdEncoding.EncodeToString(pngBuf.Bytes()),
+	}
+	body := map[string]interface{}{
+		"model": "small-model",
+		"messages": []interface{}{
+			map[string]interface{}{
+				"role": "user",
+				"content": []interface{}{
+					map[string]interface{}{"type": "image", "source": source},
+				},
+			},
+		},
+	}
+
+	request := httptest.NewRequest("POST", "/v1/messages", nil)
+	state := NewRequestState()
+	request = request.WithContext(WithRequestState(request.Context(), state))
+
+	if err := processor.TransformMessage(request, body); err != nil {
+		t.Fatal(err)
+	}
+	if source["media_type"] != "image/jpeg" {
+		t.Errorf("expected jpeg output, got %v", source["media_type"])
+	}
+	if state.ResponseHeader.Get("X-Proxy-Images-Processed") != "1" {
+		t.Errorf("expected processed header, got %v", state.ResponseHeader)
+	}
+	if len(state.ResponseHeader.Get("X-Proxy-Image-Bytes-Saved")) == 0 {
+		t.Errorf("expected savings header")
+	}
+}
+
+func TestImageProcessor_DecompressionBomb(t *testing.T) {
+	processor := NewImageProcessor(&ImageConfig{Enable: true, MaxEdge: 1568, MaxPixels: 1000 * 1000}, nil)
+
+	// a 13 byte GIF header declaring a 65535x65535 canvas
+	bomb := []byte("GIF89a\xff\xff\xff\xff\x00\x00\x00")
+	var tooLarge *ImageTooLargeError
+	if _, err := processor.ProcessImage(bomb, 1568); !errors.As(err, &tooLarge) {
+		t.Fatalf("expected the image to be rejected before decoding, got %v", err)
+	}
+
+	body := map[string]interface{}{
+		"messages": []interface{}{
+			map[string]interface{}{
+				"role": "user",
+				"content": []interface{}{
+					map[string]interface{}{"type": "image", "source": map[string]interface{}{
+						"type": "base64", "media_type": "image/gif", "data": base64.StdEncoding.EncodeToString(bomb),
+					}},
+				},
+			},
+		},
+	}
+	request := httptest.NewRequest("POST", "/v1/messages", nil)
+	err := processor.TransformMessage(request, body)
+	var proxyError *ProxyError
+	if !errors.As(err, &proxyError) || proxyError.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an invalid request error, got %v", err)
+	}
+}
+
+func TestBedrockClient_ImageProcessorMappedModel(t *testing.T) {
+	var payloads []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		payloads = append(payloads, payload)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant","content":[],"usage":{"input_tokens":1,"output_tokens":1}}`))
+	}))
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	client.config.ModelMappings = map[string]string{"claude-haiku": "anthropic.claude-haiku"}
+	client.SetExperimentRouter(NewExperimentRouter(&ExperimentConfig{
+		Experiments: map[string][]*ExperimentArm{"claude-test": {{Model: "claude-haiku", Weight: 1}}},
+	}))
+	// the limit is configured for the Bedrock model id the arm is mapped to
+	client.SetImageProcessor(NewImageProcessor(&ImageConfig{
+		Enable:        true,
+		MaxEdge:       1000,
+		ModelMaxEdges: map[string]int{"anthropic.claude-haiku": 50},
+		Quality:       80,
+	}, client.config.ModelMappings))
+
+	var pngBuf bytes.Buffer
+	png.Encode(&pngBuf, newTestImage(200, 100))
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":      "claude-test",
+		"max_tokens": 100,
+		"messages": []interface{}{
+			map[string]interface{}{"role": "user", "content": []interface{}{
+				map[string]interface{}{"type": "image", "source": map[string]interface{}{
+					"type": "base64", "media_type": "image/png", "data": base64.StdEncoding.EncodeToString(pngBuf.Bytes()),
+				}},
+			}},
+		},
+	})
+	request := httptest.NewRequest("POST", "/v1/messages", bytes.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	request = request.WithContext(WithRequestState(request.Context(), NewRequestState()))
+	w := httptest.NewRecorder()
+	client.HandleProxy(w, request)
+
+	if w.Code != http.StatusOK || len(payloads) != 1 {
+		t.Fatalf("expected the request to be served, got %d %s", w.Code, w.Body.String())
+	}
+	content := payloads[0]["messages"].([]interface{})[0].(map[string]interface{})["content"].([]interface{})
+	source := content[0].(map[string]interface{})["source"].(map[string]interface{})
+	data, _ := base64.StdEncoding.DecodeString(source["data"].(string))
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 50 || img.Bounds().Dy() != 25 {
+		t.Errorf("expected the limit of the mapped arm model, got %v", img.Bounds())
+	}
+}
@@ -0,0 +1,253 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// StreamEventObserver receives every Anthropic stream event forwarded to the client
+type StreamEventObserver func(eventType string, data []byte)
+
+// MessageAssembler rebuilds the final Message object from the events of a Messages stream
+type MessageAssembler struct {
+	message     map[string]interface{}
+	blocks      map[int]map[string]interface{}
+	partialJSON map[int]string
+	order       []int
+	err         map[string]interface{}
+}
+
+func NewMessageAssembler() *MessageAssembler {
+	return &MessageAssembler{
+		blocks:      make(map[int]map[string]interface{}),
+		partialJSON: make(map[int]string),
+	}
+}
+
+func eventIndex(event map[string]interface{}) int {
+	if index, ok := event["index"].(float64); ok {
+		return int(index)
+	}
+	return 0
+}
+
+// AddEvent applies one stream event to the message being assembled
+func (this *MessageAssembler) AddEvent(eventType string, data []byte) error {
+	event := make(map[string]interface{})
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+
+	switch eventType {
+	case "message_start":
+		if message, ok := event["message"].(map[string]interface{}); ok {
+			this.message = message
+		}
+	case "content_block_start":
+		index := eventIndex(event)
+		if block, ok := event["content_block"].(map[string]interface{}); ok {
+			if _, exists := this.blocks[index]; !exists {
+				this.order = append(this.order, index)
+			}
+			this.blocks[index] = block
+		}
+	case "content_block_delta":
+		index := eventIndex(event)
+		block, ok := this.blocks[index]
+		delta, _ := event["delta"].(map[string]interface{})
+		if !ok || delta == nil {
+			return nil
+		}
+		switch delta["type"] {
+		case "text_delta":
+			text, _ := block["text"].(string)
+			deltaText, _ := delta["text"].(string)
+			block["text"] = text + deltaText
+		case "input_json_delta":
+			partial, _ := delta["partial_json"].(string)
+			this.partialJSON[index] += partial
+		case "thinking_delta":
+			thinking, _ := block["thinking"].(string)
+			deltaThinking, _ := delta["thinking"].(string)
+			block["thinking"] = thinking + deltaThinking
+		case "signature_delta":
+			block["signature"] = delta["signature"]
+		case "citations_delta":
+			citations, _ := block["citations"].([]interface{})
+			block["citations"] = append(citations, delta["citation"])
+		}
+	case "content_block_stop":
+		index := eventIndex(event)
+		block, ok := this.blocks[index]
+		if !ok {
+			return nil
+		}
+		if partial := this.partialJSON[index]; len(partial) > 0 {
+			var input interface{}
+			if err := json.Unmarshal([]byte(partial), &input); err != nil {
+				return fmt.Errorf("invalid tool input of block %d: %v", index, err)
+			}
+			block["input"] = input
+		}
+	case "message_delta":
+		if this.message == nil {
+			return nil
+		}
+		if delta, ok := event["delta"].(map[string]interface{}); ok {
+			for k, v := range delta {
+				this.message[k] = v
+			}
+		}
+		if usage, ok := event["usage"].(map[string]interface{}); ok {
+			merged, _ := this.message["usage"].(map[string]interface{})
+			if merged == nil {
+				merged = make(map[string]interface{})
+			}
+			for k, v := range usage {
+				merged[k] = v
+			}
+			this.message["usage"] = merged
+		}
+	case "error":
+		this.err = event
+	}
+	return nil
+}
+
+// Message returns the assembled message, or nil when the stream did not start a message
+func (this *MessageAssembler) Message() map[string]interface{} {
+	if this.message == nil {
+		return nil
+	}
+	content := make([]interface{}, 0, len(this.order))
+	for _, index := range this.order {
+		content = append(content, this.blocks[index])
+	}
+	this.message["content"] = content
+	return this.message
+}
+
+// Error returns the error event of the stream, if any
+func (this *MessageAssembler) Error() map[string]interface{} {
+	return this.err
+}
+
+func writeSSEEvent(w io.Writer, eventType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, data)
+	return err
+}
+
+// WriteMessageAsSSE replays a complete Message object as a Messages stream
+func WriteMessageAsSSE(w io.Writer, message map[string]interface{}) error {
+	start := make(map[string]interface{}, len(message))
+	for k, v := range message {
+		start[k] = v
+	}
+	start["content"] = []interface{}{}
+	start["stop_reason"] = nil
+	start["stop_sequence"] = nil
+	usage, _ := message["usage"].(map[string]interface{})
+	startUsage := make(map[string]interface{}, len(usage))
+	for k, v := range usage {
+		startUsage[k] = v
+	}
+	startUsage["output_tokens"] = 0
+	start["usage"] = startUsage
+
+	if err := writeSSEEvent(w, "message_start", map[string]interface{}{"type": "message_start", "message": start}); err != nil {
+		return err
+	}
+
+	content, _ := message["content"].([]interface{})
+	for index, item := range content {
+		block, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		startBlock := make(map[string]interface{}, len(block))
+		for k, v := range block {
+			startBlock[k] = v
+		}
+
+		var deltas []map[string]interface{}
+		switch block["type"] {
+		case "text":
+			startBlock["text"] = ""
+			delete(startBlock, "citations")
+			for _, citation := range toSlice(block["citations"]) {
+				deltas = append(deltas, map[string]interface{}{"type": "citations_delta", "citation": citation})
+			}
+			deltas = append(deltas, map[string]interface{}{"type": "text_delta", "text": block["text"]})
+		case "tool_use", "server_tool_use":
+			startBlock["input"] = map[string]interface{}{}
+			input, err := json.Marshal(block["input"])
+			if err != nil {
+				return err
+			}
+			deltas = append(deltas, map[string]interface{}{"type": "input_json_delta", "partial_json": string(input)})
+		case "thinking":
+			startBlock["thinking"] = ""
+			startBlock["signature"] = ""
+			deltas = append(deltas, map[string]interface{}{"type": "thinking_delta", "thinking": block["thinking"]})
+			if signature, ok := block["signature"].(string); ok && len(signature) > 0 {
+				deltas = append(deltas, map[string]interface{}{"type": "signature_delta", "signature": signature})
+			}
+		}
+
+		if err := writeSSEEvent(w, "content_block_start", map[string]interface{}{
+			"type": "content_block_start", "index": index, "content_block": startBlock,
+		}); err != nil {
+			return err
+		}
+		for _, delta := range deltas {
+			if err := writeSSEEvent(w, "content_block_delta", map[string]interface{}{
+				"type": "content_block_delta", "index": index, "delta": delta,
+			}); err != nil {
+				return err
+			}
+		}
+		if err := writeSSEEvent(w, "content_block_stop", map[string]interface{}{
+			"type": "content_block_stop", "index": index,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := writeSSEEvent(w, "message_delta", map[string]interface{}{
+		"type": "message_delta",
+		"delta": map[string]interface{}{
+			"stop_reason":   message["stop_reason"],
+			"stop_sequence": message["stop_sequence"],
+		},
+		"usage": map[string]interface{}{"output_tokens": usage["output_tokens"]},
+	}); err != nil {
+		return err
+	}
+	return writeSSEEvent(w, "message_stop", map[string]interface{}{"type": "message_stop"})
+}
+
+func toSlice(value interface{}) []interface{} {
+	if slice, ok := value.([]interface{}); ok {
+		return slice
+	}
+	return nil
+}
+
+// parseBedrockChunk decodes a Bedrock stream chunk payload into the Anthropic event type and JSON
+func parseBedrockChunk(payload []byte) (string, []byte, error) {
+	var rawEvent RawAWSBedrockEvent
+	if err := json.Unmarshal(payload, &rawEvent); err != nil {
+		return "", nil, err
+	}
+	eventType, raw := rawEvent.GetRawChunk()
+	return eventType, []byte(raw), nil
+}
+
+func formatSSEEvent(eventType string, data []byte) string {
+	return "event: " + eventType + "\ndata: " + string(data) + "\n"
+}
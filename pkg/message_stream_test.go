@@ -0,0 +1,123 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testStreamEvents = `event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude","content":[],"stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":10,"output_tokens":1}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" world"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":0}
+
+event: content_block_start
+data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"Hong Kong\"}"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":1}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},"usage":{"output_tokens":25}}
+
+event: message_stop
+data: {"type":"message_stop"}
+`
+
+// readSSE parses "event:"/"data:" pairs from a SSE body
+func readSSE(t *testing.T, body string) ([]string, [][]byte) {
+	var types []string
+	var payloads [][]byte
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "event: ") {
+			types = append(types, strings.TrimPrefix(line, "event: "))
+		}
+		if strings.HasPrefix(line, "data: ") {
+			payloads = append(payloads, []byte(strings.TrimPrefix(line, "data: ")))
+		}
+	}
+	if len(types) != len(payloads) {
+		t.Fatalf("unbalanced SSE body: %d events, %d payloads", len(types), len(payloads))
+	}
+	return types, payloads
+}
+
+func assembleSSE(t *testing.T, body string) *MessageAssembler {
+	assembler := NewMessageAssembler()
+	types, payloads := readSSE(t, body)
+	for i := range types {
+		if err := assembler.AddEvent(types[i], payloads[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return assembler
+}
+
+func TestMessageAssembler(t *testing.T) {
+	message := assembleSSE(t, testStreamEvents).Message()
+	if message == nil {
+		t.Fatal("expected a message")
+	}
+
+	content := message["content"].([]interface{})
+	if len(content) != 2 {
+		t.Fatalf("expected 2 content blocks, got %d", len(content))
+	}
+	if text := content[0].(map[string]interface{})["text"]; text != "Hello world" {
+		t.Errorf("unexpected text %v", text)
+	}
+	input := content[1].(map[string]interface{})["input"].(map[string]interface{})
+	if input["city"] != "Hong Kong" {
+		t.Errorf("unexpected tool input %v", input)
+	}
+	if message["stop_reason"] != "tool_use" {
+		t.Errorf("unexpected stop reason %v", message["stop_reason"])
+	}
+	usage := message["usage"].(map[string]interface{})
+	if usage["input_tokens"] != float64(10) || usage["output_tokens"] != float64(25) {
+		t.Errorf("unexpected usage %v", usage)
+	}
+}
+
+func TestWriteMessageAsSSE(t *testing.T) {
+	original := assembleSSE(t, testStreamEvents).Message()
+	originalJSON, _ := json.Marshal(original)
+
+	var buf bytes.Buffer
+	if err := WriteMessageAsSSE(&buf, original); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := assembleSSE(t, buf.String()).Message()
+	var expected map[string]interface{}
+	_ = json.Unmarshal(originalJSON, &expected)
+	replayedJSON, _ := json.Marshal(replayed)
+	var actual map[string]interface{}
+	_ = json.Unmarshal(replayedJSON, &actual)
+
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("replayed message differs:\n%s\n%s", originalJSON, replayedJSON)
+	}
+}
@@ -0,0 +1,138 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// messagesRecorder is the ResponseWriter the compatible endpoints give to a Messages provider.
+// JSON responses are buffered, the events of SSE responses are passed to the observer as they are written.
+type messagesRecorder struct {
+	header     http.Header
+	statusCode int
+	stream     bool
+	body       bytes.Buffer
+	observer   StreamEventObserver
+}
+
+func newMessagesRecorder(observer StreamEventObserver) *messagesRecorder {
+	return &messagesRecorder{header: http.Header{}, observer: observer}
+}
+
+func (this *messagesRecorder) Header() http.Header {
+	return this.header
+}
+
+func (this *messagesRecorder) WriteHeader(statusCode int) {
+	if this.statusCode != 0 {
+		return
+	}
+	this.statusCode = statusCode
+	this.stream = strings.Contains(this.header.Get("Content-Type"), "text/event-stream")
+}
+
+func (this *messagesRecorder) Write(data []byte) (int, error) {
+	if this.statusCode == 0 {
+		this.WriteHeader(http.StatusOK)
+	}
+	this.body.Write(data)
+	if this.stream {
+		this.dispatch()
+	}
+	return len(data), nil
+}
+
+// Flush is a no-op, the observer sees every event once it is complete
+func (this *messagesRecorder) Flush() {}
+
+// dispatch passes the complete events in the buffer to the observer
+func (this *messagesRecorder) dispatch() {
+	for {
+		end := bytes.Index(this.body.Bytes(), []byte("\n\n"))
+		if end < 0 {
+			return
+		}
+		eventType := ""
+		var data bytes.Buffer
+		for _, line := range strings.Split(string(this.body.Next(end+2)), "\n") {
+			line = strings.TrimRight(line, "\r")
+			switch {
+			case strings.HasPrefix(line, "event:"):
+				eventType = strings.TrimSpace(line[len("event:"):])
+			case strings.HasPrefix(line, "data:"):
+				data.WriteString(strings.TrimSpace(line[len("data:"):]))
+			}
+		}
+		if data.Len() > 0 && this.observer != nil {
+			this.observer(eventType, data.Bytes())
+		}
+	}
+}
+
+// Message returns the buffered Message of a successful JSON response
+func (this *messagesRecorder) Message() (map[string]interface{}, error) {
+	message := make(map[string]interface{})
+	err := json.Unmarshal(this.body.Bytes(), &message)
+	return message, err
+}
+
+// Error returns the status code, the Anthropic error type and the message of a failed response
+func (this *messagesRecorder) Error() (int, string, string) {
+	var response APIStandardError
+	if err := json.Unmarshal(this.body.Bytes(), &response); err == nil && response.Error != nil {
+		return this.statusCode, response.Error.Type, response.Error.Message
+	}
+	return this.statusCode, "api_error", strings.TrimSpace(this.body.String())
+}
+
+// CopyHeader copies the headers set by the provider, e.g. the X-Proxy-* headers, to the client response
+func (this *messagesRecorder) CopyHeader(header http.Header) {
+	for k, v := range this.header {
+		switch k = http.CanonicalHeaderKey(k); {
+		case hopHeaders[k], k == "Content-Type", k == "Trailer", k == "Cache-Control":
+		default:
+			header[k] = v
+		}
+	}
+}
+
+// appendMessage appends the content blocks of a role to the messages, the blocks are merged into the last
+// message when it has the same role, e.g. a function response followed by a text
+func appendMessage(messages []interface{}, role string, blocks []interface{}) []interface{} {
+	if len(blocks) == 0 {
+		return messages
+	}
+	if last := len(messages) - 1; last >= 0 && messages[last].(map[string]interface{})["role"] == role {
+		previous := messages[last].(map[string]interface{})
+		previous["content"] = append(previous["content"].([]interface{}), blocks...)
+		return messages
+	}
+	return append(messages, map[string]interface{}{"role": role, "content": blocks})
+}
+
+// streamBlock is a content block of a Messages stream being translated, tool input is collected until the block stops
+type streamBlock struct {
+	kind  string
+	id    string
+	name  string
+	input strings.Builder
+}
+
+// serveTranslatedMessages sends a Messages request body translated by a compatible endpoint through the
+// providers, so it passes the transformers, the usage accounting and the routing of /v1/messages
+func (this *HTTPService) serveTranslatedMessages(request *http.Request, body map[string]interface{}, recorder *messagesRecorder) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		writeAPIError(recorder, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	inner := request.Clone(WithRequestState(request.Context(), NewRequestState()))
+	inner.Method = http.MethodPost
+	inner.Body = io.NopCloser(bytes.NewReader(payload))
+	inner.ContentLength = int64(len(payload))
+	inner.Header.Set("Content-Type", "application/json")
+	this.serveMessages(recorder, inner)
+}
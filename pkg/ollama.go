@@ -0,0 +1,522 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ollamaVersion is the Ollama version reported to clients that check it
+const ollamaVersion = "0.9.0"
+
+// OllamaConfig serves the Ollama chat, generate and tags APIs on the Messages providers
+type OllamaConfig struct {
+	Enable bool `json:"enable"`
+	// DefaultMaxTokens is the max_tokens of the requests without options.num_predict
+	DefaultMaxTokens int `json:"default_max_tokens,omitempty"`
+	// ThinkingBudgetTokens is the thinking budget of the requests with think enabled, added to max_tokens
+	ThinkingBudgetTokens int `json:"thinking_budget_tokens,omitempty"`
+}
+
+func LoadOllamaConfigWithEnv() *OllamaConfig {
+	config := &OllamaConfig{
+		Enable:               os.Getenv("OLLAMA_ENABLE") == "true",
+		DefaultMaxTokens:     8192,
+		ThinkingBudgetTokens: 4096,
+	}
+	if value, ok := parsePositiveInt(os.Getenv("OLLAMA_DEFAULT_MAX_TOKENS")); ok {
+		config.DefaultMaxTokens = value
+	}
+	if value, ok := parsePositiveInt(os.Getenv("OLLAMA_THINKING_BUDGET_TOKENS")); ok {
+		config.ThinkingBudgetTokens = value
+	}
+	return config
+}
+
+// ollamaModel returns the model name without the ":latest" tag Ollama clients may add
+func ollamaModel(model string) string {
+	return strings.TrimSuffix(model, ":latest")
+}
+
+// ollamaImage translates a base64 image of Ollama, which has no media type, into an image block
+func ollamaImage(image interface{}) (map[string]interface{}, error) {
+	data, ok := image.(string)
+	if !ok {
+		return nil, NewInvalidRequestError("images must be base64 strings")
+	}
+	// 684 base64 characters hold the 512 bytes content type detection looks at
+	prefix := data
+	if len(prefix) > 684 {
+		prefix = prefix[:684]
+	}
+	head, err := base64.StdEncoding.DecodeString(prefix)
+	if err != nil {
+		return nil, NewInvalidRequestError("invalid base64 image: %v", err)
+	}
+	mediaType := http.DetectContentType(head)
+	if !strings.HasPrefix(mediaType, "image/") {
+		return nil, NewInvalidRequestError("unsupported image type %q", mediaType)
+	}
+	return map[string]interface{}{
+		"type":   "image",
+		"source": map[string]interface{}{"type": "base64", "media_type": mediaType, "data": data},
+	}, nil
+}
+
+// ollamaRequest holds the options shared by chat and generate requests
+type ollamaRequest struct {
+	config *OllamaConfig
+	// calls holds the ids of the tool calls not answered yet, in order
+	calls    []*streamBlock
+	sequence int
+}
+
+// options applies the Ollama options, format and think to a Messages request
+func (this *ollamaRequest) options(body map[string]interface{}, translated map[string]interface{}) {
+	maxTokens := int64(this.config.DefaultMaxTokens)
+	options, _ := body["options"].(map[string]interface{})
+	if value, ok := jsonInt(options["num_predict"]); ok && value > 0 {
+		maxTokens = value
+	}
+	translated["max_tokens"] = maxTokens
+	for from, to := range map[string]string{"temperature": "temperature", "top_p": "top_p", "top_k": "top_k"} {
+		if value, ok := options[from]; ok && value != nil {
+			translated[to] = value
+		}
+	}
+	switch stop := options["stop"].(type) {
+	case string:
+		translated["stop_sequences"] = []interface{}{stop}
+	case []interface{}:
+		translated["stop_sequences"] = stop
+	}
+
+	if think, _ := body["think"].(bool); think {
+		translated["max_tokens"] = maxTokens + int64(this.config.ThinkingBudgetTokens)
+		translated["thinking"] = map[string]interface{}{"type": "enabled", "budget_tokens": this.config.ThinkingBudgetTokens}
+	}
+
+	// structured outputs are asked for in the system prompt
+	var instruction string
+	switch format := body["format"].(type) {
+	case string:
+		if format == "json" {
+			instruction = "Respond only with valid JSON."
+		}
+	case map[string]interface{}:
+		schema, _ := json.Marshal(format)
+		instruction = fmt.Sprintf("Respond only with valid JSON matching this JSON schema: %s", schema)
+	}
+	if len(instruction) > 0 {
+		if system, ok := translated["system"].(string); ok && len(system) > 0 {
+			instruction = system + "\n\n" + instruction
+		}
+		translated["system"] = instruction
+	}
+}
+
+// message translates one chat message into the content blocks of its role
+func (this *ollamaRequest) message(message map[string]interface{}) (string, []interface{}, error) {
+	role, _ := message["role"].(string)
+	content, _ := message["content"].(string)
+	blocks := make([]interface{}, 0)
+	switch role {
+	case "tool":
+		name, _ := message["tool_name"].(string)
+		// tool results answer the oldest call of the tool, or the oldest call when the tool is not named
+		index := -1
+		for i, call := range this.calls {
+			if len(name) == 0 || call.name == name {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return "", nil, NewInvalidRequestError("the tool message answers no tool call")
+		}
+		call := this.calls[index]
+		this.calls = append(this.calls[:index], this.calls[index+1:]...)
+		return "user", append(blocks, map[string]interface{}{"type": "tool_result", "tool_use_id": call.id, "content": content}), nil
+	case "user", "assistant":
+	default:
+		return "", nil, NewInvalidRequestError("unsupported message role %q", role)
+	}
+
+	if len(content) > 0 {
+		blocks = append(blocks, map[string]interface{}{"type": "text", "text": content})
+	}
+	for _, image := range toSlice(message["images"]) {
+		block, err := ollamaImage(image)
+		if err != nil {
+			return "", nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	for _, item := range toSlice(message["tool_calls"]) {
+		call, _ := item.(map[string]interface{})
+		function, _ := call["function"].(map[string]interface{})
+		this.sequence++
+		block := &streamBlock{kind: "tool_use", id: fmt.Sprintf("toolu_ollama_%d", this.sequence)}
+		block.name, _ = function["name"].(string)
+		this.calls = append(this.calls, block)
+		input := function["arguments"]
+		if input == nil {
+			input = map[string]interface{}{}
+		}
+		blocks = append(blocks, map[string]interface{}{"type": "tool_use", "id": block.id, "name": block.name, "input": input})
+	}
+	return role, blocks, nil
+}
+
+// translateOllamaChat translates a decoded /api/chat request body into a Messages request body
+func translateOllamaChat(body map[string]interface{}, config *OllamaConfig) (map[string]interface{}, error) {
+	model, _ := body["model"].(string)
+	request := &ollamaRequest{config: config}
+	translated := map[string]interface{}{"model": ollamaModel(model)}
+
+	var system []string
+	messages := make([]interface{}, 0)
+	for _, item := range toSlice(body["messages"]) {
+		message, _ := item.(map[string]interface{})
+		if message["role"] == "system" {
+			if content, _ := message["content"].(string); len(content) > 0 {
+				system = append(system, content)
+			}
+			continue
+		}
+		role, blocks, err := request.message(message)
+		if err != nil {
+			return nil, err
+		}
+		messages = appendMessage(messages, role, blocks)
+	}
+	translated["messages"] = messages
+	if len(system) > 0 {
+		translated["system"] = strings.Join(system, "\n")
+	}
+
+	tools := make([]interface{}, 0)
+	for _, item := range toSlice(body["tools"]) {
+		tool, _ := item.(map[string]interface{})
+		function, _ := tool["function"].(map[string]interface{})
+		if tool["type"] != "function" || function == nil {
+			return nil, NewInvalidRequestError("only function tools are supported")
+		}
+		schema := function["parameters"]
+		if schema == nil {
+			schema = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+		}
+		definition := map[string]interface{}{"name": function["name"], "input_schema": schema}
+		if description, ok := function["description"].(string); ok && len(description) > 0 {
+			definition["description"] = description
+		}
+		tools = append(tools, definition)
+	}
+	if len(tools) > 0 {
+		translated["tools"] = tools
+	}
+	request.options(body, translated)
+	return translated, nil
+}
+
+// translateOllamaGenerate translates a decoded /api/generate request body into a Messages request body
+func translateOllamaGenerate(body map[string]interface{}, config *OllamaConfig) (map[string]interface{}, error) {
+	if suffix, _ := body["suffix"].(string); len(suffix) > 0 {
+		return nil, NewInvalidRequestError("suffix is not supported")
+	}
+	model, _ := body["model"].(string)
+	prompt, _ := body["prompt"].(string)
+	request := &ollamaRequest{config: config}
+	_, blocks, err := request.message(map[string]interface{}{"role": "user", "content": prompt, "images": body["images"]})
+	if err != nil {
+		return nil, err
+	}
+	translated := map[string]interface{}{
+		"model":    ollamaModel(model),
+		"messages": appendMessage(nil, "user", blocks),
+	}
+	if system, _ := body["system"].(string); len(system) > 0 {
+		translated["system"] = system
+	}
+	request.options(body, translated)
+	return translated, nil
+}
+
+// ollamaDoneReason maps an Anthropic stop reason to an Ollama done reason
+func ollamaDoneReason(stopReason interface{}) string {
+	if stopReason == "max_tokens" {
+		return "length"
+	}
+	return "stop"
+}
+
+// ollamaResponder builds the responses of /api/chat or /api/generate
+type ollamaResponder struct {
+	model   string
+	chat    bool
+	started time.Time
+	write   func(response map[string]interface{})
+	blocks  map[int]*streamBlock
+	usage   map[string]interface{}
+	stop    interface{}
+}
+
+func newOllamaResponder(model string, chat bool, write func(response map[string]interface{})) *ollamaResponder {
+	return &ollamaResponder{
+		model:   model,
+		chat:    chat,
+		started: time.Now(),
+		write:   write,
+		blocks:  make(map[int]*streamBlock),
+		usage:   make(map[string]interface{}),
+	}
+}
+
+func (this *ollamaResponder) response(content string, thinking string, toolCalls []interface{}) map[string]interface{} {
+	response := map[string]interface{}{
+		"model":      this.model,
+		"created_at": time.Now().UTC().Format(time.RFC3339Nano),
+		"done":       false,
+	}
+	if !this.chat {
+		response["response"] = content
+		if len(thinking) > 0 {
+			response["thinking"] = thinking
+		}
+		return response
+	}
+	message := map[string]interface{}{"role": "assistant", "content": content}
+	if len(thinking) > 0 {
+		message["thinking"] = thinking
+	}
+	if len(toolCalls) > 0 {
+		message["tool_calls"] = toolCalls
+	}
+	response["message"] = message
+	return response
+}
+
+// done completes a response with the done reason, the token counts and the duration
+func (this *ollamaResponder) done(response map[string]interface{}, stopReason interface{}, usage map[string]interface{}) map[string]interface{} {
+	input, _ := jsonInt(usage["input_tokens"])
+	cacheRead, _ := jsonInt(usage["cache_read_input_tokens"])
+	cacheWrite, _ := jsonInt(usage["cache_creation_input_tokens"])
+	output, _ := jsonInt(usage["output_tokens"])
+	response["done"] = true
+	response["done_reason"] = ollamaDoneReason(stopReason)
+	response["total_duration"] = time.Since(this.started).Nanoseconds()
+	response["load_duration"] = 0
+	response["prompt_eval_count"] = input + cacheRead + cacheWrite
+	response["eval_count"] = output
+	return response
+}
+
+func ollamaToolCall(name string, input interface{}) map[string]interface{} {
+	return map[string]interface{}{"function": map[string]interface{}{"name": name, "arguments": input}}
+}
+
+// Message returns the single response of a complete message
+func (this *ollamaResponder) Message(message map[string]interface{}) map[string]interface{} {
+	var content, thinking strings.Builder
+	toolCalls := make([]interface{}, 0)
+	for _, item := range toSlice(message["content"]) {
+		block, _ := item.(map[string]interface{})
+		switch block["type"] {
+		case "text":
+			text, _ := block["text"].(string)
+			content.WriteString(text)
+		case "thinking":
+			text, _ := block["thinking"].(string)
+			thinking.WriteString(text)
+		case "tool_use":
+			name, _ := block["name"].(string)
+			toolCalls = append(toolCalls, ollamaToolCall(name, block["input"]))
+		}
+	}
+	usage, _ := message["usage"].(map[string]interface{})
+	return this.done(this.response(content.String(), thinking.String(), toolCalls), message["stop_reason"], usage)
+}
+
+// Observe translates the events of a Messages stream into streamed responses,
+// tool calls are sent once their input is complete
+func (this *ollamaResponder) Observe(eventType string, data []byte) {
+	event := make(map[string]interface{})
+	if err := json.Unmarshal(data, &event); err != nil {
+		Log.Error(err)
+		return
+	}
+	index := 0
+	if value, ok := jsonInt(event["index"]); ok {
+		index = int(value)
+	}
+
+	switch eventType {
+	case "message_start":
+		message, _ := event["message"].(map[string]interface{})
+		usage, _ := message["usage"].(map[string]interface{})
+		for k, v := range usage {
+			this.usage[k] = v
+		}
+	case "content_block_start":
+		contentBlock, _ := event["content_block"].(map[string]interface{})
+		block := &streamBlock{}
+		block.kind, _ = contentBlock["type"].(string)
+		block.name, _ = contentBlock["name"].(string)
+		this.blocks[index] = block
+	case "content_block_delta":
+		delta, _ := event["delta"].(map[string]interface{})
+		switch delta["type"] {
+		case "text_delta":
+			text, _ := delta["text"].(string)
+			this.write(this.response(text, "", nil))
+		case "thinking_delta":
+			text, _ := delta["thinking"].(string)
+			this.write(this.response("", text, nil))
+		case "input_json_delta":
+			if block, ok := this.blocks[index]; ok {
+				partial, _ := delta["partial_json"].(string)
+				block.input.WriteString(partial)
+			}
+		}
+	case "content_block_stop":
+		block, ok := this.blocks[index]
+		if !ok || block.kind != "tool_use" || !this.chat {
+			return
+		}
+		input := make(map[string]interface{})
+		if block.input.Len() > 0 {
+			if err := json.Unmarshal([]byte(block.input.String()), &input); err != nil {
+				Log.Error(err)
+			}
+		}
+		this.write(this.response("", "", []interface{}{ollamaToolCall(block.name, input)}))
+	case "message_delta":
+		delta, _ := event["delta"].(map[string]interface{})
+		this.stop = delta["stop_reason"]
+		usage, _ := event["usage"].(map[string]interface{})
+		for k, v := range usage {
+			this.usage[k] = v
+		}
+	case "message_stop":
+		this.write(this.done(this.response("", "", nil), this.stop, this.usage))
+	case "error":
+		var apiError APIStandardError
+		message := string(data)
+		if err := json.Unmarshal(data, &apiError); err == nil && apiError.Error != nil {
+			message = apiError.Error.Message
+		}
+		this.write(map[string]interface{}{"error": message})
+	}
+}
+
+// writeOllamaError writes an error in the shape of the Ollama API
+func writeOllamaError(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": message})
+}
+
+// HandleOllamaTags lists the models in the shape of the Ollama API
+func (this *HTTPService) HandleOllamaTags(writer http.ResponseWriter, request *http.Request) {
+	names := this.modelNames()
+	models := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		models = append(models, map[string]interface{}{
+			"name":        name,
+			"model":       name,
+			"modified_at": "2025-02-19T00:00:00Z",
+			"size":        0,
+			"digest":      "",
+			"details":     map[string]interface{}{"format": "", "family": "", "parameter_size": "", "quantization_level": ""},
+		})
+	}
+	this.ResponseJSON(map[string]interface{}{"models": models}, writer)
+}
+
+// HandleOllamaVersion reports an Ollama version, some clients check it before anything else
+func (this *HTTPService) HandleOllamaVersion(writer http.ResponseWriter, request *http.Request) {
+	this.ResponseJSON(map[string]interface{}{"version": ollamaVersion}, writer)
+}
+
+func (this *HTTPService) HandleOllamaChat(writer http.ResponseWriter, request *http.Request) {
+	this.serveOllama(writer, request, true)
+}
+
+func (this *HTTPService) HandleOllamaGenerate(writer http.ResponseWriter, request *http.Request) {
+	this.serveOllama(writer, request, false)
+}
+
+// serveOllama serves /api/chat or /api/generate on the Messages providers, streaming NDJSON unless stream is false
+func (this *HTTPService) serveOllama(writer http.ResponseWriter, request *http.Request, chat bool) {
+	body := make(map[string]interface{})
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		statusCode := http.StatusBadRequest
+		if _, ok := IsRequestTooLarge(err); ok {
+			statusCode = http.StatusRequestEntityTooLarge
+		}
+		writeOllamaError(writer, statusCode, err.Error())
+		return
+	}
+	translate := translateOllamaGenerate
+	if chat {
+		translate = translateOllamaChat
+	}
+	translated, err := translate(body, this.conf.Ollama)
+	if err != nil {
+		writeOllamaError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Ollama streams unless told not to
+	stream := body["stream"] != false
+	translated["stream"] = stream
+	model, _ := body["model"].(string)
+
+	if !stream {
+		recorder := newMessagesRecorder(nil)
+		this.serveTranslatedMessages(request, translated, recorder)
+		recorder.CopyHeader(writer.Header())
+		if recorder.statusCode != http.StatusOK {
+			statusCode, _, message := recorder.Error()
+			writeOllamaError(writer, statusCode, message)
+			return
+		}
+		message, err := recorder.Message()
+		if err != nil {
+			writeOllamaError(writer, http.StatusBadGateway, err.Error())
+			return
+		}
+		this.ResponseJSON(newOllamaResponder(model, chat, nil).Message(message), writer)
+		return
+	}
+
+	flusher, _ := writer.(http.Flusher)
+	var recorder *messagesRecorder
+	started := false
+	responder := newOllamaResponder(model, chat, func(response map[string]interface{}) {
+		if !started {
+			started = true
+			recorder.CopyHeader(writer.Header())
+			writer.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		data, err := json.Marshal(response)
+		if err != nil {
+			Log.Error(err)
+			return
+		}
+		writer.Write(append(data, '\n'))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	recorder = newMessagesRecorder(responder.Observe)
+	this.serveTranslatedMessages(request, translated, recorder)
+	if !started && recorder.statusCode != http.StatusOK {
+		recorder.CopyHeader(writer.Header())
+		statusCode, _, message := recorder.Error()
+		writeOllamaError(writer, statusCode, message)
+	}
+}
@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTranslateOllamaChat(t *testing.T) {
+	config := &OllamaConfig{DefaultMaxTokens: 1024, ThinkingBudgetTokens: 2048}
+	translated, err := translateOllamaChat(decodeTestBody(t, `{
+		"model": "claude-test:latest",
+		"messages": [
+			{"role": "system", "content": "be brief"},
+			{"role": "user", "content": "weather?", "images": ["iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="]},
+			{"role": "assistant", "content": "", "tool_calls": [{"function": {"name": "get_weather", "arguments": {"city": "Taipei"}}}]},
+			{"role": "tool", "tool_name": "get_weather", "content": "sunny"},
+			{"role": "user", "content": "thanks"}
+		],
+		"tools": [{"type": "function", "function": {"name": "get_weather", "description": "weather",
+			"parameters": {"type": "object", "properties": {"city": {"type": "string"}}}}}],
+		"options": {"num_predict": 256, "temperature": 0.2, "stop": "END"},
+		"format": "json",
+		"think": true
+	}`), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := decodeTestBody(t, `{
+		"model": "claude-test", "max_tokens": 2304, "temperature": 0.2, "stop_sequences": ["END"],
+		"system": "be brief\n\nRespond only with valid JSON.",
+		"thinking": {"type": "enabled", "budget_tokens": 2048},
+		"tools": [{"name": "get_weather", "description": "weather", "input_schema": {"type": "object", "properties": {"city": {"type": "string"}}}}],
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "text", "text": "weather?"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="}}
+			]},
+			{"role": "assistant", "content": [{"type": "tool_use", "id": "toolu_ollama_1", "name": "get_weather", "input": {"city": "Taipei"}}]},
+			{"role": "user", "content": [
+				{"type": "tool_result", "tool_use_id": "toolu_ollama_1", "content": "sunny"},
+				{"type": "text", "text": "thanks"}
+			]}
+		]}`)
+	got, _ := json.Marshal(translated)
+	want, _ := json.Marshal(expected)
+	if string(got) != string(want) {
+		t.Errorf("unexpected translation\n got: %s\nwant: %s", got, want)
+	}
+
+	for body, message := range map[string]string{
+		`{"messages": [{"role": "tool", "content": "sunny"}]}`:     "answers no tool call",
+		`{"messages": [{"role": "user", "images": ["aGVsbG8="]}]}`: "unsupported image type",
+		`{"messages": [], "tools": [{"type": "retrieval"}]}`:       "only function tools",
+		`{"messages": [{"role": "critic", "content": "hmm"}]}`:     "unsupported message role",
+	} {
+		if _, err := translateOllamaChat(decodeTestBody(t, body), config); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: expected an error about %q, got %v", body, message, err)
+		}
+	}
+	if _, err := translateOllamaGenerate(decodeTestBody(t, `{"prompt": "def f(", "suffix": "return"}`), config); err == nil {
+		t.Error("expected suffix to be rejected")
+	}
+}
+
+func newOllamaTestRequest(path string, body string) *http.Request {
+	request := httptest.NewRequest("POST", path, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	return request
+}
+
+func TestHTTPService_HandleOllamaChat(t *testing.T) {
+	server := newFakeBedrock(t, testStreamEvents, 0)
+	defer server.Close()
+	client := newTestBedrockClient(server.URL)
+	service := &HTTPService{conf: &Config{Ollama: &OllamaConfig{Enable: true, DefaultMaxTokens: 1024}}, bedrockClient: client}
+
+	// streaming is the default, one JSON object per line
+	w := httptest.NewRecorder()
+	service.HandleOllamaChat(w, newOllamaTestRequest("/api/chat", `{"model":"claude-test","messages":[{"role":"user","content":"hi"}]}`))
+	if w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("expected NDJSON, got %d %s", w.Code, w.Body.String())
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected two text chunks, a tool call and the final chunk, got %s", w.Body.String())
+	}
+	var content strings.Builder
+	for _, line := range lines[:2] {
+		message := decodeTestBody(t, line)["message"].(map[string]interface{})
+		content.WriteString(message["content"].(string))
+	}
+	if content.String() != "Hello world" {
+		t.Errorf("unexpected content %q", content.String())
+	}
+	calls := decodeTestBody(t, lines[2])["message"].(map[string]interface{})["tool_calls"].([]interface{})
+	function := calls[0].(map[string]interface{})["function"].(map[string]interface{})
+	if function["name"] != "get_weather" || function["arguments"].(map[string]interface{})["city"] != "Hong Kong" {
+		t.Errorf("unexpected tool call %s", lines[2])
+	}
+	last := decodeTestBody(t, lines[3])
+	if last["done"] != true || last["done_reason"] != "stop" || last["prompt_eval_count"] != float64(10) || last["eval_count"] != float64(25) {
+		t.Errorf("unexpected final chunk %s", lines[3])
+	}
+
+	// the fake only streams, the non-streaming call fails
+	w = httptest.NewRecorder()
+	service.HandleOllamaGenerate(w, newOllamaTestRequest("/api/generate", `{"model":"claude-test","prompt":"hi","stream":false}`))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"error":"`) {
+		t.Errorf("expected the error in the Ollama shape, got %d %s", w.Code, w.Body.String())
+	}
+
+	client.config.StreamUpstream = true
+	w = httptest.NewRecorder()
+	service.HandleOllamaGenerate(w, newOllamaTestRequest("/api/generate", `{"model":"claude-test","prompt":"hi","stream":false}`))
+	response := decodeTestBody(t, w.Body.String())
+	if response["response"] != "Hello world" || response["done"] != true || response["eval_count"] != float64(25) {
+		t.Errorf("unexpected response %s", w.Body.String())
+	}
+
+	client.config.ModelMappings = map[string]string{"claude-test": "anthropic.claude-test"}
+	w = httptest.NewRecorder()
+	service.HandleOllamaTags(w, httptest.NewRequest("GET", "/api/tags", nil))
+	models := decodeTestBody(t, w.Body.String())["models"].([]interface{})
+	if len(models) != 1 || models[0].(map[string]interface{})["name"] != "claude-test" {
+		t.Errorf("unexpected tags %s", w.Body.String())
+	}
+}
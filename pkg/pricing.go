@@ -0,0 +1,295 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// CostHeader reports the estimated cost of a request, as a trailer on streamed responses
+const CostHeader = "X-Proxy-Cost-USD"
+
+// ModelPrice is the USD price per million tokens of a model
+type ModelPrice struct {
+	Input      float64 `json:"input"`
+	Output     float64 `json:"output"`
+	CacheRead  float64 `json:"cache_read"`
+	CacheWrite float64 `json:"cache_write"`
+	// BatchDiscount overrides the table batch discount for this model
+	BatchDiscount *float64 `json:"batch_discount,omitempty"`
+}
+
+// PricingConfig is the price table used to estimate the cost of each request
+type PricingConfig struct {
+	Enable bool `json:"enable"`
+	// Models maps Bedrock model ids, or a part of them, to their price
+	Models map[string]*ModelPrice `json:"models,omitempty"`
+	// Regions overrides model prices per AWS region, for the requests served by Bedrock
+	Regions map[string]map[string]*ModelPrice `json:"regions,omitempty"`
+	// Providers overrides model prices per provider name, e.g. negotiated prices of the Anthropic API
+	Providers map[string]map[string]*ModelPrice `json:"providers,omitempty"`
+	// BatchDiscount is the fraction taken off batch invocations, e.g. 0.5
+	BatchDiscount float64 `json:"batch_discount,omitempty"`
+}
+
+// defaultModelPrices are the on-demand list prices of Anthropic models. The first-party API and Vertex AI
+// charge the Bedrock prices, so each model is also listed without the "anthropic." prefix, which matches
+// ids like "claude-sonnet-4-5-20250929" and "claude-sonnet-4-5@20250929".
+// The Claude 4 models are listed by version, and 4.0 by its dated id, so a later version is not matched
+// by the key of an older one: claude-opus-4-5 costs a third of claude-opus-4.
+func defaultModelPrices() map[string]*ModelPrice {
+	prices := map[string]*ModelPrice{}
+	for model, price := range map[string]*ModelPrice{
+		"claude-3-haiku":           {Input: 0.25, Output: 1.25, CacheRead: 0.03, CacheWrite: 0.30},
+		"claude-3-5-haiku":         {Input: 0.80, Output: 4, CacheRead: 0.08, CacheWrite: 1},
+		"claude-haiku-4-5":         {Input: 1, Output: 5, CacheRead: 0.10, CacheWrite: 1.25},
+		"claude-3-sonnet":          {Input: 3, Output: 15, CacheRead: 0.30, CacheWrite: 3.75},
+		"claude-3-5-sonnet":        {Input: 3, Output: 15, CacheRead: 0.30, CacheWrite: 3.75},
+		"claude-3-7-sonnet":        {Input: 3, Output: 15, CacheRead: 0.30, CacheWrite: 3.75},
+		"claude-sonnet-4-20250514": {Input: 3, Output: 15, CacheRead: 0.30, CacheWrite: 3.75},
+		"claude-sonnet-4@20250514": {Input: 3, Output: 15, CacheRead: 0.30, CacheWrite: 3.75},
+		"claude-sonnet-4-5":        {Input: 3, Output: 15, CacheRead: 0.30, CacheWrite: 3.75},
+		"claude-3-opus":            {Input: 15, Output: 75, CacheRead: 1.50, CacheWrite: 18.75},
+		"claude-opus-4-20250514":   {Input: 15, Output: 75, CacheRead: 1.50, CacheWrite: 18.75},
+		"claude-opus-4@20250514":   {Input: 15, Output: 75, CacheRead: 1.50, CacheWrite: 18.75},
+		"claude-opus-4-1":          {Input: 15, Output: 75, CacheRead: 1.50, CacheWrite: 18.75},
+		"claude-opus-4-5":          {Input: 5, Output: 25, CacheRead: 0.50, CacheWrite: 6.25},
+	} {
+		prices[model] = price
+		prices["anthropic."+model] = price
+	}
+	for model, price := range defaultConverseModelPrices() {
+		prices[model] = price
+	}
+	for model, price := range defaultEmbeddingModelPrices() {
+		prices[model] = price
+	}
+	return prices
+}
+
+// defaultEmbeddingModelPrices are the on-demand list prices of the Bedrock embedding models, which only charge input tokens
+func defaultEmbeddingModelPrices() map[string]*ModelPrice {
+	return map[string]*ModelPrice{
+		"amazon.titan-embed-text-v1":   {Input: 0.10},
+		"amazon.titan-embed-g1-text":   {Input: 0.10},
+		"amazon.titan-embed-text-v2":   {Input: 0.02},
+		"cohere.embed-english-v3":      {Input: 0.10},
+		"cohere.embed-multilingual-v3": {Input: 0.10},
+		"cohere.embed-v4":              {Input: 0.12},
+	}
+}
+
+// defaultConverseModelPrices are the on-demand list prices of the non-Anthropic models served by the Converse API,
+// keyed by a part of the Bedrock model id like the capability table
+func defaultConverseModelPrices() map[string]*ModelPrice {
+	return map[string]*ModelPrice{
+		"amazon.nova-micro":          {Input: 0.035, Output: 0.14, CacheRead: 0.00875},
+		"amazon.nova-lite":           {Input: 0.06, Output: 0.24, CacheRead: 0.015},
+		"amazon.nova-pro":            {Input: 0.80, Output: 3.20, CacheRead: 0.20},
+		"amazon.nova-premier":        {Input: 2.50, Output: 12.50, CacheRead: 0.625},
+		"meta.llama3-8b":             {Input: 0.30, Output: 0.60},
+		"meta.llama3-70b":            {Input: 2.65, Output: 3.50},
+		"meta.llama3-1-8b":           {Input: 0.22, Output: 0.22},
+		"meta.llama3-1-70b":          {Input: 0.72, Output: 0.72},
+		"meta.llama3-1-405b":         {Input: 2.40, Output: 2.40},
+		"meta.llama3-2-1b":           {Input: 0.10, Output: 0.10},
+		"meta.llama3-2-3b":           {Input: 0.15, Output: 0.15},
+		"meta.llama3-2-11b":          {Input: 0.16, Output: 0.16},
+		"meta.llama3-2-90b":          {Input: 0.72, Output: 0.72},
+		"meta.llama3-3-70b":          {Input: 0.72, Output: 0.72},
+		"meta.llama4-scout-17b":      {Input: 0.17, Output: 0.66},
+		"meta.llama4-maverick-17b":   {Input: 0.24, Output: 0.97},
+		"mistral.mistral-7b":         {Input: 0.15, Output: 0.20},
+		"mistral.mixtral-8x7b":       {Input: 0.45, Output: 0.70},
+		"mistral.mistral-small":      {Input: 1, Output: 3},
+		"mistral.mistral-large":      {Input: 4, Output: 12},
+		"mistral.mistral-large-2407": {Input: 2, Output: 6},
+		"mistral.pixtral-large":      {Input: 2, Output: 6},
+		"deepseek.r1":                {Input: 1.35, Output: 5.40},
+	}
+}
+
+func LoadPricingConfigWithEnv() *PricingConfig {
+	config := &PricingConfig{
+		Enable:        os.Getenv("PRICING_ENABLE") == "true",
+		Models:        defaultModelPrices(),
+		BatchDiscount: 0.5,
+	}
+
+	if filename := os.Getenv("PRICING_FILE"); len(filename) > 0 {
+		if err := config.LoadFile(filename); err != nil {
+			Log.Errorf("failed to load pricing file %s: %v", filename, err)
+		}
+	}
+	return config
+}
+
+// LoadFile merges a JSON price table into the config, file entries replace the defaults
+func (this *PricingConfig) LoadFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var table PricingConfig
+	table.BatchDiscount = -1
+	if err := json.Unmarshal(data, &table); err != nil {
+		return err
+	}
+
+	if this.Models == nil {
+		this.Models = map[string]*ModelPrice{}
+	}
+	for model, price := range table.Models {
+		this.Models[model] = price
+	}
+	if this.Regions == nil {
+		this.Regions = map[string]map[string]*ModelPrice{}
+	}
+	for region, models := range table.Regions {
+		this.Regions[region] = models
+	}
+	if this.Providers == nil {
+		this.Providers = map[string]map[string]*ModelPrice{}
+	}
+	for provider, models := range table.Providers {
+		this.Providers[provider] = models
+	}
+	if table.BatchDiscount >= 0 {
+		this.BatchDiscount = table.BatchDiscount
+	}
+	return nil
+}
+
+// PriceTable estimates request costs from a PricingConfig
+type PriceTable struct {
+	config *PricingConfig
+	// unpriced remembers the models already warned about
+	unpriced sync.Map
+}
+
+func NewPriceTable(config *PricingConfig) *PriceTable {
+	return &PriceTable{config: config}
+}
+
+// lookupPrice finds the price of a model by exact id, then by the longest key contained in the id,
+// so "us.anthropic.claude-3-5-haiku-20241022-v1:0" matches "anthropic.claude-3-5-haiku"
+func lookupPrice(prices map[string]*ModelPrice, model string) *ModelPrice {
+	if price, ok := prices[model]; ok {
+		return price
+	}
+	var found *ModelPrice
+	matched := 0
+	for key, price := range prices {
+		if len(key) > matched && strings.Contains(model, key) {
+			found = price
+			matched = len(key)
+		}
+	}
+	return found
+}
+
+// isBedrockProvider reports whether a provider name is served by Bedrock, where the region prices apply
+func isBedrockProvider(provider string) bool {
+	return len(provider) == 0 || provider == ProviderBedrock || provider == ProviderConverse
+}
+
+// Price returns the price of a model served by a provider in a region, or nil when the model is not in the table.
+// The prices of the provider come first, then those of the region for Bedrock, then the model prices.
+func (this *PriceTable) Price(model string, provider string, region string) *ModelPrice {
+	if prices, ok := this.config.Providers[provider]; ok && len(provider) > 0 {
+		if price := lookupPrice(prices, model); price != nil {
+			return price
+		}
+	}
+	if regional, ok := this.config.Regions[region]; ok && isBedrockProvider(provider) {
+		if price := lookupPrice(regional, model); price != nil {
+			return price
+		}
+	}
+	return lookupPrice(this.config.Models, model)
+}
+
+// Check returns an error for an Anthropic model without price, its requests are refused
+// rather than served for free past the dollar quotas
+func (this *PriceTable) Check(model string, provider string, region string) error {
+	if !strings.Contains(model, "claude") || this.Price(model, provider, region) != nil {
+		return nil
+	}
+	Log.Errorf("no price for model %s, add it to the pricing file", model)
+	return &ProxyError{
+		StatusCode: http.StatusInternalServerError,
+		Type:       "api_error",
+		Message:    fmt.Sprintf("no price is configured for model %s", model),
+	}
+}
+
+// Cost returns the USD cost of a request, ok is false when the model has no price.
+// batch applies the batch discount, for the usage of batch inference jobs.
+func (this *PriceTable) Cost(model string, provider string, region string, usage *RequestUsage, batch bool) (float64, bool) {
+	price := this.Price(model, provider, region)
+	if price == nil {
+		if _, warned := this.unpriced.LoadOrStore(provider+"|"+model, true); !warned && len(model) > 0 {
+			Log.Warningf("no price for model %s, its requests cost 0 and do not count against dollar quotas", model)
+		}
+		return 0, false
+	}
+	cost := (float64(usage.InputTokens)*price.Input +
+		float64(usage.OutputTokens)*price.Output +
+		float64(usage.CacheReadInputTokens)*price.CacheRead +
+		float64(usage.CacheCreationInputTokens)*price.CacheWrite) / 1e6
+	if batch {
+		discount := this.config.BatchDiscount
+		if price.BatchDiscount != nil {
+			discount = *price.BatchDiscount
+		}
+		cost *= 1 - discount
+	}
+	// micro dollars are enough for accounting and keep the header short
+	return math.Round(cost*1e6) / 1e6, true
+}
+
+func formatCost(cost float64) string {
+	return fmt.Sprintf("%.6f", cost)
+}
+
+// estimateCost fills the cost of the usage, reporting whether the model has a price
+func (this *BedrockClient) estimateCost(usage *RequestUsage) bool {
+	if this.priceTable == nil || usage.Cached {
+		return false
+	}
+	// hedged requests are priced in the region that served them
+	region := usage.Region
+	if len(region) == 0 {
+		region = this.config.Region
+	}
+	// the proxy invocations are on-demand, the batch discount does not apply
+	cost, ok := this.priceTable.Cost(usage.Model, usage.Provider, region, usage, false)
+	if ok {
+		usage.Cost = cost
+	}
+	return ok
+}
+
+// checkPrice refuses the requests of an Anthropic model without price when costs are estimated
+func (this *BedrockClient) checkPrice(model string, provider string) error {
+	if this.priceTable == nil {
+		return nil
+	}
+	return this.priceTable.Check(model, provider, this.config.Region)
+}
+
+// setCostHeader sets the cost header of the response from the usage known so far
+func (this *BedrockClient) setCostHeader(header http.Header, r *http.Request, usage *RequestUsage) {
+	if state := GetRequestState(r); state != nil {
+		usage.Model = state.Model
+		usage.Provider = state.Provider
+		usage.Region = state.Region
+	}
+	if this.estimateCost(usage) {
+		header.Set(CostHeader, formatCost(usage.Cost))
+	}
+}
@@ -0,0 +1,175 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPriceTable_Cost(t *testing.T) {
+	config := &PricingConfig{Enable: true, Models: defaultModelPrices()}
+	filename := filepath.Join(t.TempDir(), "pricing.json")
+	err := os.WriteFile(filename, []byte(`{
+		"models": {"anthropic.claude-3-haiku-20240307-v1:0": {"input": 1, "output": 2}},
+		"regions": {"ap-northeast-1": {"claude-3-5-haiku": {"input": 1, "output": 5}}},
+		"providers": {"anthropic": {"claude-3-5-haiku": {"input": 0.5, "output": 2}}},
+		"batch_discount": 0.4
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.LoadFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	table := NewPriceTable(config)
+	usage := &RequestUsage{InputTokens: 1000000, OutputTokens: 100000, CacheReadInputTokens: 1000000, CacheCreationInputTokens: 100000}
+
+	tests := []struct {
+		name     string
+		model    string
+		provider string
+		region   string
+		expected float64
+	}{
+		{"CrossRegionProfile", "us.anthropic.claude-3-5-haiku-20241022-v1:0", "", "us-east-1", 0.8 + 0.4 + 0.08 + 0.1},
+		{"RegionOverride", "anthropic.claude-3-5-haiku-20241022-v1:0", "", "ap-northeast-1", 1 + 0.5},
+		{"FileOverride", "anthropic.claude-3-haiku-20240307-v1:0", "", "us-east-1", 1 + 0.2},
+		{"ProviderOverride", "claude-3-5-haiku-20241022", "anthropic", "ap-northeast-1", 0.5 + 0.2},
+		{"VertexModelId", "claude-sonnet-4@20250514", "vertex", "ap-northeast-1", 3 + 1.5 + 0.3 + 0.375},
+		{"AnthropicModelId", "claude-3-5-haiku-20241022", "claude-api", "ap-northeast-1", 0.8 + 0.4 + 0.08 + 0.1},
+		{"ConverseModel", "us.amazon.nova-pro-v1:0", "converse", "us-east-1", 0.8 + 0.32 + 0.2},
+		{"ConverseVersion", "mistral.mistral-large-2407-v1:0", "converse", "us-east-1", 2 + 0.6},
+		{"Opus45", "us.anthropic.claude-opus-4-5-20251101-v1:0", "", "us-east-1", 5 + 2.5 + 0.5 + 0.625},
+		{"Opus41", "anthropic.claude-opus-4-1-20250805-v1:0", "", "us-east-1", 15 + 7.5 + 1.5 + 1.875},
+		{"Opus4", "anthropic.claude-opus-4-20250514-v1:0", "", "us-east-1", 15 + 7.5 + 1.5 + 1.875},
+		{"Sonnet45", "global.anthropic.claude-sonnet-4-5-20250929-v1:0", "", "us-east-1", 3 + 1.5 + 0.3 + 0.375},
+		{"Haiku45", "claude-haiku-4-5@20251001", "vertex", "us-east-1", 1 + 0.5 + 0.1 + 0.125},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cost, ok := table.Cost(test.model, test.provider, test.region, usage, false)
+			if !ok || formatCost(cost) != formatCost(test.expected) {
+				t.Errorf("expected %v, got %v (%v)", test.expected, cost, ok)
+			}
+		})
+	}
+
+	if _, ok := table.Cost("cohere.command-r-v1:0", "", "us-east-1", usage, false); ok {
+		t.Errorf("models without a price should not have a cost")
+	}
+
+	// the file discount applies, then the discount of the model
+	if cost, _ := table.Cost("anthropic.claude-3-haiku-20240307-v1:0", "", "us-east-1", usage, true); formatCost(cost) != formatCost(1.2*0.6) {
+		t.Errorf("expected the batch discount of the file, got %v", cost)
+	}
+	discount := 0.5
+	config.Models["anthropic.claude-3-haiku-20240307-v1:0"].BatchDiscount = &discount
+	if cost, _ := table.Cost("anthropic.claude-3-haiku-20240307-v1:0", "", "us-east-1", usage, true); formatCost(cost) != formatCost(1.2*0.5) {
+		t.Errorf("expected the batch discount of the model, got %v", cost)
+	}
+}
+
+func TestPriceTable_Check(t *testing.T) {
+	table := NewPriceTable(&PricingConfig{Enable: true, Models: defaultModelPrices()})
+
+	if err := table.Check("anthropic.claude-opus-4-5-20251101-v1:0", "", "us-east-1"); err != nil {
+		t.Errorf("priced model refused: %v", err)
+	}
+	if err := table.Check("cohere.command-r-v1:0", "converse", "us-east-1"); err != nil {
+		t.Errorf("only Anthropic models must be priced: %v", err)
+	}
+	// a later version is not priced as an older one
+	if err := table.Check("anthropic.claude-opus-4-9-20270101-v1:0", "", "us-east-1"); err == nil {
+		t.Errorf("expected an error for an Anthropic model without price")
+	}
+}
+
+func TestBedrockClient_UnpricedModel(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"type":"message","content":[],"usage":{"input_tokens":1,"output_tokens":1}}`))
+	}))
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	client.SetPriceTable(NewPriceTable(&PricingConfig{Enable: true, Models: defaultModelPrices()}))
+
+	w := httptest.NewRecorder()
+	client.HandleProxy(w, newTestMessageRequest(false))
+
+	if w.Code != http.StatusInternalServerError || calls != 0 {
+		t.Errorf("expected the unpriced model to be refused before Bedrock, got %d after %d calls", w.Code, calls)
+	}
+}
+
+func TestBedrockClient_EstimateCostRegion(t *testing.T) {
+	client := newTestBedrockClient("http://localhost")
+	client.SetPriceTable(NewPriceTable(&PricingConfig{
+		Models:  map[string]*ModelPrice{"anthropic.claude-test": {Input: 1}},
+		Regions: map[string]map[string]*ModelPrice{"us-west-2": {"anthropic.claude-test": {Input: 2}}},
+	}))
+
+	usage := &RequestUsage{Model: "anthropic.claude-test", InputTokens: 1000000}
+	if !client.estimateCost(usage) || usage.Cost != 1 {
+		t.Errorf("expected the primary region price, got %v", usage.Cost)
+	}
+	// a hedge served by another region is priced there
+	usage.Region = "us-west-2"
+	if !client.estimateCost(usage) || usage.Cost != 2 {
+		t.Errorf("expected the price of the serving region, got %v", usage.Cost)
+	}
+}
+
+func TestBedrockClient_CostHeader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Amzn-Bedrock-Input-Token-Count", "1000")
+		w.Header().Set("X-Amzn-Bedrock-Output-Token-Count", "100")
+		w.Write([]byte(`{"type":"message","content":[],"stop_reason":"end_turn","usage":{"input_tokens":1000,"output_tokens":100}}`))
+	}))
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	client.SetPriceTable(NewPriceTable(&PricingConfig{
+		Enable: true,
+		Models: map[string]*ModelPrice{"anthropic.claude-test": {Input: 3, Output: 15}},
+	}))
+	var reported *RequestUsage
+	client.AddUsageListener(func(request *http.Request, usage *RequestUsage) {
+		reported = usage
+	})
+
+	w := httptest.NewRecorder()
+	client.HandleProxy(w, newTestMessageRequest(false))
+
+	if header := w.Header().Get(CostHeader); header != "0.004500" {
+		t.Errorf("unexpected cost header %q", header)
+	}
+	if reported == nil || formatCost(reported.Cost) != "0.004500" {
+		t.Errorf("the cost should be reported with the usage: %+v", reported)
+	}
+}
+
+func TestBedrockClient_CostTrailer(t *testing.T) {
+	server := newFakeBedrock(t, testStreamEvents, time.Millisecond)
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	client.SetPriceTable(NewPriceTable(&PricingConfig{
+		Enable: true,
+		Models: map[string]*ModelPrice{"anthropic.claude-test": {Input: 3, Output: 15}},
+	}))
+
+	w := httptest.NewRecorder()
+	client.HandleProxy(w, newTestMessageRequest(true))
+
+	// 10 input and 25 output tokens
+	if trailer := w.Result().Trailer.Get(CostHeader); trailer != "0.000405" {
+		t.Errorf("unexpected cost trailer %q", trailer)
+	}
+}
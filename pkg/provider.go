@@ -0,0 +1,145 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+)
+
+const (
+	ProviderBedrock   = "bedrock"
+	ProviderAnthropic = "anthropic"
+	ProviderVertex    = "vertex"
+	ProviderConverse  = "converse"
+)
+
+// MessagesProvider serves Anthropic Messages requests from a backend
+type MessagesProvider interface {
+	Name() string
+	// Serves reports whether the provider serves a model requested by clients
+	Serves(model string) bool
+	// Models returns the model names clients may request from the provider
+	Models() []string
+	HandleMessages(w http.ResponseWriter, r *http.Request)
+}
+
+// ProviderConfig routes the models it lists to the first-party Anthropic API or the Anthropic models on Vertex AI
+type ProviderConfig struct {
+	Name string `json:"name"`
+	// Type is "anthropic" or "vertex"
+	Type string `json:"type"`
+	// Models maps the model requested by clients to the model id of the provider
+	Models map[string]string `json:"models"`
+	// APIKey, BaseURL and Version configure the Anthropic API
+	APIKey  string `json:"api_key,omitempty"`
+	BaseURL string `json:"base_url,omitempty"`
+	Version string `json:"version,omitempty"`
+	// ProjectID and Region locate the Vertex AI endpoint, "global" uses the global endpoint
+	ProjectID string `json:"project_id,omitempty"`
+	Region    string `json:"region,omitempty"`
+	// CredentialsFile is a service account key of Vertex AI, AccessToken a static OAuth token used instead
+	CredentialsFile string `json:"credentials_file,omitempty"`
+	AccessToken     string `json:"access_token,omitempty"`
+}
+
+// ProvidersConfig lists the providers tried before Bedrock, in order
+type ProvidersConfig struct {
+	Providers []*ProviderConfig `json:"providers,omitempty"`
+}
+
+func LoadProvidersConfigWithEnv() *ProvidersConfig {
+	config := &ProvidersConfig{}
+	if models := ParseMappingsFromStr(os.Getenv("ANTHROPIC_PROVIDER_MODELS")); len(models) > 0 {
+		config.Providers = append(config.Providers, &ProviderConfig{
+			Name:    ProviderAnthropic,
+			Type:    ProviderAnthropic,
+			Models:  models,
+			APIKey:  os.Getenv("ANTHROPIC_PROVIDER_API_KEY"),
+			BaseURL: os.Getenv("ANTHROPIC_PROVIDER_BASE_URL"),
+			Version: os.Getenv("ANTHROPIC_PROVIDER_VERSION"),
+		})
+	}
+	if models := ParseMappingsFromStr(os.Getenv("VERTEX_PROVIDER_MODELS")); len(models) > 0 {
+		config.Providers = append(config.Providers, &ProviderConfig{
+			Name:            ProviderVertex,
+			Type:            ProviderVertex,
+			Models:          models,
+			ProjectID:       os.Getenv("VERTEX_PROVIDER_PROJECT_ID"),
+			Region:          os.Getenv("VERTEX_PROVIDER_REGION"),
+			CredentialsFile: os.Getenv("VERTEX_PROVIDER_CREDENTIALS_FILE"),
+			AccessToken:     os.Getenv("VERTEX_PROVIDER_ACCESS_TOKEN"),
+		})
+	}
+	return config
+}
+
+// Name is the provider name of the Bedrock client
+func (this *BedrockClient) Name() string {
+	return ProviderBedrock
+}
+
+// Serves is true for every model, Bedrock serves the models no other provider claims
+func (this *BedrockClient) Serves(model string) bool {
+	return true
+}
+
+// Models returns the model names of the model mappings
+func (this *BedrockClient) Models() []string {
+	models := make([]string, 0, len(this.config.ModelMappings))
+	for model := range this.config.ModelMappings {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	return models
+}
+
+func (this *BedrockClient) HandleMessages(w http.ResponseWriter, r *http.Request) {
+	this.HandleProxy(w, r)
+}
+
+// modelNames returns the sorted model names of Bedrock and of every provider
+func (this *HTTPService) modelNames() []string {
+	names := this.bedrockClient.Models()
+	for _, provider := range this.providers {
+		names = append(names, provider.Models()...)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// messagesProvider returns the first provider serving a model
+func (this *HTTPService) messagesProvider(model string) MessagesProvider {
+	for _, provider := range this.providers {
+		if provider.Serves(model) {
+			return provider
+		}
+	}
+	return this.bedrockClient
+}
+
+// serveMessages runs the transformers on a Messages request before the provider is chosen,
+// so smart routing and experiment aliases are served by the provider, and wait in the queue, of the model they resolve to
+func (this *HTTPService) serveMessages(writer http.ResponseWriter, request *http.Request) {
+	body := this.bedrockClient.decodeMessages(writer, request)
+	if body == nil {
+		return
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	request.Body = io.NopCloser(bytes.NewReader(payload))
+	request.ContentLength = int64(len(payload))
+	model, _ := body["model"].(string)
+	provider := this.messagesProvider(model)
+	request, release, ok := this.queueRequest(writer, request, this.queueModel(request, provider, model))
+	if !ok {
+		return
+	}
+	defer release()
+	provider.HandleMessages(writer, request)
+}
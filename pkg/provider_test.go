@@ -0,0 +1,221 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestProviderRequest(body string) *http.Request {
+	request := httptest.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+	request.Header.Set("Content-Type", "application/json")
+	return request.WithContext(WithRequestState(request.Context(), NewRequestState()))
+}
+
+func TestAnthropicProvider(t *testing.T) {
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" || r.Header.Get("x-api-key") != "sk-ant-test" || r.Header.Get("anthropic-version") != "2023-06-01" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		received = map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&received)
+		if received["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":12,\"output_tokens\":1}}}\n\n" +
+				"event: message_delta\ndata: {\"type\":\"message_delta\",\"usage\":{\"output_tokens\":9}}\n\n" +
+				"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("request-id", "req_1")
+		w.Header().Set("anthropic-ratelimit-requests-limit", "4000")
+		w.Header().Set("retry-after", "5")
+		w.Header().Set("x-upstream", "kept")
+		w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant","content":[],"usage":{"input_tokens":4,"output_tokens":2}}`))
+	}))
+	defer server.Close()
+
+	bedrock := newTestBedrockClient("http://127.0.0.1:1")
+	var usages []*RequestUsage
+	bedrock.AddUsageListener(func(request *http.Request, usage *RequestUsage) {
+		usages = append(usages, usage)
+	})
+	provider, err := NewAnthropicProvider(&ProviderConfig{
+		Name:    "anthropic",
+		Type:    ProviderAnthropic,
+		Models:  map[string]string{"claude-direct": "claude-sonnet-4-20250514"},
+		APIKey:  "sk-ant-test",
+		BaseURL: server.URL,
+	}, bedrock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	// set by RateLimitMiddleware for the key of the request
+	w.Header().Set("anthropic-ratelimit-requests-limit", "10")
+	provider.HandleMessages(w, newTestProviderRequest(`{"model":"claude-direct","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`))
+	if w.Code != http.StatusOK || w.Header().Get("x-upstream") != "kept" || received["model"] != "claude-sonnet-4-20250514" {
+		t.Fatalf("unexpected response %d %v, sent %v", w.Code, w.Header(), received)
+	}
+	if w.Header().Get("anthropic-ratelimit-requests-limit") != "10" || len(w.Header().Get("request-id")) > 0 || len(w.Header().Get("retry-after")) > 0 {
+		t.Errorf("the headers of the upstream account should not be copied, got %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	provider.HandleMessages(w, newTestProviderRequest(`{"model":"claude-direct","max_tokens":10,"stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	if !strings.Contains(w.Body.String(), "event: message_delta") {
+		t.Fatalf("expected the stream to be relayed, got %s", w.Body.String())
+	}
+	if len(usages) != 2 || usages[0].Provider != "anthropic" || usages[0].Model != "claude-sonnet-4-20250514" || usages[0].OutputTokens != 2 ||
+		usages[1].InputTokens != 12 || usages[1].OutputTokens != 9 {
+		t.Errorf("unexpected usages %+v", usages)
+	}
+}
+
+func TestVertexProvider(t *testing.T) {
+	var path string
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ya29.test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		path = r.URL.Path
+		received = map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant","content":[],"usage":{"input_tokens":4,"output_tokens":2}}`))
+	}))
+	defer server.Close()
+
+	provider, err := NewAnthropicProvider(&ProviderConfig{
+		Type:        ProviderVertex,
+		Models:      map[string]string{"claude-vertex": "claude-sonnet-4@20250514"},
+		ProjectID:   "my-project",
+		Region:      "us-east5",
+		AccessToken: "ya29.test",
+		BaseURL:     server.URL,
+	}, newTestBedrockClient("http://127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	provider.HandleMessages(w, newTestProviderRequest(`{"model":"claude-vertex","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+	if path != "/v1/projects/my-project/locations/us-east5/publishers/anthropic/models/claude-sonnet-4@20250514:rawPredict" {
+		t.Errorf("unexpected path %s", path)
+	}
+	if _, ok := received["model"]; ok || received["anthropic_version"] != vertexAnthropicVersion {
+		t.Errorf("unexpected body %v", received)
+	}
+}
+
+func TestGoogleTokenSource(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		r.ParseForm()
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		if len(parts) != 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if !strings.Contains(string(claims), `"iss":"proxy@my-project.iam.gserviceaccount.com"`) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, `{"access_token":"ya29.issued","expires_in":3600,"token_type":"Bearer"}`)
+	}))
+	defer server.Close()
+
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	credentials, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "proxy@my-project.iam.gserviceaccount.com",
+		"private_key_id": "key-1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      server.URL,
+	})
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	os.WriteFile(path, credentials, 0600)
+
+	tokens, err := newGoogleTokenSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tokens.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if token, err := tokens.Token(); err != nil || token != "ya29.issued" {
+			t.Fatalf("unexpected token %q %v", token, err)
+		}
+	}
+	now = now.Add(59*time.Minute + 30*time.Second)
+	tokens.Token()
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("expected the token to be cached until a minute before it expires, got %d requests", calls)
+	}
+}
+
+func TestHTTPService_MessagesProvider(t *testing.T) {
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant","content":[],"usage":{"input_tokens":4,"output_tokens":2}}`))
+	}))
+	defer server.Close()
+
+	bedrock := newTestBedrockClient("http://127.0.0.1:1")
+	direct, _ := NewAnthropicProvider(&ProviderConfig{Type: ProviderAnthropic, Models: map[string]string{"claude-direct": "claude-sonnet-4-20250514"}, APIKey: "sk-ant-test", BaseURL: server.URL}, bedrock)
+	service := &HTTPService{bedrockClient: bedrock, providers: []MessagesProvider{direct}}
+
+	if provider := service.messagesProvider("claude-direct"); provider.Name() != ProviderAnthropic {
+		t.Errorf("expected the anthropic provider, got %s", provider.Name())
+	}
+	if provider := service.messagesProvider("claude-test"); provider.Name() != ProviderBedrock {
+		t.Errorf("expected bedrock, got %s", provider.Name())
+	}
+
+	// the provider is chosen for the model the smart routing alias resolves to
+	router, _ := NewSmartRouter(&SmartRoutingConfig{Enable: true, Alias: "claude-auto", DefaultModel: "claude-direct"})
+	bedrock.AddTransformer(router)
+	w := httptest.NewRecorder()
+	service.serveMessages(w, newTestProviderRequest(`{"model":"claude-auto","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`))
+	if w.Code != http.StatusOK || received["model"] != "claude-sonnet-4-20250514" || w.Header().Get(RoutedModelHeader) != "claude-direct" {
+		t.Errorf("expected the alias to be served by the anthropic provider, got %d %s, sent %v", w.Code, w.Body.String(), received)
+	}
+}
@@ -0,0 +1,458 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nutsdb/nutsdb"
+)
+
+const (
+	quotaConsumptionBucket = "quota_consumption"
+	quotaOverrideBucket    = "quota_overrides"
+
+	QuotaPeriodDaily   = "daily"
+	QuotaPeriodMonthly = "monthly"
+
+	QuotaWarningHeader = "X-Proxy-Quota-Warning"
+)
+
+// QuotaLimit is a token and/or dollar budget of a subject over a period.
+//
+// Subjects are "key:<api key>", "email:<email>" or "domain:<email domain>",
+// "key:*", "email:*" and "domain:*" apply the budget to every key, email or domain separately.
+// A zero Tokens or Cost means that dimension is unlimited.
+type QuotaLimit struct {
+	Subject string  `json:"subject"`
+	Period  string  `json:"period"`
+	Tokens  int64   `json:"tokens,omitempty"`
+	Cost    float64 `json:"cost_usd,omitempty"`
+}
+
+// QuotaConfig controls the spend and token quotas enforced by APIKeyMiddleware
+type QuotaConfig struct {
+	Enable bool          `json:"enable"`
+	Limits []*QuotaLimit `json:"limits,omitempty"`
+	// WarnThresholds are the consumed fractions that add a warning header, e.g. 0.8
+	WarnThresholds []float64 `json:"warn_thresholds,omitempty"`
+}
+
+// parseTokenAmount parses token counts like "500000", "500K", "2M" or "1B"
+func parseTokenAmount(raw string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(raw))
+	multiplier := int64(1)
+	for suffix, size := range map[string]int64{"K": 1000, "M": 1000 * 1000, "B": 1000 * 1000 * 1000} {
+		if strings.HasSuffix(str, suffix) {
+			multiplier = size
+			str = strings.TrimSuffix(str, suffix)
+			break
+		}
+	}
+	amount, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || amount < 0 {
+		return 0, fmt.Errorf("invalid token amount %q", raw)
+	}
+	return amount * multiplier, nil
+}
+
+// parseQuotaLimits parses "subject/period=amount" pairs, amounts ending with USD are dollar budgets
+// e.g. "email:*/daily=1M,domain:example.com/monthly=500USD"
+func parseQuotaLimits(raw string) []*QuotaLimit {
+	var limits []*QuotaLimit
+	for key, value := range ParseMappingsFromStr(raw) {
+		index := strings.LastIndex(key, "/")
+		if index < 0 {
+			Log.Errorf("invalid quota %q, expected subject/period=amount", key)
+			continue
+		}
+		limit := &QuotaLimit{Subject: key[:index], Period: key[index+1:]}
+		if limit.Period != QuotaPeriodDaily && limit.Period != QuotaPeriodMonthly {
+			Log.Errorf("invalid quota period %q", limit.Period)
+			continue
+		}
+
+		upper := strings.ToUpper(strings.TrimSpace(value))
+		if strings.HasSuffix(upper, "USD") {
+			cost, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(upper, "USD")), 64)
+			if err != nil {
+				Log.Errorf("invalid quota cost %q", value)
+				continue
+			}
+			limit.Cost = cost
+		} else {
+			tokens, err := parseTokenAmount(value)
+			if err != nil {
+				Log.Error(err)
+				continue
+			}
+			limit.Tokens = tokens
+		}
+		limits = append(limits, limit)
+	}
+	sort.Slice(limits, func(i, j int) bool {
+		return limits[i].Subject+limits[i].Period < limits[j].Subject+limits[j].Period
+	})
+	return limits
+}
+
+func LoadQuotaConfigWithEnv() *QuotaConfig {
+	config := &QuotaConfig{
+		Enable:         os.Getenv("QUOTA_ENABLE") == "true",
+		Limits:         parseQuotaLimits(os.Getenv("QUOTA_LIMITS")),
+		WarnThresholds: []float64{0.8},
+	}
+	if raw := os.Getenv("QUOTA_WARN_THRESHOLDS"); len(raw) > 0 {
+		config.WarnThresholds = nil
+		for _, item := range filterNonEmpty(strings.Split(raw, ",")) {
+			if threshold, err := strconv.ParseFloat(item, 64); err == nil {
+				config.WarnThresholds = append(config.WarnThresholds, threshold)
+			}
+		}
+	}
+	return config
+}
+
+// QuotaConsumption is what a subject consumed in one period
+type QuotaConsumption struct {
+	Tokens int64   `json:"tokens"`
+	Cost   float64 `json:"cost_usd"`
+}
+
+// QuotaStore keeps quota consumption and the limits overridden by admins
+type QuotaStore interface {
+	AddQuotaConsumption(key string, tokens int64, cost float64, ttl time.Duration) error
+	GetQuotaConsumption(key string) (*QuotaConsumption, error)
+	SaveQuotaOverride(limit *QuotaLimit) error
+	DeleteQuotaOverride(subject string, period string) error
+	ListQuotaOverrides() ([]*QuotaLimit, error)
+}
+
+func (c *Cache) AddQuotaConsumption(key string, tokens int64, cost float64, ttl time.Duration) error {
+	if err := c.ensureBucket(quotaConsumptionBucket); err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *nutsdb.Tx) error {
+		consumption := &QuotaConsumption{}
+		if existing, err := tx.Get(quotaConsumptionBucket, []byte(key)); err == nil {
+			_ = json.Unmarshal(existing, consumption)
+		} else if !isNotFound(err) {
+			return err
+		}
+		consumption.Tokens += tokens
+		consumption.Cost += cost
+		value, err := json.Marshal(consumption)
+		if err != nil {
+			return err
+		}
+		return tx.Put(quotaConsumptionBucket, []byte(key), value, uint32(ttl.Seconds()))
+	})
+}
+
+func (c *Cache) GetQuotaConsumption(key string) (*QuotaConsumption, error) {
+	consumption := &QuotaConsumption{}
+	value, err := c.GetValue(quotaConsumptionBucket, []byte(key))
+	if err != nil || value == nil {
+		return consumption, err
+	}
+	err = json.Unmarshal(value, consumption)
+	return consumption, err
+}
+
+func quotaOverrideKey(subject string, period string) []byte {
+	return []byte(subject + "/" + period)
+}
+
+func (c *Cache) SaveQuotaOverride(limit *QuotaLimit) error {
+	value, err := json.Marshal(limit)
+	if err != nil {
+		return err
+	}
+	return c.PutValue(quotaOverrideBucket, quotaOverrideKey(limit.Subject, limit.Period), value, 0)
+}
+
+func (c *Cache) DeleteQuotaOverride(subject string, period string) error {
+	err := c.db.Update(func(tx *nutsdb.Tx) error {
+		return tx.Delete(quotaOverrideBucket, quotaOverrideKey(subject, period))
+	})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *Cache) ListQuotaOverrides() ([]*QuotaLimit, error) {
+	var limits []*QuotaLimit
+	err := c.db.View(func(tx *nutsdb.Tx) error {
+		_, values, err := tx.GetAll(quotaOverrideBucket)
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			limit := &QuotaLimit{}
+			if err := json.Unmarshal(value, limit); err == nil {
+				limits = append(limits, limit)
+			}
+		}
+		return nil
+	})
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	return limits, nil
+}
+
+// quotaPeriod returns the id of the period containing now and when it resets
+func quotaPeriod(period string, now time.Time) (string, time.Time) {
+	now = now.UTC()
+	if period == QuotaPeriodMonthly {
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start.Format("2006-01"), start.AddDate(0, 1, 0)
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return start.Format("2006-01-02"), start.AddDate(0, 0, 1)
+}
+
+func quotaConsumptionKey(subject string, period string, now time.Time) (string, time.Time) {
+	id, reset := quotaPeriod(period, now)
+	return fmt.Sprintf("%s|%s|%s", subject, period, id), reset
+}
+
+// quotaSubjects returns the subjects an identity is accounted under, the master key has no quota
+func quotaSubjects(identity *RequestIdentity) []string {
+	if identity == nil || identity.IsMaster {
+		return nil
+	}
+	subjects := []string{"key:" + identity.APIKey}
+	if len(identity.Email) > 0 {
+		subjects = append(subjects, "email:"+identity.Email)
+		if index := strings.LastIndex(identity.Email, "@"); index >= 0 {
+			subjects = append(subjects, "domain:"+identity.Email[index+1:])
+		}
+	}
+	return subjects
+}
+
+// QuotaStatus is the state of one limit for one subject
+type QuotaStatus struct {
+	Limit       *QuotaLimit       `json:"limit"`
+	Subject     string            `json:"subject"`
+	Consumption *QuotaConsumption `json:"consumption"`
+	ResetAt     time.Time         `json:"reset_at"`
+}
+
+// Ratio is the highest consumed fraction of the token and dollar budgets
+func (this *QuotaStatus) Ratio() float64 {
+	ratio := 0.0
+	if this.Limit.Tokens > 0 {
+		ratio = math.Max(ratio, float64(this.Consumption.Tokens)/float64(this.Limit.Tokens))
+	}
+	if this.Limit.Cost > 0 {
+		ratio = math.Max(ratio, this.Consumption.Cost/this.Limit.Cost)
+	}
+	return ratio
+}
+
+// QuotaManager enforces QuotaConfig limits and records consumption from usage reports
+type QuotaManager struct {
+	config *QuotaConfig
+	store  QuotaStore
+	now    func() time.Time
+}
+
+func NewQuotaManager(config *QuotaConfig, store QuotaStore) *QuotaManager {
+	return &QuotaManager{config: config, store: store, now: time.Now}
+}
+
+// limitsFor returns the limits of a subject, an admin override replaces the configured limit of its period
+func (this *QuotaManager) limitsFor(subject string, overrides []*QuotaLimit) []*QuotaLimit {
+	byPeriod := map[string]*QuotaLimit{}
+	wildcard := subject[:strings.Index(subject, ":")+1] + "*"
+	for _, limit := range this.config.Limits {
+		if limit.Subject == wildcard {
+			if _, ok := byPeriod[limit.Period]; !ok {
+				byPeriod[limit.Period] = limit
+			}
+		}
+	}
+	for _, limit := range this.config.Limits {
+		if limit.Subject == subject {
+			byPeriod[limit.Period] = limit
+		}
+	}
+	for _, limit := range overrides {
+		if limit.Subject == subject {
+			byPeriod[limit.Period] = limit
+		}
+	}
+
+	limits := make([]*QuotaLimit, 0, len(byPeriod))
+	for _, period := range []string{QuotaPeriodDaily, QuotaPeriodMonthly} {
+		if limit, ok := byPeriod[period]; ok && (limit.Tokens > 0 || limit.Cost > 0) {
+			limits = append(limits, limit)
+		}
+	}
+	return limits
+}
+
+// Status returns the state of every limit applying to the identity
+func (this *QuotaManager) Status(identity *RequestIdentity) ([]*QuotaStatus, error) {
+	overrides, err := this.store.ListQuotaOverrides()
+	if err != nil {
+		return nil, err
+	}
+	now := this.now()
+	var statuses []*QuotaStatus
+	for _, subject := range quotaSubjects(identity) {
+		for _, limit := range this.limitsFor(subject, overrides) {
+			key, reset := quotaConsumptionKey(subject, limit.Period, now)
+			consumption, err := this.store.GetQuotaConsumption(key)
+			if err != nil {
+				return nil, err
+			}
+			statuses = append(statuses, &QuotaStatus{Limit: limit, Subject: subject, Consumption: consumption, ResetAt: reset})
+		}
+	}
+	return statuses, nil
+}
+
+// Check returns the exhausted quota with the latest reset, or nil, and the warnings of quotas over a threshold
+func (this *QuotaManager) Check(identity *RequestIdentity) (*QuotaStatus, []string, error) {
+	statuses, err := this.Status(identity)
+	if err != nil {
+		return nil, nil, err
+	}
+	var exceeded *QuotaStatus
+	var warnings []string
+	for _, status := range statuses {
+		ratio := status.Ratio()
+		if ratio >= 1 {
+			if exceeded == nil || status.ResetAt.After(exceeded.ResetAt) {
+				exceeded = status
+			}
+			continue
+		}
+		threshold := 0.0
+		for _, item := range this.config.WarnThresholds {
+			if ratio >= item && item > threshold {
+				threshold = item
+			}
+		}
+		if threshold > 0 {
+			warnings = append(warnings, fmt.Sprintf("%s %s quota %d%% used, resets at %s",
+				status.Subject, status.Limit.Period, int(ratio*100), status.ResetAt.Format(time.RFC3339)))
+		}
+	}
+	return exceeded, warnings, nil
+}
+
+// Listener is the UsageListener that adds the usage to the consumption of every subject
+func (this *QuotaManager) Listener(request *http.Request, usage *RequestUsage) {
+	if usage.Cached {
+		return
+	}
+	tokens := usage.InputTokens + usage.OutputTokens + usage.CacheReadInputTokens + usage.CacheCreationInputTokens
+	if tokens == 0 && usage.Cost == 0 {
+		return
+	}
+	now := this.now()
+	for _, subject := range quotaSubjects(GetRequestIdentity(request)) {
+		for _, period := range []string{QuotaPeriodDaily, QuotaPeriodMonthly} {
+			key, reset := quotaConsumptionKey(subject, period, now)
+			// keep the counter a day past its period so late reads still see it
+			ttl := reset.Sub(now) + 24*time.Hour
+			if err := this.store.AddQuotaConsumption(key, tokens, usage.Cost, ttl); err != nil {
+				Log.Errorf("failed to record quota consumption: %v", err)
+			}
+		}
+	}
+}
+
+// enforceQuota writes a 429 and returns false when the identity has exhausted a quota
+func (this *HTTPService) enforceQuota(writer http.ResponseWriter, request *http.Request, identity *RequestIdentity) bool {
+	if this.Quotas == nil || !isMeteredRequest(request) {
+		return true
+	}
+	exceeded, warnings, err := this.Quotas.Check(identity)
+	if err != nil {
+		// quota storage problems should not take the proxy down
+		Log.Errorf("failed to check quota: %v", err)
+		return true
+	}
+	for _, warning := range warnings {
+		writer.Header().Add(QuotaWarningHeader, warning)
+	}
+	if exceeded == nil {
+		return true
+	}
+
+	retryAfter := int(math.Ceil(time.Until(exceeded.ResetAt).Seconds()))
+	writer.Header().Set("retry-after", strconv.Itoa(retryAfter))
+	writer.Header().Set("X-Proxy-Quota-Reset", exceeded.ResetAt.Format(time.RFC3339))
+	writeAPIError(writer, http.StatusTooManyRequests, "rate_limit_error",
+		fmt.Sprintf("%s %s quota exceeded, resets at %s", exceeded.Subject, exceeded.Limit.Period, exceeded.ResetAt.Format(time.RFC3339)))
+	return false
+}
+
+// HandleAdminQuotas lists the configured limits and overrides, or the quota status of ?subject=
+func (this *HTTPService) HandleAdminQuotas(writer http.ResponseWriter, request *http.Request) {
+	overrides, err := this.Quotas.store.ListQuotaOverrides()
+	if err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, "api_error", err.Error())
+		return
+	}
+	response := map[string]interface{}{
+		"limits":    this.Quotas.config.Limits,
+		"overrides": overrides,
+	}
+
+	if subject := request.URL.Query().Get("subject"); len(subject) > 0 {
+		now := this.Quotas.now()
+		var statuses []*QuotaStatus
+		for _, limit := range this.Quotas.limitsFor(subject, overrides) {
+			key, reset := quotaConsumptionKey(subject, limit.Period, now)
+			consumption, err := this.Quotas.store.GetQuotaConsumption(key)
+			if err != nil {
+				writeAPIError(writer, http.StatusInternalServerError, "api_error", err.Error())
+				return
+			}
+			statuses = append(statuses, &QuotaStatus{Limit: limit, Subject: subject, Consumption: consumption, ResetAt: reset})
+		}
+		response["status"] = statuses
+	}
+	this.ResponseJSON(response, writer)
+}
+
+// HandleAdminSetQuota stores an override limit, a limit without tokens and cost exempts the subject
+func (this *HTTPService) HandleAdminSetQuota(writer http.ResponseWriter, request *http.Request) {
+	limit := &QuotaLimit{}
+	if err := json.NewDecoder(request.Body).Decode(limit); err != nil {
+		writeAPIError(writer, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	if !strings.Contains(limit.Subject, ":") || (limit.Period != QuotaPeriodDaily && limit.Period != QuotaPeriodMonthly) {
+		writeAPIError(writer, http.StatusBadRequest, "invalid_request_error", "subject must be key:, email: or domain: and period daily or monthly")
+		return
+	}
+	if err := this.Quotas.store.SaveQuotaOverride(limit); err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, "api_error", err.Error())
+		return
+	}
+	this.ResponseJSON(limit, writer)
+}
+
+// HandleAdminDeleteQuota removes the override of ?subject= and ?period=
+func (this *HTTPService) HandleAdminDeleteQuota(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	if err := this.Quotas.store.DeleteQuotaOverride(query.Get("subject"), query.Get("period")); err != nil {
+		writeAPIError(writer, http.StatusInternalServerError, "api_error", err.Error())
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseQuotaLimits(t *testing.T) {
+	limits := parseQuotaLimits("email:*/daily=1M,domain:example.com/monthly=500USD,key:abc/hourly=1,broken=1")
+	if len(limits) != 2 {
+		t.Fatalf("expected 2 valid limits, got %+v", limits)
+	}
+	if limits[0].Subject != "domain:example.com" || limits[0].Cost != 500 {
+		t.Errorf("unexpected cost limit %+v", limits[0])
+	}
+	if limits[1].Subject != "email:*" || limits[1].Tokens != 1000000 {
+		t.Errorf("unexpected token limit %+v", limits[1])
+	}
+}
+
+func TestQuotaManager(t *testing.T) {
+	t.Setenv("CACHE_DB_PATH", t.TempDir())
+	store, err := NewCache()
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	defer store.Close()
+
+	quotas := NewQuotaManager(&QuotaConfig{
+		Enable: true,
+		Limits: []*QuotaLimit{
+			{Subject: "email:*", Period: QuotaPeriodDaily, Tokens: 100},
+			{Subject: "domain:example.com", Period: QuotaPeriodMonthly, Cost: 1},
+		},
+		WarnThresholds: []float64{0.5, 0.8},
+	}, store)
+	service := &HTTPService{Quotas: quotas}
+
+	alice := &RequestIdentity{APIKey: "alice-key", Email: "alice@example.com"}
+	bob := &RequestIdentity{APIKey: "bob-key", Email: "bob@example.com"}
+	consume := func(identity *RequestIdentity, tokens int64, cost float64) {
+		request := httptest.NewRequest("POST", "/v1/messages", nil)
+		request = request.WithContext(WithRequestIdentity(request.Context(), identity))
+		quotas.Listener(request, &RequestUsage{InputTokens: tokens, Cost: cost})
+	}
+	enforce := func(identity *RequestIdentity) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		if service.enforceQuota(w, httptest.NewRequest("POST", "/v1/messages", nil), identity) {
+			w.WriteHeader(http.StatusOK)
+		}
+		return w
+	}
+
+	consume(alice, 85, 0.1)
+	w := enforce(alice)
+	if w.Code != http.StatusOK || w.Header().Get(QuotaWarningHeader) == "" {
+		t.Fatalf("expected a soft limit warning, got %d %v", w.Code, w.Header())
+	}
+
+	consume(alice, 20, 0.1)
+	w = enforce(alice)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 after the daily token quota, got %d", w.Code)
+	}
+	retryAfter, _ := strconv.Atoi(w.Header().Get("retry-after"))
+	if retryAfter <= 0 || retryAfter > 24*3600 {
+		t.Errorf("unexpected retry-after %q", w.Header().Get("retry-after"))
+	}
+
+	// the domain dollar budget is shared between users of the domain
+	consume(bob, 1, 0.9)
+	if w := enforce(bob); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 after the domain cost quota, got %d", w.Code)
+	}
+
+	t.Run("AdminOverride", func(t *testing.T) {
+		for _, limit := range []*QuotaLimit{
+			{Subject: "email:alice@example.com", Period: QuotaPeriodDaily, Tokens: 1000},
+			{Subject: "domain:example.com", Period: QuotaPeriodMonthly},
+		} {
+			if err := store.SaveQuotaOverride(limit); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if w := enforce(alice); w.Code != http.StatusOK {
+			t.Errorf("the override should lift the quota, got %d", w.Code)
+		}
+		if err := store.DeleteQuotaOverride("email:alice@example.com", QuotaPeriodDaily); err != nil {
+			t.Fatal(err)
+		}
+		if w := enforce(alice); w.Code != http.StatusTooManyRequests {
+			t.Errorf("expected the configured quota back, got %d", w.Code)
+		}
+	})
+
+	t.Run("Exempt", func(t *testing.T) {
+		if w := enforce(&RequestIdentity{APIKey: "master", IsMaster: true}); w.Code != http.StatusOK {
+			t.Errorf("the master key has no quota")
+		}
+		w := httptest.NewRecorder()
+		if !service.enforceQuota(w, httptest.NewRequest("GET", "/v1/usage", nil), alice) {
+			t.Errorf("reads should not be blocked by quotas")
+		}
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		quotas.now = func() time.Time { return time.Now().AddDate(0, 0, 1) }
+		defer func() { quotas.now = time.Now }()
+		exceeded, _, err := quotas.Check(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exceeded != nil && exceeded.Limit.Period == QuotaPeriodDaily {
+			t.Errorf("the daily quota should reset the next day")
+		}
+	})
+}
@@ -0,0 +1,388 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a set of per-minute token bucket limits, zero means unlimited
+type RateLimit struct {
+	RequestsPerMinute     int64 `json:"requests_per_minute,omitempty"`
+	InputTokensPerMinute  int64 `json:"input_tokens_per_minute,omitempty"`
+	OutputTokensPerMinute int64 `json:"output_tokens_per_minute,omitempty"`
+}
+
+// RateLimitConfig controls the request and token rate limits of the /v1 router.
+// Key limits apply to each API key owner, model limits are shared by everyone calling the model.
+type RateLimitConfig struct {
+	Enable      bool                  `json:"enable"`
+	KeyLimit    *RateLimit            `json:"key_limit,omitempty"`
+	KeyLimits   map[string]*RateLimit `json:"key_limits,omitempty"`
+	ModelLimits map[string]*RateLimit `json:"model_limits,omitempty"`
+}
+
+// ParseRateLimit parses limits like "rpm:50/itpm:40K/otpm:8K"
+func ParseRateLimit(raw string) (*RateLimit, error) {
+	limit := &RateLimit{}
+	for _, part := range filterNonEmpty(strings.Split(raw, "/")) {
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %q", part)
+		}
+		amount, err := parseTokenAmount(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "rpm":
+			limit.RequestsPerMinute = amount
+		case "itpm":
+			limit.InputTokensPerMinute = amount
+		case "otpm":
+			limit.OutputTokensPerMinute = amount
+		default:
+			return nil, fmt.Errorf("unknown rate limit %q", kv[0])
+		}
+	}
+	return limit, nil
+}
+
+func parseRateLimitMappings(raw string) map[string]*RateLimit {
+	limits := map[string]*RateLimit{}
+	for key, value := range ParseMappingsFromStr(raw) {
+		limit, err := ParseRateLimit(value)
+		if err != nil {
+			Log.Errorf("invalid rate limit of %s: %v", key, err)
+			continue
+		}
+		limits[key] = limit
+	}
+	return limits
+}
+
+func LoadRateLimitConfigWithEnv() *RateLimitConfig {
+	config := &RateLimitConfig{
+		Enable:      os.Getenv("RATE_LIMIT_ENABLE") == "true",
+		KeyLimits:   parseRateLimitMappings(os.Getenv("RATE_LIMIT_KEYS")),
+		ModelLimits: parseRateLimitMappings(os.Getenv("RATE_LIMIT_MODELS")),
+	}
+	if raw := os.Getenv("RATE_LIMIT_KEY_DEFAULT"); len(raw) > 0 {
+		limit, err := ParseRateLimit(raw)
+		if err != nil {
+			Log.Errorf("invalid RATE_LIMIT_KEY_DEFAULT: %v", err)
+		} else {
+			config.KeyLimit = limit
+		}
+	}
+	return config
+}
+
+// BucketState is the state of a token bucket after a take
+type BucketState struct {
+	Limit     int64
+	Remaining int64
+	// Reset is when the bucket is full again
+	Reset time.Time
+	// RetryAfter is how long until the take could succeed, zero when it did
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps token buckets holding up to limit tokens and refilling limit tokens per minute
+type RateLimitStore interface {
+	// TakeTokens removes n tokens when at least max(n, 1) are available, or always when force is set,
+	// which lets the bucket go negative to charge usage known only after the response.
+	// A forced take of a negative n refunds tokens.
+	TakeTokens(key string, limit int64, n int64, force bool) (*BucketState, bool, error)
+}
+
+type localBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// LocalRateLimitStore keeps the buckets in process memory
+type LocalRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*localBucket
+	now     func() time.Time
+}
+
+func NewLocalRateLimitStore() *LocalRateLimitStore {
+	return &LocalRateLimitStore{buckets: map[string]*localBucket{}, now: time.Now}
+}
+
+// takeFromBucket applies a take to a bucket that was refilled up to now, shared by the bucket stores
+func takeFromBucket(tokens float64, limit int64, n int64, force bool, now time.Time) (float64, *BucketState, bool) {
+	rate := float64(limit) / 60
+	need := math.Max(float64(n), 1)
+	allowed := force || tokens >= need
+	state := &BucketState{Limit: limit}
+	if allowed {
+		tokens -= float64(n)
+	} else {
+		state.RetryAfter = time.Duration((need - tokens) / rate * float64(time.Second))
+	}
+	state.Remaining = int64(math.Max(0, math.Floor(tokens)))
+	state.Reset = now.Add(time.Duration((float64(limit) - tokens) / rate * float64(time.Second)))
+	return tokens, state, allowed
+}
+
+// refillBucket returns the tokens of a bucket after refilling it for elapsed
+func refillBucket(tokens float64, limit int64, elapsed time.Duration) float64 {
+	return math.Min(float64(limit), tokens+elapsed.Seconds()*float64(limit)/60)
+}
+
+func (this *LocalRateLimitStore) TakeTokens(key string, limit int64, n int64, force bool) (*BucketState, bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := this.now()
+	bucket, ok := this.buckets[key]
+	if !ok {
+		bucket = &localBucket{tokens: float64(limit), updated: now}
+		this.buckets[key] = bucket
+	}
+	bucket.tokens = refillBucket(bucket.tokens, limit, now.Sub(bucket.updated))
+	bucket.updated = now
+
+	tokens, state, allowed := takeFromBucket(bucket.tokens, limit, n, force, now)
+	bucket.tokens = math.Min(tokens, float64(limit))
+	return state, allowed, nil
+}
+
+type rateLimitContextKey struct{}
+
+// rateLimitTicket remembers which buckets a request was admitted by, to charge its tokens afterwards
+type rateLimitTicket struct {
+	keyBucket   string
+	keyLimit    *RateLimit
+	modelBucket string
+	modelLimit  *RateLimit
+}
+
+// RateLimiter enforces RateLimitConfig with Anthropic style rate limit headers
+type RateLimiter struct {
+	config *RateLimitConfig
+	store  RateLimitStore
+}
+
+func NewRateLimiter(config *RateLimitConfig, store RateLimitStore) *RateLimiter {
+	return &RateLimiter{config: config, store: store}
+}
+
+func (this *RateLimiter) keyLimitOf(identity *RequestIdentity) *RateLimit {
+	if identity == nil || identity.IsMaster {
+		return nil
+	}
+	if limit, ok := this.config.KeyLimits[identity.APIKey]; ok {
+		return limit
+	}
+	if limit, ok := this.config.KeyLimits[identity.Email]; ok && len(identity.Email) > 0 {
+		return limit
+	}
+	return this.config.KeyLimit
+}
+
+// requestModel reads the model of a Messages request and restores the body for the next handler
+func requestModel(request *http.Request) (string, error) {
+	if request.Body == nil || !strings.Contains(request.Header.Get("Content-Type"), "json") {
+		return "", nil
+	}
+	raw, err := io.ReadAll(request.Body)
+	if err != nil {
+		return "", err
+	}
+	request.Body = io.NopCloser(bytes.NewReader(raw))
+	var body struct {
+		Model string `json:"model"`
+	}
+	_ = json.Unmarshal(raw, &body)
+	return body.Model, nil
+}
+
+type rateLimitCheck struct {
+	bucket string
+	limit  int64
+	kind   string
+}
+
+// Admit takes a request token from the key and model buckets and checks their token buckets are not exhausted.
+// It returns the states per kind ("requests", "input-tokens", "output-tokens") and whether the request may proceed.
+func (this *RateLimiter) Admit(ticket *rateLimitTicket) (map[string]*BucketState, bool, error) {
+	var checks []rateLimitCheck
+	for _, item := range []struct {
+		bucket string
+		limit  *RateLimit
+	}{{ticket.keyBucket, ticket.keyLimit}, {ticket.modelBucket, ticket.modelLimit}} {
+		if item.limit == nil {
+			continue
+		}
+		if item.limit.InputTokensPerMinute > 0 {
+			checks = append(checks, rateLimitCheck{item.bucket + "|input", item.limit.InputTokensPerMinute, "input-tokens"})
+		}
+		if item.limit.OutputTokensPerMinute > 0 {
+			checks = append(checks, rateLimitCheck{item.bucket + "|output", item.limit.OutputTokensPerMinute, "output-tokens"})
+		}
+	}
+	// requests are taken last so a request rejected for tokens does not use up a request
+	for _, item := range []struct {
+		bucket string
+		limit  *RateLimit
+	}{{ticket.keyBucket, ticket.keyLimit}, {ticket.modelBucket, ticket.modelLimit}} {
+		if item.limit != nil && item.limit.RequestsPerMinute > 0 {
+			checks = append(checks, rateLimitCheck{item.bucket + "|requests", item.limit.RequestsPerMinute, "requests"})
+		}
+	}
+
+	states := map[string]*BucketState{}
+	var taken []rateLimitCheck
+	for _, check := range checks {
+		n := int64(0)
+		if check.kind == "requests" {
+			n = 1
+		}
+		state, allowed, err := this.store.TakeTokens(check.bucket, check.limit, n, false)
+		if err != nil {
+			this.refund(taken)
+			return nil, false, err
+		}
+		// report the most restrictive bucket of each kind
+		if current, ok := states[check.kind]; !ok || state.Remaining < current.Remaining || !allowed {
+			states[check.kind] = state
+		}
+		if !allowed {
+			this.refund(taken)
+			return states, false, nil
+		}
+		if n > 0 {
+			taken = append(taken, check)
+		}
+	}
+	return states, true, nil
+}
+
+// refund gives back the request tokens taken by a request that a later bucket rejected,
+// so a call refused by the model limit does not use up the requests of the key
+func (this *RateLimiter) refund(taken []rateLimitCheck) {
+	for _, check := range taken {
+		if _, _, err := this.store.TakeTokens(check.bucket, check.limit, -1, true); err != nil {
+			Log.Error(err)
+		}
+	}
+}
+
+func setRateLimitHeaders(header http.Header, states map[string]*BucketState) {
+	var tokens *BucketState
+	for _, kind := range []string{"requests", "input-tokens", "output-tokens"} {
+		state, ok := states[kind]
+		if !ok {
+			continue
+		}
+		header.Set("anthropic-ratelimit-"+kind+"-limit", strconv.FormatInt(state.Limit, 10))
+		header.Set("anthropic-ratelimit-"+kind+"-remaining", strconv.FormatInt(state.Remaining, 10))
+		header.Set("anthropic-ratelimit-"+kind+"-reset", state.Reset.UTC().Format(time.RFC3339))
+		if kind != "requests" && (tokens == nil || state.Remaining < tokens.Remaining) {
+			tokens = state
+		}
+	}
+	if tokens != nil {
+		header.Set("anthropic-ratelimit-tokens-limit", strconv.FormatInt(tokens.Limit, 10))
+		header.Set("anthropic-ratelimit-tokens-remaining", strconv.FormatInt(tokens.Remaining, 10))
+		header.Set("anthropic-ratelimit-tokens-reset", tokens.Reset.UTC().Format(time.RFC3339))
+	}
+}
+
+// Listener is the UsageListener that charges the tokens of a completed request to its buckets
+func (this *RateLimiter) Listener(request *http.Request, usage *RequestUsage) {
+	ticket, ok := request.Context().Value(rateLimitContextKey{}).(*rateLimitTicket)
+	if !ok || usage.Cached {
+		return
+	}
+	// cache reads do not count towards input token rate limits
+	input := usage.InputTokens + usage.CacheCreationInputTokens
+	for _, item := range []struct {
+		bucket string
+		limit  *RateLimit
+	}{{ticket.keyBucket, ticket.keyLimit}, {ticket.modelBucket, ticket.modelLimit}} {
+		if item.limit == nil {
+			continue
+		}
+		if item.limit.InputTokensPerMinute > 0 && input > 0 {
+			if _, _, err := this.store.TakeTokens(item.bucket+"|input", item.limit.InputTokensPerMinute, input, true); err != nil {
+				Log.Error(err)
+			}
+		}
+		if item.limit.OutputTokensPerMinute > 0 && usage.OutputTokens > 0 {
+			if _, _, err := this.store.TakeTokens(item.bucket+"|output", item.limit.OutputTokensPerMinute, usage.OutputTokens, true); err != nil {
+				Log.Error(err)
+			}
+		}
+	}
+}
+
+// RateLimitMiddleware enforces the rate limits of the /v1 router and returns the anthropic-ratelimit-* headers
+func (this *HTTPService) RateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if this.RateLimiter == nil || !isMeteredRequest(request) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		identity := GetRequestIdentity(request)
+		ticket := &rateLimitTicket{
+			keyBucket: "ratelimit|key|" + usageUser(identity),
+			keyLimit:  this.RateLimiter.keyLimitOf(identity),
+		}
+		if len(this.RateLimiter.config.ModelLimits) > 0 {
+			model, err := requestModel(request)
+			if err != nil {
+				if !writeProxyError(writer, err) {
+					writeAPIError(writer, http.StatusBadRequest, "invalid_request_error", err.Error())
+				}
+				return
+			}
+			if limit, ok := this.RateLimiter.config.ModelLimits[model]; ok {
+				ticket.modelBucket = "ratelimit|model|" + model
+				ticket.modelLimit = limit
+			}
+		}
+		if ticket.keyLimit == nil && ticket.modelLimit == nil {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		states, allowed, err := this.RateLimiter.Admit(ticket)
+		if err != nil {
+			// a broken limiter store should not take the proxy down
+			Log.Errorf("failed to check rate limit: %v", err)
+			next.ServeHTTP(writer, request)
+			return
+		}
+		setRateLimitHeaders(writer.Header(), states)
+		if !allowed {
+			retryAfter := time.Duration(0)
+			for _, state := range states {
+				if state.RetryAfter > retryAfter {
+					retryAfter = state.RetryAfter
+				}
+			}
+			writer.Header().Set("retry-after", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeAPIError(writer, http.StatusTooManyRequests, "rate_limit_error",
+				"This request would exceed the rate limit of your API key or model, please retry later")
+			return
+		}
+
+		ctx := context.WithValue(request.Context(), rateLimitContextKey{}, ticket)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
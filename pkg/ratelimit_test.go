@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := ParseRateLimit("rpm:50/itpm:40K/otpm:8k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit.RequestsPerMinute != 50 || limit.InputTokensPerMinute != 40000 || limit.OutputTokensPerMinute != 8000 {
+		t.Errorf("unexpected limit %+v", limit)
+	}
+	if _, err := ParseRateLimit("rps:1"); err == nil {
+		t.Errorf("expected an error for unknown limits")
+	}
+}
+
+func TestLocalRateLimitStore(t *testing.T) {
+	store := NewLocalRateLimitStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if _, allowed, _ := store.TakeTokens("key", 2, 1, false); !allowed {
+			t.Fatalf("take %d should be allowed", i)
+		}
+	}
+	state, allowed, _ := store.TakeTokens("key", 2, 1, false)
+	if allowed || state.Remaining != 0 || state.RetryAfter != 30*time.Second {
+		t.Fatalf("expected the empty bucket to refuse with a 30s retry, got %+v %v", state, allowed)
+	}
+
+	now = now.Add(30 * time.Second)
+	if _, allowed, _ := store.TakeTokens("key", 2, 1, false); !allowed {
+		t.Errorf("the bucket should refill a token every 30s")
+	}
+
+	// charging usage afterwards can overdraw the bucket
+	state, _, _ = store.TakeTokens("tokens", 1000, 1500, true)
+	if state.Remaining != 0 || !state.Reset.Equal(now.Add(90*time.Second)) {
+		t.Errorf("unexpected overdrawn state %+v", state)
+	}
+	if _, allowed, _ := store.TakeTokens("tokens", 1000, 0, false); allowed {
+		t.Errorf("an overdrawn bucket should refuse new requests")
+	}
+}
+
+func TestHTTPService_RateLimitMiddleware(t *testing.T) {
+	limiter := NewRateLimiter(&RateLimitConfig{
+		Enable:      true,
+		KeyLimit:    &RateLimit{RequestsPerMinute: 2, OutputTokensPerMinute: 100},
+		ModelLimits: map[string]*RateLimit{"claude-test": {RequestsPerMinute: 3}},
+	}, NewLocalRateLimitStore())
+	service := &HTTPService{RateLimiter: limiter}
+
+	var lastBody string
+	handler := service.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lastBody = string(body)
+		limiter.Listener(r, &RequestUsage{OutputTokens: 10})
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(identity *RequestIdentity) *httptest.ResponseRecorder {
+		body := `{"model":"claude-test","messages":[]}`
+		request := httptest.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+		request.Header.Set("Content-Type", "application/json")
+		request = request.WithContext(WithRequestIdentity(request.Context(), identity))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request)
+		return w
+	}
+
+	alice := &RequestIdentity{APIKey: "alice", Email: "alice@example.com"}
+	w := send(alice)
+	if w.Code != http.StatusOK || lastBody != `{"model":"claude-test","messages":[]}` {
+		t.Fatalf("expected the request and its body to pass, got %d %q", w.Code, lastBody)
+	}
+	if w.Header().Get("anthropic-ratelimit-requests-remaining") != "1" || w.Header().Get("anthropic-ratelimit-output-tokens-limit") != "100" {
+		t.Errorf("unexpected rate limit headers %v", w.Header())
+	}
+
+	send(alice)
+	w = send(alice)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the third request of the key to be limited, got %d", w.Code)
+	}
+	if retryAfter, _ := strconv.Atoi(w.Header().Get("retry-after")); retryAfter <= 0 {
+		t.Errorf("expected a retry-after header, got %q", w.Header().Get("retry-after"))
+	}
+	if w.Header().Get("anthropic-ratelimit-tokens-remaining") != "80" {
+		t.Errorf("output tokens should be charged after each response: %v", w.Header())
+	}
+
+	// alice used 2 of the 3 model requests
+	if w := send(&RequestIdentity{APIKey: "bob", Email: "bob@example.com"}); w.Code != http.StatusOK {
+		t.Errorf("another key should still be admitted, got %d", w.Code)
+	}
+	if w := send(&RequestIdentity{APIKey: "carol", Email: "carol@example.com"}); w.Code != http.StatusTooManyRequests {
+		t.Errorf("the model limit is shared by every key, got %d", w.Code)
+	}
+	// the request refused by the model limit does not use up a request of the key
+	if state, _, _ := limiter.store.TakeTokens("ratelimit|key|carol@example.com|requests", 2, 0, false); state.Remaining != 2 {
+		t.Errorf("expected the key request to be refunded, got %+v", state)
+	}
+}
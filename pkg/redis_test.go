@@ -0,0 +1,218 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedisStore(t *testing.T, server *miniredis.Miniredis) *RedisStore {
+	store, err := NewRedisStore(&SharedStateConfig{RedisURL: "redis://" + server.Addr(), KeyPrefix: "test:", PoolSize: 2, TimeoutMillis: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestNewRedisStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireAuth("secret")
+	if _, err := NewRedisStore(&SharedStateConfig{RedisURL: "redis://:wrong@" + server.Addr(), TimeoutMillis: 1000}); err == nil {
+		t.Errorf("expected a wrong password to fail")
+	}
+	store, err := NewRedisStore(&SharedStateConfig{RedisURL: "redis://:secret@" + server.Addr() + "/1", PoolSize: 1, TimeoutMillis: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	if _, err := NewRedisStore(&SharedStateConfig{RedisURL: "http://localhost", TimeoutMillis: 1000}); err == nil {
+		t.Errorf("expected an unsupported scheme to fail")
+	}
+}
+
+func TestRedisStore_SharedBetweenReplicas(t *testing.T) {
+	server := miniredis.RunT(t)
+	first := newTestRedisStore(t, server)
+	second := newTestRedisStore(t, server)
+
+	t.Run("APIKeys", func(t *testing.T) {
+		if err := first.SaveAPIKey("alice@example.com", "key-1"); err != nil {
+			t.Fatal(err)
+		}
+		if exists, _ := second.HasAPIKey("alice@example.com"); !exists {
+			t.Fatalf("a key saved by one replica should exist on the other")
+		}
+		if key, err := second.GetAPIKey("alice@example.com"); err != nil || key != "key-1" {
+			t.Errorf("unexpected key %q %v", key, err)
+		}
+		if err := second.DeleteAPIKey("alice@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := first.GetAPIKey("alice@example.com"); err == nil {
+			t.Errorf("expected the deleted key to be gone")
+		}
+	})
+
+	t.Run("Quotas", func(t *testing.T) {
+		if err := first.AddQuotaConsumption("email:alice@example.com|daily|2024-01-01", 10, 0.25, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if err := second.AddQuotaConsumption("email:alice@example.com|daily|2024-01-01", 5, 0.5, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		consumption, err := first.GetQuotaConsumption("email:alice@example.com|daily|2024-01-01")
+		if err != nil || consumption.Tokens != 15 || consumption.Cost != 0.75 {
+			t.Errorf("unexpected consumption %+v %v", consumption, err)
+		}
+		if empty, err := first.GetQuotaConsumption("missing"); err != nil || empty.Tokens != 0 {
+			t.Errorf("unexpected empty consumption %+v %v", empty, err)
+		}
+
+		if err := first.SaveQuotaOverride(&QuotaLimit{Subject: "email:alice@example.com", Period: QuotaPeriodDaily, Tokens: 100}); err != nil {
+			t.Fatal(err)
+		}
+		if overrides, _ := second.ListQuotaOverrides(); len(overrides) != 1 || overrides[0].Tokens != 100 {
+			t.Errorf("unexpected overrides %+v", overrides)
+		}
+		if err := second.DeleteQuotaOverride("email:alice@example.com", QuotaPeriodDaily); err != nil {
+			t.Fatal(err)
+		}
+		if overrides, _ := first.ListQuotaOverrides(); len(overrides) != 0 {
+			t.Errorf("expected the override to be deleted, got %+v", overrides)
+		}
+	})
+
+	t.Run("RateLimits", func(t *testing.T) {
+		now := time.Unix(1700000000/60*60, 0).Add(30 * time.Second)
+		first.now = func() time.Time { return now }
+		second.now = func() time.Time { return now }
+
+		if _, allowed, _ := first.TakeTokens("ratelimit|key|alice", 2, 1, false); !allowed {
+			t.Fatal("the first request should be allowed")
+		}
+		state, allowed, err := second.TakeTokens("ratelimit|key|alice", 2, 1, false)
+		if err != nil || !allowed || state.Remaining != 0 {
+			t.Fatalf("the second replica should see one request left, got %+v %v %v", state, allowed, err)
+		}
+		state, allowed, _ = first.TakeTokens("ratelimit|key|alice", 2, 1, false)
+		if allowed || state.RetryAfter != time.Minute {
+			t.Fatalf("expected the third request to be refused until the window slides, got %+v", state)
+		}
+
+		// halfway through the next minute half of the previous requests still count
+		now = now.Add(time.Minute)
+		if _, allowed, _ := second.TakeTokens("ratelimit|key|alice", 2, 1, false); !allowed {
+			t.Errorf("expected a request to be available in the next window")
+		}
+		if _, allowed, _ := second.TakeTokens("ratelimit|key|alice", 2, 1, false); allowed {
+			t.Errorf("the refused take should have been rolled back and the window is full")
+		}
+
+		// usage charged afterwards may overdraw the window
+		state, _, _ = first.TakeTokens("ratelimit|key|alice|output", 100, 150, true)
+		if state.Remaining != 0 {
+			t.Errorf("unexpected overdrawn state %+v", state)
+		}
+		if _, allowed, _ := second.TakeTokens("ratelimit|key|alice|output", 100, 0, false); allowed {
+			t.Errorf("an overdrawn window should refuse new requests")
+		}
+	})
+}
+
+func TestFallbackRateLimitStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	shared := newTestRedisStore(t, server)
+	store := &fallbackRateLimitStore{primary: shared, local: NewLocalRateLimitStore()}
+
+	server.Close()
+	if _, allowed, err := store.TakeTokens("key", 1, 1, false); err != nil || !allowed {
+		t.Fatalf("expected the local store to admit the request, got %v %v", allowed, err)
+	}
+	if _, allowed, _ := store.TakeTokens("key", 1, 1, false); allowed {
+		t.Errorf("the local store should still enforce the limit")
+	}
+}
+
+func TestFallbackAPIKeyStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	shared := newTestRedisStore(t, server)
+	local := NewMemoryStore(time.Hour)
+	store := &fallbackAPIKeyStore{primary: shared, local: local}
+
+	if err := store.SaveAPIKey("key-1", "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// a key saved by another replica is mirrored once it was looked up here
+	if err := shared.SaveAPIKey("key-2", "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if email, err := store.GetAPIKey("key-2"); err != nil || email != "bob@example.com" {
+		t.Fatalf("unexpected email %q %v", email, err)
+	}
+	if err := shared.SaveAPIKey("key-3", "carol@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Close()
+	for _, key := range []string{"key-1", "key-2"} {
+		if exists, err := store.HasAPIKey(key); err != nil || !exists {
+			t.Errorf("expected %s to be admitted from the local copy, got %v %v", key, exists, err)
+		}
+	}
+	if email, err := store.GetAPIKey("key-1"); err != nil || email != "alice@example.com" {
+		t.Errorf("unexpected email %q %v", email, err)
+	}
+	if exists, _ := store.HasAPIKey("key-3"); exists {
+		t.Errorf("a key never seen by this replica can not be known during the outage")
+	}
+}
+
+func TestFallbackAPIKeyStoreMigration(t *testing.T) {
+	server := miniredis.RunT(t)
+	shared := newTestRedisStore(t, server)
+	local := NewMemoryStore(time.Hour)
+	other := NewMemoryStore(time.Hour)
+	store := &fallbackAPIKeyStore{primary: shared, local: local}
+	otherStore := &fallbackAPIKeyStore{primary: shared, local: other}
+
+	// keys saved before the shared store was enabled only exist in the local stores
+	for _, replica := range []APIKeyStore{local, other} {
+		if err := replica.SaveAPIKey("key-1", "alice@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if exists, err := store.HasAPIKey("key-1"); err != nil || !exists {
+		t.Fatalf("expected the local key to be admitted, got %v %v", exists, err)
+	}
+	if email, err := shared.GetAPIKey("key-1"); err != nil || email != "alice@example.com" {
+		t.Fatalf("expected the local key to be copied to the shared store, got %q %v", email, err)
+	}
+	if _, err := store.GetAPIKey("key-2"); err == nil {
+		t.Errorf("expected an unknown key to be refused")
+	}
+
+	// a deleted key is not copied back from the local store of another replica
+	if err := store.DeleteAPIKey("key-1"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := otherStore.HasAPIKey("key-1"); exists {
+		t.Errorf("a deleted key should not be admitted")
+	}
+	if _, err := other.GetAPIKey("key-1"); err == nil {
+		t.Errorf("the stale local copy should be deleted")
+	}
+	if _, err := shared.GetAPIKey("key-1"); !errors.Is(err, errDeletedSharedAPIKey) {
+		t.Errorf("expected the key to stay deleted, got %v", err)
+	}
+
+	// saving the key again clears the tombstone
+	if err := store.SaveAPIKey("key-1", "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if email, err := otherStore.GetAPIKey("key-1"); err != nil || email != "alice@example.com" {
+		t.Errorf("unexpected email %q %v", email, err)
+	}
+}
@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+)
+
+type requestStateContextKey struct{}
+
+// RequestState carries per-request data shared by the handlers, the transformers and the bedrock client
+type RequestState struct {
+	// ResponseHeader holds extra headers added to the response sent to the client
+	ResponseHeader http.Header
+	// Provider is the name of the provider serving the request, empty for Bedrock
+	Provider string
+	// Model is the Bedrock model id the request was translated for
+	Model string
+	// PayloadHash is the sha256 of the translated Bedrock request body
+	PayloadHash string
+	// Payload is the translated Bedrock request body
+	Payload []byte
+	// Deterministic is true when the request asked for temperature 0
+	Deterministic bool
+	// Transformed is true once the transformers ran on the request body
+	Transformed bool
+	// BreakerModel is the model whose circuit breaker admitted the request
+	BreakerModel string
+	// BreakerProbe is true when the request is the probe of a half open circuit breaker
+	BreakerProbe bool
+	// Experiment is the model alias the request was routed for by the experiment router
+	Experiment string
+	// Arm is the name of the experiment arm that served the request
+	Arm string
+	// Shadowed is true when the request was sampled for the shadow model, its output is then kept in Output
+	Shadowed bool
+	// Output is the Message returned to the client of a shadowed request
+	Output []byte
+	// Hedged is true when a second attempt of the request was sent to another target
+	Hedged bool
+	// Region is the AWS region of the hedge target that served the request, empty for the primary region
+	Region string
+	// Target is the hedge target that served the request, nil for the primary target
+	Target *BedrockTarget
+	// Usage is the usage record of the request, filled while the response is proxied
+	Usage *RequestUsage
+}
+
+func NewRequestState() *RequestState {
+	return &RequestState{
+		ResponseHeader: http.Header{},
+	}
+}
+
+func WithRequestState(ctx context.Context, state *RequestState) context.Context {
+	return context.WithValue(ctx, requestStateContextKey{}, state)
+}
+
+// GetRequestState returns the state attached to the request, or nil when there is none
+func GetRequestState(request *http.Request) *RequestState {
+	if state, ok := request.Context().Value(requestStateContextKey{}).(*RequestState); ok {
+		return state
+	}
+	return nil
+}
+
+// SetResponseHeader sets a header on the client response of the request, when the request has a state
+func SetResponseHeader(request *http.Request, key string, value string) {
+	if state := GetRequestState(request); state != nil {
+		state.ResponseHeader.Set(key, value)
+	}
+}
+
+// copyStateHeaders copies the headers collected in the request state to the response
+func copyStateHeaders(w http.ResponseWriter, request *http.Request) {
+	state := GetRequestState(request)
+	if state == nil {
+		return
+	}
+	for k, v := range state.ResponseHeader {
+		w.Header()[k] = v
+	}
+}
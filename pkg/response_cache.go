@@ -0,0 +1,194 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const responseCacheBucket = "responses"
+
+// ResponseCacheConfig controls the exact-match cache of Messages responses
+type ResponseCacheConfig struct {
+	Enable     bool  `json:"enable"`
+	TTLSeconds int   `json:"ttl_seconds"`
+	MaxEntry   int64 `json:"max_entry_size"`
+	// DeterministicOnly limits the cache to requests with temperature 0
+	DeterministicOnly bool `json:"deterministic_only"`
+	// Shared lets different API key owners hit the same cache entries
+	Shared      bool     `json:"shared,omitempty"`
+	ExcludeKeys []string `json:"exclude_keys,omitempty"`
+}
+
+func LoadResponseCacheConfigWithEnv() *ResponseCacheConfig {
+	config := &ResponseCacheConfig{
+		Enable:            os.Getenv("RESPONSE_CACHE_ENABLE") == "true",
+		TTLSeconds:        3600,
+		MaxEntry:          1024 * 1024,
+		DeterministicOnly: os.Getenv("RESPONSE_CACHE_DETERMINISTIC_ONLY") != "false",
+		Shared:            os.Getenv("RESPONSE_CACHE_SHARED") == "true",
+		ExcludeKeys:       filterNonEmpty(strings.Split(os.Getenv("RESPONSE_CACHE_EXCLUDE_KEYS"), ",")),
+	}
+
+	if raw := os.Getenv("RESPONSE_CACHE_TTL_SECONDS"); len(raw) > 0 {
+		if seconds, err := strconv.Atoi(raw); err == nil {
+			config.TTLSeconds = seconds
+		}
+	}
+	if raw := os.Getenv("RESPONSE_CACHE_MAX_ENTRY_SIZE"); len(raw) > 0 {
+		if size, err := ParseByteSize(raw); err == nil {
+			config.MaxEntry = size
+		}
+	}
+
+	return config
+}
+
+// ResponseCache stores complete Message responses in NutsDB, keyed by the translated Bedrock request
+type ResponseCache struct {
+	config *ResponseCacheConfig
+	store  *Cache
+}
+
+func NewResponseCache(config *ResponseCacheConfig, store *Cache) *ResponseCache {
+	return &ResponseCache{config: config, store: store}
+}
+
+func (this *ResponseCache) isExcluded(identity *RequestIdentity) bool {
+	if identity == nil {
+		return false
+	}
+	for _, key := range this.config.ExcludeKeys {
+		if key == identity.APIKey || (len(identity.Email) > 0 && key == identity.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// Key returns the cache key of a signed request, or "" when the request must not use the cache
+func (this *ResponseCache) Key(request *http.Request) string {
+	state := GetRequestState(request)
+	if state == nil || len(state.PayloadHash) == 0 {
+		return ""
+	}
+	if strings.EqualFold(request.Header.Get("X-Proxy-Cache"), "bypass") {
+		SetResponseHeader(request, "X-Proxy-Cache", "BYPASS")
+		return ""
+	}
+	if this.config.DeterministicOnly && !state.Deterministic {
+		return ""
+	}
+	identity := GetRequestIdentity(request)
+	if this.isExcluded(identity) {
+		return ""
+	}
+
+	scope := ""
+	if !this.config.Shared {
+		scope = identity.Owner()
+	}
+	hash := sha256.Sum256([]byte(state.Model + "\n" + state.PayloadHash + "\n" + scope))
+	return hex.EncodeToString(hash[:])
+}
+
+// Get returns the cached message of key, or nil on a miss
+func (this *ResponseCache) Get(key string) map[string]interface{} {
+	data, err := this.store.GetValue(responseCacheBucket, []byte(key))
+	if err != nil {
+		Log.Error(err)
+		return nil
+	}
+	if data == nil {
+		return nil
+	}
+	message := make(map[string]interface{})
+	if err := json.Unmarshal(data, &message); err != nil {
+		Log.Error(err)
+		return nil
+	}
+	return message
+}
+
+// Put stores a complete Message response body
+func (this *ResponseCache) Put(key string, body []byte) {
+	if int64(len(body)) > this.config.MaxEntry {
+		return
+	}
+	var message struct {
+		Type       string      `json:"type"`
+		StopReason interface{} `json:"stop_reason"`
+	}
+	if err := json.Unmarshal(body, &message); err != nil || message.Type != "message" || message.StopReason == nil {
+		return
+	}
+	ttl := time.Duration(this.config.TTLSeconds) * time.Second
+	if err := this.store.PutValue(responseCacheBucket, []byte(key), body, ttl); err != nil {
+		Log.Error(err)
+	}
+}
+
+// PutMessage stores a message assembled from a stream
+func (this *ResponseCache) PutMessage(key string, message map[string]interface{}) {
+	if message == nil {
+		return
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		Log.Error(err)
+		return
+	}
+	this.Put(key, body)
+}
+
+// Serve writes the cached response of key, as JSON or as a SSE stream, and reports whether it was a hit
+func (this *ResponseCache) Serve(w http.ResponseWriter, request *http.Request, key string, isStream bool) bool {
+	message := this.Get(key)
+	if message == nil {
+		SetResponseHeader(request, "X-Proxy-Cache", "MISS")
+		return false
+	}
+
+	SetResponseHeader(request, "X-Proxy-Cache", "HIT")
+	copyStateHeaders(w, request)
+	if !isStream {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(message); err != nil {
+			Log.Error(err)
+		}
+		return true
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := WriteMessageAsSSE(w, message); err != nil {
+		Log.Error(err)
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return true
+}
+
+// cappedBuffer buffers writes up to a limit, remembering whether the limit was exceeded
+type cappedBuffer struct {
+	bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (this *cappedBuffer) Write(p []byte) (int, error) {
+	if !this.overflow && int64(this.Len()+len(p)) <= this.limit {
+		this.Buffer.Write(p)
+	} else {
+		this.overflow = true
+		this.Reset()
+	}
+	return len(p), nil
+}
@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseCache(t *testing.T) {
+	t.Setenv("CACHE_DB_PATH", t.TempDir())
+	store, err := NewCache()
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	defer store.Close()
+
+	cache := NewResponseCache(&ResponseCacheConfig{
+		Enable:            true,
+		TTLSeconds:        60,
+		MaxEntry:          1024,
+		DeterministicOnly: true,
+		ExcludeKeys:       []string{"excluded@example.com"},
+	}, store)
+
+	buildKey := func(identity *RequestIdentity, deterministic bool) string {
+		request := httptest.NewRequest("POST", "/v1/messages", nil)
+		state := NewRequestState()
+		state.Model = "anthropic.claude"
+		state.PayloadHash = "abc"
+		state.Deterministic = deterministic
+		ctx := WithRequestState(request.Context(), state)
+		ctx = WithRequestIdentity(ctx, identity)
+		request = request.WithContext(ctx)
+		return cache.Key(request)
+	}
+
+	alice := &RequestIdentity{APIKey: "a", Email: "alice@example.com"}
+	bob := &RequestIdentity{APIKey: "b", Email: "bob@example.com"}
+
+	key := buildKey(alice, false)
+	if key != "" {
+		t.Errorf("non deterministic requests should not be cached")
+	}
+	key = buildKey(&RequestIdentity{APIKey: "c", Email: "excluded@example.com"}, true)
+	if key != "" {
+		t.Errorf("excluded keys should not be cached")
+	}
+
+	aliceKey := buildKey(alice, true)
+	bobKey := buildKey(bob, true)
+	if aliceKey == "" || aliceKey == bobKey {
+		t.Fatalf("expected distinct per-owner keys, got %q and %q", aliceKey, bobKey)
+	}
+
+	if cache.Get(aliceKey) != nil {
+		t.Fatal("expected a miss before put")
+	}
+
+	body := `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","stop_sequence":null,"usage":{"input_tokens":3,"output_tokens":1}}`
+	cache.Put(aliceKey, []byte(body))
+	cache.Put(bobKey, []byte(strings.Repeat("x", 2048)))
+
+	t.Run("JSONHit", func(t *testing.T) {
+		request := httptest.NewRequest("POST", "/v1/messages", nil)
+		request = request.WithContext(WithRequestState(request.Context(), NewRequestState()))
+		w := httptest.NewRecorder()
+		if !cache.Serve(w, request, aliceKey, false) {
+			t.Fatal("expected a hit")
+		}
+		if w.Header().Get("X-Proxy-Cache") != "HIT" || !strings.Contains(w.Body.String(), `"text":"hi"`) {
+			t.Errorf("unexpected hit response: %v %s", w.Header(), w.Body.String())
+		}
+	})
+
+	t.Run("StreamHit", func(t *testing.T) {
+		request := httptest.NewRequest("POST", "/v1/messages", nil)
+		w := httptest.NewRecorder()
+		if !cache.Serve(w, request, aliceKey, true) {
+			t.Fatal("expected a hit")
+		}
+		if w.Header().Get("Content-Type") != "text/event-stream" {
+			t.Errorf("expected a SSE response, got %s", w.Header().Get("Content-Type"))
+		}
+		message := assembleSSE(t, w.Body.String()).Message()
+		if message["stop_reason"] != "end_turn" {
+			t.Errorf("unexpected replayed message %v", message)
+		}
+	})
+
+	t.Run("SizeCap", func(t *testing.T) {
+		if cache.Get(bobKey) != nil {
+			t.Errorf("oversized entries should not be stored")
+		}
+	})
+}
@@ -0,0 +1,279 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nutsdb/nutsdb"
+)
+
+const shadowRecordBucket = "shadow_records"
+
+// shadowTimeout bounds a shadow invocation, it never holds a client request
+const shadowTimeout = 5 * time.Minute
+
+// ShadowConfig mirrors a sample of the Messages traffic to a candidate model for offline evaluation
+type ShadowConfig struct {
+	Enable bool `json:"enable"`
+	// Model is the candidate, a name of the model mappings or a Bedrock model id
+	Model string `json:"model"`
+	// SampleRate is the fraction of eligible requests that are mirrored
+	SampleRate float64 `json:"sample_rate"`
+	// Keys are the API keys or emails that may be sampled, "*" allows every key
+	Keys []string `json:"keys,omitempty"`
+	// ExcludeKeys are never sampled, even when Keys allows every key
+	ExcludeKeys []string `json:"exclude_keys,omitempty"`
+	// StoreRequest keeps the translated request beside the outputs
+	StoreRequest   bool `json:"store_request,omitempty"`
+	RetentionDays  int  `json:"retention_days,omitempty"`
+	MaxConcurrency int  `json:"max_concurrency,omitempty"`
+}
+
+func LoadShadowConfigWithEnv() *ShadowConfig {
+	config := &ShadowConfig{
+		Enable:         os.Getenv("SHADOW_ENABLE") == "true",
+		Model:          os.Getenv("SHADOW_MODEL"),
+		SampleRate:     0.01,
+		Keys:           filterNonEmpty(strings.Split(os.Getenv("SHADOW_KEYS"), ",")),
+		ExcludeKeys:    filterNonEmpty(strings.Split(os.Getenv("SHADOW_EXCLUDE_KEYS"), ",")),
+		StoreRequest:   os.Getenv("SHADOW_STORE_REQUEST") == "true",
+		RetentionDays:  30,
+		MaxConcurrency: 4,
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("SHADOW_SAMPLE_RATE"), 64); err == nil && value >= 0 && value <= 1 {
+		config.SampleRate = value
+	}
+	if value, ok := parsePositiveInt(os.Getenv("SHADOW_RETENTION_DAYS")); ok {
+		config.RetentionDays = value
+	}
+	if value, ok := parsePositiveInt(os.Getenv("SHADOW_MAX_CONCURRENCY")); ok {
+		config.MaxConcurrency = value
+	}
+	return config
+}
+
+// ShadowOutput is the response of one model to a mirrored request
+type ShadowOutput struct {
+	Model      string `json:"model"`
+	StatusCode int    `json:"status_code"`
+	// Latency is the milliseconds until the complete response
+	Latency int64           `json:"latency_ms"`
+	Usage   *RequestUsage   `json:"usage,omitempty"`
+	Output  json.RawMessage `json:"output,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// ShadowRecord holds the outputs of the served model and of the candidate side by side
+type ShadowRecord struct {
+	Time      time.Time       `json:"time"`
+	User      string          `json:"user"`
+	Request   json.RawMessage `json:"request,omitempty"`
+	Primary   *ShadowOutput   `json:"primary"`
+	Candidate *ShadowOutput   `json:"candidate"`
+}
+
+// Shadow samples Messages requests and replays them to the candidate model once the client was answered
+type Shadow struct {
+	config   *ShadowConfig
+	client   *BedrockClient
+	cache    *Cache
+	slots    chan struct{}
+	sequence uint64
+	random   func() float64
+}
+
+func NewShadow(config *ShadowConfig, client *BedrockClient, cache *Cache) *Shadow {
+	return &Shadow{
+		config: config,
+		client: client,
+		cache:  cache,
+		slots:  make(chan struct{}, config.MaxConcurrency),
+		random: rand.Float64,
+	}
+}
+
+// allowed reports whether the privacy settings let the requests of an identity be sampled
+func (this *Shadow) allowed(identity *RequestIdentity) bool {
+	matches := func(keys []string) bool {
+		for _, key := range keys {
+			if key == "*" || (identity != nil && (key == identity.APIKey || (len(identity.Email) > 0 && key == identity.Email))) {
+				return true
+			}
+		}
+		return false
+	}
+	return matches(this.config.Keys) && !matches(this.config.ExcludeKeys)
+}
+
+// TransformMessage samples the request, the body is left untouched
+func (this *Shadow) TransformMessage(request *http.Request, body map[string]interface{}) error {
+	state := GetRequestState(request)
+	if state == nil || len(this.config.Model) == 0 || !this.allowed(GetRequestIdentity(request)) {
+		return nil
+	}
+	state.Shadowed = this.random() < this.config.SampleRate
+	return nil
+}
+
+// Listener is the UsageListener that starts the replay of a sampled request which was served successfully
+func (this *Shadow) Listener(request *http.Request, usage *RequestUsage) {
+	state := GetRequestState(request)
+	if state == nil || !state.Shadowed || usage.Cached || usage.StatusCode != http.StatusOK || len(state.Output) == 0 || len(state.Payload) == 0 {
+		return
+	}
+	select {
+	case this.slots <- struct{}{}:
+	default:
+		Log.Debugf("shadow replay of %s skipped, %d replays running", state.Model, cap(this.slots))
+		return
+	}
+
+	primaryUsage := *usage
+	record := &ShadowRecord{
+		Time: time.Now().UTC(),
+		User: usageUser(GetRequestIdentity(request)),
+		Primary: &ShadowOutput{
+			Model:      state.Model,
+			StatusCode: usage.StatusCode,
+			Latency:    usage.InvocationLatency,
+			Usage:      &primaryUsage,
+			Output:     state.Output,
+		},
+	}
+	if this.config.StoreRequest {
+		record.Request = state.Payload
+	}
+	payload := state.Payload
+
+	go func() {
+		defer func() { <-this.slots }()
+		record.Candidate = this.replay(payload)
+		if err := this.save(record); err != nil {
+			Log.Errorf("failed to save the shadow record: %v", err)
+		}
+	}()
+}
+
+// replay sends the translated request to the candidate model without streaming
+func (this *Shadow) replay(payload []byte) *ShadowOutput {
+	model := this.config.Model
+	if mapped, ok := this.client.config.ModelMappings[model]; ok {
+		model = mapped
+	}
+	output := &ShadowOutput{Model: model}
+	usage := NewRequestUsage()
+	usage.Model = model
+	output.Usage = usage
+
+	request, err := this.client.signInvoke(this.client.primaryTarget(), model, "application/json", bytes.NewReader(payload), payload, false)
+	if err != nil {
+		output.Error = err.Error()
+		return output
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	defer cancel()
+	started := time.Now()
+	resp, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		output.Error = err.Error()
+		output.Latency = time.Since(started).Milliseconds()
+		return output
+	}
+	defer resp.Body.Close()
+	usage.MarkFirstByte()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, usageCaptureLimit))
+	output.Latency = time.Since(started).Milliseconds()
+	output.StatusCode = resp.StatusCode
+	if err != nil {
+		output.Error = err.Error()
+		return output
+	}
+	if json.Valid(body) {
+		output.Output = body
+	} else {
+		output.Error = string(body)
+	}
+
+	usage.MergeResponseHeader(resp.Header)
+	if resp.StatusCode == http.StatusOK {
+		usage.MergeResponseBody(body)
+	}
+	usage.Finish(resp.StatusCode)
+	this.client.estimateCost(usage)
+	return output
+}
+
+func (this *Shadow) save(record *ShadowRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	sequence := atomic.AddUint64(&this.sequence, 1)
+	key := []byte(fmt.Sprintf("%s|%08d", record.Time.Format(usageKeyLayout), sequence%100000000))
+	return this.cache.PutValue(shadowRecordBucket, key, data, time.Duration(this.config.RetentionDays)*24*time.Hour)
+}
+
+// Records returns the newest shadow records in the filter range up to the limit, oldest first
+func (this *Shadow) Records(filter *UsageFilter) ([]*ShadowRecord, error) {
+	var values [][]byte
+	err := this.cache.db.View(func(tx *nutsdb.Tx) error {
+		found, err := tx.RangeScan(shadowRecordBucket,
+			[]byte(filter.Start.UTC().Format(usageKeyLayout)),
+			[]byte(filter.End.UTC().Format(usageKeyLayout)+"|~"))
+		values = found
+		return err
+	})
+	if err != nil && !isNotFound(err) && err != nutsdb.ErrRangeScan {
+		return nil, err
+	}
+
+	// the limit keeps the newest records, so the scan runs newest first and the result is reversed
+	records := make([]*ShadowRecord, 0)
+	for i := len(values) - 1; i >= 0; i-- {
+		record := &ShadowRecord{}
+		if err := json.Unmarshal(values[i], record); err != nil {
+			Log.Error(err)
+			continue
+		}
+		if !filter.match(record.User, record.Primary.Model) {
+			continue
+		}
+		records = append(records, record)
+		if filter.Limit > 0 && len(records) >= filter.Limit {
+			break
+		}
+	}
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+// HandleAdminShadow serves the shadow records, filtered like the request usage records
+func (this *HTTPService) HandleAdminShadow(writer http.ResponseWriter, request *http.Request) {
+	filter, err := parseUsageFilter(request, UsageGranularityRequest)
+	if err != nil {
+		writeProxyError(writer, err)
+		return
+	}
+	records, err := this.Shadow.Records(filter)
+	if err != nil {
+		Log.Error(err)
+		writeAPIError(writer, http.StatusInternalServerError, "api_error", err.Error())
+		return
+	}
+	this.ResponseJSON(map[string]interface{}{
+		"candidate": this.Shadow.config.Model,
+		"data":      records,
+	}, writer)
+}
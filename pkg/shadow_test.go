@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShadow(t *testing.T) {
+	t.Setenv("CACHE_DB_PATH", t.TempDir())
+	store, err := NewCache()
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	defer store.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "anthropic.claude-candidate") {
+			time.Sleep(20 * time.Millisecond)
+			w.Write([]byte(`{"id":"msg_2","type":"message","role":"assistant","content":[{"type":"text","text":"candidate"}],"usage":{"input_tokens":3,"output_tokens":7}}`))
+			return
+		}
+		w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"primary"}],"usage":{"input_tokens":3,"output_tokens":5}}`))
+	}))
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	client.config.ModelMappings = map[string]string{"claude-test": "anthropic.claude-test", "claude-candidate": "anthropic.claude-candidate"}
+	shadow := NewShadow(&ShadowConfig{
+		Model:          "claude-candidate",
+		SampleRate:     0.5,
+		Keys:           []string{"*"},
+		ExcludeKeys:    []string{"private@example.com"},
+		RetentionDays:  1,
+		MaxConcurrency: 2,
+	}, client, store)
+	client.AddTransformer(shadow)
+	client.AddUsageListener(shadow.Listener)
+
+	send := func(identity *RequestIdentity, sample float64) *httptest.ResponseRecorder {
+		shadow.random = func() float64 { return sample }
+		request := newTestMessageRequest(false)
+		request = request.WithContext(WithRequestIdentity(request.Context(), identity))
+		w := httptest.NewRecorder()
+		client.HandleProxy(w, request)
+		return w
+	}
+
+	w := send(&RequestIdentity{APIKey: "alice-key-0123456789", Email: "alice@example.com"}, 0.1)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "primary") {
+		t.Fatalf("the client should get the primary response, got %d %s", w.Code, w.Body.String())
+	}
+	send(&RequestIdentity{APIKey: "alice-key-0123456789", Email: "alice@example.com"}, 0.9)
+	send(&RequestIdentity{APIKey: "private-key-0123456789", Email: "private@example.com"}, 0.1)
+	// taking every replay slot waits for the running replays
+	for i := 0; i < cap(shadow.slots); i++ {
+		shadow.slots <- struct{}{}
+	}
+
+	records, err := shadow.Records(&UsageFilter{Start: time.Now().Add(-time.Hour), End: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected only the sampled request of the allowed key, got %d records", len(records))
+	}
+	record := records[0]
+	if record.User != "alice@example.com" || len(record.Request) > 0 {
+		t.Errorf("unexpected record %+v", record)
+	}
+	if record.Primary.Model != "anthropic.claude-test" || !strings.Contains(string(record.Primary.Output), "primary") || record.Primary.Usage.OutputTokens != 5 {
+		t.Errorf("unexpected primary output %+v", record.Primary)
+	}
+	if record.Candidate.Model != "anthropic.claude-candidate" || record.Candidate.StatusCode != http.StatusOK ||
+		!strings.Contains(string(record.Candidate.Output), "candidate") || record.Candidate.Usage.OutputTokens != 7 || record.Candidate.Latency < 20 {
+		t.Errorf("unexpected candidate output %+v", record.Candidate)
+	}
+
+	// the limit keeps the newest records
+	start := time.Now().UTC().Add(-time.Minute)
+	for i := 1; i <= 3; i++ {
+		older := &ShadowRecord{Time: start.Add(time.Duration(i) * time.Second), User: fmt.Sprintf("user-%d", i), Primary: &ShadowOutput{Model: "anthropic.claude-test"}}
+		if err := shadow.save(older); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err = shadow.Records(&UsageFilter{Start: start, End: start.Add(10 * time.Second), Limit: 2})
+	if err != nil || len(records) != 2 || records[0].User != "user-2" || records[1].User != "user-3" {
+		t.Errorf("expected the two newest records oldest first, got %d records %v", len(records), err)
+	}
+}
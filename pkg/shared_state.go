@@ -0,0 +1,415 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SharedStateConfig points the replicas of a deployment at one Redis compatible server
+// for API keys, quota consumption and rate limit counters
+type SharedStateConfig struct {
+	RedisURL  string `json:"redis_url,omitempty"`
+	KeyPrefix string `json:"key_prefix,omitempty"`
+	PoolSize  int    `json:"pool_size,omitempty"`
+	// TimeoutMillis bounds connecting and each round trip
+	TimeoutMillis int `json:"timeout_millis,omitempty"`
+}
+
+func LoadSharedStateConfigWithEnv() *SharedStateConfig {
+	config := &SharedStateConfig{
+		RedisURL:      os.Getenv("SHARED_STATE_REDIS_URL"),
+		KeyPrefix:     "bedrock-proxy:",
+		PoolSize:      10,
+		TimeoutMillis: 500,
+	}
+	if prefix, ok := os.LookupEnv("SHARED_STATE_KEY_PREFIX"); ok {
+		config.KeyPrefix = prefix
+	}
+	if size, err := strconv.Atoi(os.Getenv("SHARED_STATE_POOL_SIZE")); err == nil && size > 0 {
+		config.PoolSize = size
+	}
+	if timeout, err := strconv.Atoi(os.Getenv("SHARED_STATE_TIMEOUT_MILLIS")); err == nil && timeout > 0 {
+		config.TimeoutMillis = timeout
+	}
+	return config
+}
+
+// RedisStore keeps API keys, quota consumption and rate limit windows in Redis,
+// so that every replica behind a load balancer sees the same state.
+// Key lookups fail while the server is unreachable, wrap it in a fallbackAPIKeyStore
+// to keep admitting the keys this replica has seen.
+type RedisStore struct {
+	client        *redis.Client
+	prefix        string
+	timeout       time.Duration
+	defaultExpiry time.Duration
+	now           func() time.Time
+}
+
+// errNoSharedAPIKey tells a missing key apart from a server that could not be reached
+var errNoSharedAPIKey = errors.New("no API key found")
+
+// errDeletedSharedAPIKey is a missing key that was deleted, local copies of it are stale
+var errDeletedSharedAPIKey = fmt.Errorf("%w, it was deleted", errNoSharedAPIKey)
+
+// NewRedisStore connects to the configured server and checks it answers PING
+func NewRedisStore(config *SharedStateConfig) (*RedisStore, error) {
+	options, err := redis.ParseURL(config.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	timeout := time.Duration(config.TimeoutMillis) * time.Millisecond
+	options.PoolSize = config.PoolSize
+	options.DialTimeout = timeout
+	options.ReadTimeout = timeout
+	options.WriteTimeout = timeout
+
+	store := &RedisStore{
+		client:        redis.NewClient(options),
+		prefix:        config.KeyPrefix,
+		timeout:       timeout,
+		defaultExpiry: 24 * time.Hour,
+		now:           time.Now,
+	}
+	ctx, cancel := store.context()
+	defer cancel()
+	if err := store.client.Ping(ctx).Err(); err != nil {
+		store.client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	if hours, err := strconv.Atoi(os.Getenv("CACHE_DEFAULT_EXPIRY_HOURS")); err == nil {
+		store.defaultExpiry = time.Duration(hours) * time.Hour
+	}
+	return store, nil
+}
+
+// context bounds a whole command or pipeline, including waiting for a pooled connection
+func (this *RedisStore) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), this.timeout)
+}
+
+func (this *RedisStore) key(parts ...string) string {
+	return this.prefix + strings.Join(parts, "|")
+}
+
+func (this *RedisStore) SaveAPIKey(email, apiKey string, expiry ...time.Duration) error {
+	expiryDuration := this.defaultExpiry
+	if len(expiry) > 0 {
+		expiryDuration = expiry[0]
+	}
+	data, err := json.Marshal(APIKeyEntry{APIKey: apiKey, CreatedAt: time.Now()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal API key entry: %w", err)
+	}
+	if expiryDuration < time.Second {
+		expiryDuration = 0
+	}
+
+	ctx, cancel := this.context()
+	defer cancel()
+	_, err = this.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, this.key("apikey", email), data, expiryDuration)
+		pipe.Del(ctx, this.key("apikey-deleted", email))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save API key: %w", err)
+	}
+	return nil
+}
+
+// GetAPIKey returns errNoSharedAPIKey for a missing key, and errDeletedSharedAPIKey when it was deleted
+func (this *RedisStore) GetAPIKey(email string) (string, error) {
+	ctx, cancel := this.context()
+	defer cancel()
+	values, err := this.client.MGet(ctx, this.key("apikey", email), this.key("apikey-deleted", email)).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to get API key: %w", err)
+	}
+	data, ok := values[0].(string)
+	if !ok {
+		if values[1] != nil {
+			return "", fmt.Errorf("%w for email: %s", errDeletedSharedAPIKey, email)
+		}
+		return "", fmt.Errorf("%w for email: %s", errNoSharedAPIKey, email)
+	}
+	var entry APIKeyEntry
+	if err := json.Unmarshal([]byte(data), &entry); err != nil {
+		return "", fmt.Errorf("failed to get API key: %w", err)
+	}
+	return entry.APIKey, nil
+}
+
+// DeleteAPIKey leaves a tombstone for the key expiry, so the local copies of other replicas
+// are not copied back into the shared store
+func (this *RedisStore) DeleteAPIKey(email string) error {
+	tombstoneExpiry := this.defaultExpiry
+	if tombstoneExpiry < time.Second {
+		tombstoneExpiry = 0
+	}
+	ctx, cancel := this.context()
+	defer cancel()
+	_, err := this.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, this.key("apikey", email))
+		pipe.Set(ctx, this.key("apikey-deleted", email), "1", tombstoneExpiry)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete API key: %w", err)
+	}
+	return nil
+}
+
+func (this *RedisStore) HasAPIKey(email string) (bool, error) {
+	ctx, cancel := this.context()
+	defer cancel()
+	count, err := this.client.Exists(ctx, this.key("apikey", email)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check API key existence: %w", err)
+	}
+	return count > 0, nil
+}
+
+func (this *RedisStore) GetDefaultExpiry() time.Duration {
+	return this.defaultExpiry
+}
+
+func (this *RedisStore) Close() error {
+	return this.client.Close()
+}
+
+func (this *RedisStore) AddQuotaConsumption(key string, tokens int64, cost float64, ttl time.Duration) error {
+	hash := this.key("quota", key)
+	ctx, cancel := this.context()
+	defer cancel()
+	_, err := this.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, hash, "tokens", tokens)
+		pipe.HIncrByFloat(ctx, hash, "cost", cost)
+		if ttl >= time.Second {
+			pipe.Expire(ctx, hash, ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+func (this *RedisStore) GetQuotaConsumption(key string) (*QuotaConsumption, error) {
+	consumption := &QuotaConsumption{}
+	ctx, cancel := this.context()
+	defer cancel()
+	values, err := this.client.HMGet(ctx, this.key("quota", key), "tokens", "cost").Result()
+	if err != nil {
+		return consumption, err
+	}
+	if tokens, ok := values[0].(string); ok {
+		if consumption.Tokens, err = strconv.ParseInt(tokens, 10, 64); err != nil {
+			return consumption, err
+		}
+	}
+	if cost, ok := values[1].(string); ok {
+		if consumption.Cost, err = strconv.ParseFloat(cost, 64); err != nil {
+			return consumption, err
+		}
+	}
+	return consumption, nil
+}
+
+func (this *RedisStore) SaveQuotaOverride(limit *QuotaLimit) error {
+	value, err := json.Marshal(limit)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := this.context()
+	defer cancel()
+	return this.client.HSet(ctx, this.key("quota_overrides"), string(quotaOverrideKey(limit.Subject, limit.Period)), value).Err()
+}
+
+func (this *RedisStore) DeleteQuotaOverride(subject string, period string) error {
+	ctx, cancel := this.context()
+	defer cancel()
+	return this.client.HDel(ctx, this.key("quota_overrides"), string(quotaOverrideKey(subject, period))).Err()
+}
+
+func (this *RedisStore) ListQuotaOverrides() ([]*QuotaLimit, error) {
+	ctx, cancel := this.context()
+	defer cancel()
+	values, err := this.client.HVals(ctx, this.key("quota_overrides")).Result()
+	if err != nil {
+		return nil, err
+	}
+	var limits []*QuotaLimit
+	for _, value := range values {
+		limit := &QuotaLimit{}
+		if err := json.Unmarshal([]byte(value), limit); err == nil {
+			limits = append(limits, limit)
+		}
+	}
+	return limits, nil
+}
+
+// TakeTokens approximates the token bucket with a sliding window of two one minute counters,
+// which only needs atomic increments on the server. The usage of the window is the current
+// counter plus the previous counter weighted by the part of it still inside the last minute.
+func (this *RedisStore) TakeTokens(key string, limit int64, n int64, force bool) (*BucketState, bool, error) {
+	now := this.now()
+	window := now.Unix() / 60
+	windowStart := time.Unix(window*60, 0)
+	elapsed := now.Sub(windowStart).Seconds() / 60
+	current := this.key(key, strconv.FormatInt(window, 10))
+	previous := this.key(key, strconv.FormatInt(window-1, 10))
+
+	// charge first so concurrent replicas can not both take the last tokens, a refused take is rolled back
+	ctx, cancel := this.context()
+	defer cancel()
+	var incr *redis.IntCmd
+	var get *redis.StringCmd
+	_, err := this.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.IncrBy(ctx, current, n)
+		pipe.Expire(ctx, current, 2*time.Minute)
+		get = pipe.Get(ctx, previous)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, false, err
+	}
+	currentCount := incr.Val()
+	previousCount, err := get.Int64()
+	if err != nil && err != redis.Nil {
+		return nil, false, err
+	}
+
+	previousWeight := float64(previousCount) * (1 - elapsed)
+	used := float64(currentCount) + previousWeight
+	need := math.Max(float64(n), 1)
+	allowed := force || float64(limit)-(used-float64(n)) >= need
+
+	state := &BucketState{Limit: limit}
+	if !allowed {
+		if n != 0 {
+			if err := this.client.DecrBy(ctx, current, n).Err(); err != nil {
+				return nil, false, err
+			}
+			currentCount -= n
+		}
+		used = float64(currentCount) + previousWeight
+		deficit := used + need - float64(limit)
+		if previousCount > 0 && deficit <= previousWeight {
+			// the previous minute slides out of the window fast enough
+			state.RetryAfter = time.Duration(deficit / float64(previousCount) * float64(time.Minute))
+		} else {
+			// wait for the next window, where this minute becomes the sliding part
+			state.RetryAfter = windowStart.Add(time.Minute).Sub(now)
+			if currentCount > 0 {
+				fraction := 1 - (float64(limit)-need)/float64(currentCount)
+				state.RetryAfter += time.Duration(math.Min(1, math.Max(0, fraction)) * float64(time.Minute))
+			}
+		}
+	}
+	state.Remaining = int64(math.Max(0, math.Floor(float64(limit)-used)))
+	state.Reset = windowStart.Add(time.Minute)
+	if currentCount > 0 {
+		state.Reset = windowStart.Add(2 * time.Minute)
+	}
+	return state, allowed, nil
+}
+
+// fallbackRateLimitStore uses the local buckets while the shared store is unreachable,
+// limiting each replica on its own rather than failing every request
+type fallbackRateLimitStore struct {
+	primary RateLimitStore
+	local   RateLimitStore
+}
+
+func (this *fallbackRateLimitStore) TakeTokens(key string, limit int64, n int64, force bool) (*BucketState, bool, error) {
+	state, allowed, err := this.primary.TakeTokens(key, limit, n, force)
+	if err == nil {
+		return state, allowed, nil
+	}
+	Log.Warningf("shared rate limit store failed, using the local store: %v", err)
+	return this.local.TakeTokens(key, limit, n, force)
+}
+
+// fallbackAPIKeyStore mirrors the keys this replica saves or looks up into the local store
+// and answers from that copy while the shared store is unreachable, instead of rejecting every user key.
+// Keys created or deleted on other replicas during an outage are only seen once the server is back.
+// A key missing from the shared store is read from the local store and copied back, so the keys
+// created before the shared store was enabled keep working; keys deleted from the shared store are not.
+type fallbackAPIKeyStore struct {
+	primary APIKeyStore
+	local   APIKeyStore
+}
+
+func (this *fallbackAPIKeyStore) SaveAPIKey(email, apiKey string, expiry ...time.Duration) error {
+	if err := this.primary.SaveAPIKey(email, apiKey, expiry...); err != nil {
+		return err
+	}
+	if err := this.local.SaveAPIKey(email, apiKey, expiry...); err != nil {
+		Log.Warningf("failed to mirror the API key locally: %v", err)
+	}
+	return nil
+}
+
+func (this *fallbackAPIKeyStore) GetAPIKey(email string) (string, error) {
+	apiKey, err := this.primary.GetAPIKey(email)
+	if err == nil {
+		if mirrored, _ := this.local.GetAPIKey(email); mirrored != apiKey {
+			if err := this.local.SaveAPIKey(email, apiKey); err != nil {
+				Log.Warningf("failed to mirror the API key locally: %v", err)
+			}
+		}
+		return apiKey, nil
+	}
+	if errors.Is(err, errDeletedSharedAPIKey) {
+		this.local.DeleteAPIKey(email)
+		return "", err
+	}
+	if errors.Is(err, errNoSharedAPIKey) {
+		apiKey, localErr := this.local.GetAPIKey(email)
+		if localErr != nil {
+			return "", err
+		}
+		if err := this.primary.SaveAPIKey(email, apiKey); err != nil {
+			Log.Warningf("failed to copy the local API key to the shared store: %v", err)
+		}
+		return apiKey, nil
+	}
+	Log.Warningf("shared API key store failed, using the local copy: %v", err)
+	return this.local.GetAPIKey(email)
+}
+
+func (this *fallbackAPIKeyStore) DeleteAPIKey(email string) error {
+	this.local.DeleteAPIKey(email)
+	return this.primary.DeleteAPIKey(email)
+}
+
+func (this *fallbackAPIKeyStore) HasAPIKey(email string) (bool, error) {
+	exists, err := this.primary.HasAPIKey(email)
+	if err != nil {
+		Log.Warningf("shared API key store failed, using the local copy: %v", err)
+		return this.local.HasAPIKey(email)
+	}
+	if exists {
+		return true, nil
+	}
+	// reads the local copy through when the key was never copied to the shared store
+	_, err = this.GetAPIKey(email)
+	return err == nil, nil
+}
+
+func (this *fallbackAPIKeyStore) GetDefaultExpiry() time.Duration {
+	return this.primary.GetDefaultExpiry()
+}
+
+func (this *fallbackAPIKeyStore) Close() error {
+	this.local.Close()
+	return this.primary.Close()
+}
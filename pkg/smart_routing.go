@@ -0,0 +1,247 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// RoutedModelHeader names the model the smart router chose for a request
+	RoutedModelHeader = "X-Proxy-Routed-Model"
+	// RoutingRuleHeader names the rule that chose it, "default" when no rule matched
+	RoutingRuleHeader = "X-Proxy-Routing-Rule"
+)
+
+// imageTokenEstimate is the estimated tokens of one image, about a 1092x1092 image
+const imageTokenEstimate = 1600
+
+// RoutingRule chooses Model when every condition that is set holds
+type RoutingRule struct {
+	Name string `json:"name,omitempty"`
+	// Model is a model name clients may request, e.g. a name of the model mappings or an experiment alias
+	Model string `json:"model"`
+	// MinTokens and MaxTokens bound the estimated prompt tokens, 0 is no bound
+	MinTokens int   `json:"min_tokens,omitempty"`
+	MaxTokens int   `json:"max_tokens,omitempty"`
+	Tools     *bool `json:"tools,omitempty"`
+	Images    *bool `json:"images,omitempty"`
+	Thinking  *bool `json:"thinking,omitempty"`
+	// SystemPattern is a regular expression matched against the system prompt
+	SystemPattern string `json:"system_pattern,omitempty"`
+
+	system *regexp.Regexp
+}
+
+// SmartRoutingConfig routes the requests for a virtual model alias by their features
+type SmartRoutingConfig struct {
+	Enable bool   `json:"enable"`
+	Alias  string `json:"alias"`
+	// Rules are evaluated in order, the first match wins
+	Rules []*RoutingRule `json:"rules,omitempty"`
+	// DefaultModel serves the requests no rule matched
+	DefaultModel string `json:"default_model"`
+}
+
+// parseRoutingRules parses rules like "tokens<2000&!tools=>claude-haiku;images=>claude-sonnet".
+// The conditions are tokens<N, tokens>N, tools, images, thinking, their negation with "!", and system~REGEX.
+func parseRoutingRules(raw string) ([]*RoutingRule, error) {
+	rules := make([]*RoutingRule, 0)
+	for index, item := range filterNonEmpty(strings.Split(raw, ";")) {
+		parts := strings.SplitN(item, "=>", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[1])) == 0 {
+			return nil, fmt.Errorf("routing rule %q has no model", item)
+		}
+		rule := &RoutingRule{Name: fmt.Sprintf("rule-%d", index+1), Model: strings.TrimSpace(parts[1])}
+		for _, condition := range filterNonEmpty(strings.Split(parts[0], "&")) {
+			condition = strings.TrimSpace(condition)
+			expected := !strings.HasPrefix(condition, "!")
+			switch name := strings.TrimPrefix(condition, "!"); {
+			case strings.HasPrefix(condition, "system~"):
+				rule.SystemPattern = strings.TrimPrefix(condition, "system~")
+			case strings.HasPrefix(condition, "tokens<"), strings.HasPrefix(condition, "tokens>"):
+				value, err := strconv.Atoi(condition[len("tokens<"):])
+				if err != nil || value < 0 {
+					return nil, fmt.Errorf("invalid token bound %q", condition)
+				}
+				if condition[len("tokens")] == '<' {
+					rule.MaxTokens = value
+				} else {
+					rule.MinTokens = value
+				}
+			case name == "tools":
+				rule.Tools = &expected
+			case name == "images":
+				rule.Images = &expected
+			case name == "thinking":
+				rule.Thinking = &expected
+			default:
+				return nil, fmt.Errorf("unknown routing condition %q", condition)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func LoadSmartRoutingConfigWithEnv() *SmartRoutingConfig {
+	config := &SmartRoutingConfig{
+		Enable:       os.Getenv("SMART_ROUTING_ENABLE") == "true",
+		Alias:        "auto",
+		DefaultModel: os.Getenv("SMART_ROUTING_DEFAULT_MODEL"),
+	}
+	if alias := os.Getenv("SMART_ROUTING_ALIAS"); len(alias) > 0 {
+		config.Alias = alias
+	}
+	rules, err := parseRoutingRules(os.Getenv("SMART_ROUTING_RULES"))
+	if err != nil {
+		Log.Errorf("invalid SMART_ROUTING_RULES: %v", err)
+	}
+	config.Rules = rules
+	return config
+}
+
+// RequestFeatures are the features of a Messages request the routing rules look at
+type RequestFeatures struct {
+	Tokens   int
+	Tools    bool
+	Images   bool
+	Thinking bool
+	System   string
+}
+
+// estimateTextTokens is the usual estimate of about four characters per token
+func estimateTextTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// textOf returns the text of a string or of the text blocks of a content array
+func textOf(content interface{}) string {
+	if text, ok := content.(string); ok {
+		return text
+	}
+	var builder strings.Builder
+	blocks, _ := content.([]interface{})
+	for _, item := range blocks {
+		if block, ok := item.(map[string]interface{}); ok {
+			if text, ok := block["text"].(string); ok {
+				builder.WriteString(text)
+				builder.WriteString("\n")
+			}
+		}
+	}
+	return builder.String()
+}
+
+// ExtractRequestFeatures reads the routing features of a decoded Messages request body
+func ExtractRequestFeatures(body map[string]interface{}) *RequestFeatures {
+	features := &RequestFeatures{System: textOf(body["system"])}
+	features.Tokens = estimateTextTokens(features.System)
+
+	if tools, ok := body["tools"].([]interface{}); ok && len(tools) > 0 {
+		features.Tools = true
+		for _, tool := range tools {
+			if definition, ok := tool.(map[string]interface{}); ok {
+				features.Tokens += estimateTextTokens(fmt.Sprint(definition["description"], definition["input_schema"]))
+			}
+		}
+	}
+	if thinking, ok := body["thinking"].(map[string]interface{}); ok && thinking["type"] == "enabled" {
+		features.Thinking = true
+	}
+
+	messages, _ := body["messages"].([]interface{})
+	for _, message := range messages {
+		if msg, ok := message.(map[string]interface{}); ok {
+			if text, ok := msg["content"].(string); ok {
+				features.Tokens += estimateTextTokens(text)
+			}
+		}
+	}
+	_ = WalkContentBlocks(body, func(block map[string]interface{}) error {
+		switch block["type"] {
+		case "image":
+			features.Images = true
+			features.Tokens += imageTokenEstimate
+		case "text":
+			text, _ := block["text"].(string)
+			features.Tokens += estimateTextTokens(text)
+		case "tool_use":
+			features.Tokens += estimateTextTokens(fmt.Sprint(block["input"]))
+		case "tool_result":
+			if text, ok := block["content"].(string); ok {
+				features.Tokens += estimateTextTokens(text)
+			}
+		}
+		return nil
+	})
+	return features
+}
+
+// match reports whether every condition of the rule holds for the features
+func (this *RoutingRule) match(features *RequestFeatures) bool {
+	if this.MinTokens > 0 && features.Tokens < this.MinTokens {
+		return false
+	}
+	if this.MaxTokens > 0 && features.Tokens >= this.MaxTokens {
+		return false
+	}
+	if (this.Tools != nil && *this.Tools != features.Tools) ||
+		(this.Images != nil && *this.Images != features.Images) ||
+		(this.Thinking != nil && *this.Thinking != features.Thinking) {
+		return false
+	}
+	return this.system == nil || this.system.MatchString(features.System)
+}
+
+// SmartRouter is the MessageTransformer that replaces the alias by the model of the first matching rule
+type SmartRouter struct {
+	config *SmartRoutingConfig
+}
+
+func NewSmartRouter(config *SmartRoutingConfig) (*SmartRouter, error) {
+	for _, rule := range config.Rules {
+		if len(rule.SystemPattern) == 0 {
+			continue
+		}
+		system, err := regexp.Compile(rule.SystemPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid system pattern of routing rule %s: %v", rule.Name, err)
+		}
+		rule.system = system
+	}
+	return &SmartRouter{config: config}, nil
+}
+
+// Route returns the model and the name of the rule chosen for the features
+func (this *SmartRouter) Route(features *RequestFeatures) (string, string) {
+	for index, rule := range this.config.Rules {
+		if rule.match(features) {
+			name := rule.Name
+			if len(name) == 0 {
+				name = fmt.Sprintf("rule-%d", index+1)
+			}
+			return rule.Model, name
+		}
+	}
+	return this.config.DefaultModel, "default"
+}
+
+func (this *SmartRouter) TransformMessage(request *http.Request, body map[string]interface{}) error {
+	if model, _ := body["model"].(string); model != this.config.Alias {
+		return nil
+	}
+	features := ExtractRequestFeatures(body)
+	model, rule := this.Route(features)
+	if len(model) == 0 {
+		return NewInvalidRequestError("no routing rule matched the request for %s", this.config.Alias)
+	}
+	Log.Debugf("routed %s to %s by %s, about %d tokens", this.config.Alias, model, rule, features.Tokens)
+	body["model"] = model
+	SetResponseHeader(request, RoutedModelHeader, model)
+	SetResponseHeader(request, RoutingRuleHeader, rule)
+	return nil
+}
@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseRoutingRules(t *testing.T) {
+	rules, err := parseRoutingRules("system~(?i)title|summar=>claude-haiku; tokens>50000=>claude-sonnet ;images&!thinking=>claude-sonnet;tokens<2000&!tools=>claude-haiku")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 4 || rules[0].SystemPattern != "(?i)title|summar" || rules[1].MinTokens != 50000 || rules[3].MaxTokens != 2000 {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+	if !*rules[2].Images || *rules[2].Thinking || *rules[3].Tools || rules[3].Name != "rule-4" {
+		t.Errorf("unexpected conditions %+v %+v", rules[2], rules[3])
+	}
+	for _, raw := range []string{"tools", "vision=>claude-haiku", "tokens<many=>claude-haiku"} {
+		if _, err := parseRoutingRules(raw); err == nil {
+			t.Errorf("expected %q to be rejected", raw)
+		}
+	}
+}
+
+func TestSmartRouter(t *testing.T) {
+	rules, _ := parseRoutingRules("system~(?i)title|summar=>claude-haiku;thinking=>claude-opus;images=>claude-sonnet;tokens<2000&!tools=>claude-haiku")
+	router, err := NewSmartRouter(&SmartRoutingConfig{Alias: "auto", Rules: rules, DefaultModel: "claude-sonnet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("word ", 4000)
+	cases := []struct {
+		body  map[string]interface{}
+		model string
+		rule  string
+	}{
+		{map[string]interface{}{"system": "Write a short title for the conversation", "messages": []interface{}{
+			map[string]interface{}{"role": "user", "content": long}}}, "claude-haiku", "rule-1"},
+		{map[string]interface{}{"thinking": map[string]interface{}{"type": "enabled", "budget_tokens": 1024.0}, "messages": []interface{}{
+			map[string]interface{}{"role": "user", "content": "hi"}}}, "claude-opus", "rule-2"},
+		{map[string]interface{}{"messages": []interface{}{map[string]interface{}{"role": "user", "content": []interface{}{
+			map[string]interface{}{"type": "image", "source": map[string]interface{}{"type": "base64", "data": "aGk="}},
+			map[string]interface{}{"type": "text", "text": "what is this?"}}}}}, "claude-sonnet", "rule-3"},
+		{map[string]interface{}{"messages": []interface{}{map[string]interface{}{"role": "user", "content": "hi"}}}, "claude-haiku", "rule-4"},
+		{map[string]interface{}{"tools": []interface{}{map[string]interface{}{"name": "bash", "description": "run"}},
+			"messages": []interface{}{map[string]interface{}{"role": "user", "content": "hi"}}}, "claude-sonnet", "default"},
+		{map[string]interface{}{"messages": []interface{}{map[string]interface{}{"role": "user", "content": long}}}, "claude-sonnet", "default"},
+	}
+	for index, item := range cases {
+		if model, rule := router.Route(ExtractRequestFeatures(item.body)); model != item.model || rule != item.rule {
+			t.Errorf("case %d: expected %s by %s, got %s by %s", index, item.model, item.rule, model, rule)
+		}
+	}
+}
+
+func TestBedrockClient_SmartRouting(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant","content":[],"usage":{"input_tokens":1,"output_tokens":1}}`))
+	}))
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	client.config.ModelMappings = map[string]string{"claude-haiku": "anthropic.claude-haiku", "claude-sonnet": "anthropic.claude-sonnet"}
+	rules, _ := parseRoutingRules("tokens<2000&!tools=>claude-haiku")
+	router, _ := NewSmartRouter(&SmartRoutingConfig{Alias: "auto", Rules: rules, DefaultModel: "claude-sonnet"})
+	client.AddTransformer(router)
+
+	request := httptest.NewRequest("POST", "/v1/messages", bytes.NewBufferString(`{"model":"auto","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`))
+	request.Header.Set("Content-Type", "application/json")
+	request = request.WithContext(WithRequestState(request.Context(), NewRequestState()))
+	w := httptest.NewRecorder()
+	client.HandleProxy(w, request)
+
+	if w.Code != http.StatusOK || w.Header().Get(RoutedModelHeader) != "claude-haiku" || w.Header().Get(RoutingRuleHeader) != "rule-1" {
+		t.Fatalf("expected the request to be routed to claude-haiku, got %d %v", w.Code, w.Header())
+	}
+	if len(paths) != 1 || !strings.Contains(paths[0], "anthropic.claude-haiku") {
+		t.Errorf("expected the mapped model of the rule, got %v", paths)
+	}
+}
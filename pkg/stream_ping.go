@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var pingEventData = []byte(`{"type": "ping"}`)
+
+// ssePinger serialises SSE writes of a stream and emits a "ping" event
+// whenever nothing has been written for interval.
+// Events are written whole under the lock, so a ping never splits or reorders upstream events.
+type ssePinger struct {
+	mu        sync.Mutex
+	w         http.ResponseWriter
+	flusher   http.Flusher
+	interval  time.Duration
+	lastWrite time.Time
+	timer     *time.Timer
+	stopped   bool
+}
+
+func newSSEPinger(w http.ResponseWriter, flusher http.Flusher, interval time.Duration) *ssePinger {
+	pinger := &ssePinger{
+		w:         w,
+		flusher:   flusher,
+		interval:  interval,
+		lastWrite: time.Now(),
+	}
+	if interval > 0 {
+		pinger.mu.Lock()
+		pinger.timer = time.AfterFunc(interval, pinger.tick)
+		pinger.mu.Unlock()
+	}
+	return pinger
+}
+
+func (this *ssePinger) tick() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.stopped {
+		return
+	}
+	// an event was forwarded since the timer was armed
+	if idle := time.Since(this.lastWrite); idle < this.interval {
+		this.timer.Reset(this.interval - idle)
+		return
+	}
+	this.write(formatSSEEvent("ping", pingEventData))
+	this.timer.Reset(this.interval)
+}
+
+func (this *ssePinger) write(event string) {
+	fmt.Fprintf(this.w, "%s\n", event)
+	this.flusher.Flush()
+	this.lastWrite = time.Now()
+}
+
+// WriteEvent forwards one SSE event
+func (this *ssePinger) WriteEvent(event string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.stopped {
+		return
+	}
+	this.write(event)
+}
+
+// Stop ends the pings, no write happens after it returns
+func (this *ssePinger) Stop() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.stopped = true
+	if this.timer != nil {
+		this.timer.Stop()
+	}
+}
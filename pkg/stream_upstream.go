@@ -0,0 +1,182 @@
+package pkg
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keepaliveWriter writes whitespace to a JSON response while the final body is not ready yet.
+// Leading whitespace is valid JSON, so clients parse the final body as usual.
+// Once the first keepalive is sent the status code is committed as 200.
+type keepaliveWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	request *http.Request
+	started bool
+	stopped bool
+}
+
+func (this *keepaliveWriter) keepalive() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.stopped {
+		return
+	}
+	if !this.started {
+		copyStateHeaders(this.w, this.request)
+		this.w.Header().Set("Content-Type", "application/json")
+		this.w.WriteHeader(http.StatusOK)
+		this.started = true
+	}
+	this.w.Write([]byte(" "))
+	if flusher, ok := this.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish writes the final body, with status only when no keepalive was sent
+func (this *keepaliveWriter) finish(status int, header http.Header, body []byte) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.stopped = true
+	if !this.started {
+		for k, v := range header {
+			this.w.Header()[k] = v
+		}
+		copyStateHeaders(this.w, this.request)
+		this.w.Header().Set("Content-Type", "application/json")
+		this.w.WriteHeader(status)
+	}
+	this.w.Write(body)
+}
+
+// run sends a keepalive every interval until the returned stop function is called
+func (this *keepaliveWriter) run(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				this.keepalive()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		this.mu.Lock()
+		this.stopped = true
+		this.mu.Unlock()
+	}
+}
+
+// handleAssembledStream calls invoke-with-response-stream for a non-streaming request and
+// returns the assembled Message object as a single JSON body
+func (this *BedrockClient) handleAssembledStream(w http.ResponseWriter, r *http.Request, cloneReq *http.Request, cacheKey string) {
+	writer := &keepaliveWriter{w: w, request: r}
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	if this.hedger != nil {
+		// the hedge replays the translated payload on invoke-with-response-stream of its target
+		model, payload := "", []byte(nil)
+		if state := GetRequestState(r); state != nil {
+			model, payload = state.Model, state.Payload
+		}
+		var outcome *hedgeOutcome
+		resp, outcome, err = this.doHedged(r, cloneReq, this.upstreamClient(), model, payload, true, true)
+		recordHedge(r, outcome)
+	} else {
+		resp, err = this.upstreamClient().Do(cloneReq)
+	}
+	if err != nil {
+		Log.Error(err)
+		body, _ := json.Marshal(&APIStandardError{Type: "error", Error: &APIError{Type: "api_error", Message: err.Error()}})
+		writer.finish(http.StatusBadGateway, nil, body)
+		return
+	}
+	defer resp.Body.Close()
+
+	header := resp.Header.Clone()
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+	header.Del("X-Amzn-Bedrock-Content-Type")
+
+	// Bedrock 在請求失敗時返回普通的 JSON 錯誤
+	if !strings.Contains(resp.Header.Get("Content-Type"), "amazon.eventstream") {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			Log.Error(err)
+		}
+		writer.finish(resp.StatusCode, header, body)
+		return
+	}
+
+	// keepalives start once Bedrock accepted the request, so its errors keep their status code.
+	// An error in the middle of the stream is sent after the committed 200 as an Anthropic error body.
+	if this.config.KeepaliveSeconds > 0 {
+		stop := writer.run(time.Duration(this.config.KeepaliveSeconds) * time.Second)
+		defer stop()
+	}
+
+	assembler := NewMessageAssembler()
+	err = this.decodeBedrockStream(resp.Body, func(eventType string, raw []byte) {
+		if state := GetRequestState(r); state != nil && state.Usage != nil {
+			state.Usage.ObserveStreamEvent(eventType, raw)
+		}
+		if err := assembler.AddEvent(eventType, raw); err != nil {
+			Log.Error(err)
+		}
+	})
+	if err != nil {
+		Log.Error(err)
+		body, _ := json.Marshal(&APIStandardError{Type: "error", Error: &APIError{Type: "api_error", Message: err.Error()}})
+		writer.finish(http.StatusBadGateway, header, body)
+		return
+	}
+
+	if streamError := assembler.Error(); streamError != nil {
+		body, _ := json.Marshal(streamError)
+		errType := ""
+		if detail, ok := streamError["error"].(map[string]interface{}); ok {
+			errType, _ = detail["type"].(string)
+		}
+		writer.finish(anthropicErrorStatus(errType), header, body)
+		return
+	}
+
+	message := assembler.Message()
+	if message == nil {
+		body, _ := json.Marshal(&APIStandardError{Type: "error", Error: &APIError{Type: "api_error", Message: "empty response from bedrock"}})
+		writer.finish(http.StatusBadGateway, header, body)
+		return
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		Log.Error(err)
+		return
+	}
+	if state := GetRequestState(r); state != nil && state.Usage != nil {
+		this.setCostHeader(header, r, state.Usage)
+	}
+	writer.finish(http.StatusOK, header, body)
+
+	if state := GetRequestState(r); state != nil && state.Shadowed {
+		state.Output = body
+	}
+	if len(cacheKey) > 0 {
+		this.responseCache.Put(cacheKey, body)
+	}
+}
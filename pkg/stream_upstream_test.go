@@ -0,0 +1,215 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/protocol/eventstream"
+)
+
+// writeBedrockChunk writes one Anthropic event as a Bedrock event stream chunk
+func writeBedrockChunk(t *testing.T, w http.ResponseWriter, data []byte) {
+	payload, _ := json.Marshal(map[string]string{"bytes": base64.StdEncoding.EncodeToString(data)})
+	msg := eventstream.Message{Payload: payload}
+	msg.Headers.Set(":event-type", eventstream.StringValue("chunk"))
+	msg.Headers.Set(":content-type", eventstream.StringValue("application/json"))
+	msg.Headers.Set(":message-type", eventstream.StringValue("event"))
+	if err := eventstream.NewEncoder().Encode(w, msg); err != nil {
+		t.Error(err)
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// writeBedrockException writes an exception message of a Bedrock event stream
+func writeBedrockException(t *testing.T, w http.ResponseWriter, exceptionType string, message string) {
+	payload, _ := json.Marshal(map[string]string{"message": message})
+	msg := eventstream.Message{Payload: payload}
+	msg.Headers.Set(":exception-type", eventstream.StringValue(exceptionType))
+	msg.Headers.Set(":content-type", eventstream.StringValue("application/json"))
+	msg.Headers.Set(":message-type", eventstream.StringValue("exception"))
+	if err := eventstream.NewEncoder().Encode(w, msg); err != nil {
+		t.Error(err)
+	}
+}
+
+// newFakeBedrock serves the SSE events of sseBody as a Bedrock event stream, waiting delay before each event
+func newFakeBedrock(t *testing.T, sseBody string, delay time.Duration) *httptest.Server {
+	_, payloads := readSSE(t, sseBody)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/invoke-with-response-stream") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message":"expected a streaming call"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+		w.Header().Set("X-Amzn-Bedrock-Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		for _, payload := range payloads {
+			time.Sleep(delay)
+			writeBedrockChunk(t, w, payload)
+		}
+	}))
+}
+
+func newTestBedrockClient(endpoint string) *BedrockClient {
+	return NewBedrockClient(&BedrockConfig{
+		AccessKey:               "test",
+		SecretKey:               "test",
+		Region:                  "us-east-1",
+		Endpoint:                endpoint,
+		AnthropicDefaultModel:   "anthropic.claude-test",
+		AnthropicDefaultVersion: "bedrock-2023-05-31",
+	})
+}
+
+func newTestMessageRequest(stream bool) *http.Request {
+	body := `{"model":"claude-test","max_tokens":100,"messages":[{"role":"user","content":"hi"}],"stream":false}`
+	if stream {
+		body = strings.Replace(body, `"stream":false`, `"stream":true`, 1)
+	}
+	request := httptest.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+	request.Header.Set("Content-Type", "application/json")
+	return request.WithContext(WithRequestState(request.Context(), NewRequestState()))
+}
+
+func TestBedrockClient_HandleAssembledStream(t *testing.T) {
+	server := newFakeBedrock(t, testStreamEvents, 30*time.Millisecond)
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	client.config.StreamUpstream = true
+	client.config.KeepaliveSeconds = 0
+
+	w := httptest.NewRecorder()
+	client.HandleProxy(w, newTestMessageRequest(false))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected a JSON response, got %s", w.Header().Get("Content-Type"))
+	}
+	var message map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &message); err != nil {
+		t.Fatal(err)
+	}
+	if message["stop_reason"] != "tool_use" || len(message["content"].([]interface{})) != 2 {
+		t.Errorf("unexpected message: %s", w.Body.String())
+	}
+}
+
+func TestBedrockClient_HandleAssembledStreamKeepalive(t *testing.T) {
+	server := newFakeBedrock(t, testStreamEvents, 200*time.Millisecond)
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	client.config.StreamUpstream = true
+	client.config.KeepaliveSeconds = 1
+
+	w := httptest.NewRecorder()
+	client.HandleProxy(w, newTestMessageRequest(false))
+
+	if !strings.HasPrefix(w.Body.String(), " ") {
+		t.Errorf("expected whitespace keepalives before the body")
+	}
+	var message map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &message); err != nil {
+		t.Fatalf("body with keepalives should be valid JSON: %v", err)
+	}
+}
+
+func TestBedrockClient_HandleAssembledStreamKeepaliveError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"message":"Too many requests"}`))
+	}))
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	client.config.StreamUpstream = true
+	client.config.KeepaliveSeconds = 1
+
+	w := httptest.NewRecorder()
+	client.HandleProxy(w, newTestMessageRequest(false))
+
+	// no keepalive is sent before Bedrock answered, the error keeps its status code
+	if w.Code != http.StatusTooManyRequests || strings.HasPrefix(w.Body.String(), " ") {
+		t.Errorf("expected 429 without keepalives, got %d: %q", w.Code, w.Body.String())
+	}
+}
+
+func TestBedrockClient_HandleAssembledStreamException(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+		w.Header().Set("X-Amzn-Bedrock-Content-Type", "application/json")
+		writeBedrockException(t, w, "throttlingException", "Too many requests")
+	}))
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	client.config.StreamUpstream = true
+
+	w := httptest.NewRecorder()
+	client.HandleProxy(w, newTestMessageRequest(false))
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "rate_limit_error") {
+		t.Errorf("unexpected body %s", w.Body.String())
+	}
+}
+
+func TestBedrockClient_HandleBedrockStreamPing(t *testing.T) {
+	types, payloads := readSSE(t, testStreamEvents)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+		w.Header().Set("X-Amzn-Bedrock-Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		for i, payload := range payloads {
+			// 模擬思考期間沒有事件
+			if i == 1 {
+				time.Sleep(1500 * time.Millisecond)
+			}
+			writeBedrockChunk(t, w, payload)
+		}
+	}))
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	client.config.PingIntervalSeconds = 1
+
+	w := httptest.NewRecorder()
+	client.HandleProxy(w, newTestMessageRequest(true))
+
+	received, _ := readSSE(t, w.Body.String())
+	var forwarded []string
+	pings := 0
+	for _, eventType := range received {
+		if eventType == "ping" {
+			pings++
+			continue
+		}
+		forwarded = append(forwarded, eventType)
+	}
+	if pings != 1 {
+		t.Errorf("expected 1 ping, got %d: %v", pings, received)
+	}
+	if received[1] != "ping" {
+		t.Errorf("expected the ping after message_start, got %v", received)
+	}
+	if strings.Join(forwarded, ",") != strings.Join(types, ",") {
+		t.Errorf("upstream events were reordered: %v", forwarded)
+	}
+}
@@ -0,0 +1,63 @@
+package pkg
+
+import (
+	"net/http"
+)
+
+// MessageTransformer rewrites a decoded Messages request body before the provider is chosen and the request is sent
+type MessageTransformer interface {
+	TransformMessage(request *http.Request, body map[string]interface{}) error
+}
+
+// ContentBlockVisitor is called for every content block of a Messages request
+type ContentBlockVisitor func(block map[string]interface{}) error
+
+// WalkContentBlocks visits the content blocks of every message, including the blocks nested in tool results
+func WalkContentBlocks(body map[string]interface{}, visitor ContentBlockVisitor) error {
+	messages, ok := body["messages"].([]interface{})
+	if !ok {
+		return nil
+	}
+	for _, message := range messages {
+		msg, ok := message.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if err := walkBlocks(msg["content"], visitor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkBlocks(content interface{}, visitor ContentBlockVisitor) error {
+	blocks, ok := content.([]interface{})
+	if !ok {
+		return nil
+	}
+	for _, item := range blocks {
+		block, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if err := visitor(block); err != nil {
+			return err
+		}
+		if block["type"] == "tool_result" {
+			if err := walkBlocks(block["content"], visitor); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getBlockSource returns the source object of an image or document block
+func getBlockSource(block map[string]interface{}) (map[string]interface{}, bool) {
+	blockType, _ := block["type"].(string)
+	if blockType != "image" && blockType != "document" {
+		return nil, false
+	}
+	source, ok := block["source"].(map[string]interface{})
+	return source, ok
+}
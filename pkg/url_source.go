@@ -0,0 +1,342 @@
+package pkg
+
+import (
+	"container/list"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// URLSourceConfig controls how `{"source": {"type": "url"}}` image and document blocks are resolved
+type URLSourceConfig struct {
+	Enable               bool     `json:"enable"`
+	AllowHosts           []string `json:"allow_hosts,omitempty"`
+	DenyHosts            []string `json:"deny_hosts,omitempty"`
+	AllowPrivateNetworks bool     `json:"allow_private_networks,omitempty"`
+	MaxBytes             int64    `json:"max_bytes"`
+	TimeoutSeconds       int      `json:"timeout_seconds"`
+	CacheSize            int64    `json:"cache_size"`
+}
+
+func LoadURLSourceConfigWithEnv() *URLSourceConfig {
+	config := &URLSourceConfig{
+		Enable:               os.Getenv("URL_SOURCE_ENABLE") == "true",
+		AllowHosts:           filterNonEmpty(strings.Split(os.Getenv("URL_SOURCE_ALLOW_HOSTS"), ",")),
+		DenyHosts:            filterNonEmpty(strings.Split(os.Getenv("URL_SOURCE_DENY_HOSTS"), ",")),
+		AllowPrivateNetworks: os.Getenv("URL_SOURCE_ALLOW_PRIVATE_NETWORKS") == "true",
+		MaxBytes:             20 * 1024 * 1024,
+		TimeoutSeconds:       30,
+		CacheSize:            64 * 1024 * 1024,
+	}
+
+	if raw := os.Getenv("URL_SOURCE_MAX_SIZE"); len(raw) > 0 {
+		if size, err := ParseByteSize(raw); err == nil {
+			config.MaxBytes = size
+		}
+	}
+	if raw := os.Getenv("URL_SOURCE_TIMEOUT_SECONDS"); len(raw) > 0 {
+		if seconds, err := strconv.Atoi(raw); err == nil {
+			config.TimeoutSeconds = seconds
+		}
+	}
+	if raw := os.Getenv("URL_SOURCE_CACHE_SIZE"); len(raw) > 0 {
+		if size, err := ParseByteSize(raw); err == nil {
+			config.CacheSize = size
+		}
+	}
+
+	return config
+}
+
+// FetchedAsset is the downloaded content of a url source
+type FetchedAsset struct {
+	URL       string
+	ETag      string
+	MediaType string
+	Data      []byte
+}
+
+var supportedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// AsSource converts the asset into a source object accepted by Bedrock for the given block type
+func (this *FetchedAsset) AsSource(blockType string) (map[string]interface{}, error) {
+	switch {
+	case blockType == "image" && supportedImageTypes[this.MediaType]:
+		return map[string]interface{}{
+			"type":       "base64",
+			"media_type": this.MediaType,
+			"data":       base64.StdEncoding.EncodeToString(this.Data),
+		}, nil
+	case blockType == "document" && this.MediaType == "application/pdf":
+		return map[string]interface{}{
+			"type":       "base64",
+			"media_type": this.MediaType,
+			"data":       base64.StdEncoding.EncodeToString(this.Data),
+		}, nil
+	case blockType == "document" && strings.HasPrefix(this.MediaType, "text/"):
+		return map[string]interface{}{
+			"type":       "text",
+			"media_type": "text/plain",
+			"data":       string(this.Data),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported media type %s for %s block", this.MediaType, blockType)
+}
+
+// sniffMediaType trusts the content for binary formats Bedrock validates, and the header otherwise
+func sniffMediaType(header string, data []byte) string {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if supportedImageTypes[sniffed] || sniffed == "application/pdf" {
+		return sniffed
+	}
+	declared, _, err := mime.ParseMediaType(header)
+	if err != nil || declared == "application/octet-stream" || declared == "binary/octet-stream" {
+		return sniffed
+	}
+	if declared == "image/jpg" {
+		return "image/jpeg"
+	}
+	return declared
+}
+
+// matchHost matches a host against "example.com" or "*.example.com" patterns
+func matchHost(host string, pattern string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	// carrier-grade NAT
+	_, cgnat, _ := net.ParseCIDR("100.64.0.0/10")
+	return cgnat.Contains(ip)
+}
+
+// URLSourceResolver downloads url sources and inlines them as base64 / text sources
+type URLSourceResolver struct {
+	config *URLSourceConfig
+	client *http.Client
+	cache  *assetCache
+}
+
+func NewURLSourceResolver(config *URLSourceConfig) *URLSourceResolver {
+	resolver := &URLSourceResolver{
+		config: config,
+		cache:  newAssetCache(config.CacheSize),
+	}
+
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: resolver.controlDial,
+	}
+	resolver.client = &http.Client{
+		Timeout: time.Duration(config.TimeoutSeconds) * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			ForceAttemptHTTP2:   true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			return resolver.checkURL(req.URL)
+		},
+	}
+
+	return resolver
+}
+
+// controlDial checks the address actually dialed, so DNS answers can not point the proxy at internal services
+func (this *URLSourceResolver) controlDial(network, address string, _ syscall.RawConn) error {
+	if this.config.AllowPrivateNetworks {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isPrivateIP(ip) {
+		return fmt.Errorf("address %s is not allowed", host)
+	}
+	return nil
+}
+
+func (this *URLSourceResolver) checkURL(target *url.URL) error {
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", target.Scheme)
+	}
+	host := strings.ToLower(target.Hostname())
+	for _, pattern := range this.config.DenyHosts {
+		if matchHost(host, pattern) {
+			return fmt.Errorf("host %s is denied", host)
+		}
+	}
+	if len(this.config.AllowHosts) == 0 {
+		return nil
+	}
+	for _, pattern := range this.config.AllowHosts {
+		if matchHost(host, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("host %s is not allowed", host)
+}
+
+// Fetch downloads rawURL, revalidating cached assets with their ETag
+func (this *URLSourceResolver) Fetch(ctx context.Context, rawURL string) (*FetchedAsset, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := this.checkURL(target); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	cached := this.cache.Get(rawURL)
+	if cached != nil {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if resp.ContentLength > this.config.MaxBytes {
+		return nil, fmt.Errorf("content exceeds %d bytes", this.config.MaxBytes)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, this.config.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > this.config.MaxBytes {
+		return nil, fmt.Errorf("content exceeds %d bytes", this.config.MaxBytes)
+	}
+
+	asset := &FetchedAsset{
+		URL:       rawURL,
+		ETag:      resp.Header.Get("ETag"),
+		MediaType: sniffMediaType(resp.Header.Get("Content-Type"), data),
+		Data:      data,
+	}
+	if len(asset.ETag) > 0 {
+		this.cache.Put(asset)
+	}
+
+	return asset, nil
+}
+
+func (this *URLSourceResolver) TransformMessage(request *http.Request, body map[string]interface{}) error {
+	if !this.config.Enable {
+		return nil
+	}
+
+	return WalkContentBlocks(body, func(block map[string]interface{}) error {
+		source, ok := getBlockSource(block)
+		if !ok || source["type"] != "url" {
+			return nil
+		}
+		rawURL, _ := source["url"].(string)
+		asset, err := this.Fetch(request.Context(), rawURL)
+		if err != nil {
+			Log.Errorf("failed to fetch url source %s: %v", rawURL, err)
+			return NewInvalidRequestError("Unable to download the file from %s: %v", rawURL, err)
+		}
+		newSource, err := asset.AsSource(block["type"].(string))
+		if err != nil {
+			return NewInvalidRequestError("Unable to use the file from %s: %v", rawURL, err)
+		}
+		block["source"] = newSource
+		return nil
+	})
+}
+
+// assetCache is a LRU cache of fetched assets bounded by the total size of their data
+type assetCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+func newAssetCache(maxBytes int64) *assetCache {
+	return &assetCache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (this *assetCache) Get(key string) *FetchedAsset {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	element, ok := this.entries[key]
+	if !ok {
+		return nil
+	}
+	this.order.MoveToFront(element)
+	return element.Value.(*FetchedAsset)
+}
+
+func (this *assetCache) Put(asset *FetchedAsset) {
+	size := int64(len(asset.Data))
+	if size > this.maxBytes {
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if element, ok := this.entries[asset.URL]; ok {
+		this.size -= int64(len(element.Value.(*FetchedAsset).Data))
+		this.order.Remove(element)
+	}
+	this.entries[asset.URL] = this.order.PushFront(asset)
+	this.size += size
+
+	for this.size > this.maxBytes {
+		oldest := this.order.Back()
+		evicted := this.order.Remove(oldest).(*FetchedAsset)
+		delete(this.entries, evicted.URL)
+		this.size -= int64(len(evicted.Data))
+	}
+}
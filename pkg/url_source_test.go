@@ -0,0 +1,158 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func getTestPNG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestURLSourceResolver_TransformMessage(t *testing.T) {
+	pngData := getTestPNG(t)
+	var downloads int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			atomic.AddInt32(&downloads, 1)
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(pngData)
+		case "/notes.txt":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte("hello"))
+		case "/large":
+			w.Write(bytes.Repeat([]byte("a"), 2048))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	resolver := NewURLSourceResolver(&URLSourceConfig{
+		Enable:               true,
+		AllowPrivateNetworks: true,
+		MaxBytes:             1024,
+		TimeoutSeconds:       5,
+		CacheSize:            1024 * 1024,
+	})
+
+	buildBody := func(blockType string, url string) map[string]interface{} {
+		return map[string]interface{}{
+			"messages": []interface{}{
+				map[string]interface{}{
+					"role": "user",
+					"content": []interface{}{
+						map[string]interface{}{
+							"type":   blockType,
+							"source": map[string]interface{}{"type": "url", "url": url},
+						},
+					},
+				},
+			},
+		}
+	}
+	firstSource := func(body map[string]interface{}) map[string]interface{} {
+		content := body["messages"].([]interface{})[0].(map[string]interface{})["content"].([]interface{})
+		return content[0].(map[string]interface{})["source"].(map[string]interface{})
+	}
+	request := httptest.NewRequest("POST", "/v1/messages", nil)
+
+	t.Run("ImageWithETagCache", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			body := buildBody("image", server.URL+"/image")
+			if err := resolver.TransformMessage(request, body); err != nil {
+				t.Fatal(err)
+			}
+			source := firstSource(body)
+			if source["type"] != "base64" || source["media_type"] != "image/png" {
+				t.Fatalf("unexpected source: %v", source)
+			}
+			if source["data"] != base64.StdEncoding.EncodeToString(pngData) {
+				t.Errorf("unexpected image data")
+			}
+		}
+		if downloads != 1 {
+			t.Errorf("expected 1 download, got %d", downloads)
+		}
+	})
+
+	t.Run("TextDocument", func(t *testing.T) {
+		body := buildBody("document", server.URL+"/notes.txt")
+		if err := resolver.TransformMessage(request, body); err != nil {
+			t.Fatal(err)
+		}
+		source := firstSource(body)
+		if source["type"] != "text" || source["data"] != "hello" {
+			t.Errorf("unexpected source: %v", source)
+		}
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		err := resolver.TransformMessage(request, buildBody("document", server.URL+"/large"))
+		if err == nil || !strings.Contains(err.Error(), "exceeds") {
+			t.Errorf("expected size error, got %v", err)
+		}
+	})
+
+	t.Run("DeniedHost", func(t *testing.T) {
+		denied := NewURLSourceResolver(&URLSourceConfig{
+			Enable:         true,
+			DenyHosts:      []string{"127.0.0.1"},
+			MaxBytes:       1024,
+			TimeoutSeconds: 5,
+		})
+		err := denied.TransformMessage(request, buildBody("image", server.URL+"/image"))
+		if proxyError, ok := err.(*ProxyError); !ok || proxyError.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected invalid request error, got %v", err)
+		}
+	})
+
+	t.Run("PrivateNetworkBlocked", func(t *testing.T) {
+		blocked := NewURLSourceResolver(&URLSourceConfig{
+			Enable:         true,
+			MaxBytes:       1024,
+			TimeoutSeconds: 5,
+		})
+		if err := blocked.TransformMessage(request, buildBody("image", server.URL+"/image")); err == nil {
+			t.Errorf("expected loopback address to be blocked")
+		}
+	})
+}
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		host     string
+		pattern  string
+		expected bool
+	}{
+		{"example.com", "example.com", true},
+		{"cdn.example.com", "*.example.com", true},
+		{"example.com", "*.example.com", false},
+		{"badexample.com", "*.example.com", false},
+		{"other.com", "example.com", false},
+	}
+
+	for _, test := range tests {
+		if result := matchHost(test.host, test.pattern); result != test.expected {
+			t.Errorf("matchHost(%s, %s) = %v, want %v", test.host, test.pattern, result, test.expected)
+		}
+	}
+}
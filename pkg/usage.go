@@ -0,0 +1,229 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const invocationMetricsField = "amazon-bedrock-invocationMetrics"
+
+// usageCaptureLimit is the largest non-streaming response body buffered to read its usage
+const usageCaptureLimit = 4 * 1024 * 1024
+
+// RequestUsage is the token usage and latency of one proxied Messages request
+type RequestUsage struct {
+	Model                    string `json:"model"`
+	Provider                 string `json:"provider,omitempty"`
+	InputTokens              int64  `json:"input_tokens"`
+	OutputTokens             int64  `json:"output_tokens"`
+	CacheReadInputTokens     int64  `json:"cache_read_input_tokens"`
+	CacheCreationInputTokens int64  `json:"cache_creation_input_tokens"`
+	// FirstByteLatency is the milliseconds until Bedrock returned the first byte
+	FirstByteLatency int64 `json:"first_byte_latency_ms"`
+	// InvocationLatency is the milliseconds Bedrock took to complete the invocation
+	InvocationLatency int64 `json:"invocation_latency_ms"`
+	StatusCode        int   `json:"status_code"`
+	// ErrorType is the Anthropic error type of an "error" event raised in the middle of a stream
+	ErrorType string `json:"error_type,omitempty"`
+	// Cost is the estimated USD cost from the price table
+	Cost float64 `json:"cost_usd"`
+	// Cached is true when the response was served from the response cache
+	Cached bool `json:"cached,omitempty"`
+	// Local is true when the proxy answered the request itself without calling the upstream
+	Local bool `json:"local,omitempty"`
+	// Experiment is the model alias of an A/B experiment and Arm the arm that served the request
+	Experiment string `json:"experiment,omitempty"`
+	Arm        string `json:"arm,omitempty"`
+	// Region is the AWS region of the hedge target that served the request, empty for the primary region
+	Region string `json:"region,omitempty"`
+
+	startTime time.Time
+	// streamed is true when the response was a stream, its first byte latency does not include the generation
+	streamed bool
+}
+
+// UsageListener is called once a proxied request is complete, e.g. to log or account its usage
+type UsageListener func(request *http.Request, usage *RequestUsage)
+
+func NewRequestUsage() *RequestUsage {
+	return &RequestUsage{startTime: time.Now()}
+}
+
+func jsonInt(value interface{}) (int64, bool) {
+	if number, ok := value.(float64); ok {
+		return int64(number), true
+	}
+	return 0, false
+}
+
+// MergeAnthropicUsage applies an Anthropic "usage" object, fields that are present override earlier values
+func (this *RequestUsage) MergeAnthropicUsage(usage map[string]interface{}) {
+	if value, ok := jsonInt(usage["input_tokens"]); ok {
+		this.InputTokens = value
+	}
+	if value, ok := jsonInt(usage["output_tokens"]); ok {
+		this.OutputTokens = value
+	}
+	if value, ok := jsonInt(usage["cache_read_input_tokens"]); ok {
+		this.CacheReadInputTokens = value
+	}
+	if value, ok := jsonInt(usage["cache_creation_input_tokens"]); ok {
+		this.CacheCreationInputTokens = value
+	}
+}
+
+// MergeInvocationMetrics applies the amazon-bedrock-invocationMetrics block of the last stream chunk
+func (this *RequestUsage) MergeInvocationMetrics(metrics map[string]interface{}) {
+	if value, ok := jsonInt(metrics["inputTokenCount"]); ok {
+		this.InputTokens = value
+	}
+	if value, ok := jsonInt(metrics["outputTokenCount"]); ok {
+		this.OutputTokens = value
+	}
+	if value, ok := jsonInt(metrics["cacheReadInputTokenCount"]); ok {
+		this.CacheReadInputTokens = value
+	}
+	if value, ok := jsonInt(metrics["cacheWriteInputTokenCount"]); ok {
+		this.CacheCreationInputTokens = value
+	}
+	if value, ok := jsonInt(metrics["invocationLatency"]); ok {
+		this.InvocationLatency = value
+	}
+	if value, ok := jsonInt(metrics["firstByteLatency"]); ok {
+		this.FirstByteLatency = value
+	}
+}
+
+// MergeResponseHeader applies the X-Amzn-Bedrock-* metric headers of a non-streaming invoke response
+func (this *RequestUsage) MergeResponseHeader(header http.Header) {
+	fields := map[string]*int64{
+		"X-Amzn-Bedrock-Input-Token-Count":             &this.InputTokens,
+		"X-Amzn-Bedrock-Output-Token-Count":            &this.OutputTokens,
+		"X-Amzn-Bedrock-Cache-Read-Input-Token-Count":  &this.CacheReadInputTokens,
+		"X-Amzn-Bedrock-Cache-Write-Input-Token-Count": &this.CacheCreationInputTokens,
+		"X-Amzn-Bedrock-Invocation-Latency":            &this.InvocationLatency,
+	}
+	for name, field := range fields {
+		if value, err := strconv.ParseInt(header.Get(name), 10, 64); err == nil {
+			*field = value
+		}
+	}
+}
+
+// MergeResponseBody applies the "usage" of a non-streaming Message response
+func (this *RequestUsage) MergeResponseBody(body []byte) {
+	var message struct {
+		Usage map[string]interface{} `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &message); err != nil || message.Usage == nil {
+		return
+	}
+	this.MergeAnthropicUsage(message.Usage)
+}
+
+// ObserveStreamEvent collects usage from message_start, message_delta and the invocation metrics of message_stop
+func (this *RequestUsage) ObserveStreamEvent(eventType string, data []byte) {
+	this.streamed = true
+	if this.FirstByteLatency == 0 {
+		this.MarkFirstByte()
+	}
+	if eventType == "error" {
+		var event APIStandardError
+		if err := json.Unmarshal(data, &event); err == nil && event.Error != nil {
+			this.ErrorType = event.Error.Type
+		}
+		return
+	}
+	if eventType != "message_start" && eventType != "message_delta" && eventType != "message_stop" {
+		return
+	}
+
+	event := make(map[string]interface{})
+	if err := json.Unmarshal(data, &event); err != nil {
+		return
+	}
+	if message, ok := event["message"].(map[string]interface{}); ok {
+		if usage, ok := message["usage"].(map[string]interface{}); ok {
+			this.MergeAnthropicUsage(usage)
+		}
+	}
+	if usage, ok := event["usage"].(map[string]interface{}); ok {
+		this.MergeAnthropicUsage(usage)
+	}
+	if metrics, ok := event[invocationMetricsField].(map[string]interface{}); ok {
+		this.MergeInvocationMetrics(metrics)
+	}
+}
+
+// MarkFirstByte records the measured first byte latency, Bedrock metrics override it when they arrive
+func (this *RequestUsage) MarkFirstByte() {
+	this.FirstByteLatency = time.Since(this.startTime).Milliseconds()
+}
+
+// Finish fills the status code and falls back to the measured latency when Bedrock reported none
+func (this *RequestUsage) Finish(statusCode int) {
+	this.StatusCode = statusCode
+	if this.InvocationLatency == 0 {
+		this.InvocationLatency = time.Since(this.startTime).Milliseconds()
+	}
+}
+
+// stripInvocationMetrics removes the Bedrock specific metrics from a stream event
+func stripInvocationMetrics(data []byte) []byte {
+	if !bytes.Contains(data, []byte(invocationMetricsField)) {
+		return data
+	}
+	event := make(map[string]interface{})
+	if err := json.Unmarshal(data, &event); err != nil {
+		return data
+	}
+	delete(event, invocationMetricsField)
+	stripped, err := json.Marshal(event)
+	if err != nil {
+		return data
+	}
+	return stripped
+}
+
+// isMeteredRequest reports whether a request may consume model tokens, reads and uploads do not
+func isMeteredRequest(request *http.Request) bool {
+	return request.Method == http.MethodPost && !strings.HasPrefix(request.URL.Path, "/v1/files")
+}
+
+// usageResponseWriter records the status code sent to the client
+type usageResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (this *usageResponseWriter) WriteHeader(statusCode int) {
+	if this.statusCode == 0 {
+		this.statusCode = statusCode
+	}
+	this.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (this *usageResponseWriter) Write(data []byte) (int, error) {
+	if this.statusCode == 0 {
+		this.statusCode = http.StatusOK
+	}
+	return this.ResponseWriter.Write(data)
+}
+
+func (this *usageResponseWriter) Flush() {
+	if flusher, ok := this.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// logUsage is the default usage listener
+func logUsage(request *http.Request, usage *RequestUsage) {
+	Log.Debugf("usage %s owner=%s model=%s arm=%s status=%d input=%d output=%d cache_read=%d cache_write=%d first_byte=%dms latency=%dms cached=%v",
+		request.URL.Path, GetRequestIdentity(request).Owner(), usage.Model, usage.Arm, usage.StatusCode,
+		usage.InputTokens, usage.OutputTokens, usage.CacheReadInputTokens, usage.CacheCreationInputTokens,
+		usage.FirstByteLatency, usage.InvocationLatency, usage.Cached)
+}
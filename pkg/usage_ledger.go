@@ -0,0 +1,498 @@
+package pkg
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nutsdb/nutsdb"
+)
+
+const (
+	usageRecordBucket = "usage_records"
+	usageRollupBucket = "usage_rollups"
+
+	UsageGranularityRequest = "request"
+	UsageGranularityHour    = "hour"
+	UsageGranularityDay     = "day"
+
+	usageHourLayout = "2006-01-02T15"
+	usageDayLayout  = "2006-01-02"
+	// usageKeyLayout sorts lexically in time order
+	usageKeyLayout = "20060102150405.000000000"
+)
+
+// UsageLedgerConfig controls the persistent usage ledger
+type UsageLedgerConfig struct {
+	Enable bool `json:"enable"`
+	// RetentionDays is how long request records and hourly rollups are kept
+	RetentionDays int `json:"retention_days"`
+	// RollupRetentionDays is how long daily rollups are kept, 0 keeps them forever
+	RollupRetentionDays int `json:"rollup_retention_days"`
+}
+
+func LoadUsageLedgerConfigWithEnv() *UsageLedgerConfig {
+	config := &UsageLedgerConfig{
+		Enable:              os.Getenv("USAGE_LEDGER_ENABLE") == "true",
+		RetentionDays:       90,
+		RollupRetentionDays: 400,
+	}
+	if raw := os.Getenv("USAGE_LEDGER_RETENTION_DAYS"); len(raw) > 0 {
+		if days, err := strconv.Atoi(raw); err == nil {
+			config.RetentionDays = days
+		}
+	}
+	if raw := os.Getenv("USAGE_LEDGER_ROLLUP_RETENTION_DAYS"); len(raw) > 0 {
+		if days, err := strconv.Atoi(raw); err == nil {
+			config.RollupRetentionDays = days
+		}
+	}
+	return config
+}
+
+// UsageRecord is the ledger entry of one proxied request
+type UsageRecord struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	APIKey string    `json:"api_key"`
+	Email  string    `json:"email,omitempty"`
+	RequestUsage
+}
+
+// UsageRollup aggregates the usage of one user and model over an hour or a day
+type UsageRollup struct {
+	Period                   string  `json:"period"`
+	User                     string  `json:"user"`
+	Model                    string  `json:"model"`
+	Requests                 int64   `json:"requests"`
+	Errors                   int64   `json:"errors"`
+	InputTokens              int64   `json:"input_tokens"`
+	OutputTokens             int64   `json:"output_tokens"`
+	CacheReadInputTokens     int64   `json:"cache_read_input_tokens"`
+	CacheCreationInputTokens int64   `json:"cache_creation_input_tokens"`
+	TotalLatency             int64   `json:"total_latency_ms"`
+	Cost                     float64 `json:"cost_usd"`
+}
+
+func (this *UsageRollup) add(record *UsageRecord) {
+	this.Requests++
+	if record.StatusCode >= 400 {
+		this.Errors++
+	}
+	this.InputTokens += record.InputTokens
+	this.OutputTokens += record.OutputTokens
+	this.CacheReadInputTokens += record.CacheReadInputTokens
+	this.CacheCreationInputTokens += record.CacheCreationInputTokens
+	this.TotalLatency += record.InvocationLatency
+	this.Cost += record.Cost
+}
+
+// UsageFilter selects ledger entries, empty fields match everything
+type UsageFilter struct {
+	Start time.Time
+	End   time.Time
+	User  string
+	Model string
+	Limit int
+}
+
+func (this *UsageFilter) match(user string, model string) bool {
+	return (len(this.User) == 0 || this.User == user) && (len(this.Model) == 0 || this.Model == model)
+}
+
+// UsageStore persists usage records and their rollups
+type UsageStore interface {
+	RecordUsage(record *UsageRecord) error
+	// QueryRecords returns the newest request records in the filter range up to the limit, oldest first
+	QueryRecords(filter *UsageFilter) ([]*UsageRecord, error)
+	// QueryRollups returns the hourly or daily rollups in the filter range, oldest first
+	QueryRollups(granularity string, filter *UsageFilter) ([]*UsageRollup, error)
+}
+
+// maskAPIKey keeps the start and the end of a key so it can be recognised without being leaked
+func maskAPIKey(apiKey string) string {
+	if len(apiKey) <= 12 {
+		return strings.Repeat("*", len(apiKey))
+	}
+	return apiKey[:6] + "..." + apiKey[len(apiKey)-4:]
+}
+
+// usageUser returns the user an identity is accounted as
+func usageUser(identity *RequestIdentity) string {
+	switch {
+	case identity == nil:
+		return "anonymous"
+	case len(identity.Email) > 0:
+		return identity.Email
+	case identity.IsMaster:
+		return "master"
+	}
+	return maskAPIKey(identity.APIKey)
+}
+
+// NewUsageRecord builds the ledger entry of a completed request
+func NewUsageRecord(request *http.Request, usage *RequestUsage) *UsageRecord {
+	identity := GetRequestIdentity(request)
+	record := &UsageRecord{
+		Time:         time.Now().UTC(),
+		User:         usageUser(identity),
+		RequestUsage: *usage,
+	}
+	if identity != nil {
+		record.APIKey = maskAPIKey(identity.APIKey)
+		record.Email = identity.Email
+	}
+	return record
+}
+
+// NutsUsageStore keeps the usage ledger in the NutsDB cache
+type NutsUsageStore struct {
+	cache           *Cache
+	retention       time.Duration
+	rollupRetention time.Duration
+	sequence        uint64
+}
+
+func NewNutsUsageStore(cache *Cache, config *UsageLedgerConfig) *NutsUsageStore {
+	return &NutsUsageStore{
+		cache:           cache,
+		retention:       time.Duration(config.RetentionDays) * 24 * time.Hour,
+		rollupRetention: time.Duration(config.RollupRetentionDays) * 24 * time.Hour,
+	}
+}
+
+func rollupKey(granularity string, period string, user string, model string) []byte {
+	return []byte(fmt.Sprintf("%s|%s|%s|%s", granularity, period, user, model))
+}
+
+func (this *NutsUsageStore) RecordUsage(record *UsageRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range []string{usageRecordBucket, usageRollupBucket} {
+		if err := this.cache.ensureBucket(bucket); err != nil {
+			return err
+		}
+	}
+
+	sequence := atomic.AddUint64(&this.sequence, 1)
+	key := []byte(fmt.Sprintf("%s|%08d", record.Time.Format(usageKeyLayout), sequence%100000000))
+	ttl := uint32(this.retention.Seconds())
+
+	// rollups are read-modify-write, NutsDB serialises update transactions
+	return this.cache.db.Update(func(tx *nutsdb.Tx) error {
+		if err := tx.Put(usageRecordBucket, key, data, ttl); err != nil {
+			return err
+		}
+		periods := []struct {
+			granularity string
+			period      string
+			ttl         uint32
+		}{
+			{UsageGranularityHour, record.Time.Format(usageHourLayout), ttl},
+			{UsageGranularityDay, record.Time.Format(usageDayLayout), uint32(this.rollupRetention.Seconds())},
+		}
+		for _, item := range periods {
+			rollup := &UsageRollup{Period: item.period, User: record.User, Model: record.Model}
+			key := rollupKey(item.granularity, item.period, record.User, record.Model)
+			if existing, err := tx.Get(usageRollupBucket, key); err == nil {
+				_ = json.Unmarshal(existing, rollup)
+			} else if !isNotFound(err) {
+				return err
+			}
+			rollup.add(record)
+			value, err := json.Marshal(rollup)
+			if err != nil {
+				return err
+			}
+			if err := tx.Put(usageRollupBucket, key, value, item.ttl); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// rangeScan returns the values between start and end, an empty range is not an error
+func (this *NutsUsageStore) rangeScan(bucket string, start []byte, end []byte) ([][]byte, error) {
+	var values [][]byte
+	err := this.cache.db.View(func(tx *nutsdb.Tx) error {
+		found, err := tx.RangeScan(bucket, start, end)
+		if err != nil {
+			return err
+		}
+		values = found
+		return nil
+	})
+	if err != nil && (isNotFound(err) || err == nutsdb.ErrRangeScan) {
+		return nil, nil
+	}
+	return values, err
+}
+
+func (this *NutsUsageStore) QueryRecords(filter *UsageFilter) ([]*UsageRecord, error) {
+	values, err := this.rangeScan(usageRecordBucket,
+		[]byte(filter.Start.UTC().Format(usageKeyLayout)),
+		[]byte(filter.End.UTC().Format(usageKeyLayout)+"|~"))
+	if err != nil {
+		return nil, err
+	}
+
+	// the limit keeps the newest records, so the scan runs newest first and the result is reversed
+	records := make([]*UsageRecord, 0)
+	for i := len(values) - 1; i >= 0; i-- {
+		record := &UsageRecord{}
+		if err := json.Unmarshal(values[i], record); err != nil {
+			Log.Error(err)
+			continue
+		}
+		if !filter.match(record.User, record.Model) {
+			continue
+		}
+		records = append(records, record)
+		if filter.Limit > 0 && len(records) >= filter.Limit {
+			break
+		}
+	}
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+func (this *NutsUsageStore) QueryRollups(granularity string, filter *UsageFilter) ([]*UsageRollup, error) {
+	layout := usageDayLayout
+	if granularity == UsageGranularityHour {
+		layout = usageHourLayout
+	}
+	values, err := this.rangeScan(usageRollupBucket,
+		[]byte(granularity+"|"+filter.Start.UTC().Format(layout)),
+		[]byte(granularity+"|"+filter.End.UTC().Format(layout)+"|~"))
+	if err != nil {
+		return nil, err
+	}
+
+	rollups := make([]*UsageRollup, 0)
+	for _, value := range values {
+		rollup := &UsageRollup{}
+		if err := json.Unmarshal(value, rollup); err != nil {
+			Log.Error(err)
+			continue
+		}
+		if filter.match(rollup.User, rollup.Model) {
+			rollups = append(rollups, rollup)
+		}
+	}
+	sort.SliceStable(rollups, func(i, j int) bool {
+		return rollups[i].Period < rollups[j].Period
+	})
+	return rollups, nil
+}
+
+// UsageLedger records the usage of completed requests and serves the usage endpoints
+type UsageLedger struct {
+	store UsageStore
+}
+
+func NewUsageLedger(store UsageStore) *UsageLedger {
+	return &UsageLedger{store: store}
+}
+
+// Listener is the UsageListener that writes to the ledger
+func (this *UsageLedger) Listener(request *http.Request, usage *RequestUsage) {
+	if err := this.store.RecordUsage(NewUsageRecord(request, usage)); err != nil {
+		Log.Errorf("failed to record usage: %v", err)
+	}
+}
+
+// parseUsageTime accepts RFC3339 timestamps and YYYY-MM-DD dates
+func parseUsageTime(raw string, endOfDay bool) (time.Time, error) {
+	if value, err := time.Parse(time.RFC3339, raw); err == nil {
+		return value, nil
+	}
+	value, err := time.Parse(usageDayLayout, raw)
+	if err != nil {
+		return time.Time{}, NewInvalidRequestError("invalid time %q, expected RFC3339 or YYYY-MM-DD", raw)
+	}
+	if endOfDay {
+		value = value.Add(24*time.Hour - time.Nanosecond)
+	}
+	return value, nil
+}
+
+// parseUsageFilter reads start, end, model, user and limit from the query string
+func parseUsageFilter(request *http.Request, granularity string) (*UsageFilter, error) {
+	query := request.URL.Query()
+	filter := &UsageFilter{
+		End:   time.Now().UTC(),
+		User:  query.Get("user"),
+		Model: query.Get("model"),
+		Limit: 1000,
+	}
+	if granularity == UsageGranularityRequest {
+		filter.Start = filter.End.Add(-24 * time.Hour)
+	} else {
+		filter.Start = filter.End.Add(-30 * 24 * time.Hour)
+	}
+
+	var err error
+	if raw := query.Get("start"); len(raw) > 0 {
+		if filter.Start, err = parseUsageTime(raw, false); err != nil {
+			return nil, err
+		}
+	}
+	if raw := query.Get("end"); len(raw) > 0 {
+		if filter.End, err = parseUsageTime(raw, true); err != nil {
+			return nil, err
+		}
+	}
+	if raw := query.Get("limit"); len(raw) > 0 {
+		if filter.Limit, err = strconv.Atoi(raw); err != nil || filter.Limit <= 0 {
+			return nil, NewInvalidRequestError("invalid limit %q", raw)
+		}
+	}
+	return filter, nil
+}
+
+// ServeUsage answers a usage query, user limits the results to one user when it is not empty
+func (this *UsageLedger) ServeUsage(writer http.ResponseWriter, request *http.Request, user string) {
+	query := request.URL.Query()
+	granularity := query.Get("granularity")
+	if len(granularity) == 0 {
+		granularity = UsageGranularityDay
+	}
+	if granularity != UsageGranularityRequest && granularity != UsageGranularityHour && granularity != UsageGranularityDay {
+		writeAPIError(writer, http.StatusBadRequest, "invalid_request_error", "granularity must be request, hour or day")
+		return
+	}
+	format := query.Get("format")
+	if len(format) == 0 {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		writeAPIError(writer, http.StatusBadRequest, "invalid_request_error", "format must be json or csv")
+		return
+	}
+
+	filter, err := parseUsageFilter(request, granularity)
+	if err != nil {
+		writeProxyError(writer, err)
+		return
+	}
+	if len(user) > 0 {
+		filter.User = user
+	}
+
+	var data interface{}
+	var rows [][]string
+	if granularity == UsageGranularityRequest {
+		records, err := this.store.QueryRecords(filter)
+		if err != nil {
+			Log.Error(err)
+			writeAPIError(writer, http.StatusInternalServerError, "api_error", err.Error())
+			return
+		}
+		data = records
+		rows = usageRecordRows(records)
+	} else {
+		rollups, err := this.store.QueryRollups(granularity, filter)
+		if err != nil {
+			Log.Error(err)
+			writeAPIError(writer, http.StatusInternalServerError, "api_error", err.Error())
+			return
+		}
+		data = rollups
+		rows = usageRollupRows(rollups)
+	}
+
+	if format == "csv" {
+		writer.Header().Set("Content-Type", "text/csv")
+		writer.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s.csv"`, granularity))
+		csvWriter := csv.NewWriter(writer)
+		_ = csvWriter.WriteAll(rows)
+		return
+	}
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+	writer.Header().Set("Content-Type", "application/json")
+	_ = encoder.Encode(map[string]interface{}{
+		"granularity": granularity,
+		"start":       filter.Start.UTC().Format(time.RFC3339),
+		"end":         filter.End.UTC().Format(time.RFC3339),
+		"data":        data,
+	})
+}
+
+func usageRecordRows(records []*UsageRecord) [][]string {
+	rows := [][]string{{"time", "user", "api_key", "model", "status_code", "input_tokens", "output_tokens",
+		"cache_read_input_tokens", "cache_creation_input_tokens", "first_byte_latency_ms", "invocation_latency_ms", "cached", "cost_usd",
+		"experiment", "arm"}}
+	for _, record := range records {
+		rows = append(rows, []string{
+			record.Time.Format(time.RFC3339Nano), record.User, record.APIKey, record.Model,
+			strconv.Itoa(record.StatusCode),
+			strconv.FormatInt(record.InputTokens, 10),
+			strconv.FormatInt(record.OutputTokens, 10),
+			strconv.FormatInt(record.CacheReadInputTokens, 10),
+			strconv.FormatInt(record.CacheCreationInputTokens, 10),
+			strconv.FormatInt(record.FirstByteLatency, 10),
+			strconv.FormatInt(record.InvocationLatency, 10),
+			strconv.FormatBool(record.Cached),
+			formatCost(record.Cost),
+			record.Experiment, record.Arm,
+		})
+	}
+	return rows
+}
+
+func usageRollupRows(rollups []*UsageRollup) [][]string {
+	rows := [][]string{{"period", "user", "model", "requests", "errors", "input_tokens", "output_tokens",
+		"cache_read_input_tokens", "cache_creation_input_tokens", "total_latency_ms", "cost_usd"}}
+	for _, rollup := range rollups {
+		rows = append(rows, []string{
+			rollup.Period, rollup.User, rollup.Model,
+			strconv.FormatInt(rollup.Requests, 10),
+			strconv.FormatInt(rollup.Errors, 10),
+			strconv.FormatInt(rollup.InputTokens, 10),
+			strconv.FormatInt(rollup.OutputTokens, 10),
+			strconv.FormatInt(rollup.CacheReadInputTokens, 10),
+			strconv.FormatInt(rollup.CacheCreationInputTokens, 10),
+			strconv.FormatInt(rollup.TotalLatency, 10),
+			formatCost(rollup.Cost),
+		})
+	}
+	return rows
+}
+
+// HandleUsage serves the usage of the calling user
+func (this *HTTPService) HandleUsage(writer http.ResponseWriter, request *http.Request) {
+	this.UsageLedger.ServeUsage(writer, request, usageUser(GetRequestIdentity(request)))
+}
+
+// HandleAdminUsage serves the usage of all users, filtered by the "user" query parameter
+func (this *HTTPService) HandleAdminUsage(writer http.ResponseWriter, request *http.Request) {
+	this.UsageLedger.ServeUsage(writer, request, "")
+}
+
+// AdminMiddleware only lets requests made with the global API_KEY through
+func (this *HTTPService) AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if len(this.conf.APIKey) > 0 {
+			identity := GetRequestIdentity(request)
+			if identity == nil || !identity.IsMaster {
+				writeAPIError(writer, http.StatusForbidden, "permission_error", "admin endpoints require the master API key")
+				return
+			}
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageLedger(t *testing.T) {
+	t.Setenv("CACHE_DB_PATH", t.TempDir())
+	store, err := NewCache()
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	defer store.Close()
+
+	ledger := NewUsageLedger(NewNutsUsageStore(store, &UsageLedgerConfig{Enable: true, RetentionDays: 1}))
+	record := func(identity *RequestIdentity, model string, status int, input int64) {
+		request := httptest.NewRequest("POST", "/v1/messages", nil)
+		request = request.WithContext(WithRequestIdentity(request.Context(), identity))
+		ledger.Listener(request, &RequestUsage{Model: model, StatusCode: status, InputTokens: input, OutputTokens: 1})
+	}
+
+	alice := &RequestIdentity{APIKey: "alice-key-0123456789", Email: "alice@example.com"}
+	bob := &RequestIdentity{APIKey: "bob-key-0123456789", Email: "bob@example.com"}
+	record(alice, "claude-haiku", 200, 10)
+	record(alice, "claude-haiku", 200, 20)
+	record(alice, "claude-sonnet", 429, 0)
+	record(bob, "claude-haiku", 200, 5)
+
+	t.Run("Records", func(t *testing.T) {
+		records, err := ledger.store.QueryRecords(&UsageFilter{
+			Start: time.Now().Add(-time.Hour),
+			End:   time.Now().Add(time.Hour),
+			User:  "alice@example.com",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 3 {
+			t.Fatalf("expected 3 records, got %d", len(records))
+		}
+		if records[0].APIKey == alice.APIKey {
+			t.Errorf("api keys should be masked in the ledger")
+		}
+	})
+
+	t.Run("NewestRecords", func(t *testing.T) {
+		records, err := ledger.store.QueryRecords(&UsageFilter{
+			Start: time.Now().Add(-time.Hour),
+			End:   time.Now().Add(time.Hour),
+			User:  "alice@example.com",
+			Limit: 2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 2 || records[0].InputTokens != 20 || records[1].StatusCode != 429 {
+			t.Fatalf("expected the 2 newest records oldest first, got %+v", records)
+		}
+	})
+
+	t.Run("DailyRollup", func(t *testing.T) {
+		rollups, err := ledger.store.QueryRollups(UsageGranularityDay, &UsageFilter{
+			Start: time.Now().Add(-time.Hour),
+			End:   time.Now().Add(time.Hour),
+			User:  "alice@example.com",
+			Model: "claude-haiku",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rollups) != 1 || rollups[0].Requests != 2 || rollups[0].InputTokens != 30 {
+			t.Fatalf("unexpected rollups %+v", rollups)
+		}
+	})
+
+	t.Run("OwnUsage", func(t *testing.T) {
+		request := httptest.NewRequest("GET", "/v1/usage?granularity=hour&user=bob@example.com", nil)
+		w := httptest.NewRecorder()
+		ledger.ServeUsage(w, request, "alice@example.com")
+
+		var response struct {
+			Data []*UsageRollup `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Data) != 2 {
+			t.Fatalf("expected the 2 models of alice, got %+v", response.Data)
+		}
+		for _, rollup := range response.Data {
+			if rollup.User != "alice@example.com" {
+				t.Errorf("users must not see the usage of others: %+v", rollup)
+			}
+		}
+	})
+
+	t.Run("CSVExport", func(t *testing.T) {
+		request := httptest.NewRequest("GET", "/v1/admin/usage?granularity=request&format=csv", nil)
+		w := httptest.NewRecorder()
+		ledger.ServeUsage(w, request, "")
+
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		if w.Header().Get("Content-Type") != "text/csv" || len(lines) != 5 {
+			t.Fatalf("expected a header and 4 rows, got:\n%s", w.Body.String())
+		}
+	})
+
+	t.Run("InvalidRange", func(t *testing.T) {
+		request := httptest.NewRequest("GET", "/v1/usage?start=yesterday", nil)
+		w := httptest.NewRecorder()
+		ledger.ServeUsage(w, request, "alice@example.com")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+}
+
+func TestHTTPService_AdminMiddleware(t *testing.T) {
+	service := &HTTPService{conf: &Config{HttpConfig: HttpConfig{APIKey: "master"}}}
+	handler := service.AdminMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, identity := range []*RequestIdentity{{APIKey: "user", Email: "user@example.com"}, {APIKey: "master", IsMaster: true}} {
+		request := httptest.NewRequest("GET", "/v1/admin/usage", nil)
+		request = request.WithContext(WithRequestIdentity(request.Context(), identity))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request)
+
+		expected := http.StatusForbidden
+		if identity.IsMaster {
+			expected = http.StatusNoContent
+		}
+		if w.Code != expected {
+			t.Errorf("expected %d for %+v, got %d", expected, identity, w.Code)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testInvocationMetrics = `"amazon-bedrock-invocationMetrics":{"inputTokenCount":12,"outputTokenCount":25,"invocationLatency":1234,"firstByteLatency":321,"cacheReadInputTokenCount":100,"cacheWriteInputTokenCount":5}`
+
+func TestRequestUsage_ObserveStreamEvent(t *testing.T) {
+	usage := NewRequestUsage()
+	types, payloads := readSSE(t, testStreamEvents)
+	for i := range types {
+		usage.ObserveStreamEvent(types[i], payloads[i])
+	}
+	if usage.InputTokens != 10 || usage.OutputTokens != 25 {
+		t.Errorf("unexpected usage from events %+v", usage)
+	}
+
+	usage.ObserveStreamEvent("message_stop", []byte(`{"type":"message_stop",`+testInvocationMetrics+`}`))
+	if usage.InputTokens != 12 || usage.CacheReadInputTokens != 100 || usage.CacheCreationInputTokens != 5 {
+		t.Errorf("unexpected tokens from invocation metrics %+v", usage)
+	}
+	if usage.FirstByteLatency != 321 || usage.InvocationLatency != 1234 {
+		t.Errorf("unexpected latency from invocation metrics %+v", usage)
+	}
+}
+
+func TestRequestUsage_MergeResponseHeader(t *testing.T) {
+	usage := NewRequestUsage()
+	header := http.Header{}
+	header.Set("X-Amzn-Bedrock-Input-Token-Count", "7")
+	header.Set("X-Amzn-Bedrock-Output-Token-Count", "3")
+	header.Set("X-Amzn-Bedrock-Invocation-Latency", "456")
+	usage.MergeResponseHeader(header)
+	usage.MergeResponseBody([]byte(`{"type":"message","usage":{"input_tokens":7,"output_tokens":3,"cache_read_input_tokens":50}}`))
+
+	if usage.InputTokens != 7 || usage.OutputTokens != 3 || usage.CacheReadInputTokens != 50 || usage.InvocationLatency != 456 {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+}
+
+func TestBedrockClient_HandleProxyUsage(t *testing.T) {
+	events := strings.Replace(testStreamEvents, `data: {"type":"message_stop"}`, `data: {"type":"message_stop",`+testInvocationMetrics+`}`, 1)
+	server := newFakeBedrock(t, events, 0)
+	defer server.Close()
+
+	client := newTestBedrockClient(server.URL)
+	client.config.StripInvocationMetrics = true
+	var reported *RequestUsage
+	client.AddUsageListener(func(request *http.Request, usage *RequestUsage) {
+		reported = usage
+	})
+
+	w := httptest.NewRecorder()
+	client.HandleProxy(w, newTestMessageRequest(true))
+
+	if reported == nil {
+		t.Fatal("expected the usage to be reported")
+	}
+	if reported.StatusCode != http.StatusOK || reported.Model != "anthropic.claude-test" {
+		t.Errorf("unexpected usage %+v", reported)
+	}
+	if reported.InputTokens != 12 || reported.OutputTokens != 25 || reported.InvocationLatency != 1234 {
+		t.Errorf("unexpected usage %+v", reported)
+	}
+	if strings.Contains(w.Body.String(), "invocationMetrics") {
+		t.Errorf("invocation metrics should be stripped from the client stream")
+	}
+}